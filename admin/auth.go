@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// authenticate requires requests to the admin API to carry one of the
+// configured tokens as bearer token. Without any configured tokens, the
+// admin API is not protected.
+func authenticate(handler http.Handler, tokens []string) http.Handler {
+	if len(tokens) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") {
+			given := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+			for _, token := range tokens {
+				if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+					handler.ServeHTTP(res, req)
+					return
+				}
+			}
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		res.Header().Set("WWW-Authenticate", `Bearer realm="servicegateway admin"`)
+		res.WriteHeader(401)
+		_, _ = res.Write([]byte(`{"msg":"not authenticated"}`))
+	})
+}
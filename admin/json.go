@@ -1,7 +1,77 @@
 package admin
 
 type TokenJson struct {
-	Jwt   string `json:"jwt"`
-	Token string `json:"token"`
-	Href  string `json:"href"`
+	Jwt          string   `json:"jwt"`
+	ID           string   `json:"id"`
+	Token        string   `json:"token,omitempty"`
+	Href         string   `json:"href,omitempty"`
+	Applications []string `json:"applications,omitempty"`
+	Expires      string   `json:"expires,omitempty"`
+}
+
+type CircuitBreakerJson struct {
+	Application string `json:"application"`
+	State       string `json:"state"`
+	Requests    int    `json:"requests"`
+	Failures    int    `json:"failures"`
+	OpenedAt    string `json:"opened_at,omitempty"`
+}
+
+type TokenDetailsJson struct {
+	Token        string                 `json:"token"`
+	Jwt          string                 `json:"jwt"`
+	Claims       map[string]interface{} `json:"claims"`
+	Applications []string               `json:"applications,omitempty"`
+	Refreshable  bool                   `json:"refreshable"`
+}
+
+type UpstreamJson struct {
+	Url       string `json:"url"`
+	Group     string `json:"group,omitempty"`
+	Weight    int    `json:"weight,omitempty"`
+	Healthy   bool   `json:"healthy"`
+	LastCheck string `json:"last_check,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type ApplicationJson struct {
+	Name           string              `json:"name"`
+	Enabled        bool                `json:"enabled"`
+	Maintenance    bool                `json:"maintenance"`
+	Routing        string              `json:"routing"`
+	Path           string              `json:"path,omitempty"`
+	Hostname       string              `json:"hostname,omitempty"`
+	Hosts          []string            `json:"hosts,omitempty"`
+	Patterns       map[string]string   `json:"patterns,omitempty"`
+	RateLimiting   bool                `json:"rate_limiting"`
+	Authentication bool                `json:"authentication"`
+	Upstreams      []UpstreamJson      `json:"upstreams"`
+	CircuitBreaker *CircuitBreakerJson `json:"circuit_breaker,omitempty"`
+}
+
+type RateLimitBucketJson struct {
+	Client    string `json:"client"`
+	Override  string `json:"override,omitempty"`
+	Remaining int    `json:"remaining"`
+	Limit     int    `json:"limit"`
+	ResetIn   string `json:"reset_in"`
+}
+
+type QuotaJson struct {
+	Client       string `json:"client"`
+	Plan         string `json:"plan"`
+	Daily        int64  `json:"daily"`
+	DailyLimit   int64  `json:"daily_limit,omitempty"`
+	Monthly      int64  `json:"monthly"`
+	MonthlyLimit int64  `json:"monthly_limit,omitempty"`
+}
+
+type BotRuleJson struct {
+	Name       string   `json:"name"`
+	UserAgents []string `json:"user_agents,omitempty"`
+	Rate       int      `json:"rate,omitempty"`
+	Window     string   `json:"window,omitempty"`
+	Statuses   []int    `json:"statuses,omitempty"`
+	Action     string   `json:"action"`
+	Matches    int64    `json:"matches"`
 }
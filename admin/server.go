@@ -4,13 +4,28 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/go-zoo/bone"
+	"github.com/mittwald/servicegateway/audit"
 	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/bots"
+	"github.com/mittwald/servicegateway/cache"
+	"github.com/mittwald/servicegateway/circuitbreaker"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/health"
+	"github.com/mittwald/servicegateway/proxy"
+	"github.com/mittwald/servicegateway/quota"
+	"github.com/mittwald/servicegateway/ratelimit"
+	"github.com/mittwald/servicegateway/redact"
 	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func writeError(res http.ResponseWriter, msg string) {
@@ -18,10 +33,119 @@ func writeError(res http.ResponseWriter, msg string) {
 	_, _ = res.Write([]byte(fmt.Sprintf(`{"msg":"%s"}`, msg)))
 }
 
+// jwtClaims decodes the claims of a JWT without verifying it.
+func jwtClaims(token string) map[string]interface{} {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return nil
+	}
+
+	return claims
+}
+
+func jwtSubject(token string) string {
+	subject, _ := jwtClaims(token)["sub"].(string)
+	return subject
+}
+
+func circuitBreakerJson(name string, breaker *circuitbreaker.Breaker) CircuitBreakerJson {
+	status := breaker.Status()
+	breakerJson := CircuitBreakerJson{
+		Application: name,
+		State:       status.State.String(),
+		Requests:    status.Requests,
+		Failures:    status.Failures,
+	}
+
+	if !status.OpenedAt.IsZero() {
+		breakerJson.OpenedAt = status.OpenedAt.Format(time.RFC3339)
+	}
+
+	return breakerJson
+}
+
+func botRuleJson(rule *bots.Rule) BotRuleJson {
+	return BotRuleJson{
+		Name:       rule.Config.Name,
+		UserAgents: rule.Config.UserAgents,
+		Rate:       rule.Config.Rate,
+		Window:     rule.Config.Window,
+		Statuses:   rule.Config.Statuses,
+		Action:     rule.Config.Action,
+		Matches:    atomic.LoadInt64(&rule.Matches),
+	}
+}
+
+func applicationJson(status proxy.ApplicationStatus, targets map[string]health.TargetStatus, breakers *circuitbreaker.Registry) ApplicationJson {
+	appJson := ApplicationJson{
+		Name:           status.Name,
+		Enabled:        status.Enabled,
+		Maintenance:    status.Maintenance,
+		Routing:        status.Config.Routing.Type,
+		Path:           status.Config.Routing.Path,
+		Hostname:       status.Config.Routing.Hostname,
+		Hosts:          status.Config.Routing.Hosts,
+		Patterns:       status.Config.Routing.Patterns,
+		RateLimiting:   status.Config.RateLimiting,
+		Authentication: !status.Config.Auth.Disable,
+		Upstreams:      make([]UpstreamJson, 0, len(status.Upstreams)),
+	}
+
+	addUpstream := func(upstream config.Upstream, group string) {
+		upstreamJson := UpstreamJson{
+			Url:     upstream.Url,
+			Group:   group,
+			Weight:  upstream.Weight,
+			Healthy: true,
+		}
+
+		if target, ok := targets[upstream.Url]; ok {
+			upstreamJson.Healthy = target.Healthy
+			upstreamJson.LastError = target.LastError
+
+			if !target.LastCheck.IsZero() {
+				upstreamJson.LastCheck = target.LastCheck.Format(time.RFC3339)
+			}
+		}
+
+		appJson.Upstreams = append(appJson.Upstreams, upstreamJson)
+	}
+
+	for _, upstream := range status.Upstreams {
+		addUpstream(upstream, "")
+	}
+
+	for _, group := range status.Config.Backend.Groups {
+		if len(group.Upstreams) == 0 {
+			addUpstream(config.Upstream{Url: group.Url}, group.Name)
+		}
+
+		for _, upstream := range group.Upstreams {
+			addUpstream(upstream, group.Name)
+		}
+	}
+
+	if breaker, ok := breakers.Get(status.Name); ok {
+		breakerJson := circuitBreakerJson(status.Name, breaker)
+		appJson.CircuitBreaker = &breakerJson
+	}
+
+	return appJson
+}
+
 func NewAdminServer(
+	cfg *config.AdminConfiguration,
 	tokenStore auth.TokenStore,
 	tokenVerifier *auth.JwtVerifier,
 	authHandler *auth.AuthenticationHandler,
+	breakers *circuitbreaker.Registry,
+	prx *proxy.ProxyHandler,
+	rlim ratelimit.RateLimitingMiddleware,
+	quotas *quota.Manager,
+	cch cache.CacheMiddleware,
+	detector *bots.Detector,
+	reload func() error,
+	auditLogger *audit.Logger,
 	logger *logging.Logger,
 ) (http.Handler, error) {
 	mux := bone.New()
@@ -42,13 +166,38 @@ func NewAdminServer(
 			scheme = req.URL.Scheme
 		}
 
+		subject := req.URL.Query().Get("subject")
+		first := true
+
 		_, _ = res.Write([]byte{'['})
 		for v := range tokenStream {
-			err := enc.Encode(TokenJson{
-				Jwt:   v.Jwt,
-				Token: v.Token,
-				Href:  fmt.Sprintf("%s://%s/tokens/%s", scheme, req.Host, url.QueryEscape(v.Token)),
-			})
+			if subject != "" && jwtSubject(v.Jwt) != subject {
+				continue
+			}
+
+			if !first {
+				_, _ = res.Write([]byte{','})
+			}
+			first = false
+
+			// stores that only keep the hashes of tokens cannot list the
+			// tokens themselves
+			token := TokenJson{
+				Jwt:          v.Jwt,
+				ID:           v.ID,
+				Token:        v.Token,
+				Applications: v.Applications,
+			}
+
+			if v.Token != "" {
+				token.Href = fmt.Sprintf("%s://%s/tokens/%s", scheme, req.Host, url.QueryEscape(v.Token))
+			}
+
+			if v.ExpireAt > 0 {
+				token.Expires = time.Unix(v.ExpireAt, 0).Format(time.RFC3339)
+			}
+
+			err := enc.Encode(token)
 			if err != nil {
 				logger.Error(err)
 				writeError(res, "could not encode tokens")
@@ -58,6 +207,77 @@ func NewAdminServer(
 		_, _ = res.Write([]byte{']'})
 	}))
 
+	mux.Get("/tokens/#token^(.*)$", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		tokenString := bone.GetValue(req, "token")
+
+		token, err := tokenStore.GetToken(tokenString)
+		if err == auth.NoTokenError {
+			res.WriteHeader(404)
+			_, _ = res.Write([]byte(`{"msg":"token not found"}`))
+			return
+		} else if err != nil {
+			logger.Errorf("error while loading token: %s", err)
+			writeError(res, "could not load token")
+			return
+		}
+
+		details := TokenDetailsJson{
+			Token:        tokenString,
+			Jwt:          token.JWT,
+			Claims:       jwtClaims(token.JWT),
+			Applications: token.AllowedApplications,
+			Refreshable:  token.RefreshToken != "",
+		}
+
+		_ = json.NewEncoder(res).Encode(&details)
+	}))
+
+	// purging removes token mappings without revoking their JWTs; either all
+	// mappings or those of a single subject are removed
+	mux.Delete("/tokens", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		subject := req.URL.Query().Get("subject")
+		all := req.URL.Query().Get("all") == "true"
+
+		if subject == "" && !all {
+			res.WriteHeader(400)
+			_, _ = res.Write([]byte(`{"msg":"either 'subject' or 'all=true' is required"}`))
+			return
+		}
+
+		tokenStream, err := tokenStore.GetAllTokens()
+		if err != nil {
+			logger.Error(err.Error())
+			writeError(res, "could not load tokens")
+			return
+		}
+
+		purged := 0
+		var purgeErr error
+
+		for v := range tokenStream {
+			if purgeErr != nil || (!all && jwtSubject(v.Jwt) != subject) {
+				continue
+			}
+
+			if purgeErr = tokenStore.RemoveTokenByID(v.ID); purgeErr == nil {
+				purged++
+			}
+		}
+
+		if purgeErr != nil {
+			logger.Errorf("error while purging tokens: %s", purgeErr)
+			writeError(res, "could not purge tokens")
+			return
+		}
+
+		logger.Noticef("purged %d token mappings", purged)
+		_, _ = res.Write([]byte(fmt.Sprintf(`{"purged":%d}`, purged)))
+	}))
+
 	mux.Put("/tokens/#token^(.*)$", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
 
@@ -120,7 +340,7 @@ func NewAdminServer(
 
 		jwt := string(jwtBytes)
 
-		valid, _, _, err := tokenVerifier.VerifyToken(jwt)
+		valid, _, mapClaims, err := tokenVerifier.VerifyToken(jwt)
 		if err != nil || !valid {
 			res.WriteHeader(400)
 			_, _ = res.Write([]byte(fmt.Sprintf(`{"msg":"invalid token","reason":"%s"}`, err)))
@@ -135,6 +355,9 @@ func NewAdminServer(
 			return
 		}
 
+		subject, _ := mapClaims["sub"].(string)
+		auditLogger.Log(audit.NewEvent(audit.TokenIssued, req, subject).WithDetail("jti", mapClaims["jti"]))
+
 		res.WriteHeader(200)
 		if exp != 0 {
 			_, _ = res.Write([]byte(fmt.Sprintf(`{"token":"%s","expires":"%s"}`, tokenString, time.Unix(exp, 0).Format(time.RFC3339))))
@@ -143,5 +366,367 @@ func NewAdminServer(
 		}
 	}))
 
-	return mux, nil
+	mux.Delete("/tokens/#jti^(.*)$", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		jti := bone.GetValue(req, "jti")
+		if jti == "" {
+			res.WriteHeader(400)
+			_, _ = res.Write([]byte(`{"msg":"missing token ID"}`))
+			return
+		}
+
+		var exp int64
+		if expParam := req.URL.Query().Get("exp"); expParam != "" {
+			var err error
+			exp, err = strconv.ParseInt(expParam, 10, 64)
+			if err != nil {
+				res.WriteHeader(400)
+				_, _ = res.Write([]byte(`{"msg":"invalid expiration timestamp"}`))
+				return
+			}
+		}
+
+		if err := authHandler.RevokeToken(jti, exp); err != nil {
+			logger.Errorf("error while revoking token %s: %s", jti, err)
+			writeError(res, "could not revoke token")
+			return
+		}
+
+		logger.Noticef("revoked token %s", jti)
+		auditLogger.Log(audit.NewEvent(audit.TokenRevoked, req, "").WithDetail("jti", jti))
+		res.WriteHeader(204)
+	}))
+
+	mux.Get("/circuit-breakers", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		result := make([]CircuitBreakerJson, 0)
+		for _, name := range breakers.Applications() {
+			breaker, ok := breakers.Get(name)
+			if !ok {
+				continue
+			}
+
+			result = append(result, circuitBreakerJson(name, breaker))
+		}
+
+		if err := json.NewEncoder(res).Encode(result); err != nil {
+			logger.Errorf("error while encoding circuit breakers: %s", err)
+		}
+	}))
+
+	mux.Post("/circuit-breakers/:application/reset", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		name := bone.GetValue(req, "application")
+		breaker, ok := breakers.Get(name)
+		if !ok {
+			res.WriteHeader(404)
+			_, _ = res.Write([]byte(`{"msg":"circuit breaker not found"}`))
+			return
+		}
+
+		breaker.Reset()
+		logger.Noticef("reset circuit breaker of application %s", name)
+		res.WriteHeader(204)
+	}))
+
+	// the health of each upstream, by application and URL
+	upstreamHealth := func() map[string]map[string]health.TargetStatus {
+		result := make(map[string]map[string]health.TargetStatus)
+		for appName, targets := range prx.Health().Status() {
+			result[appName] = make(map[string]health.TargetStatus, len(targets))
+			for _, target := range targets {
+				result[appName][target.Url] = target
+			}
+		}
+
+		return result
+	}
+
+	mux.Get("/applications", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		targets := upstreamHealth()
+
+		result := make([]ApplicationJson, 0)
+		for _, app := range prx.Applications() {
+			result = append(result, applicationJson(app, targets[app.Name], breakers))
+		}
+
+		if err := json.NewEncoder(res).Encode(result); err != nil {
+			logger.Errorf("error while encoding applications: %s", err)
+		}
+	}))
+
+	mux.Get("/applications/:application", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		name := bone.GetValue(req, "application")
+		for _, app := range prx.Applications() {
+			if app.Name != name {
+				continue
+			}
+
+			if err := json.NewEncoder(res).Encode(applicationJson(app, upstreamHealth()[name], breakers)); err != nil {
+				logger.Errorf("error while encoding application: %s", err)
+			}
+			return
+		}
+
+		res.WriteHeader(404)
+		_, _ = res.Write([]byte(`{"msg":"application not found"}`))
+	}))
+
+	setEnabled := func(enabled bool) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("Content-Type", "application/json")
+
+			name := bone.GetValue(req, "application")
+			if !prx.SetEnabled(name, enabled) {
+				res.WriteHeader(404)
+				_, _ = res.Write([]byte(`{"msg":"application not found"}`))
+				return
+			}
+
+			if enabled {
+				logger.Noticef("enabled application %s", name)
+			} else {
+				logger.Noticef("disabled application %s", name)
+			}
+			res.WriteHeader(204)
+		})
+	}
+
+	mux.Post("/applications/:application/enable", setEnabled(true))
+	mux.Post("/applications/:application/disable", setEnabled(false))
+
+	setMaintenance := func(maintenance bool) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("Content-Type", "application/json")
+
+			name := bone.GetValue(req, "application")
+			if !prx.SetMaintenance(name, maintenance) {
+				res.WriteHeader(404)
+				_, _ = res.Write([]byte(`{"msg":"application not found"}`))
+				return
+			}
+
+			if maintenance {
+				logger.Noticef("put application %s into maintenance mode", name)
+			} else {
+				logger.Noticef("cleared maintenance mode of application %s that was set at runtime", name)
+			}
+			res.WriteHeader(204)
+		})
+	}
+
+	mux.Post("/applications/:application/maintenance", setMaintenance(true))
+	mux.Delete("/applications/:application/maintenance", setMaintenance(false))
+
+	mux.Get("/rate-limits", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		buckets, err := rlim.Buckets()
+		if err != nil {
+			logger.Errorf("error while loading rate-limit buckets: %s", err)
+			writeError(res, "could not load rate-limit buckets")
+			return
+		}
+
+		result := make([]RateLimitBucketJson, 0, len(buckets))
+		for _, bucket := range buckets {
+			// clients are identified by their Authorization header if they
+			// send one
+			client := bucket.Client
+			if net.ParseIP(client) == nil {
+				client = redact.Token(client)
+			}
+
+			result = append(result, RateLimitBucketJson{
+				Client:    client,
+				Override:  bucket.Override,
+				Remaining: bucket.Remaining,
+				Limit:     bucket.Limit,
+				ResetIn:   bucket.ResetIn.Round(time.Second).String(),
+			})
+		}
+
+		if err := json.NewEncoder(res).Encode(result); err != nil {
+			logger.Errorf("error while encoding rate-limit buckets: %s", err)
+		}
+	}))
+
+	mux.Get("/quotas", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		usages, err := quotas.Usage()
+		if err != nil {
+			logger.Errorf("error while loading quotas: %s", err)
+			writeError(res, "could not load quotas")
+			return
+		}
+
+		result := make([]QuotaJson, 0, len(usages))
+		for _, usage := range usages {
+			result = append(result, QuotaJson{
+				Client:       usage.Client,
+				Plan:         usage.Plan,
+				Daily:        usage.Daily,
+				DailyLimit:   usage.DailyLimit,
+				Monthly:      usage.Monthly,
+				MonthlyLimit: usage.MonthlyLimit,
+			})
+		}
+
+		if err := json.NewEncoder(res).Encode(result); err != nil {
+			logger.Errorf("error while encoding quotas: %s", err)
+		}
+	}))
+
+	mux.Delete("/quotas/#client^(.*)$", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		client := bone.GetValue(req, "client")
+
+		found, err := quotas.Reset(client)
+		if err != nil {
+			logger.Errorf("error while resetting quota: %s", err)
+			writeError(res, "could not reset quota")
+			return
+		}
+
+		if !found {
+			res.WriteHeader(404)
+			_, _ = res.Write([]byte(`{"msg":"quota not found"}`))
+			return
+		}
+
+		logger.Noticef("reset quota of client %s", client)
+		res.WriteHeader(204)
+	}))
+
+	// purging removes cached responses by application, URL prefix or
+	// surrogate key, so that upstreams can invalidate them after writes
+	mux.Delete("/cache", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		selector := cache.Selector{
+			Application:  req.URL.Query().Get("application"),
+			Prefix:       req.URL.Query().Get("prefix"),
+			SurrogateKey: req.URL.Query().Get("key"),
+		}
+
+		if selector == (cache.Selector{}) {
+			res.WriteHeader(400)
+			_, _ = res.Write([]byte(`{"msg":"one of 'application', 'prefix' or 'key' is required"}`))
+			return
+		}
+
+		purged, err := cch.Purge(selector)
+		if err != nil {
+			logger.Errorf("error while purging cached responses: %s", err)
+			writeError(res, "could not purge cached responses")
+			return
+		}
+
+		logger.Noticef("purged %d cached responses", purged)
+		_, _ = res.Write([]byte(fmt.Sprintf(`{"purged":%d}`, purged)))
+	}))
+
+	mux.Get("/bot-rules", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		rules := detector.Rules()
+		result := make([]BotRuleJson, 0, len(rules))
+		for _, rule := range rules {
+			result = append(result, botRuleJson(rule))
+		}
+
+		if err := json.NewEncoder(res).Encode(result); err != nil {
+			logger.Errorf("error while encoding bot detection rules: %s", err)
+		}
+	}))
+
+	// rules that are changed here are kept until the gateway is restarted
+	// or its configuration is reloaded
+	mux.Put("/bot-rules/:name", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		name := bone.GetValue(req, "name")
+
+		ruleCfg := config.BotRule{}
+		if err := json.NewDecoder(req.Body).Decode(&ruleCfg); err != nil {
+			res.WriteHeader(400)
+			_ = json.NewEncoder(res).Encode(map[string]string{"msg": fmt.Sprintf("invalid rule: %s", err)})
+			return
+		}
+		ruleCfg.Name = name
+
+		rule, err := bots.NewRule(ruleCfg)
+		if err != nil {
+			res.WriteHeader(400)
+			_ = json.NewEncoder(res).Encode(map[string]string{"msg": err.Error()})
+			return
+		}
+
+		detector.SetRule(rule)
+		logger.Noticef("set bot detection rule %s", name)
+		res.WriteHeader(204)
+	}))
+
+	mux.Delete("/bot-rules/:name", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		name := bone.GetValue(req, "name")
+		if !detector.RemoveRule(name) {
+			res.WriteHeader(404)
+			_, _ = res.Write([]byte(`{"msg":"bot detection rule not found"}`))
+			return
+		}
+
+		logger.Noticef("removed bot detection rule %s", name)
+		res.WriteHeader(204)
+	}))
+
+	mux.Post("/reload", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		if err := reload(); err != nil {
+			logger.Errorf("could not reload configuration: %s", err)
+
+			res.WriteHeader(500)
+			_ = json.NewEncoder(res).Encode(map[string]string{"msg": fmt.Sprintf("could not reload configuration: %s", err)})
+			return
+		}
+
+		res.WriteHeader(204)
+	}))
+
+	// JSON schemas of the configuration file and of application
+	// definitions, for editors and CI pipelines
+	schemas := map[string]interface{}{
+		"configuration": config.Schema(config.Configuration{}),
+		"application":   config.Schema(config.Application{}),
+	}
+
+	mux.Get("/schema/:type", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		schema, ok := schemas[bone.GetValue(req, "type")]
+		if !ok {
+			res.WriteHeader(404)
+			_, _ = res.Write([]byte(`{"msg":"schema not found"}`))
+			return
+		}
+
+		if err := json.NewEncoder(res).Encode(schema); err != nil {
+			logger.Errorf("error while encoding schema: %s", err)
+		}
+	}))
+
+	mux.Get("/metrics", promhttp.Handler())
+
+	return authenticate(mux, cfg.Tokens), nil
 }
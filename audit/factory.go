@@ -0,0 +1,42 @@
+package audit
+
+import (
+	"fmt"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+// LoggerFromConfig builds an audit logger that writes to all configured
+// sinks. It returns nil if no sinks are configured.
+func LoggerFromConfig(configs []config.AuditConfiguration, logger *logging.Logger) (*Logger, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	sinks := make([]Sink, len(configs))
+	for i := range configs {
+		sink, err := SinkFromConfig(&configs[i])
+		if err != nil {
+			return nil, err
+		}
+		sinks[i] = sink
+	}
+
+	return NewLogger(sinks, logger), nil
+}
+
+func SinkFromConfig(cfg *config.AuditConfiguration) (Sink, error) {
+	switch cfg.Type {
+	case "file":
+		return NewFileSink(cfg.Filename)
+	case "syslog":
+		return NewSyslogSink(cfg.Network, cfg.Address, cfg.Tag)
+	case "webhook":
+		return NewWebhookSink(cfg)
+	case "kafka":
+		return NewKafkaSink(cfg)
+	default:
+		return nil, fmt.Errorf("unsupported audit sink type: '%s'", cfg.Type)
+	}
+}
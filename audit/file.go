@@ -0,0 +1,35 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// FileSink appends events to a file, one JSON document per line.
+type FileSink struct {
+	file *os.File
+}
+
+func NewFileSink(filename string) (*FileSink, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("audit sink 'file' requires a filename")
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log '%s': %s", filename, err)
+	}
+
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Write(event *Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,48 @@
+package audit
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+type kafkaRecord struct {
+	Key   string `json:"key,omitempty"`
+	Value *Event `json:"value"`
+}
+
+type kafkaProduceRequest struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+// KafkaSink publishes events to a Kafka topic using the produce API of a
+// Kafka REST proxy. Events are keyed by user, so that all events of a user
+// end up in the same partition.
+type KafkaSink struct {
+	*WebhookSink
+}
+
+func NewKafkaSink(cfg *config.AuditConfiguration) (*KafkaSink, error) {
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("audit sink 'kafka' requires a topic")
+	}
+
+	webhook, err := NewWebhookSink(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	webhook.url = strings.TrimRight(cfg.Url, "/") + "/topics/" + url.PathEscape(cfg.Topic)
+
+	return &KafkaSink{WebhookSink: webhook}, nil
+}
+
+func (s *KafkaSink) Write(event *Event) error {
+	request := kafkaProduceRequest{
+		Records: []kafkaRecord{{Key: event.User, Value: event}},
+	}
+
+	return postJSON(s.httpClient, s.url, "application/vnd.kafka.json.v2+json", s.headers, &request)
+}
@@ -0,0 +1,110 @@
+package audit
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mittwald/servicegateway/clientip"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/op/go-logging"
+)
+
+const (
+	LoginSuccess   = "login_success"
+	LoginFailure   = "login_failure"
+	LoginThrottled = "login_throttled"
+	LoginLockout   = "login_lockout"
+	MfaChallenge   = "mfa_challenge"
+	Logout         = "logout"
+	Impersonation  = "impersonation"
+	TokenIssued    = "token_issued"
+	TokenRevoked   = "token_revoked"
+)
+
+// Event is a security-relevant event, like a login or the revocation of a
+// token.
+type Event struct {
+	Time      time.Time              `json:"time"`
+	Type      string                 `json:"type"`
+	User      string                 `json:"user,omitempty"`
+	ClientIP  string                 `json:"client_ip,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// NewEvent creates an event of the given type that was caused by the given
+// request. The request may be nil.
+func NewEvent(eventType string, req *http.Request, user string) *Event {
+	event := Event{
+		Time: time.Now(),
+		Type: eventType,
+		User: user,
+	}
+
+	if req != nil {
+		event.ClientIP = clientip.FromRequest(req)
+
+		event.RequestID = requestid.FromRequest(req)
+	}
+
+	return &event
+}
+
+// WithDetail adds additional information to the event.
+func (e *Event) WithDetail(key string, value interface{}) *Event {
+	if e.Details == nil {
+		e.Details = make(map[string]interface{})
+	}
+
+	e.Details[key] = value
+	return e
+}
+
+// Sink stores audit events.
+type Sink interface {
+	Write(event *Event) error
+}
+
+// Logger writes audit events to a set of sinks. Events are written
+// asynchronously, so that slow sinks do not delay the requests causing the
+// events; when the sinks cannot keep up, events are dropped.
+//
+// A nil logger discards all events.
+type Logger struct {
+	sinks  []Sink
+	events chan *Event
+	logger *logging.Logger
+}
+
+func NewLogger(sinks []Sink, logger *logging.Logger) *Logger {
+	l := Logger{
+		sinks:  sinks,
+		events: make(chan *Event, 1024),
+		logger: logger,
+	}
+
+	go func() {
+		for event := range l.events {
+			for _, sink := range l.sinks {
+				if err := sink.Write(event); err != nil {
+					l.logger.Errorf("could not write audit event %s: %s", event.Type, err)
+				}
+			}
+		}
+	}()
+
+	return &l
+}
+
+// Log queues an event for writing.
+func (l *Logger) Log(event *Event) {
+	if l == nil {
+		return
+	}
+
+	select {
+	case l.events <- event:
+	default:
+		l.logger.Warningf("audit event queue is full; dropping %s event for user %s", event.Type, event.User)
+	}
+}
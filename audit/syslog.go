@@ -0,0 +1,34 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+)
+
+// SyslogSink sends events as JSON messages to a syslog daemon.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+func NewSyslogSink(network string, address string, tag string) (*SyslogSink, error) {
+	if tag == "" {
+		tag = "servicegateway"
+	}
+
+	writer, err := syslog.Dial(network, address, syslog.LOG_NOTICE|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to syslog: %s", err)
+	}
+
+	return &SyslogSink{writer: writer}, nil
+}
+
+func (s *SyslogSink) Write(event *Event) error {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return s.writer.Notice(string(message))
+}
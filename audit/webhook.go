@@ -0,0 +1,86 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+// WebhookSink posts each event as JSON document to an HTTP endpoint.
+type WebhookSink struct {
+	url        string
+	headers    map[string]string
+	httpClient *http.Client
+}
+
+func NewWebhookSink(cfg *config.AuditConfiguration) (*WebhookSink, error) {
+	if cfg.Url == "" {
+		return nil, fmt.Errorf("audit sink '%s' requires a URL", cfg.Type)
+	}
+
+	httpClient, err := newHttpClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookSink{
+		url:        cfg.Url,
+		headers:    cfg.Headers,
+		httpClient: httpClient,
+	}, nil
+}
+
+func (s *WebhookSink) Write(event *Event) error {
+	return postJSON(s.httpClient, s.url, "application/json", s.headers, event)
+}
+
+func newHttpClient(cfg *config.AuditConfiguration) (*http.Client, error) {
+	timeout := 5 * time.Second
+	if cfg.Timeout != "" {
+		var err error
+
+		timeout, err = time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid audit sink timeout '%s': %s", cfg.Timeout, err)
+		}
+	}
+
+	return &http.Client{Timeout: timeout}, nil
+}
+
+func postJSON(httpClient *http.Client, url string, contentType string, headers map[string]string, document interface{}) error {
+	jsonString, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonString))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code %d from %s: %s", resp.StatusCode, url, body)
+	}
+
+	return nil
+}
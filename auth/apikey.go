@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+	"github.com/patrickmn/go-cache"
+)
+
+// ApiKeyReader authenticates requests using static API keys (from the
+// configuration) or API keys stored in Redis. Requests without an API key
+// fall back to the wrapped token reader.
+type ApiKeyReader struct {
+	config    *config.ApiKeyConfig
+	redisPool RedisConnectionSource
+	signer    *JwtSigner
+	fallback  TokenReader
+	logger    *logging.Logger
+
+	keyCache *cache.Cache
+
+	// staticKeys holds the SHA-256 hashes of the configured keys, which
+	// are compared in constant time
+	staticKeys []staticApiKey
+}
+
+type staticApiKey struct {
+	hash [sha256.Size]byte
+	key  config.ApiKey
+}
+
+func NewApiKeyReader(cfg *config.ApiKeyConfig, redisPool RedisConnectionSource, signer *JwtSigner, fallback TokenReader, logger *logging.Logger) *ApiKeyReader {
+	staticKeys := make([]staticApiKey, 0, len(cfg.Keys))
+	for keyString, key := range cfg.Keys {
+		staticKeys = append(staticKeys, staticApiKey{hash: sha256.Sum256([]byte(keyString)), key: key})
+	}
+
+	return &ApiKeyReader{
+		config:     cfg,
+		redisPool:  redisPool,
+		signer:     signer,
+		fallback:   fallback,
+		logger:     logger,
+		keyCache:   cache.New(time.Minute, 5*time.Minute),
+		staticKeys: staticKeys,
+	}
+}
+
+func (r *ApiKeyReader) TokenFromRequest(req *http.Request) (*JWTResponse, error) {
+	keyString := r.keyStringFromRequest(req)
+	if keyString == "" {
+		return r.fallback.TokenFromRequest(req)
+	}
+
+	// the caches are keyed by the hash of the key, so that they do not
+	// hold the keys themselves
+	hash := sha256.Sum256([]byte(keyString))
+	cacheId := hex.EncodeToString(hash[:])
+
+	key, err := r.lookup(keyString, hash, cacheId)
+	if err != nil {
+		return nil, err
+	}
+
+	response := JWTResponse{
+		AllowedApplications: key.AllowedApplications,
+		ApiKey:              key,
+	}
+
+	if r.signer != nil {
+		cacheKey := "jwt_" + cacheId
+		if jwt, ok := r.keyCache.Get(cacheKey); ok {
+			response.JWT = jwt.(string)
+		} else {
+			claims := map[string]interface{}{}
+			if key.RateLimitTier != "" {
+				claims["rate_limit_tier"] = key.RateLimitTier
+			}
+
+			response.JWT, err = r.signer.Sign(key.Owner, claims)
+			if err != nil {
+				return nil, err
+			}
+
+			if ttl := r.signer.ttl - time.Minute; ttl > 0 {
+				r.keyCache.Set(cacheKey, response.JWT, ttl)
+			}
+		}
+	}
+
+	return &response, nil
+}
+
+// keyStringFromRequest reads the API key from the configured header or query
+// parameter, and removes it from the request so that it is not forwarded to
+// upstream services.
+func (r *ApiKeyReader) keyStringFromRequest(req *http.Request) string {
+	header := r.config.Header
+	if header == "" {
+		header = "X-API-Key"
+	}
+
+	if key := req.Header.Get(header); key != "" {
+		req.Header.Del(header)
+		return key
+	}
+
+	param := r.config.QueryParam
+	if param == "" {
+		param = "api_key"
+	}
+
+	query := req.URL.Query()
+	if key := query.Get(param); key != "" {
+		query.Del(param)
+		req.URL.RawQuery = query.Encode()
+		return key
+	}
+
+	return ""
+}
+
+// staticKey returns the configured key that matches the given key. All
+// configured keys are compared (by their hashes, so that the comparison
+// does not depend on their length), so that the time taken does not reveal
+// how much of a key matched.
+func (r *ApiKeyReader) staticKey(hash [sha256.Size]byte) (*config.ApiKey, bool) {
+	var found *config.ApiKey
+	for i := range r.staticKeys {
+		if subtle.ConstantTimeCompare(hash[:], r.staticKeys[i].hash[:]) == 1 {
+			found = &r.staticKeys[i].key
+		}
+	}
+
+	if found == nil {
+		return nil, false
+	}
+
+	key := *found
+	return &key, true
+}
+
+// lookup returns the configured key or the key in Redis. Keys that were
+// found in Redis are cached; unknown keys are not, so that requests with
+// random keys cannot fill the cache.
+func (r *ApiKeyReader) lookup(keyString string, hash [sha256.Size]byte, cacheId string) (*config.ApiKey, error) {
+	if key, ok := r.staticKey(hash); ok {
+		return key, nil
+	}
+
+	if !r.config.Redis {
+		r.logger.Warning("request with unknown API key")
+		return nil, NoTokenError
+	}
+
+	if key, ok := r.keyCache.Get("key_" + cacheId); ok {
+		return key.(*config.ApiKey), nil
+	}
+
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	values, err := redis.StringMap(conn.Do("HGETALL", "apikey_"+keyString))
+	if err != nil {
+		return nil, fmt.Errorf("error while loading API key: %s", err)
+	}
+
+	if len(values) == 0 {
+		r.logger.Warning("request with unknown API key")
+		return nil, NoTokenError
+	}
+
+	key := config.ApiKey{
+		Owner:         values["owner"],
+		RateLimitTier: values["tier"],
+	}
+	if values["applications"] != "" {
+		key.AllowedApplications = strings.Split(values["applications"], ";")
+	}
+
+	r.keyCache.SetDefault("key_"+cacheId, &key)
+	return &key, nil
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+type authorizationRule struct {
+	path    *regexp.Regexp
+	methods []string
+	scopes  []string
+	roles   []string
+}
+
+// Authorizer checks the scopes and roles of an authenticated request against
+// the authorization rules of an application.
+type Authorizer struct {
+	scopeClaim string
+	roleClaim  string
+	rules      []authorizationRule
+}
+
+// AuthorizationError describes why a request was denied. It is returned to
+// the client as-is.
+type AuthorizationError struct {
+	Message       string   `json:"msg"`
+	MissingScopes []string `json:"missing_scopes,omitempty"`
+	RequiredRoles []string `json:"required_roles,omitempty"`
+}
+
+func (e *AuthorizationError) Error() string {
+	return fmt.Sprintf("%s (missing scopes: %s, required roles: %s)", e.Message, e.MissingScopes, e.RequiredRoles)
+}
+
+// NewAuthorizer compiles the authorization rules of an application. It
+// returns nil if the application has no rules.
+func NewAuthorizer(cfg *config.AuthorizationConfig) (*Authorizer, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+
+	authorizer := Authorizer{
+		scopeClaim: cfg.ScopeClaim,
+		roleClaim:  cfg.RoleClaim,
+		rules:      make([]authorizationRule, len(cfg.Rules)),
+	}
+
+	if authorizer.scopeClaim == "" {
+		authorizer.scopeClaim = "scope"
+	}
+
+	if authorizer.roleClaim == "" {
+		authorizer.roleClaim = "roles"
+	}
+
+	for i, ruleCfg := range cfg.Rules {
+		rule := authorizationRule{
+			scopes: ruleCfg.Scopes,
+			roles:  ruleCfg.Roles,
+		}
+
+		if ruleCfg.Path != "" {
+			re, err := regexp.Compile(ruleCfg.Path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path pattern '%s' in authorization rule: %s", ruleCfg.Path, err)
+			}
+			rule.path = re
+		}
+
+		for _, method := range ruleCfg.Methods {
+			rule.methods = append(rule.methods, strings.ToUpper(method))
+		}
+
+		authorizer.rules[i] = rule
+	}
+
+	return &authorizer, nil
+}
+
+func (r *authorizationRule) matches(req *http.Request) bool {
+	if r.path != nil && !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+
+	if len(r.methods) > 0 && !containsString(r.methods, req.Method) {
+		return false
+	}
+
+	return true
+}
+
+// Authorize evaluates all rules that match the request. A request is allowed
+// if, for each matching rule, the token has all of the rule's scopes and at
+// least one of its roles. Unauthenticated requests (with no claims) are
+// denied by any matching rule.
+func (a *Authorizer) Authorize(req *http.Request, claims map[string]interface{}) *AuthorizationError {
+	var scopes, roles []string
+
+	if claims != nil {
+		scopes = scopesFromClaim(claimByPath(claims, a.scopeClaim))
+		roles = claimStrings(claimByPath(claims, a.roleClaim))
+	}
+
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if !rule.matches(req) {
+			continue
+		}
+
+		var missing []string
+		for _, scope := range rule.scopes {
+			if !containsString(scopes, scope) {
+				missing = append(missing, scope)
+			}
+		}
+
+		hasRole := len(rule.roles) == 0
+		for _, role := range rule.roles {
+			if containsString(roles, role) {
+				hasRole = true
+				break
+			}
+		}
+
+		if len(missing) > 0 || !hasRole {
+			authErr := AuthorizationError{
+				Message:       "insufficient permissions",
+				MissingScopes: missing,
+			}
+			if !hasRole {
+				authErr.RequiredRoles = rule.roles
+			}
+			return &authErr
+		}
+	}
+
+	return nil
+}
+
+// scopesFromClaim reads OAuth2 scopes, which are either given as a
+// space-separated string (like the "scope" claim) or as a list (like the
+// "scp" claim).
+func scopesFromClaim(claim interface{}) []string {
+	if str, ok := claim.(string); ok {
+		return strings.Fields(str)
+	}
+
+	return claimStrings(claim)
+}
+
+func writeAuthorizationError(rw http.ResponseWriter, authErr *AuthorizationError) {
+	body, _ := json.Marshal(authErr)
+
+	rw.Header().Set("Content-Type", "application/json;charset=utf8")
+	rw.WriteHeader(403)
+	_, _ = rw.Write(body)
+}
@@ -25,16 +25,18 @@ import (
 	"net/http"
 	"reflect"
 
-	"github.com/gomodule/redigo/redis"
 	"github.com/julienschmidt/httprouter"
 	"github.com/mittwald/servicegateway/config"
 	"github.com/op/go-logging"
 )
 
 var InvalidCredentialsError = errors.New("invalid credentials given")
+var NoRefreshTokenError = errors.New("token cannot be refreshed")
 
 type AuthenticationIncompleteError struct {
 	AdditionalProperties map[string]interface{}
+	Username             string
+	AllowedApplications  []string
 }
 
 type InvalidResponseBodyContentTypeError struct {
@@ -72,15 +74,19 @@ type AuthenticationRequest struct {
 
 func NewAuthDecorator(
 	authConfig *config.GlobalAuth,
-	redisPool *redis.Pool,
+	redisPool RedisConnectionSource,
 	logger *logging.Logger,
 	authHandler *AuthenticationHandler,
 	tokenStore TokenStore,
 	uiDir string,
 ) (AuthDecorator, error) {
 	switch authConfig.Mode {
-	case "rest":
+	case "rest", "mtls":
 		return NewRestAuthDecorator(authHandler, tokenStore, logger), nil
+	case "oidc":
+		return NewOIDCAuthDecorator(authHandler, tokenStore, logger)
+	case "saml":
+		return NewSAMLAuthDecorator(authHandler, tokenStore, logger)
 	}
 	return nil, fmt.Errorf("unsupported authentication mode: '%s'", authConfig.Mode)
 }
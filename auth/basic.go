@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+	"github.com/patrickmn/go-cache"
+)
+
+// BasicAuthTokenReader translates HTTP Basic credentials into a JWT by
+// logging in at the authentication provider on the client's behalf. This
+// allows legacy clients that cannot perform a login flow to access protected
+// services. Requests without Basic credentials fall back to the wrapped
+// token reader.
+type BasicAuthTokenReader struct {
+	config   *config.BasicAuthConfig
+	handler  *AuthenticationHandler
+	fallback TokenReader
+	logger   *logging.Logger
+
+	cacheTtl time.Duration
+	tokens   *cache.Cache
+}
+
+func NewBasicAuthTokenReader(cfg *config.BasicAuthConfig, handler *AuthenticationHandler, fallback TokenReader, logger *logging.Logger) (*BasicAuthTokenReader, error) {
+	cacheTtl := 5 * time.Minute
+	if cfg.CacheTtl != "" {
+		var err error
+
+		cacheTtl, err = time.ParseDuration(cfg.CacheTtl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid basic auth cache TTL '%s': %s", cfg.CacheTtl, err)
+		}
+	}
+
+	return &BasicAuthTokenReader{
+		config:   cfg,
+		handler:  handler,
+		fallback: fallback,
+		logger:   logger,
+		cacheTtl: cacheTtl,
+		tokens:   cache.New(cacheTtl, 5*time.Minute),
+	}, nil
+}
+
+func (r *BasicAuthTokenReader) TokenFromRequest(req *http.Request) (*JWTResponse, error) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return r.fallback.TokenFromRequest(req)
+	}
+
+	if !r.config.Passthrough {
+		req.Header.Del("Authorization")
+	}
+
+	// credentials are only kept in memory in hashed form
+	sum := sha256.Sum256([]byte(username + ":" + password))
+	cacheKey := hex.EncodeToString(sum[:])
+
+	if token, ok := r.tokens.Get(cacheKey); ok {
+		return token.(*JWTResponse), nil
+	}
+
+	token, err := r.handler.AuthenticateClient(req, username, password, map[string]interface{}{})
+	if err == InvalidCredentialsError {
+		return nil, NoTokenError
+	} else if _, ok := err.(LoginThrottledError); ok {
+		return nil, NoTokenError
+	} else if errors.Is(err, AuthenticationIncompleteError{}) {
+		r.logger.Warningf("user %s requires an additional authentication factor, which is not supported for basic auth", username)
+		return nil, NoTokenError
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the client will send its credentials again with the next request, so
+	// there is no need to keep a refresh token around
+	token.RefreshToken = ""
+	token.RefreshExpiresAt = 0
+
+	ttl := r.cacheTtl
+	if _, stdClaims, _, err := r.handler.verifier.VerifyToken(token.JWT); err == nil && stdClaims.ExpiresAt > 0 {
+		if remaining := time.Until(time.Unix(stdClaims.ExpiresAt, 0)) - time.Minute; remaining < ttl {
+			ttl = remaining
+		}
+	}
+	if ttl > 0 {
+		r.tokens.Set(cacheKey, token, ttl)
+	}
+
+	return token, nil
+}
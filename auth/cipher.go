@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+const encryptedValuePrefix = "enc1."
+
+// TokenCipher encrypts the JWTs (and provider refresh tokens) that are kept
+// in a token store using AES-GCM, so that a dump of the store does not leak
+// usable credentials. Values are encrypted with the first key; all keys can
+// be used for decryption, which allows rotating keys without invalidating
+// existing tokens.
+//
+// Each encrypted value is bound to the ID of the token it belongs to (see
+// tokenKey), so that encrypted values cannot be moved between tokens.
+type TokenCipher struct {
+	keys    map[string]cipher.AEAD
+	primary string
+}
+
+func NewTokenCipher(keys [][]byte) (*TokenCipher, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no encryption keys configured")
+	}
+
+	c := TokenCipher{keys: make(map[string]cipher.AEAD, len(keys))}
+
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key: %s", err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:4])
+
+		c.keys[id] = aead
+		if i == 0 {
+			c.primary = id
+		}
+	}
+
+	return &c, nil
+}
+
+// TokenCipherFromConfig loads the configured encryption keys. It returns nil
+// if encryption is not enabled.
+func TokenCipherFromConfig(cfg *config.TokenEncryptionConfiguration) (*TokenCipher, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, nil
+	}
+
+	keys := make([][]byte, 0, len(cfg.Keys))
+	for _, ref := range cfg.Keys {
+		key, err := loadEncryptionKey(ref)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return NewTokenCipher(keys)
+}
+
+// loadEncryptionKey reads a base64-encoded key from an environment variable
+// ("env:NAME") or a file ("file:/path").
+func loadEncryptionKey(ref string) ([]byte, error) {
+	var encoded string
+
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s for encryption key is not set", name)
+		}
+		encoded = value
+	case strings.HasPrefix(ref, "file:"):
+		value, err := ioutil.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return nil, fmt.Errorf("could not read encryption key: %s", err)
+		}
+		encoded = string(value)
+	default:
+		return nil, fmt.Errorf("encryption key '%s' must be referenced as 'env:NAME' or 'file:PATH'", ref)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not base64-encoded: %s", err)
+	}
+
+	return key, nil
+}
+
+// Encrypt encrypts a value that belongs to the token with the given ID. Empty
+// values are not encrypted.
+func (c *TokenCipher) Encrypt(value string, id string) (string, error) {
+	if c == nil || value == "" {
+		return value, nil
+	}
+
+	aead := c.keys[c.primary]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(id))
+	return encryptedValuePrefix + c.primary + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value that was encrypted for the token with the given
+// ID. Values that were stored before encryption was enabled are returned
+// unchanged.
+func (c *TokenCipher) Decrypt(value string, id string) (string, error) {
+	if !strings.HasPrefix(value, encryptedValuePrefix) {
+		return value, nil
+	}
+
+	if c == nil {
+		return "", fmt.Errorf("value is encrypted, but no encryption keys are configured")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedValuePrefix), ".", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	aead, ok := c.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("value is encrypted with unknown key %s", parts[0])
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt value: %s", err)
+	}
+
+	return string(plain), nil
+}
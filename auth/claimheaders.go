@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// ClaimHeaderWriter forwards claims of the verified JWT to upstream services
+// as request headers. Header values are rendered from text templates with
+// the JWT's claims as data, like "{{.sub}}" or `{{join .roles ","}}`.
+type ClaimHeaderWriter struct {
+	headers map[string]*template.Template
+}
+
+var claimTemplateFuncs = template.FuncMap{
+	"join": func(value interface{}, sep string) string {
+		return strings.Join(claimStrings(value), sep)
+	},
+	"claim": func(claims map[string]interface{}, path string) interface{} {
+		return claimByPath(claims, path)
+	},
+}
+
+func NewClaimHeaderWriter(headers map[string]string) (*ClaimHeaderWriter, error) {
+	w := ClaimHeaderWriter{
+		headers: make(map[string]*template.Template, len(headers)),
+	}
+
+	for name, value := range headers {
+		tmpl, err := template.New(name).Funcs(claimTemplateFuncs).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for header %s: %s", name, err)
+		}
+
+		w.headers[http.CanonicalHeaderKey(name)] = tmpl
+	}
+
+	return &w, nil
+}
+
+// WriteClaimsToRequest sets the configured headers. Headers whose template
+// refers to a claim that the JWT does not have are not set.
+func (w *ClaimHeaderWriter) WriteClaimsToRequest(claims map[string]interface{}, req *http.Request) error {
+	for name, tmpl := range w.headers {
+		value := strings.Builder{}
+		if err := tmpl.Execute(&value, claims); err != nil {
+			continue
+		}
+
+		if strings.ContainsAny(value.String(), "\r\n") {
+			return fmt.Errorf("value of header %s contains line breaks", name)
+		}
+
+		if value.Len() > 0 {
+			req.Header.Set(name, value.String())
+		}
+	}
+
+	return nil
+}
+
+// RemoveClaimsFromRequest removes the configured headers, so that clients
+// cannot pass them to upstream services themselves.
+func (w *ClaimHeaderWriter) RemoveClaimsFromRequest(req *http.Request) {
+	for name := range w.headers {
+		req.Header.Del(name)
+	}
+}
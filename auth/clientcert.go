@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+	"github.com/patrickmn/go-cache"
+)
+
+// LoadCertPool reads a PEM-encoded CA bundle from disk.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	caPEM, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA bundle from '%s': %s", file, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in CA bundle '%s'", file)
+	}
+
+	return pool, nil
+}
+
+// ClientCertificateTokenReader derives the caller's identity from its TLS
+// client certificate and issues a gateway-signed JWT for it. Requests
+// without a client certificate fall back to the wrapped token reader.
+type ClientCertificateTokenReader struct {
+	config   *config.ClientCertificateAuthConfig
+	signer   *JwtSigner
+	roots    *x509.CertPool
+	proxies  []*net.IPNet
+	fallback TokenReader
+	logger   *logging.Logger
+
+	tokens *cache.Cache
+}
+
+func NewClientCertificateTokenReader(cfg *config.ClientCertificateAuthConfig, signer *JwtSigner, fallback TokenReader, logger *logging.Logger) (*ClientCertificateTokenReader, error) {
+	if signer == nil {
+		return nil, fmt.Errorf("client certificate authentication requires a JWT signing key")
+	}
+
+	reader := ClientCertificateTokenReader{
+		config:   cfg,
+		signer:   signer,
+		fallback: fallback,
+		logger:   logger,
+		tokens:   cache.New(cache.NoExpiration, 5*time.Minute),
+	}
+
+	if cfg.ForwardedHeader != "" {
+		if cfg.CAFile == "" {
+			return nil, fmt.Errorf("a CA bundle is required to verify forwarded client certificates")
+		}
+
+		roots, err := LoadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		reader.roots = roots
+
+		for _, cidr := range cfg.TrustedProxies {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy network '%s': %s", cidr, err)
+			}
+			reader.proxies = append(reader.proxies, network)
+		}
+	}
+
+	return &reader, nil
+}
+
+func (r *ClientCertificateTokenReader) TokenFromRequest(req *http.Request) (*JWTResponse, error) {
+	cert, err := r.certificateFromRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if cert == nil {
+		return r.fallback.TokenFromRequest(req)
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	cacheKey := hex.EncodeToString(fingerprint[:])
+
+	if token, ok := r.tokens.Get(cacheKey); ok {
+		return &JWTResponse{JWT: token.(string)}, nil
+	}
+
+	subject := certificateField(cert, r.config.SubjectSource)
+	if subject == "" {
+		r.logger.Warningf("client certificate %s has no usable subject", cert.Subject)
+		return nil, NoTokenError
+	}
+
+	claims := map[string]interface{}{
+		"x5t#S256": cacheKey,
+	}
+	for claim, field := range r.config.Claims {
+		if value := certificateField(cert, field); value != "" {
+			claims[claim] = value
+		}
+	}
+
+	token, err := r.signer.Sign(subject, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	// re-issue tokens some time before they expire, but never cache a token
+	// for longer than the certificate is valid
+	ttl := r.signer.ttl - time.Minute
+	if remaining := time.Until(cert.NotAfter); remaining < ttl {
+		ttl = remaining
+	}
+	if ttl > 0 {
+		r.tokens.Set(cacheKey, token, ttl)
+	}
+
+	return &JWTResponse{JWT: token}, nil
+}
+
+// certificateFromRequest returns the verified client certificate of a request,
+// either from the TLS connection or from a header set by a TLS-terminating
+// proxy in front of the gateway. It returns nil if there is none.
+func (r *ClientCertificateTokenReader) certificateFromRequest(req *http.Request) (*x509.Certificate, error) {
+	var header string
+
+	if r.config.ForwardedHeader != "" {
+		header = req.Header.Get(r.config.ForwardedHeader)
+
+		// the header must never reach upstream services
+		req.Header.Del(r.config.ForwardedHeader)
+	}
+
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return req.TLS.VerifiedChains[0][0], nil
+	}
+
+	if header == "" {
+		return nil, nil
+	}
+
+	// certificates are public; the header may only be trusted when it was
+	// set by the proxy that actually performed the TLS handshake
+	if !r.isTrustedProxy(req.RemoteAddr) {
+		r.logger.Warningf("ignoring forwarded client certificate from untrusted address %s", req.RemoteAddr)
+		return nil, nil
+	}
+
+	certPEM, err := url.QueryUnescape(header)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode forwarded client certificate: %s", err)
+	}
+
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, fmt.Errorf("forwarded client certificate is not PEM-encoded")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse forwarded client certificate: %s", err)
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     r.roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		r.logger.Warningf("rejecting forwarded client certificate %s: %s", cert.Subject, err)
+		return nil, NoTokenError
+	}
+
+	return cert, nil
+}
+
+func (r *ClientCertificateTokenReader) isTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range r.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// certificateField extracts a value from a certificate. Supported fields are
+// "cn" (the default), "o", "ou", "serial", "dns_san", "uri_san" and
+// "email_san". For SANs, the first entry is used.
+func certificateField(cert *x509.Certificate, field string) string {
+	switch field {
+	case "", "cn":
+		return cert.Subject.CommonName
+	case "o":
+		return strings.Join(cert.Subject.Organization, ",")
+	case "ou":
+		return strings.Join(cert.Subject.OrganizationalUnit, ",")
+	case "serial":
+		return cert.SerialNumber.String()
+	case "dns_san":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case "uri_san":
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	case "email_san":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+type contextKey int
+
+const (
+	apiKeyContextKey contextKey = iota
+	issuerContextKey
+	claimsContextKey
+)
+
+// ApiKeyFromContext returns the metadata of the API key that the current
+// request was authenticated with, if any.
+func ApiKeyFromContext(ctx context.Context) (*config.ApiKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey).(*config.ApiKey)
+	return key, ok
+}
+
+func contextWithApiKey(ctx context.Context, key *config.ApiKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey, key)
+}
+
+// IssuerFromContext returns the issuer of the JWT that the current request
+// was authenticated with, if any.
+func IssuerFromContext(ctx context.Context) (string, bool) {
+	issuer, ok := ctx.Value(issuerContextKey).(string)
+	return issuer, ok
+}
+
+func contextWithIssuer(ctx context.Context, issuer string) context.Context {
+	return context.WithValue(ctx, issuerContextKey, issuer)
+}
+
+// ClaimsFromContext returns the claims of the token that the current request
+// was authenticated with, if any.
+func ClaimsFromContext(ctx context.Context) (map[string]interface{}, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(map[string]interface{})
+	return claims, ok
+}
+
+func contextWithClaims(ctx context.Context, claims map[string]interface{}) context.Context {
+	return context.WithValue(ctx, claimsContextKey, claims)
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+type externalAuthorizationRequest struct {
+	Application   string                 `json:"application"`
+	Method        string                 `json:"method"`
+	Host          string                 `json:"host"`
+	Path          string                 `json:"path"`
+	Query         string                 `json:"query,omitempty"`
+	Headers       map[string]string      `json:"headers,omitempty"`
+	Authenticated bool                   `json:"authenticated"`
+	Claims        map[string]interface{} `json:"claims,omitempty"`
+}
+
+// RequestAuthorizer decides whether a request may be forwarded upstream. The
+// token is nil for unauthenticated requests.
+type RequestAuthorizer interface {
+	Check(req *http.Request, appName string, token *JWTResponse) (*ExternalAuthorizationResult, error)
+}
+
+// ExternalAuthorizationResult is the decision of an external authorization
+// service.
+type ExternalAuthorizationResult struct {
+	Allow         *bool             `json:"allow"`
+	Status        int               `json:"status"`
+	Message       string            `json:"msg"`
+	SetHeaders    map[string]string `json:"set_headers"`
+	RemoveHeaders []string          `json:"remove_headers"`
+}
+
+// Allowed returns whether the request may be forwarded upstream.
+func (r *ExternalAuthorizationResult) Allowed() bool {
+	return r.Allow == nil || *r.Allow
+}
+
+// ExternalAuthorizer delegates authorization decisions to an external HTTP
+// service. For each request, the service receives the request's method, path
+// and token claims, and answers whether the request should be allowed and
+// which request headers should be modified before it is forwarded.
+type ExternalAuthorizer struct {
+	config     *config.ExternalAuthorizationConfig
+	httpClient *http.Client
+	logger     *logging.Logger
+}
+
+func NewExternalAuthorizer(cfg *config.ExternalAuthorizationConfig, logger *logging.Logger) (*ExternalAuthorizer, error) {
+	timeout := 5 * time.Second
+	if cfg.Timeout != "" {
+		var err error
+
+		timeout, err = time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid external authorization timeout '%s': %s", cfg.Timeout, err)
+		}
+	}
+
+	return &ExternalAuthorizer{
+		config:     cfg,
+		httpClient: &http.Client{Timeout: timeout},
+		logger:     logger,
+	}, nil
+}
+
+// Check asks the external authorization service for a decision on the given
+// request. The token may be nil for unauthenticated requests. If the service
+// cannot be reached and fail_open is set, the request is allowed unchanged.
+func (e *ExternalAuthorizer) Check(req *http.Request, appName string, token *JWTResponse) (*ExternalAuthorizationResult, error) {
+	result, err := e.check(req, appName, token)
+	if err != nil && e.config.FailOpen {
+		e.logger.Warningf("external authorization failed, allowing request: %s", err)
+		return &ExternalAuthorizationResult{}, nil
+	}
+
+	return result, err
+}
+
+func newExternalAuthorizationRequest(req *http.Request, appName string, token *JWTResponse, forwardHeaders []string) *externalAuthorizationRequest {
+	authzRequest := externalAuthorizationRequest{
+		Application: appName,
+		Method:      req.Method,
+		Host:        req.Host,
+		Path:        req.URL.Path,
+		Query:       req.URL.RawQuery,
+	}
+
+	if token != nil {
+		authzRequest.Authenticated = true
+		authzRequest.Claims = token.Claims
+	}
+
+	if len(forwardHeaders) > 0 {
+		authzRequest.Headers = make(map[string]string, len(forwardHeaders))
+		for _, name := range forwardHeaders {
+			if value := req.Header.Get(name); value != "" {
+				authzRequest.Headers[name] = value
+			}
+		}
+	}
+
+	return &authzRequest
+}
+
+func (e *ExternalAuthorizer) check(req *http.Request, appName string, token *JWTResponse) (*ExternalAuthorizationResult, error) {
+	authzRequest := newExternalAuthorizationRequest(req, appName, token, e.config.ForwardHeaders)
+
+	jsonString, err := json.Marshal(authzRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	authzReq, err := http.NewRequest("POST", e.config.Url, bytes.NewBuffer(jsonString))
+	if err != nil {
+		return nil, err
+	}
+	authzReq.Header.Set("Accept", "application/json")
+	authzReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.httpClient.Do(authzReq)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach external authorization service: %s", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := ExternalAuthorizationResult{}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		_ = json.Unmarshal(body, &result)
+
+		denied := false
+		result.Allow = &denied
+		if result.Status == 0 {
+			result.Status = resp.StatusCode
+		}
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("unexpected status code %d from external authorization service: %s", resp.StatusCode, body)
+	case len(bytes.TrimSpace(body)) > 0:
+		if err := json.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("could not decode external authorization response: %s", err)
+		}
+	}
+
+	return &result, nil
+}
+
+// Apply performs the header mutations requested by the external
+// authorization service.
+func (r *ExternalAuthorizationResult) Apply(req *http.Request) {
+	for _, name := range r.RemoveHeaders {
+		req.Header.Del(name)
+	}
+
+	for name, value := range r.SetHeaders {
+		req.Header.Set(name, value)
+	}
+}
+
+func writeExternalAuthorizationDenial(rw http.ResponseWriter, result *ExternalAuthorizationResult) {
+	status := result.Status
+	if status < 400 || status > 599 {
+		status = 403
+	}
+
+	msg := result.Message
+	if msg == "" {
+		msg = "access denied"
+	}
+
+	body, _ := json.Marshal(map[string]string{"msg": msg})
+
+	rw.Header().Set("Content-Type", "application/json;charset=utf8")
+	rw.WriteHeader(status)
+	_, _ = rw.Write(body)
+}
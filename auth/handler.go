@@ -21,18 +21,27 @@ package auth
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	"github.com/gomodule/redigo/redis"
+	"github.com/mittwald/servicegateway/audit"
+	"github.com/mittwald/servicegateway/clientip"
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/redact"
 	"github.com/op/go-logging"
-	cache "github.com/patrickmn/go-cache"
 	"github.com/robertkrimen/otto"
 )
 
@@ -44,25 +53,85 @@ type AuthenticationHandler struct {
 	logger      *logging.Logger
 	verifier    *JwtVerifier
 
-	hookPreAuth *otto.Script
+	hookPreAuth  *otto.Script
+	hookPostAuth *otto.Script
 
-	expCache *cache.Cache
+	oidc *OIDCClient
+	saml *SAMLServiceProvider
+	ldap *LDAPProvider
+
+	requestAuthorizers []RequestAuthorizer
+
+	throttle    *LoginThrottle
+	auditLogger *audit.Logger
+
+	expCache *verificationCache
 
 	jsVM *otto.Otto
+
+	postAuthVM   *otto.Otto
+	postAuthLock sync.Mutex
 }
 
 type JWTResponse struct {
 	JWT                 string
 	AllowedApplications []string
+
+	// ExpiresAt is set when the authentication provider reported the
+	// lifetime of the JWT separately. Mapped tokens expire no later than
+	// this, even if the JWT itself does not expire.
+	ExpiresAt int64
+
+	// Token is the opaque token that this JWT is mapped to. It is only
+	// populated for responses loaded from a TokenStore.
+	Token string
+
+	// RefreshToken and RefreshExpiresAt are set when the identity provider
+	// issued a refresh token that can be used to renew an expired JWT.
+	RefreshToken     string
+	RefreshExpiresAt int64
+
+	// ApiKey is set when the request was authenticated using an API key
+	// instead of a token.
+	ApiKey *config.ApiKey
+
+	// Audience contains the applications that the JWT is restricted to by
+	// its audience claim. It is only populated by IsAuthenticated.
+	Audience []string
+
+	// Claims contains the verified claims of the JWT, after applying the
+	// claims mapping of its issuer. It is only populated by IsAuthenticated.
+	Claims map[string]interface{}
+
+	// Issuer is the issuer of the JWT. It is only populated by
+	// IsAuthenticated.
+	Issuer string
+}
+
+// verifiedToken is stored in the expiration cache for JWTs whose signature
+// has already been verified.
+type verifiedToken struct {
+	exp      int64
+	jti      string
+	audience []string
+	claims   map[string]interface{}
+	issuer   string
 }
 
 func NewAuthenticationHandler(
 	cfg *config.GlobalAuth,
-	redisPool *redis.Pool,
+	redisPool RedisConnectionSource,
 	tokenStore TokenStore,
 	verifier *JwtVerifier,
+	auditLogger *audit.Logger,
+	metrics *monitoring.PromMetrics,
 	logger *logging.Logger,
 ) (*AuthenticationHandler, error) {
+	expCache, err := newVerificationCache(cfg.VerificationCacheSize, metrics)
+	if err != nil {
+		return nil, err
+	}
+
 	handler := AuthenticationHandler{
 		config:      cfg,
 		storage:     tokenStore,
@@ -70,47 +139,283 @@ func NewAuthenticationHandler(
 		httpClient:  &http.Client{},
 		logger:      logger,
 		verifier:    verifier,
-		expCache:    cache.New(cache.NoExpiration, 5*time.Minute),
+		auditLogger: auditLogger,
+		expCache:    expCache,
 	}
 
 	if cfg.ProviderConfig.PreAuthenticationHook != "" {
-		handler.jsVM = otto.New()
-		err := handler.jsVM.Set(
-			"log", func(call otto.FunctionCall) otto.Value {
-				format := call.Argument(0).String()
-				args := call.ArgumentList[1:]
-				values := make([]interface{}, len(args))
-
-				for i := range args {
-					values[i], _ = args[i].Export()
-				}
+		vm, script, err := newHookVM(cfg.ProviderConfig.PreAuthenticationHook, logger)
+		if err != nil {
+			return nil, err
+		}
+		handler.jsVM = vm
+		handler.hookPreAuth = script
+	}
+
+	if (cfg.JwtIssuer.Resign || cfg.ProviderConfig.PostAuthenticationHook != "") && verifier.Signer() == nil {
+		return nil, fmt.Errorf("re-signing tokens requires a JWT signing key")
+	}
+
+	if cfg.ProviderConfig.PostAuthenticationHook != "" {
 
-				logger.Debugf(format, values...)
-				return otto.UndefinedValue()
-			},
-		)
+		vm, script, err := newHookVM(cfg.ProviderConfig.PostAuthenticationHook, logger)
 		if err != nil {
 			return nil, err
 		}
+		handler.postAuthVM = vm
+		handler.hookPostAuth = script
+	}
+
+	if cfg.Mode == "oidc" {
+		handler.oidc = NewOIDCClient(&cfg.OIDC, handler.httpClient, logger)
+	}
 
-		script, err := handler.jsVM.Compile(cfg.ProviderConfig.PreAuthenticationHook, nil)
+	if cfg.Mode == "saml" {
+		samlProvider, err := NewSAMLServiceProvider(&cfg.SAML, verifier.Signer(), handler.httpClient, logger)
 		if err != nil {
-			return nil, fmt.Errorf("could not parse JS hook %s: %s", cfg.ProviderConfig.PreAuthenticationHook, err.Error())
+			return nil, err
 		}
-		handler.hookPreAuth = script
+		handler.saml = samlProvider
+	}
+
+	if cfg.LoginThrottling.Enabled {
+		throttle, err := NewLoginThrottle(&cfg.LoginThrottling, redisPool, logger)
+		if err != nil {
+			return nil, err
+		}
+		handler.throttle = throttle
+	}
+
+	if cfg.BasicAuth.Enabled {
+		reader, err := NewBasicAuthTokenReader(&cfg.BasicAuth, &handler, handler.tokenReader, logger)
+		if err != nil {
+			return nil, err
+		}
+		handler.tokenReader = reader
+	}
+
+	if cfg.ApiKeys.Enabled {
+		handler.tokenReader = NewApiKeyReader(&cfg.ApiKeys, redisPool, verifier.Signer(), handler.tokenReader, logger)
+	}
+
+	if cfg.Mode == "mtls" {
+		reader, err := NewClientCertificateTokenReader(&cfg.ClientCertificate, verifier.Signer(), handler.tokenReader, logger)
+		if err != nil {
+			return nil, err
+		}
+		handler.tokenReader = reader
+	}
+
+	if cfg.ExternalAuthz.Url != "" {
+		extAuthz, err := NewExternalAuthorizer(&cfg.ExternalAuthz, logger)
+		if err != nil {
+			return nil, err
+		}
+		handler.requestAuthorizers = append(handler.requestAuthorizers, extAuthz)
+	}
+
+	switch cfg.ProviderConfig.Request.Format {
+	case "", "json", "form":
+	default:
+		return nil, fmt.Errorf("unsupported provider request format: '%s'", cfg.ProviderConfig.Request.Format)
+	}
+
+	switch cfg.ProviderConfig.Type {
+	case "", "rest":
+	case "ldap":
+		ldapProvider, err := NewLDAPProvider(&cfg.ProviderConfig.LDAP, verifier.Signer(), logger)
+		if err != nil {
+			return nil, err
+		}
+		handler.ldap = ldapProvider
+	default:
+		return nil, fmt.Errorf("unsupported authentication provider type: '%s'", cfg.ProviderConfig.Type)
+	}
+
+	// the OPA authorizer is set up last, since it starts reloading policies
+	// in the background
+	if len(cfg.OPA.PolicyFiles) > 0 || cfg.OPA.BundleUrl != "" {
+		opa, err := NewOPAAuthorizer(&cfg.OPA, logger)
+		if err != nil {
+			return nil, err
+		}
+		handler.requestAuthorizers = append(handler.requestAuthorizers, opa)
 	}
 
 	return &handler, nil
 }
 
+// Close stops the background tasks of the handler's authorizers and closes
+// its idle connections, once the gateway that it was built for has been
+// replaced.
+func (h *AuthenticationHandler) Close() error {
+	for _, authorizer := range h.requestAuthorizers {
+		if closer, ok := authorizer.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				return err
+			}
+		}
+	}
+
+	h.httpClient.CloseIdleConnections()
+	return nil
+}
+
+func newHookVM(source string, logger *logging.Logger) (*otto.Otto, *otto.Script, error) {
+	vm := otto.New()
+	err := vm.Set(
+		"log", func(call otto.FunctionCall) otto.Value {
+			format := call.Argument(0).String()
+			args := call.ArgumentList[1:]
+			values := make([]interface{}, len(args))
+
+			for i := range args {
+				values[i], _ = args[i].Export()
+			}
+
+			logger.Debugf(format, values...)
+			return otto.UndefinedValue()
+		},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	script, err := vm.Compile(source, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse JS hook %s: %s", source, err.Error())
+	}
+
+	return vm, script, nil
+}
+
+// CheckHook checks that a JS hook file can be read and compiled.
+func CheckHook(file string) error {
+	if _, err := os.Stat(file); err != nil {
+		return fmt.Errorf("could not read JS hook: %s", err)
+	}
+
+	if _, err := otto.New().Compile(file, nil); err != nil {
+		return fmt.Errorf("could not parse JS hook %s: %s", file, err)
+	}
+
+	return nil
+}
+
+// AuthenticateClient authenticates a user like Authenticate, but also
+// enforces the login throttling for the user and for the client's IP
+// address, and records the outcome in the audit log.
+func (h *AuthenticationHandler) AuthenticateClient(req *http.Request, username string, password string, additionalBodyProperties map[string]interface{}) (*JWTResponse, error) {
+	clientIP := clientip.FromRequest(req)
+
+	if h.throttle != nil {
+		if err := h.throttle.Check(username, clientIP); err != nil {
+			if _, ok := err.(LoginThrottledError); ok {
+				h.logger.Warningf("rejecting login of user %s from %s: %s", username, clientIP, err)
+				h.auditLogger.Log(audit.NewEvent(audit.LoginThrottled, req, username))
+			}
+			return nil, err
+		}
+	}
+
+	response, err := h.Authenticate(username, password, additionalBodyProperties)
+	if err == InvalidCredentialsError {
+		h.auditLogger.Log(audit.NewEvent(audit.LoginFailure, req, username))
+
+		if h.throttle != nil {
+			lockout, recordErr := h.throttle.RecordFailure(username, clientIP)
+			if recordErr != nil {
+				h.logger.Errorf("could not record failed login: %s", recordErr)
+			} else if lockout > 0 {
+				h.auditLogger.Log(audit.NewEvent(audit.LoginLockout, req, username).WithDetail("lockout", lockout.String()))
+			}
+		}
+	} else if errors.Is(err, AuthenticationIncompleteError{}) {
+		// the failed logins of the user are only reset once all factors
+		// were answered, so that repeating the first factor does not allow
+		// to guess the others
+		h.auditLogger.Log(audit.NewEvent(audit.MfaChallenge, req, username))
+	} else if err == nil {
+		h.auditLogger.Log(audit.NewEvent(audit.LoginSuccess, req, username))
+
+		if h.throttle != nil {
+			if recordErr := h.throttle.RecordSuccess(username); recordErr != nil {
+				h.logger.Errorf("could not record successful login: %s", recordErr)
+			}
+		}
+	}
+
+	return response, err
+}
+
+// CompleteAuthenticationClient completes a multi-factor login like
+// CompleteAuthentication. Wrong answers to a challenge count as failed logins
+// of the user and the client's IP address, so that the login throttling
+// applies to them as well.
+func (h *AuthenticationHandler) CompleteAuthenticationClient(req *http.Request, pending *PendingAuthentication, properties map[string]interface{}) (*JWTResponse, error) {
+	clientIP := clientip.FromRequest(req)
+
+	if h.throttle != nil {
+		if err := h.throttle.Check(pending.Username, clientIP); err != nil {
+			if _, ok := err.(LoginThrottledError); ok {
+				h.logger.Warningf("rejecting MFA login of user %s from %s: %s", pending.Username, clientIP, err)
+				h.auditLogger.Log(audit.NewEvent(audit.LoginThrottled, req, pending.Username).WithDetail("factor", "mfa"))
+			}
+			return nil, err
+		}
+	}
+
+	response, err := h.CompleteAuthentication(pending, properties)
+	if err == InvalidCredentialsError {
+		h.auditLogger.Log(audit.NewEvent(audit.LoginFailure, req, pending.Username).WithDetail("factor", "mfa"))
+
+		if h.throttle != nil {
+			lockout, recordErr := h.throttle.RecordFailure(pending.Username, clientIP)
+			if recordErr != nil {
+				h.logger.Errorf("could not record failed MFA login: %s", recordErr)
+			} else if lockout > 0 {
+				h.auditLogger.Log(audit.NewEvent(audit.LoginLockout, req, pending.Username).WithDetail("lockout", lockout.String()))
+			}
+		}
+	} else if errors.Is(err, AuthenticationIncompleteError{}) {
+		h.auditLogger.Log(audit.NewEvent(audit.MfaChallenge, req, pending.Username))
+	} else if err == nil {
+		h.auditLogger.Log(audit.NewEvent(audit.LoginSuccess, req, pending.Username).WithDetail("factor", "mfa"))
+
+		if h.throttle != nil {
+			if recordErr := h.throttle.RecordSuccess(pending.Username); recordErr != nil {
+				h.logger.Errorf("could not record successful login: %s", recordErr)
+			}
+		}
+	}
+
+	return response, err
+}
+
 func (h *AuthenticationHandler) Authenticate(username string, password string, additionalBodyProperties map[string]interface{}) (*JWTResponse, error) {
+	if h.ldap != nil {
+		response, err := h.ldap.Authenticate(username, password)
+		if err != nil {
+			return nil, err
+		}
+		return h.finalizeToken(response)
+	}
+
 	response := JWTResponse{}
 
-	authRequest := h.config.ProviderConfig.Parameters
-	authRequest["username"] = username
-	authRequest["password"] = password
+	// the configured parameters are shared between concurrent logins
+	authRequest := make(map[string]interface{}, len(h.config.ProviderConfig.Parameters)+2)
+	for k, v := range h.config.ProviderConfig.Parameters {
+		authRequest[k] = v
+	}
+	usernameField, passwordField := h.credentialFields()
+	authRequest[usernameField] = username
+	authRequest[passwordField] = password
 
-	requestURL := h.config.ProviderConfig.Url + "/authenticate"
+	requestURL := h.config.ProviderConfig.AuthenticationUrl
+	if requestURL == "" {
+		requestURL = h.config.ProviderConfig.Url + "/authenticate"
+	}
 
 	if h.hookPreAuth != nil {
 		_, err := h.jsVM.Run(h.hookPreAuth)
@@ -179,14 +484,12 @@ func (h *AuthenticationHandler) Authenticate(username string, password string, a
 		}
 	}
 
-	jsonString, err := json.Marshal(authRequest)
-	if err != nil {
-		return nil, err
+	redactedAuthRequest := make(map[string]interface{}, len(authRequest))
+	for k, v := range authRequest {
+		redactedAuthRequest[k] = v
 	}
-
-	redactedAuthRequest := authRequest
-	if _, ok := redactedAuthRequest["password"]; ok {
-		redactedAuthRequest["password"] = "*REDACTED*"
+	if _, ok := redactedAuthRequest[passwordField]; ok {
+		redactedAuthRequest[passwordField] = "*REDACTED*"
 	}
 
 	debugJsonString, _ := json.Marshal(redactedAuthRequest)
@@ -194,12 +497,10 @@ func (h *AuthenticationHandler) Authenticate(username string, password string, a
 	h.logger.Infof("authenticating user %s", username)
 	h.logger.Debugf("authentication request: %s", debugJsonString)
 
-	req, err := http.NewRequest("POST", requestURL, bytes.NewBuffer(jsonString))
+	req, err := h.newProviderRequest(requestURL, authRequest)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Accept", "application/jwt")
-	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := h.httpClient.Do(req)
 	if err != nil {
@@ -209,6 +510,81 @@ func (h *AuthenticationHandler) Authenticate(username string, password string, a
 		_ = resp.Body.Close()
 	}()
 
+	authResponse, err := h.readProviderResponse(resp, username, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.finalizeToken(authResponse)
+}
+
+// credentialFields returns the names of the fields that the username and
+// password are sent in to the authentication provider.
+func (h *AuthenticationHandler) credentialFields() (string, string) {
+	usernameField := h.config.ProviderConfig.Request.UsernameField
+	if usernameField == "" {
+		usernameField = "username"
+	}
+
+	passwordField := h.config.ProviderConfig.Request.PasswordField
+	if passwordField == "" {
+		passwordField = "password"
+	}
+
+	return usernameField, passwordField
+}
+
+// newProviderRequest builds a request to the authentication provider. The
+// body is encoded either as JSON (the default) or as form, depending on the
+// provider's request configuration.
+func (h *AuthenticationHandler) newProviderRequest(requestURL string, body map[string]interface{}) (*http.Request, error) {
+	var encoded []byte
+	var contentType string
+
+	switch h.config.ProviderConfig.Request.Format {
+	case "", "json":
+		jsonString, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded = jsonString
+		contentType = "application/json"
+	case "form":
+		form := url.Values{}
+		for k, v := range body {
+			switch value := v.(type) {
+			case nil:
+			case string:
+				form.Set(k, value)
+			default:
+				form.Set(k, fmt.Sprint(value))
+			}
+		}
+
+		encoded = []byte(form.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	default:
+		return nil, fmt.Errorf("unsupported provider request format: '%s'", h.config.ProviderConfig.Request.Format)
+	}
+
+	req, err := http.NewRequest("POST", requestURL, bytes.NewBuffer(encoded))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/jwt")
+	req.Header.Set("Content-Type", contentType)
+
+	for name, value := range h.config.ProviderConfig.Request.Headers {
+		req.Header.Set(name, value)
+	}
+
+	return req, nil
+}
+
+// readProviderResponse evaluates the authentication provider's response to a
+// login request (or to the completion of a multi-factor login).
+func (h *AuthenticationHandler) readProviderResponse(resp *http.Response, username string, response *JWTResponse) (*JWTResponse, error) {
 	if resp.StatusCode >= 400 {
 		body, _ := io.ReadAll(resp.Body)
 
@@ -237,16 +613,394 @@ func (h *AuthenticationHandler) Authenticate(username string, password string, a
 		}
 		return nil, &AuthenticationIncompleteError{
 			AdditionalProperties: unmarshalledBody,
+			Username:             username,
+			AllowedApplications:  response.AllowedApplications,
 		}
 	}
 
 	body, _ := io.ReadAll(resp.Body)
 
-	response.JWT = string(body)
+	response.RefreshToken, response.RefreshExpiresAt = refreshTokenFromResponse(resp)
+	if err := h.readProviderResponseBody(body, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// readProviderResponseBody reads the JWT from the body of a successful
+// response of the authentication provider. By default, the body is expected
+// to contain nothing but the JWT; if a token path is configured, the body is
+// read as JSON object instead, and the JWT (and optionally, its lifetime and
+// a refresh token) are extracted from it.
+func (h *AuthenticationHandler) readProviderResponseBody(body []byte, response *JWTResponse) error {
+	responseCfg := &h.config.ProviderConfig.Response
+
+	if responseCfg.TokenPath == "" {
+		response.JWT = string(body)
+		return nil
+	}
+
+	var document map[string]interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return fmt.Errorf("could not decode authentication provider response: %s", err)
+	}
+
+	token, ok := claimByPath(document, strings.TrimPrefix(responseCfg.TokenPath, "$.")).(string)
+	if !ok || token == "" {
+		return fmt.Errorf("authentication provider response contains no token at '%s'", responseCfg.TokenPath)
+	}
+	response.JWT = token
+
+	if responseCfg.ExpiresInPath != "" {
+		if expiresIn, ok := claimByPath(document, strings.TrimPrefix(responseCfg.ExpiresInPath, "$.")).(float64); ok && expiresIn > 0 {
+			response.ExpiresAt = time.Now().Unix() + int64(expiresIn)
+		}
+	}
+
+	if responseCfg.RefreshTokenPath != "" {
+		if refreshToken, ok := claimByPath(document, strings.TrimPrefix(responseCfg.RefreshTokenPath, "$.")).(string); ok && refreshToken != "" {
+			response.RefreshToken = refreshToken
+		}
+	}
+
+	return nil
+}
+
+// CompleteAuthentication continues a login that required an additional
+// authentication factor, by sending the client's response to the challenge
+// (together with the challenge data previously returned by the provider) to
+// the authentication provider.
+func (h *AuthenticationHandler) CompleteAuthentication(pending *PendingAuthentication, properties map[string]interface{}) (*JWTResponse, error) {
+	requestURL := h.config.ProviderConfig.MfaUrl
+	if requestURL == "" {
+		requestURL = h.config.ProviderConfig.Url + "/mfa"
+	}
+
+	// the properties of the pending challenge were set by the server, and
+	// take precedence over those that the client supplied
+	mfaRequest := make(map[string]interface{})
+	for k, v := range properties {
+		mfaRequest[k] = v
+	}
+	for k, v := range pending.Properties {
+		mfaRequest[k] = v
+	}
+	usernameField, _ := h.credentialFields()
+	mfaRequest[usernameField] = pending.Username
+
+	h.logger.Infof("completing authentication of user %s", pending.Username)
+
+	req, err := h.newProviderRequest(requestURL, mfaRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	response := JWTResponse{AllowedApplications: pending.AllowedApplications}
+	authResponse, err := h.readProviderResponse(resp, pending.Username, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.finalizeToken(authResponse)
+}
+
+// ExchangeAuthorizationCode completes an OpenID Connect login.
+func (h *AuthenticationHandler) ExchangeAuthorizationCode(code string) (*JWTResponse, error) {
+	response, err := h.oidc.Exchange(code)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.finalizeToken(response)
+}
+
+// AuthenticateSAMLResponse completes a SAML login.
+func (h *AuthenticationHandler) AuthenticateSAMLResponse(req *http.Request, requestIDs []string) (*JWTResponse, error) {
+	response, err := h.saml.Authenticate(req, requestIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.finalizeToken(response)
+}
+
+// finalizeToken post-processes a JWT that was issued by the authentication
+// provider, before it is mapped to an opaque token. If re-signing or a
+// post-authentication hook is configured, the provider's JWT is replaced
+// with a JWT signed by the gateway.
+func (h *AuthenticationHandler) finalizeToken(response *JWTResponse) (*JWTResponse, error) {
+	if !h.config.JwtIssuer.Resign && h.hookPostAuth == nil {
+		return response, nil
+	}
+
+	_, _, mapClaims, err := h.verifier.VerifyToken(response.JWT)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode JWT issued by authentication provider: %s", err)
+	}
+
+	claims := make(map[string]interface{}, len(mapClaims))
+	for k, v := range mapClaims {
+		claims[k] = v
+	}
+
+	if len(h.config.JwtIssuer.ClaimsMapping) > 0 {
+		claims = mapClaimsWithTable(claims, h.config.JwtIssuer.ClaimsMapping)
+	}
+
+	if h.hookPostAuth != nil {
+		claims, err = h.runPostAuthenticationHook(claims)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	subject, _ := claims["sub"].(string)
+	delete(claims, "sub")
+
+	response.JWT, err = h.verifier.Signer().Sign(subject, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// mapClaimsWithTable builds a new set of claims according to a mapping table
+// of target claim names to source claim names. Source claim names may refer
+// to nested claims using dots (like "realm_access.roles").
+func mapClaimsWithTable(claims map[string]interface{}, table map[string]string) map[string]interface{} {
+	mapped := make(map[string]interface{}, len(table))
+
+	for target, source := range table {
+		if value := claimByPath(claims, source); value != nil {
+			mapped[target] = value
+		}
+	}
+
+	return mapped
+}
+
+// claimByPath looks up a claim by its name. Nested claims can be referred to
+// using dots (like "realm_access.roles").
+func claimByPath(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+
+	for _, segment := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[segment]
+	}
+
+	return value
+}
+
+// runPostAuthenticationHook passes the claims of the provider's JWT to the
+// post-authentication hook and returns the claims that the hook returned.
+// The hook can reject the login by returning false.
+func (h *AuthenticationHandler) runPostAuthenticationHook(claims map[string]interface{}) (map[string]interface{}, error) {
+	h.postAuthLock.Lock()
+	defer h.postAuthLock.Unlock()
+
+	_, err := h.postAuthVM.Run(h.hookPostAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	export, _ := h.postAuthVM.Get("exports")
+	if !export.IsFunction() {
+		return nil, fmt.Errorf("hook script must export a function!")
+	}
+
+	hookResult, err := export.Call(otto.UndefinedValue(), claims)
+	if err != nil {
+		return nil, fmt.Errorf("error while calling hook function: %s", err.Error())
+	}
+
+	if hookResultBool, _ := hookResult.ToBoolean(); !hookResultBool {
+		return nil, InvalidCredentialsError
+	}
+
+	if !hookResult.IsObject() {
+		return nil, fmt.Errorf("hook function must return object. is: %s", hookResult.Class())
+	}
+
+	exported, _ := hookResult.Export()
+	newClaims, ok := exported.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("hook function must return a claims object")
+	}
+
+	return newClaims, nil
+}
+
+// refreshTokenFromResponse reads an (optional) refresh token that the
+// authentication provider may supply in the "X-Refresh-Token" header. Its
+// lifetime in seconds can be given in the "X-Refresh-Token-Expires-In" header.
+func refreshTokenFromResponse(resp *http.Response) (string, int64) {
+	refreshToken := resp.Header.Get("X-Refresh-Token")
+	if refreshToken == "" {
+		return "", 0
+	}
+
+	var refreshExpiresAt int64
+	if expiresIn, err := strconv.ParseInt(resp.Header.Get("X-Refresh-Token-Expires-In"), 10, 64); err == nil && expiresIn > 0 {
+		refreshExpiresAt = time.Now().Unix() + expiresIn
+	}
+
+	return refreshToken, refreshExpiresAt
+}
+
+// Refresh obtains a new JWT from the authentication provider, using the
+// refresh token that the provider issued alongside the given (expired) JWT.
+func (h *AuthenticationHandler) Refresh(token *JWTResponse) (*JWTResponse, error) {
+	if token.RefreshToken == "" {
+		return nil, NoRefreshTokenError
+	}
+
+	var refreshed *JWTResponse
+	var err error
+
+	if h.oidc != nil {
+		refreshed, err = h.oidc.Refresh(token.RefreshToken)
+	} else {
+		refreshed, err = h.refreshAtProvider(token.RefreshToken)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	refreshed, err = h.finalizeToken(refreshed)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshed.Token = token.Token
+	refreshed.AllowedApplications = token.AllowedApplications
+
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = token.RefreshToken
+		refreshed.RefreshExpiresAt = token.RefreshExpiresAt
+	}
+
+	return refreshed, nil
+}
+
+func (h *AuthenticationHandler) refreshAtProvider(refreshToken string) (*JWTResponse, error) {
+	requestURL := h.config.ProviderConfig.RefreshUrl
+	if requestURL == "" {
+		requestURL = h.config.ProviderConfig.Url + "/refresh"
+	}
+
+	req, err := h.newProviderRequest(requestURL, map[string]interface{}{"refresh_token": refreshToken})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized {
+		h.logger.Warningf("provider rejected refresh token: %s", body)
+		return nil, InvalidCredentialsError
+	} else if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("unexpected status code %d while refreshing token: %s", resp.StatusCode, body)
+	}
+
+	response := JWTResponse{}
+	response.RefreshToken, response.RefreshExpiresAt = refreshTokenFromResponse(resp)
+	if err := h.readProviderResponseBody(body, &response); err != nil {
+		return nil, err
+	}
 
 	return &response, nil
 }
 
+// Logout ends the session of a mapped token. The token mapping is removed,
+// and the JWT is revoked (by its ID, or by its hash if it has none) and
+// purged from the verification cache, so that the session also ends on
+// gateway instances that have cached the mapping. If a logout URL is
+// configured, the authentication provider is notified as well.
+func (h *AuthenticationHandler) Logout(token *JWTResponse) error {
+	if err := h.storage.RemoveToken(token.Token); err != nil {
+		return err
+	}
+
+	h.expCache.Delete(token.JWT)
+
+	claims := jwt.StandardClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token.JWT, &claims); err == nil {
+		if err := h.RevokeToken(revocationId(token.JWT, claims.Id), claims.ExpiresAt); err != nil {
+			return err
+		}
+	}
+
+	if h.config.ProviderConfig.LogoutUrl != "" {
+		if err := h.logoutAtProvider(token); err != nil {
+			h.logger.Warningf("could not notify provider of logout: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// RevokeToken adds a token ID to the revocation list and purges the JWT
+// with this ID from the verification cache.
+func (h *AuthenticationHandler) RevokeToken(jti string, exp int64) error {
+	if err := h.storage.RevokeToken(jti, exp); err != nil {
+		return err
+	}
+
+	h.expCache.Invalidate(jti)
+	return nil
+}
+
+func (h *AuthenticationHandler) logoutAtProvider(token *JWTResponse) error {
+	body := map[string]interface{}{}
+	if token.RefreshToken != "" {
+		body["refresh_token"] = token.RefreshToken
+	}
+
+	req, err := h.newProviderRequest(h.config.ProviderConfig.LogoutUrl, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.JWT)
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode >= 400 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, respBody)
+	}
+
+	return nil
+}
+
 func (h *AuthenticationHandler) IsAuthenticated(req *http.Request) (bool, *JWTResponse, error) {
 	token, err := h.tokenReader.TokenFromRequest(req)
 	if err == NoTokenError {
@@ -256,39 +1010,249 @@ func (h *AuthenticationHandler) IsAuthenticated(req *http.Request) (bool, *JWTRe
 		return false, nil, err
 	}
 
-	exp, ok := h.expCache.Get(token.JWT)
-	var expiry int64
+	// API keys are validated by the token reader itself
+	if token.ApiKey != nil {
+		return true, token, nil
+	}
+
+	return h.verifyToken(token)
+}
+
+// Introspect looks up an opaque token in the token store and checks whether
+// it is still valid. It returns false for unknown tokens. Unlike requests
+// that use the token, introspection neither extends the idle timeout of the
+// session nor refreshes an expired JWT.
+func (h *AuthenticationHandler) Introspect(tokenString string) (bool, *JWTResponse, error) {
+	token, err := h.storage.GetToken(tokenString)
+	if err == NoTokenError {
+		return false, nil, nil
+	} else if err != nil {
+		return false, nil, err
+	}
+
+	verified, _, err := h.verifyJwt(token.JWT)
+	if verified == nil {
+		return false, nil, err
+	}
+
+	return h.checkRevocation(token, verified)
+}
+
+// verifyToken verifies the JWT of a token read from a request or from the
+// token store, refreshing it if it has expired.
+func (h *AuthenticationHandler) verifyToken(token *JWTResponse) (bool, *JWTResponse, error) {
+	verified, expired, err := h.verifyJwt(token.JWT)
+	if expired {
+		return h.refreshExpiredToken(token)
+	} else if verified == nil {
+		return false, nil, err
+	}
+
+	ok, token, err := h.checkRevocation(token, verified)
+	if !ok {
+		return false, nil, err
+	}
+
+	return h.touchSession(token)
+}
+
+// verifyJwt verifies a JWT, using the cache of verified tokens. Expired JWTs
+// are reported separately, so that callers can decide whether to refresh
+// them; for other invalid JWTs, nil is returned.
+func (h *AuthenticationHandler) verifyJwt(tokenString string) (*verifiedToken, bool, error) {
+	verified, ok := h.expCache.Get(tokenString)
 	if ok {
-		expiry = exp.(int64)
+		if verified.exp == 0 || verified.exp > time.Now().Unix() {
+			return verified, false, nil
+		}
+
+		return nil, true, nil
 	}
 
-	if ok && (exp == 0 || expiry > time.Now().Unix()) {
-		return true, token, nil
-	} else if !ok {
-		valid, stdClaims, _, err := h.verifier.VerifyToken(token.JWT)
-		if err == nil && valid {
-			if stdClaims.ExpiresAt == 0 {
-				h.expCache.Set(token.JWT, 0, cache.NoExpiration)
-				return true, token, nil
+	valid, stdClaims, mapClaims, err := h.verifier.VerifyToken(tokenString)
+	if err == nil && valid {
+		verified := h.newVerifiedToken(stdClaims, mapClaims)
+
+		if stdClaims.ExpiresAt == 0 || stdClaims.ExpiresAt > time.Now().Unix() {
+			h.expCache.Set(tokenString, verified)
+			return verified, false, nil
+		}
+	}
+
+	if err != nil {
+		var validationErr *jwt.ValidationError
+		if errors.As(err, &validationErr) {
+			if validationErr.Errors&jwt.ValidationErrorExpired != 0 {
+				return nil, true, nil
+			}
+
+			if validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+				return nil, false, nil
+			}
+
+			var algorithmErr *AlgorithmError
+			if errors.As(validationErr.Inner, &algorithmErr) {
+				h.logger.Warningf("rejecting JWT: %s", algorithmErr)
+				return nil, false, nil
 			}
+		}
+		return nil, false, err
+	}
+
+	return nil, false, nil
+}
 
-			if stdClaims.ExpiresAt > time.Now().Unix() {
-				h.expCache.Set(token.JWT, stdClaims.ExpiresAt, time.Duration(stdClaims.ExpiresAt-time.Now().Unix())*time.Second)
+func (h *AuthenticationHandler) newVerifiedToken(stdClaims *jwt.StandardClaims, mapClaims jwt.MapClaims) *verifiedToken {
+	verified := verifiedToken{
+		exp:    stdClaims.ExpiresAt,
+		jti:    stdClaims.Id,
+		claims: make(map[string]interface{}, len(mapClaims)),
+		issuer: stdClaims.Issuer,
+	}
+
+	for k, v := range mapClaims {
+		verified.claims[k] = v
+	}
 
-				return true, token, nil
+	// tokens of trusted issuers may use different claim names, which are
+	// normalized using the issuer's mapping table
+	for i := range h.config.TrustedIssuers {
+		if issuer := &h.config.TrustedIssuers[i]; issuer.Issuer == stdClaims.Issuer && len(issuer.ClaimsMapping) > 0 {
+			for k, v := range mapClaimsWithTable(mapClaims, issuer.ClaimsMapping) {
+				verified.claims[k] = v
 			}
 		}
+	}
 
-		acceptableErrors := jwt.ValidationErrorExpired | jwt.ValidationErrorSignatureInvalid
-		if err != nil {
-			switch t := err.(type) {
-			case *jwt.ValidationError:
-				if t.Errors&acceptableErrors != 0 {
-					return false, nil, nil
-				}
+	if h.config.AudienceClaim != "" {
+		verified.audience = claimStrings(verified.claims[h.config.AudienceClaim])
+	}
+
+	return &verified
+}
+
+// checkRevocation rejects tokens that have been revoked. Since the
+// verification result of a JWT is cached, the revocation list needs to be
+// consulted on every request.
+func (h *AuthenticationHandler) checkRevocation(token *JWTResponse, verified *verifiedToken) (bool, *JWTResponse, error) {
+	// responses may be shared with the token store's local cache
+	verifiedResponse := *token
+	verifiedResponse.Audience = verified.audience
+	verifiedResponse.Claims = verified.claims
+	verifiedResponse.Issuer = verified.issuer
+	token = &verifiedResponse
+
+	id := revocationId(token.JWT, verified.jti)
+
+	revoked, err := h.storage.IsTokenRevoked(id)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if revoked {
+		h.logger.Warningf("rejecting revoked token %s", id)
+		return false, nil, nil
+	}
+
+	return true, token, nil
+}
+
+// revocationId returns the ID under which a JWT is revoked: its "jti" claim,
+// or the hash of the JWT for tokens that do not have an ID.
+func revocationId(token string, jti string) string {
+	if jti != "" {
+		return jti
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// tokenSubject returns the subject and ID of a JWT without verifying its
+// signature. It must only be used for tokens that were issued by trusted
+// parties, like the authentication provider.
+func tokenSubject(token string) (string, string) {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return "", ""
+	}
+
+	subject, _ := claims["sub"].(string)
+	jti, _ := claims["jti"].(string)
+
+	return subject, jti
+}
+
+// claimStrings converts a claim that may either be a single string or a list
+// of strings (like the "aud" claim) into a list.
+func claimStrings(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return []string{c}
+	case []interface{}:
+		values := make([]string, 0, len(c))
+		for _, v := range c {
+			if str, ok := v.(string); ok {
+				values = append(values, str)
 			}
-			return false, nil, err
 		}
+		return values
+	}
+
+	return nil
+}
+
+// touchSession extends the idle timeout of the session that a mapped token
+// belongs to.
+func (h *AuthenticationHandler) touchSession(token *JWTResponse) (bool, *JWTResponse, error) {
+	if token.Token == "" {
+		return true, token, nil
 	}
-	return false, nil, nil
+
+	err := h.storage.TouchToken(token.Token)
+	if err == NoTokenError {
+		h.logger.Debugf("session for token %s has expired", redact.Token(token.Token))
+		return false, nil, nil
+	} else if err != nil {
+		return false, nil, err
+	}
+
+	return true, token, nil
+}
+
+// refreshExpiredToken tries to renew an expired JWT using the refresh token
+// that the identity provider issued alongside it. If the token could be
+// refreshed, the token mapping is updated in place, so that the client can
+// continue to use its existing opaque token.
+func (h *AuthenticationHandler) refreshExpiredToken(token *JWTResponse) (bool, *JWTResponse, error) {
+	if token.RefreshToken == "" || token.Token == "" {
+		return false, nil, nil
+	}
+
+	h.logger.Debugf("JWT for token %s expired; trying to refresh it", redact.Token(token.Token))
+
+	refreshed, err := h.Refresh(token)
+	if err != nil {
+		h.logger.Warningf("could not refresh expired JWT: %s", err)
+		return false, nil, nil
+	}
+
+	if _, err := h.storage.SetToken(token.Token, refreshed); err != nil {
+		return false, nil, err
+	}
+
+	h.expCache.Delete(token.JWT)
+
+	_, stdClaims, mapClaims, err := h.verifier.VerifyToken(refreshed.JWT)
+	if err != nil {
+		h.logger.Warningf("refreshed JWT is invalid: %s", err)
+		return false, nil, nil
+	}
+
+	ok, refreshed, err := h.checkRevocation(refreshed, h.newVerifiedToken(stdClaims, mapClaims))
+	if !ok {
+		return false, nil, err
+	}
+
+	return h.touchSession(refreshed)
 }
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/audit"
+)
+
+type impersonationRequest struct {
+	Subject string `json:"subject"`
+}
+
+// isAdmin checks whether the verified claims of a token grant administrative
+// privileges. The claim needs to be either a boolean or the string "true".
+// It is only accepted on tokens of the gateway's own issuer, so that trusted
+// third-party issuers (whose claims may be mapped) cannot grant it.
+func isAdmin(token *JWTResponse, issuer string, claim string) bool {
+	if token.Issuer != issuer {
+		return false
+	}
+
+	switch value := claimByPath(token.Claims, claim).(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+
+	return false
+}
+
+// registerImpersonationRoute registers a token exchange endpoint that allows
+// administrators to obtain a token acting as another user, for example for
+// support workflows. The issued JWT is signed by the gateway and records the
+// administrator's identity in an "act" claim (RFC 8693).
+func (a *RestAuthDecorator) registerImpersonationRoute(mux *httprouter.Router) error {
+	cfg := &a.authHandler.config.Impersonation
+	if !cfg.Enabled {
+		return nil
+	}
+
+	signer := a.authHandler.verifier.Signer()
+	if signer == nil {
+		return fmt.Errorf("impersonation requires a JWT signing key")
+	}
+
+	uri := cfg.Uri
+	if uri == "" {
+		uri = "/auth/impersonate"
+	}
+
+	adminClaim := cfg.AdminClaim
+	if adminClaim == "" {
+		adminClaim = "admin"
+	}
+
+	ttl := 15 * time.Minute
+	if cfg.TokenTtl != "" {
+		var err error
+		if ttl, err = time.ParseDuration(cfg.TokenTtl); err != nil {
+			return fmt.Errorf("invalid impersonation token TTL: %s", err)
+		}
+	}
+
+	handleError := func(err error, rw http.ResponseWriter) {
+		a.logger.Errorf("error while handling impersonation request: %s", err)
+		rw.Header().Set("Content-Type", "application/json;charset=utf8")
+		rw.WriteHeader(500)
+		_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
+	}
+
+	if a.authHandler.config.EnableCORS {
+		mux.OPTIONS(
+			uri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+				setCORSHeaders(rw.Header())
+				rw.WriteHeader(200)
+			},
+		)
+	}
+
+	mux.POST(
+		uri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			if a.authHandler.config.EnableCORS {
+				setCORSHeaders(rw.Header())
+			}
+
+			authenticated, token, err := a.authHandler.IsAuthenticated(req)
+			if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			if !authenticated {
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.WriteHeader(401)
+				_, _ = rw.Write([]byte(`{"msg":"not authenticated"}`))
+				return
+			}
+
+			if !a.checkCSRF(req) {
+				writeCSRFError(rw)
+				return
+			}
+
+			// impersonated tokens cannot be used to impersonate yet another user
+			if token.ApiKey != nil || !isAdmin(token, signer.Issuer(), adminClaim) || token.Claims["act"] != nil {
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.WriteHeader(403)
+				_, _ = rw.Write([]byte(`{"msg":"forbidden"}`))
+				return
+			}
+
+			var impersonation impersonationRequest
+			if err := json.NewDecoder(req.Body).Decode(&impersonation); err != nil || impersonation.Subject == "" {
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.WriteHeader(400)
+				_, _ = rw.Write([]byte(`{"msg":"bad request"}`))
+				return
+			}
+
+			actor, _ := token.Claims["sub"].(string)
+
+			jwt, err := signer.SignWithTtl(impersonation.Subject, map[string]interface{}{
+				"act": map[string]interface{}{"sub": actor},
+			}, ttl)
+			if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			a.authHandler.auditLogger.Log(audit.NewEvent(audit.Impersonation, req, impersonation.Subject).WithDetail("actor", actor))
+
+			// the impersonated token is restricted to the administrator's
+			// applications
+			response, _, err := a.issueToken(req, &JWTResponse{
+				JWT:                 jwt,
+				AllowedApplications: token.AllowedApplications,
+			})
+			if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			jsonResponse, err := json.Marshal(response)
+			if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			rw.Header().Set("Content-Type", "application/json;charset=utf8")
+			rw.Header().Set("Cache-Control", "no-store")
+			_, _ = rw.Write(jsonResponse)
+		},
+	)
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// registerIntrospectionRoute registers a token introspection endpoint as
+// specified in RFC 7662. Downstream services can use it to look up the claims
+// and expiry of an opaque gateway token. Callers need to authenticate using
+// HTTP Basic auth with one of the configured client credentials.
+func (a *RestAuthDecorator) registerIntrospectionRoute(mux *httprouter.Router) error {
+	cfg := &a.authHandler.config.Introspection
+	if !cfg.Enabled {
+		return nil
+	}
+
+	if len(cfg.Clients) == 0 {
+		return fmt.Errorf("token introspection requires at least one client")
+	}
+
+	uri := cfg.Uri
+	if uri == "" {
+		uri = "/auth/introspect"
+	}
+
+	handleError := func(err error, rw http.ResponseWriter) {
+		a.logger.Errorf("error while handling introspection request: %s", err)
+		rw.Header().Set("Content-Type", "application/json;charset=utf8")
+		rw.WriteHeader(500)
+		_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
+	}
+
+	mux.POST(
+		uri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			clientID, clientSecret, ok := req.BasicAuth()
+			expectedSecret, known := cfg.Clients[clientID]
+			if !ok || !known || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(expectedSecret)) != 1 {
+				rw.Header().Set("WWW-Authenticate", `Basic realm="token introspection"`)
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.WriteHeader(401)
+				_, _ = rw.Write([]byte(`{"msg":"invalid client credentials"}`))
+				return
+			}
+
+			tokenString := req.PostFormValue("token")
+			if tokenString == "" {
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.WriteHeader(400)
+				_, _ = rw.Write([]byte(`{"msg":"bad request"}`))
+				return
+			}
+
+			active, token, err := a.authHandler.Introspect(tokenString)
+			if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			response := map[string]interface{}{"active": false}
+			if active {
+				for k, v := range token.Claims {
+					response[k] = v
+				}
+
+				response["active"] = true
+				response["token_type"] = "Bearer"
+
+				if exp, ok := token.Claims["exp"].(float64); token.ExpiresAt > 0 && (!ok || int64(exp) > token.ExpiresAt) {
+					response["exp"] = token.ExpiresAt
+				}
+			}
+
+			jsonResponse, err := json.Marshal(response)
+			if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			rw.Header().Set("Content-Type", "application/json;charset=utf8")
+			rw.Header().Set("Cache-Control", "no-store")
+			_, _ = rw.Write(jsonResponse)
+		},
+	)
+
+	return nil
+}
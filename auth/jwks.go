@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jwksMinRefreshInterval limits how often an unknown key ID may trigger a
+// reload of the key set, so that tokens with bogus key IDs cannot be used to
+// hammer the JWKS endpoint.
+const jwksMinRefreshInterval = 30 * time.Second
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type JwksKeyStore struct {
+	url             string
+	refreshInterval time.Duration
+	httpClient      *http.Client
+
+	keys        map[string]interface{}
+	lastRefresh time.Time
+	lock        sync.RWMutex
+}
+
+func NewJwksKeyStore(url string, refreshInterval time.Duration) *JwksKeyStore {
+	return &JwksKeyStore{
+		url:             url,
+		refreshInterval: refreshInterval,
+		httpClient:      &http.Client{Timeout: 10 * time.Second},
+		keys:            make(map[string]interface{}),
+	}
+}
+
+// Key returns the verification key with the given key ID. The key set is
+// reloaded when it is older than the refresh interval, or when the key ID is
+// not known (at most once every jwksMinRefreshInterval).
+func (s *JwksKeyStore) Key(kid string) (interface{}, error) {
+	s.lock.RLock()
+	stale := time.Since(s.lastRefresh) > s.refreshInterval
+	key, found := s.lookup(kid)
+	canRefresh := time.Since(s.lastRefresh) > jwksMinRefreshInterval
+	s.lock.RUnlock()
+
+	if found && !stale {
+		return key, nil
+	}
+
+	if stale || canRefresh {
+		if err := s.refresh(); err != nil {
+			if found {
+				return key, nil
+			}
+			return nil, err
+		}
+
+		s.lock.RLock()
+		key, found = s.lookup(kid)
+		s.lock.RUnlock()
+	}
+
+	if !found {
+		return nil, fmt.Errorf("no key with ID '%s' found in key set '%s'", kid, s.url)
+	}
+
+	return key, nil
+}
+
+// lookup must be called while holding the read lock.
+func (s *JwksKeyStore) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+func (s *JwksKeyStore) refresh() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// another goroutine may have refreshed the key set while we were waiting
+	// for the lock
+	if time.Since(s.lastRefresh) < jwksMinRefreshInterval {
+		return nil
+	}
+
+	resp, err := s.httpClient.Get(s.url)
+	if err != nil {
+		return fmt.Errorf("could not retrieve key set from '%s': %s", s.url, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not retrieve key set from '%s': unexpected status code %d", s.url, resp.StatusCode)
+	}
+
+	keySet := jsonWebKeySet{}
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return fmt.Errorf("could not decode key set from '%s': %s", s.url, err)
+	}
+
+	keys := make(map[string]interface{}, len(keySet.Keys))
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return fmt.Errorf("invalid key '%s' in key set '%s': %s", jwk.Kid, s.url, err)
+		}
+
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	s.keys = keys
+	s.lastRefresh = time.Now()
+
+	return nil
+}
+
+// publicKey converts the JWK into a public key usable for signature
+// verification. Unsupported key types are skipped by returning a nil key.
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		key := ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+
+		return &key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key length %d", len(x))
+		}
+
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, nil
+}
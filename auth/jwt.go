@@ -12,79 +12,248 @@ import (
 	"time"
 )
 
-type JwtVerifier struct {
-	config              *config.GlobalAuth
+// verificationKeys holds the keys that the JWTs of one issuer are verified
+// with: either a single (static or downloaded) PEM-encoded key, or a JSON Web
+// Key Set.
+type verificationKeys struct {
+	key                 []byte
+	keyUrl              string
+	allowedAlgorithms   []string
 	cacheTtl            time.Duration
 	cachedKey           []byte
 	cachedKeyExpiration time.Time
 	cachedKeyLock       sync.Mutex
+	jwks                *JwksKeyStore
 }
 
-func NewJwtVerifier(cfg *config.GlobalAuth) (*JwtVerifier, error) {
-	cacheTtl, err := time.ParseDuration(cfg.KeyCacheTtl)
-	if err != nil {
-		return nil, err
+func newVerificationKeys(key []byte, keyUrl string, jwksUrl string, allowedAlgorithms []string, cacheTtl time.Duration) *verificationKeys {
+	keys := verificationKeys{
+		key:               key,
+		keyUrl:            keyUrl,
+		allowedAlgorithms: allowedAlgorithms,
+		cacheTtl:          cacheTtl,
+	}
+
+	if jwksUrl != "" {
+		keys.jwks = NewJwksKeyStore(jwksUrl, cacheTtl)
 	}
 
-	return &JwtVerifier{
-		config:   cfg,
-		cacheTtl: cacheTtl,
-	}, nil
+	return &keys
 }
 
-func (h *JwtVerifier) GetVerificationKey() ([]byte, error) {
-	if h.config.VerificationKey != nil && len(h.config.VerificationKey) > 0 {
-		return h.config.VerificationKey, nil
+func (k *verificationKeys) configured() bool {
+	return k.jwks != nil || len(k.key) > 0 || k.keyUrl != ""
+}
+
+func (k *verificationKeys) pemKey() ([]byte, error) {
+	if len(k.key) > 0 {
+		return k.key, nil
 	}
 
-	if h.cachedKey != nil && h.cachedKeyExpiration.After(time.Now()) {
-		return h.cachedKey, nil
+	if k.cachedKey != nil && k.cachedKeyExpiration.After(time.Now()) {
+		return k.cachedKey, nil
 	}
 
-	h.cachedKeyLock.Lock()
-	defer h.cachedKeyLock.Unlock()
+	k.cachedKeyLock.Lock()
+	defer k.cachedKeyLock.Unlock()
 
-	if h.cachedKey != nil && h.cachedKeyExpiration.After(time.Now()) {
-		return h.cachedKey, nil
+	if k.cachedKey != nil && k.cachedKeyExpiration.After(time.Now()) {
+		return k.cachedKey, nil
 	}
 
-	resp, err := http.Get(h.config.VerificationKeyUrl)
+	resp, err := http.Get(k.keyUrl)
 	if err != nil {
-		return nil, fmt.Errorf("could not retrieve key from '%s': %s", h.config.VerificationKeyUrl, err)
+		return nil, fmt.Errorf("could not retrieve key from '%s': %s", k.keyUrl, err)
 	}
 
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("could not retrieve key from '%s': %s", h.config.VerificationKeyUrl, err)
+		return nil, fmt.Errorf("could not retrieve key from '%s': %s", k.keyUrl, err)
 	}
 
-	h.cachedKey = body
-	h.cachedKeyExpiration = time.Now().Add(h.cacheTtl)
+	k.cachedKey = body
+	k.cachedKeyExpiration = time.Now().Add(k.cacheTtl)
 
-	return h.cachedKey, nil
+	return k.cachedKey, nil
 }
 
-func (h *JwtVerifier) VerifyToken(token string) (bool, *jwt.StandardClaims, jwt.MapClaims, error) {
-	keyPEM, err := h.GetVerificationKey()
+// verificationKey returns the key that the given token needs to be verified
+// with, after checking that the token's algorithm is allowed for this key.
+func (k *verificationKeys) verificationKey(token *jwt.Token) (interface{}, error) {
+	var key interface{}
+
+	if k.jwks != nil {
+		kid, _ := token.Header["kid"].(string)
+
+		var err error
+		key, err = k.jwks.Key(kid)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		keyPEM, err := k.pemKey()
+		if err != nil {
+			return nil, fmt.Errorf("error while getting verification key. Err: '%+v'", err)
+		}
+
+		key, err = parsePublicKeyFromPEM(keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse verification key: %s", err)
+		}
+	}
+
+	if err := checkAlgorithm(token, key, k.allowedAlgorithms); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+type JwtVerifier struct {
+	lock    sync.RWMutex
+	config  *config.GlobalAuth
+	keys    *verificationKeys
+	issuers map[string]*verificationKeys
+	signer  *JwtSigner
+}
+
+func NewJwtVerifier(cfg *config.GlobalAuth) (*JwtVerifier, error) {
+	cacheTtl, err := time.ParseDuration(cfg.KeyCacheTtl)
 	if err != nil {
-		return false, nil, nil, fmt.Errorf("error while getting verification key. Err: '%+v'", err)
+		return nil, err
 	}
 
-	keyFunc := func(token *jwt.Token) (interface{}, error) {
-		return jwt.ParseRSAPublicKeyFromPEM(keyPEM)
+	verifier := JwtVerifier{
+		config:  cfg,
+		keys:    newVerificationKeys(cfg.VerificationKey, cfg.VerificationKeyUrl, cfg.JwksUrl, cfg.AllowedAlgorithms, cacheTtl),
+		issuers: make(map[string]*verificationKeys, len(cfg.TrustedIssuers)),
 	}
 
+	for i := range cfg.TrustedIssuers {
+		issuer := &cfg.TrustedIssuers[i]
+		keys := newVerificationKeys(issuer.VerificationKey, issuer.VerificationKeyUrl, issuer.JwksUrl, issuer.AllowedAlgorithms, cacheTtl)
+
+		if issuer.Issuer == "" {
+			return nil, fmt.Errorf("trusted issuers require an issuer name")
+		}
+
+		if !keys.configured() {
+			return nil, fmt.Errorf("no verification key configured for trusted issuer '%s'", issuer.Issuer)
+		}
+
+		verifier.issuers[issuer.Issuer] = keys
+	}
+
+	// tokens issued by the gateway itself are verified using the public key
+	// of the gateway's signing key
+	if len(cfg.JwtIssuer.SigningKey) > 0 || cfg.JwtIssuer.SigningKeyFile != "" {
+		verifier.signer, err = NewJwtSigner(&cfg.JwtIssuer)
+		if err != nil {
+			return nil, err
+		}
+
+		// tokens of the gateway's issuer carry privileges (like
+		// impersonation), which trusted issuers must not be able to grant
+		if _, ok := verifier.issuers[verifier.signer.Issuer()]; ok {
+			return nil, fmt.Errorf("trusted issuer '%s' must not use the gateway's issuer name", verifier.signer.Issuer())
+		}
+	}
+
+	return &verifier, nil
+}
+
+// Replace takes over the verification keys, trusted issuers and signing key
+// of another verifier (for example, when they were rotated in Vault and a
+// reloaded configuration was built with them).
+func (h *JwtVerifier) Replace(updated *JwtVerifier) {
+	updated.lock.RLock()
+	defer updated.lock.RUnlock()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.config = updated.config
+	h.keys = updated.keys
+	h.issuers = updated.issuers
+	h.signer = updated.signer
+}
+
+func (h *JwtVerifier) GetVerificationKey() ([]byte, error) {
+	h.lock.RLock()
+	keys := h.keys
+	h.lock.RUnlock()
+
+	return keys.pemKey()
+}
+
+// Signer returns the gateway's own JWT signer, or nil if no signing key is
+// configured.
+func (h *JwtVerifier) Signer() *JwtSigner {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return h.signer
+}
+
+// keyFunc selects the verification key for a token. Tokens of a trusted
+// issuer are only verified with that issuer's keys, and tokens of the
+// gateway's own issuer only with the gateway's key, since they carry
+// privileges that the default verification key must not be able to grant.
+// All other tokens are verified with the gateway's own key (if the key ID
+// matches) or the default verification key.
+func (h *JwtVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	h.lock.RLock()
+	keys, issuers, signer := h.keys, h.issuers, h.signer
+	h.lock.RUnlock()
+
+	issuer := tokenIssuer(token)
+	if issuerKeys, ok := issuers[issuer]; ok {
+		return issuerKeys.verificationKey(token)
+	}
+
+	if signer != nil {
+		if kid, _ := token.Header["kid"].(string); issuer == signer.Issuer() || kid == signer.KeyID() || !keys.configured() {
+			// the gateway only issues RS256 tokens
+			if err := checkAlgorithm(token, signer.PublicKey(), []string{"RS256"}); err != nil {
+				return nil, err
+			}
+
+			return signer.PublicKey(), nil
+		}
+	}
+
+	return keys.verificationKey(token)
+}
+
+// tokenIssuer returns the (not yet verified) "iss" claim of a token that is
+// being parsed.
+func tokenIssuer(token *jwt.Token) string {
+	switch claims := token.Claims.(type) {
+	case *jwt.StandardClaims:
+		return claims.Issuer
+	case *jwt.MapClaims:
+		issuer, _ := (*claims)["iss"].(string)
+		return issuer
+	case jwt.MapClaims:
+		issuer, _ := claims["iss"].(string)
+		return issuer
+	}
+
+	return ""
+}
+
+func (h *JwtVerifier) VerifyToken(token string) (bool, *jwt.StandardClaims, jwt.MapClaims, error) {
 	stdClaims := jwt.StandardClaims{}
-	_, err = jwt.ParseWithClaims(token, &stdClaims, keyFunc)
+	_, err := jwt.ParseWithClaims(token, &stdClaims, h.keyFunc)
 	if err != nil {
-		return false, nil, nil, fmt.Errorf("error while parsing token with std-claims. Err: '%+v'", err)
+		return false, nil, nil, fmt.Errorf("error while parsing token with std-claims. Err: '%w'", err)
 	}
 
 	mapClaims := jwt.MapClaims{}
-	_, err = jwt.ParseWithClaims(token, &mapClaims, keyFunc)
+	_, err = jwt.ParseWithClaims(token, &mapClaims, h.keyFunc)
 	if err != nil {
-		return false, nil, nil, fmt.Errorf("error while parsing token with map-claims. Err: '%+v'", err)
+		return false, nil, nil, fmt.Errorf("error while parsing token with map-claims. Err: '%w'", err)
 	}
 
 	return true, &stdClaims, mapClaims, err
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// AlgorithmError is returned when a JWT is signed with an algorithm that is
+// not allowed, or that does not fit the type of the verification key.
+// Rejecting these tokens before verifying their signature prevents
+// algorithm confusion attacks.
+type AlgorithmError struct {
+	Algorithm string
+	Reason    string
+}
+
+func (e *AlgorithmError) Error() string {
+	return fmt.Sprintf("JWT signing algorithm %s %s", e.Algorithm, e.Reason)
+}
+
+// parsePublicKeyFromPEM parses an RSA, ECDSA or Ed25519 public key. The PEM
+// block may contain a PKIX public key, a PKCS#1 RSA public key or a
+// certificate.
+func parsePublicKeyFromPEM(keyPEM []byte) (interface{}, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("verification key is not PEM-encoded")
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+}
+
+// checkAlgorithm verifies that the algorithm of a token is allowed, and that
+// it matches the type of the key that the token is verified with.
+func checkAlgorithm(token *jwt.Token, key interface{}, allowedAlgorithms []string) error {
+	alg := token.Method.Alg()
+
+	if len(allowedAlgorithms) > 0 && !containsString(allowedAlgorithms, alg) {
+		return &AlgorithmError{Algorithm: alg, Reason: "is not allowed"}
+	}
+
+	if !algorithmMatchesKey(alg, key) {
+		return &AlgorithmError{Algorithm: alg, Reason: fmt.Sprintf("cannot be used with key of type %T", key)}
+	}
+
+	return nil
+}
+
+func algorithmMatchesKey(alg string, key interface{}) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+			return true
+		}
+	case *ecdsa.PublicKey:
+		switch alg {
+		case "ES256":
+			return k.Curve == elliptic.P256()
+		case "ES384":
+			return k.Curve == elliptic.P384()
+		case "ES512":
+			return k.Curve == elliptic.P521()
+		}
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+
+	return false
+}
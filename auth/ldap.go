@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+// LDAPProvider authenticates users by binding against an LDAP directory (for
+// example, an Active Directory domain controller). Since LDAP servers do not
+// issue JWTs, the token is issued and signed by the gateway itself.
+type LDAPProvider struct {
+	config *config.LDAPProviderConfig
+	signer *JwtSigner
+	logger *logging.Logger
+}
+
+func NewLDAPProvider(cfg *config.LDAPProviderConfig, signer *JwtSigner, logger *logging.Logger) (*LDAPProvider, error) {
+	if cfg.Url == "" {
+		return nil, fmt.Errorf("no LDAP URL configured")
+	}
+
+	if cfg.UserDNTemplate == "" && (cfg.BaseDN == "" || cfg.UserFilter == "") {
+		return nil, fmt.Errorf("LDAP provider requires either a user DN template or a base DN and user filter")
+	}
+
+	if signer == nil {
+		return nil, fmt.Errorf("LDAP provider requires a JWT signing key")
+	}
+
+	return &LDAPProvider{
+		config: cfg,
+		signer: signer,
+		logger: logger,
+	}, nil
+}
+
+func (p *LDAPProvider) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(p.config.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL '%s': %s", p.config.Url, err)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: p.config.InsecureSkipVerify,
+	}
+
+	conn, err := ldap.DialURL(p.config.Url, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to LDAP server '%s': %s", p.config.Url, err)
+	}
+
+	if p.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not start TLS on LDAP connection: %s", err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (p *LDAPProvider) attributes() []string {
+	attributes := []string{"dn"}
+
+	if p.config.GroupAttribute != "" {
+		attributes = append(attributes, p.config.GroupAttribute)
+	}
+
+	for _, attribute := range p.config.ClaimAttributes {
+		attributes = append(attributes, attribute)
+	}
+
+	return attributes
+}
+
+func (p *LDAPProvider) searchUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	filter := strings.ReplaceAll(p.config.UserFilter, "%s", ldap.EscapeFilter(username))
+
+	request := ldap.NewSearchRequest(
+		p.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		filter,
+		p.attributes(),
+		nil,
+	)
+
+	result, err := conn.Search(request)
+	if err != nil {
+		return nil, fmt.Errorf("LDAP search for user %s failed: %s", username, err)
+	}
+
+	if len(result.Entries) != 1 {
+		p.logger.Warningf("LDAP search for user %s returned %d entries", username, len(result.Entries))
+		return nil, InvalidCredentialsError
+	}
+
+	return result.Entries[0], nil
+}
+
+// Authenticate verifies the given credentials using an LDAP bind and issues a
+// new JWT on success.
+func (p *LDAPProvider) Authenticate(username string, password string) (*JWTResponse, error) {
+	// an empty password would result in an unauthenticated bind, which most
+	// LDAP servers accept without checking anything
+	if username == "" || password == "" {
+		return nil, InvalidCredentialsError
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var entry *ldap.Entry
+	var userDN string
+
+	if p.config.UserDNTemplate != "" {
+		userDN = strings.ReplaceAll(p.config.UserDNTemplate, "%s", ldap.EscapeDN(username))
+	} else {
+		if p.config.BindDN != "" {
+			if err := conn.Bind(p.config.BindDN, p.config.BindPassword); err != nil {
+				return nil, fmt.Errorf("could not bind to LDAP server as %s: %s", p.config.BindDN, err)
+			}
+		}
+
+		entry, err = p.searchUser(conn, username)
+		if err != nil {
+			return nil, err
+		}
+
+		userDN = entry.DN
+	}
+
+	if err := conn.Bind(userDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			p.logger.Warningf("invalid credentials for user %s", username)
+			return nil, InvalidCredentialsError
+		}
+
+		return nil, fmt.Errorf("LDAP bind for user %s failed: %s", username, err)
+	}
+
+	// when binding directly, user attributes are read with the user's own
+	// permissions after a successful bind
+	if entry == nil && p.config.BaseDN != "" && p.config.UserFilter != "" {
+		entry, err = p.searchUser(conn, username)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	claims := map[string]interface{}{}
+
+	if entry != nil {
+		for claim, attribute := range p.config.ClaimAttributes {
+			if value := entry.GetAttributeValue(attribute); value != "" {
+				claims[claim] = value
+			}
+		}
+
+		if p.config.GroupAttribute != "" {
+			claims["groups"] = entry.GetAttributeValues(p.config.GroupAttribute)
+		}
+	}
+
+	p.logger.Infof("user %s authenticated against LDAP", username)
+
+	token, err := p.signer.Sign(username, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTResponse{JWT: token}, nil
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/audit"
+)
+
+func (a *RestAuthDecorator) registerLogoutRoute(mux *httprouter.Router) {
+	uri := a.authHandler.config.ProviderConfig.LogoutUri
+	if uri == "" {
+		uri = "/auth/logout"
+	}
+
+	handleError := func(err error, rw http.ResponseWriter) {
+		a.logger.Errorf("error while handling logout request: %s", err)
+		rw.Header().Set("Content-Type", "application/json;charset=utf8")
+		rw.WriteHeader(500)
+		_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
+	}
+
+	if a.authHandler.config.EnableCORS {
+		mux.OPTIONS(
+			uri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+				setCORSHeaders(rw.Header())
+				rw.WriteHeader(200)
+			},
+		)
+	}
+
+	reader := BearerTokenReader{store: a.tokenStore}
+
+	mux.POST(
+		uri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			if a.authHandler.config.EnableCORS {
+				setCORSHeaders(rw.Header())
+			}
+
+			if !a.checkCSRF(req) {
+				writeCSRFError(rw)
+				return
+			}
+
+			token, err := reader.TokenFromRequest(req)
+			if err != nil && err != NoTokenError {
+				handleError(err, rw)
+				return
+			}
+
+			// logging out is idempotent; unknown tokens have already ended
+			if token != nil {
+				if err := a.authHandler.Logout(token); err != nil {
+					handleError(err, rw)
+					return
+				}
+
+				subject, _ := tokenSubject(token.JWT)
+				a.authHandler.auditLogger.Log(audit.NewEvent(audit.Logout, req, subject))
+			}
+
+			a.clearSessionCookies(rw)
+			rw.WriteHeader(204)
+		},
+	)
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// writeIncompleteAuthentication stores the state of a login that requires an
+// additional authentication factor and responds with the provider's challenge
+// data, together with an "mfa_token" that the client needs to complete the
+// login.
+func (a *RestAuthDecorator) writeIncompleteAuthentication(authenticationIncompleteErr *AuthenticationIncompleteError, rw http.ResponseWriter) error {
+	mfaToken, err := a.tokenStore.AddPendingAuthentication(&PendingAuthentication{
+		Username:            authenticationIncompleteErr.Username,
+		AllowedApplications: authenticationIncompleteErr.AllowedApplications,
+		Properties:          authenticationIncompleteErr.AdditionalProperties,
+	})
+	if err != nil {
+		return err
+	}
+
+	response := make(map[string]interface{})
+	for k, v := range authenticationIncompleteErr.AdditionalProperties {
+		response[k] = v
+	}
+	response["mfa_token"] = mfaToken
+
+	jsonString, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	rw.Header().Set("Content-Type", "application/json;charset=utf8")
+	rw.WriteHeader(202)
+	_, _ = rw.Write(jsonString)
+	return nil
+}
+
+func (a *RestAuthDecorator) registerMfaRoute(mux *httprouter.Router) {
+	uri := a.authHandler.config.ProviderConfig.MfaUri
+	if uri == "" {
+		uri = "/auth/mfa"
+	}
+
+	handleError := func(err error, rw http.ResponseWriter) {
+		a.logger.Errorf("error while handling MFA request: %s", err)
+		rw.Header().Set("Content-Type", "application/json;charset=utf8")
+		rw.WriteHeader(500)
+		_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
+	}
+
+	if a.authHandler.config.EnableCORS {
+		mux.OPTIONS(
+			uri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+				setCORSHeaders(rw.Header())
+				rw.WriteHeader(200)
+			},
+		)
+	}
+
+	mux.POST(
+		uri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			var mfaRequest map[string]interface{}
+
+			if a.authHandler.config.EnableCORS {
+				setCORSHeaders(rw.Header())
+			}
+
+			if err := json.NewDecoder(req.Body).Decode(&mfaRequest); err != nil {
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.WriteHeader(400)
+				_, _ = rw.Write([]byte(`{"msg":"bad request"}`))
+				return
+			}
+
+			mfaToken, _ := mfaRequest["mfa_token"].(string)
+			delete(mfaRequest, "mfa_token")
+
+			// the challenge may only be answered once, regardless of the
+			// outcome; taking it from the store makes concurrent answers fail
+			pending, err := a.tokenStore.TakePendingAuthentication(mfaToken)
+			if err == NoTokenError || mfaToken == "" {
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.WriteHeader(403)
+				_, _ = rw.Write([]byte(`{"msg":"invalid mfa token"}`))
+				return
+			} else if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			authResponse, err := a.authHandler.CompleteAuthenticationClient(req, pending, mfaRequest)
+			if throttled, ok := err.(LoginThrottledError); ok {
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.Header().Set("Retry-After", strconv.Itoa(int(throttled.RetryAfter.Seconds())+1))
+				rw.WriteHeader(429)
+				_, _ = rw.Write([]byte(`{"msg":"too many failed login attempts"}`))
+				return
+			} else if err == InvalidCredentialsError {
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.WriteHeader(403)
+				_, _ = rw.Write([]byte(`{"msg":"invalid credentials"}`))
+				return
+			} else if errors.Is(err, AuthenticationIncompleteError{}) {
+				if innerErr := a.writeIncompleteAuthentication(err.(*AuthenticationIncompleteError), rw); innerErr != nil {
+					handleError(innerErr, rw)
+				}
+				return
+			} else if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			response, exp, err := a.issueToken(req, authResponse)
+			if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			// with cookie sessions, the tokens must not be exposed to scripts
+			if a.authHandler.config.CookieSession.Enabled {
+				a.startCookieSession(rw, response, exp)
+			}
+
+			jsonResponse, err := json.Marshal(response)
+			if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			rw.Header().Set("Content-Type", "application/json;charset=utf8")
+			_, _ = rw.Write(jsonResponse)
+		},
+	)
+}
@@ -0,0 +1,346 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/audit"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+const oidcStateCookie = "oidc_state"
+
+type oidcDiscoveryDocument struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+	TokenType        string `json:"token_type"`
+}
+
+type oidcErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// OIDCClient talks to an OpenID Connect identity provider using the
+// authorization code flow.
+type OIDCClient struct {
+	config     *config.OIDCProviderConfig
+	httpClient *http.Client
+	logger     *logging.Logger
+
+	discovery     *oidcDiscoveryDocument
+	discoveryLock sync.Mutex
+}
+
+func NewOIDCClient(cfg *config.OIDCProviderConfig, httpClient *http.Client, logger *logging.Logger) *OIDCClient {
+	return &OIDCClient{
+		config:     cfg,
+		httpClient: httpClient,
+		logger:     logger,
+	}
+}
+
+func (c *OIDCClient) discover() (*oidcDiscoveryDocument, error) {
+	c.discoveryLock.Lock()
+	defer c.discoveryLock.Unlock()
+
+	if c.discovery != nil {
+		return c.discovery, nil
+	}
+
+	discoveryUrl := strings.TrimRight(c.config.Issuer, "/") + "/.well-known/openid-configuration"
+
+	resp, err := c.httpClient.Get(discoveryUrl)
+	if err != nil {
+		return nil, fmt.Errorf("could not load OIDC discovery document from '%s': %s", discoveryUrl, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d while loading OIDC discovery document from '%s'", resp.StatusCode, discoveryUrl)
+	}
+
+	doc := oidcDiscoveryDocument{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("could not decode OIDC discovery document from '%s': %s", discoveryUrl, err)
+	}
+
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" {
+		return nil, fmt.Errorf("OIDC discovery document from '%s' is missing required endpoints", discoveryUrl)
+	}
+
+	c.discovery = &doc
+	return c.discovery, nil
+}
+
+func (c *OIDCClient) scopes() string {
+	if len(c.config.Scopes) == 0 {
+		return "openid profile email"
+	}
+
+	scopes := c.config.Scopes
+	for _, s := range scopes {
+		if s == "openid" {
+			return strings.Join(scopes, " ")
+		}
+	}
+
+	return strings.Join(append([]string{"openid"}, scopes...), " ")
+}
+
+// AuthCodeURL builds the URL of the identity provider's authorization endpoint
+// that the user agent should be redirected to.
+func (c *OIDCClient) AuthCodeURL(state string) (string, error) {
+	doc, err := c.discover()
+	if err != nil {
+		return "", err
+	}
+
+	authUrl, err := url.Parse(doc.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	query := authUrl.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", c.config.ClientID)
+	query.Set("redirect_uri", c.config.RedirectUrl)
+	query.Set("scope", c.scopes())
+	query.Set("state", state)
+	authUrl.RawQuery = query.Encode()
+
+	return authUrl.String(), nil
+}
+
+// Exchange trades an authorization code for a set of tokens.
+func (c *OIDCClient) Exchange(code string) (*JWTResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", c.config.RedirectUrl)
+
+	return c.tokenRequest(form)
+}
+
+// Refresh uses a refresh token previously issued by the identity provider to
+// obtain a new set of tokens.
+func (c *OIDCClient) Refresh(refreshToken string) (*JWTResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+
+	return c.tokenRequest(form)
+}
+
+func (c *OIDCClient) tokenRequest(form url.Values) (*JWTResponse, error) {
+	doc, err := c.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.config.ClientID), url.QueryEscape(c.config.ClientSecret))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		errResponse := oidcErrorResponse{}
+		_ = json.Unmarshal(body, &errResponse)
+
+		if errResponse.Error == "invalid_grant" {
+			c.logger.Warningf("identity provider rejected grant: %s", errResponse.ErrorDescription)
+			return nil, InvalidCredentialsError
+		}
+
+		return nil, fmt.Errorf("unexpected status code %d from token endpoint: %s", resp.StatusCode, body)
+	}
+
+	tokenResponse := oidcTokenResponse{}
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return nil, fmt.Errorf("could not decode token endpoint response: %s", err)
+	}
+
+	response := JWTResponse{
+		JWT:          tokenResponse.AccessToken,
+		RefreshToken: tokenResponse.RefreshToken,
+	}
+
+	if c.config.UseIDToken {
+		response.JWT = tokenResponse.IDToken
+	}
+
+	if response.JWT == "" {
+		return nil, fmt.Errorf("token endpoint response did not contain a token")
+	}
+
+	if tokenResponse.RefreshExpiresIn > 0 {
+		response.RefreshExpiresAt = time.Now().Unix() + tokenResponse.RefreshExpiresIn
+	}
+
+	return &response, nil
+}
+
+// OIDCAuthDecorator authenticates requests the same way as the REST decorator,
+// but delegates the login itself to an OpenID Connect identity provider.
+type OIDCAuthDecorator struct {
+	*RestAuthDecorator
+	client *OIDCClient
+}
+
+func NewOIDCAuthDecorator(authHandler *AuthenticationHandler, tokenStore TokenStore, logger *logging.Logger) (*OIDCAuthDecorator, error) {
+	if authHandler.oidc == nil {
+		return nil, fmt.Errorf("authentication handler has no OIDC client configured")
+	}
+
+	return &OIDCAuthDecorator{
+		RestAuthDecorator: NewRestAuthDecorator(authHandler, tokenStore, logger),
+		client:            authHandler.oidc,
+	}, nil
+}
+
+func (a *OIDCAuthDecorator) RegisterRoutes(mux *httprouter.Router) error {
+	cfg := a.client.config
+
+	loginUri := cfg.LoginUri
+	if loginUri == "" {
+		loginUri = "/auth/oidc/login"
+	}
+
+	callbackUri := cfg.CallbackUri
+	if callbackUri == "" {
+		callbackUri = "/auth/oidc/callback"
+	}
+
+	handleError := func(err error, rw http.ResponseWriter) {
+		a.logger.Errorf("error while handling OIDC authentication request: %s", err)
+		rw.Header().Set("Content-Type", "application/json;charset=utf8")
+		rw.WriteHeader(500)
+		_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
+	}
+
+	mux.GET(
+		loginUri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			stateBytes := make([]byte, 32)
+			if _, err := rand.Read(stateBytes); err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			state := base64.RawURLEncoding.EncodeToString(stateBytes)
+
+			authUrl, err := a.client.AuthCodeURL(state)
+			if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			http.SetCookie(rw, &http.Cookie{
+				Name:     oidcStateCookie,
+				Value:    state,
+				Path:     callbackUri,
+				MaxAge:   600,
+				HttpOnly: true,
+				Secure:   a.secureCookies(),
+				SameSite: http.SameSiteLaxMode,
+			})
+
+			http.Redirect(rw, req, authUrl, http.StatusFound)
+		},
+	)
+
+	mux.GET(
+		callbackUri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			query := req.URL.Query()
+
+			if errCode := query.Get("error"); errCode != "" {
+				a.logger.Warningf("identity provider returned error '%s': %s", errCode, query.Get("error_description"))
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.WriteHeader(403)
+				_, _ = rw.Write([]byte(`{"msg":"authentication failed"}`))
+				return
+			}
+
+			stateCookie, err := req.Cookie(oidcStateCookie)
+			if err != nil || stateCookie.Value == "" || stateCookie.Value != query.Get("state") {
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.WriteHeader(400)
+				_, _ = rw.Write([]byte(`{"msg":"invalid state"}`))
+				return
+			}
+
+			http.SetCookie(rw, &http.Cookie{
+				Name:   oidcStateCookie,
+				Path:   callbackUri,
+				MaxAge: -1,
+			})
+
+			authResponse, err := a.authHandler.ExchangeAuthorizationCode(query.Get("code"))
+			if err == InvalidCredentialsError {
+				a.authHandler.auditLogger.Log(audit.NewEvent(audit.LoginFailure, req, "").WithDetail("method", "oidc"))
+
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.WriteHeader(403)
+				_, _ = rw.Write([]byte(`{"msg":"invalid credentials"}`))
+				return
+			} else if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			subject, _ := tokenSubject(authResponse.JWT)
+			a.authHandler.auditLogger.Log(audit.NewEvent(audit.LoginSuccess, req, subject).WithDetail("method", "oidc"))
+
+			if err := a.completeBrowserLogin(rw, req, authResponse, cfg.PostLoginRedirect); err != nil {
+				handleError(err, rw)
+				return
+			}
+		},
+	)
+
+	a.registerRefreshRoute(mux)
+	a.registerLogoutRoute(mux)
+
+	if err := a.registerImpersonationRoute(mux); err != nil {
+		return err
+	}
+
+	return a.registerIntrospectionRoute(mux)
+}
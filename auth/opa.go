@@ -0,0 +1,386 @@
+package auth
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
+)
+
+// OPAAuthorizer evaluates Rego policies in the gateway, using the evaluator
+// of Open Policy Agent. Policies are loaded from local files or a bundle
+// URL, and compiled again whenever they change.
+//
+// The decision document may either be a boolean, or an object with the same
+// properties as the response of an external authorization service.
+type OPAAuthorizer struct {
+	config     *config.OPAConfig
+	query      string
+	timeout    time.Duration
+	httpClient *http.Client
+	logger     *logging.Logger
+
+	// the modules and data documents of the bundle, which are kept while
+	// the bundle has not changed
+	bundleModules map[string]string
+	bundleData    map[string]interface{}
+	bundleETag    string
+
+	checksum   string
+	reloadLock sync.Mutex
+
+	prepared     rego.PreparedEvalQuery
+	preparedLock sync.RWMutex
+
+	stop chan struct{}
+}
+
+func NewOPAAuthorizer(cfg *config.OPAConfig, logger *logging.Logger) (*OPAAuthorizer, error) {
+	timeout := 5 * time.Second
+	if cfg.Timeout != "" {
+		var err error
+
+		timeout, err = time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OPA timeout '%s': %s", cfg.Timeout, err)
+		}
+	}
+
+	reloadInterval := 30 * time.Second
+	if cfg.ReloadInterval != "" {
+		var err error
+
+		reloadInterval, err = time.ParseDuration(cfg.ReloadInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OPA reload interval '%s': %s", cfg.ReloadInterval, err)
+		}
+	}
+
+	decisionPath := cfg.DecisionPath
+	if decisionPath == "" {
+		decisionPath = "servicegateway/allow"
+	}
+
+	// the segments of the path are quoted, so that they may contain any
+	// character
+	query := strings.Builder{}
+	query.WriteString("data")
+	for _, segment := range strings.Split(strings.Trim(decisionPath, "/"), "/") {
+		query.WriteString(fmt.Sprintf("[%q]", segment))
+	}
+
+	o := OPAAuthorizer{
+		config:     cfg,
+		query:      query.String(),
+		timeout:    timeout,
+		httpClient: &http.Client{Timeout: timeout},
+		logger:     logger,
+		stop:       make(chan struct{}),
+	}
+
+	if err := o.ReloadPolicies(); err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(reloadInterval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-o.stop:
+				return
+			case <-ticker.C:
+				if err := o.ReloadPolicies(); err != nil {
+					o.logger.Errorf("could not reload OPA policies: %s", err)
+				}
+			}
+		}
+	}()
+
+	return &o, nil
+}
+
+// Close stops reloading the policies.
+func (o *OPAAuthorizer) Close() error {
+	close(o.stop)
+	o.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// ReloadPolicies reads the policy files and the bundle again, and compiles
+// the policies if any of them has changed. If they cannot be compiled, the
+// previous policies stay in use.
+func (o *OPAAuthorizer) ReloadPolicies() error {
+	o.reloadLock.Lock()
+	defer o.reloadLock.Unlock()
+
+	modules := make(map[string]string)
+
+	for _, file := range o.config.PolicyFiles {
+		policy, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("could not read policy file '%s': %s", file, err)
+		}
+
+		modules[file] = string(policy)
+	}
+
+	if o.config.BundleUrl != "" {
+		if err := o.reloadBundle(); err != nil {
+			return err
+		}
+
+		for name, policy := range o.bundleModules {
+			modules["bundle/"+name] = policy
+		}
+	}
+
+	checksum, err := policyChecksum(modules, o.bundleData)
+	if err != nil {
+		return err
+	}
+
+	if checksum == o.checksum {
+		return nil
+	}
+
+	data := o.bundleData
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+
+	options := []func(*rego.Rego){
+		rego.Query(o.query),
+		rego.Store(inmem.NewFromObject(data)),
+	}
+
+	for name, policy := range modules {
+		options = append(options, rego.Module(name, policy))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+
+	prepared, err := rego.New(options...).PrepareForEval(ctx)
+	if err != nil {
+		return fmt.Errorf("could not compile OPA policies: %s", err)
+	}
+
+	o.preparedLock.Lock()
+	o.prepared = prepared
+	o.preparedLock.Unlock()
+
+	o.checksum = checksum
+	o.logger.Infof("compiled %d OPA policies", len(modules))
+
+	return nil
+}
+
+// policyChecksum returns a checksum of the policies and data documents, so
+// that they are only compiled when they changed.
+func policyChecksum(modules map[string]string, data map[string]interface{}) (string, error) {
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		_, _ = fmt.Fprintf(hash, "%s\x00%s\x00", name, modules[name])
+	}
+
+	// maps are encoded with sorted keys
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	hash.Write(encoded)
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (o *OPAAuthorizer) reloadBundle() error {
+	req, err := http.NewRequest("GET", o.config.BundleUrl, nil)
+	if err != nil {
+		return err
+	}
+
+	if o.bundleETag != "" {
+		req.Header.Set("If-None-Match", o.bundleETag)
+	}
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not download policy bundle from '%s': %s", o.config.BundleUrl, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d while downloading policy bundle from '%s'", resp.StatusCode, o.config.BundleUrl)
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("policy bundle from '%s' is not gzip-compressed: %s", o.config.BundleUrl, err)
+	}
+
+	modules := make(map[string]string)
+	data := make(map[string]interface{})
+
+	bundle := tar.NewReader(gz)
+	for {
+		header, err := bundle.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("could not read policy bundle from '%s': %s", o.config.BundleUrl, err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := strings.TrimLeft(path.Clean("/"+header.Name), "/")
+
+		switch {
+		case strings.HasSuffix(name, ".rego"):
+			policy, err := io.ReadAll(bundle)
+			if err != nil {
+				return err
+			}
+
+			modules[name] = string(policy)
+		case path.Base(name) == "data.json":
+			var document map[string]interface{}
+			if err := json.NewDecoder(bundle).Decode(&document); err != nil {
+				return fmt.Errorf("invalid data document '%s' in policy bundle: %s", name, err)
+			}
+
+			if err := mergeData(data, path.Dir(name), document); err != nil {
+				return fmt.Errorf("invalid data document '%s' in policy bundle: %s", name, err)
+			}
+		}
+	}
+
+	o.bundleModules = modules
+	o.bundleData = data
+	o.bundleETag = resp.Header.Get("ETag")
+	o.logger.Infof("loaded policy bundle from %s", o.config.BundleUrl)
+
+	return nil
+}
+
+// mergeData adds a data document of a bundle to the data of all documents,
+// below the path of its directory.
+func mergeData(data map[string]interface{}, dir string, document map[string]interface{}) error {
+	target := data
+
+	if dir != "." {
+		for _, segment := range strings.Split(dir, "/") {
+			nested, ok := target[segment]
+			if !ok {
+				nested = make(map[string]interface{})
+				target[segment] = nested
+			}
+
+			if target, ok = nested.(map[string]interface{}); !ok {
+				return fmt.Errorf("'%s' is not an object", segment)
+			}
+		}
+	}
+
+	for key, value := range document {
+		if _, ok := target[key]; ok {
+			return fmt.Errorf("'%s' is defined more than once", key)
+		}
+
+		target[key] = value
+	}
+
+	return nil
+}
+
+// Check evaluates the decision document for the given request.
+func (o *OPAAuthorizer) Check(req *http.Request, appName string, token *JWTResponse) (*ExternalAuthorizationResult, error) {
+	result, err := o.check(req, appName, token)
+	if err != nil && o.config.FailOpen {
+		o.logger.Warningf("policy evaluation failed, allowing request: %s", err)
+		return &ExternalAuthorizationResult{}, nil
+	}
+
+	return result, err
+}
+
+func (o *OPAAuthorizer) check(req *http.Request, appName string, token *JWTResponse) (*ExternalAuthorizationResult, error) {
+	input := newExternalAuthorizationRequest(req, appName, token, o.config.ForwardHeaders)
+
+	o.preparedLock.RLock()
+	prepared := o.prepared
+	o.preparedLock.RUnlock()
+
+	ctx, cancel := context.WithTimeout(req.Context(), o.timeout)
+	defer cancel()
+
+	results, err := prepared.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return nil, fmt.Errorf("could not evaluate OPA policies: %s", err)
+	}
+
+	result := ExternalAuthorizationResult{}
+
+	// an undefined decision denies the request
+	var allow bool
+	if len(results) > 0 && len(results[0].Expressions) > 0 {
+		switch decision := results[0].Expressions[0].Value.(type) {
+		case bool:
+			allow = decision
+		default:
+			encoded, err := json.Marshal(decision)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := json.Unmarshal(encoded, &result); err != nil {
+				return nil, fmt.Errorf("could not decode OPA decision: %s", err)
+			}
+		}
+	}
+
+	if result.Allow == nil {
+		result.Allow = &allow
+	}
+
+	if o.config.LogDecisions {
+		o.logger.Infof(
+			"policy decision for %s %s (app %s, subject %v): allow=%t",
+			req.Method, req.URL.Path, appName, input.Claims["sub"], *result.Allow,
+		)
+	}
+
+	return &result, nil
+}
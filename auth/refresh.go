@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/audit"
+)
+
+type ExternalRefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// issueToken maps a JWT to a new opaque token. If the authentication provider
+// supplied a refresh token, a gateway refresh token is issued as well.
+func (a *RestAuthDecorator) issueToken(req *http.Request, authResponse *JWTResponse) (*ExternalAuthenticationResponse, int64, error) {
+	token, exp, err := a.tokenStore.AddToken(authResponse)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	subject, jti := tokenSubject(authResponse.JWT)
+	event := audit.NewEvent(audit.TokenIssued, req, subject).WithDetail("jti", jti)
+	if exp > 0 {
+		event.WithDetail("expires", time.Unix(exp, 0).Format(time.RFC3339))
+	}
+	a.authHandler.auditLogger.Log(event)
+
+	response := ExternalAuthenticationResponse{
+		Token:   token,
+		Expires: time.Unix(exp, 0).Format(time.RFC3339),
+	}
+
+	if authResponse.RefreshToken != "" {
+		response.RefreshToken, err = a.tokenStore.AddRefreshToken(token, authResponse.RefreshExpiresAt)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return &response, exp, nil
+}
+
+// completeBrowserLogin issues a token for a login that was performed by a
+// user agent (like the OIDC or SAML login flows), stores it in a cookie, and
+// either redirects the user agent or responds with the token.
+func (a *RestAuthDecorator) completeBrowserLogin(rw http.ResponseWriter, req *http.Request, authResponse *JWTResponse, redirect string) error {
+	response, exp, err := a.issueToken(req, authResponse)
+	if err != nil {
+		return err
+	}
+
+	if a.authHandler.config.CookieSession.Enabled {
+		a.startCookieSession(rw, response, exp)
+	} else {
+		a.setSessionCookies(rw, response.Token, exp, authResponse.RefreshToken == "")
+	}
+
+	if redirect != "" {
+		http.Redirect(rw, req, redirect, http.StatusFound)
+		return nil
+	}
+
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	rw.Header().Set("Content-Type", "application/json;charset=utf8")
+	_, _ = rw.Write(jsonResponse)
+
+	return nil
+}
+
+func (a *RestAuthDecorator) refreshUri() string {
+	if uri := a.authHandler.config.ProviderConfig.RefreshUri; uri != "" {
+		return uri
+	}
+	return "/auth/refresh"
+}
+
+// refreshTokenFromRequest reads the refresh token from the request body or,
+// with cookie sessions, from the refresh cookie. Since the cookie is sent
+// along automatically, these requests need to carry the CSRF token of the
+// session.
+func (a *RestAuthDecorator) refreshTokenFromRequest(rw http.ResponseWriter, req *http.Request) (string, bool) {
+	badRequest := func() {
+		rw.Header().Set("Content-Type", "application/json;charset=utf8")
+		rw.WriteHeader(400)
+		_, _ = rw.Write([]byte(`{"msg":"bad request"}`))
+	}
+
+	if a.authHandler.config.CookieSession.Enabled {
+		if _, ok := sessionTokenFromCookie(req); !ok || !a.checkCSRF(req) {
+			writeCSRFError(rw)
+			return "", false
+		}
+
+		cookie, err := req.Cookie(refreshCookie)
+		if err != nil || cookie.Value == "" {
+			badRequest()
+			return "", false
+		}
+
+		return cookie.Value, true
+	}
+
+	var refreshRequest ExternalRefreshRequest
+	if err := json.NewDecoder(req.Body).Decode(&refreshRequest); err != nil || refreshRequest.RefreshToken == "" {
+		badRequest()
+		return "", false
+	}
+
+	return refreshRequest.RefreshToken, true
+}
+
+func (a *RestAuthDecorator) registerRefreshRoute(mux *httprouter.Router) {
+	uri := a.refreshUri()
+
+	handleError := func(err error, rw http.ResponseWriter) {
+		a.logger.Errorf("error while handling refresh request: %s", err)
+		rw.Header().Set("Content-Type", "application/json;charset=utf8")
+		rw.WriteHeader(500)
+		_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
+	}
+
+	handleInvalid := func(rw http.ResponseWriter) {
+		rw.Header().Set("Content-Type", "application/json;charset=utf8")
+		rw.WriteHeader(403)
+		_, _ = rw.Write([]byte(`{"msg":"invalid refresh token"}`))
+	}
+
+	if a.authHandler.config.EnableCORS {
+		mux.OPTIONS(
+			uri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+				setCORSHeaders(rw.Header())
+				rw.WriteHeader(200)
+			},
+		)
+	}
+
+	mux.POST(
+		uri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			if a.authHandler.config.EnableCORS {
+				setCORSHeaders(rw.Header())
+			}
+
+			refreshToken, ok := a.refreshTokenFromRequest(rw, req)
+			if !ok {
+				return
+			}
+
+			// refresh tokens are single-use; taking it from the store makes
+			// concurrent refreshes with the same refresh token fail
+			token, err := a.tokenStore.TakeRefreshToken(refreshToken)
+			if err == NoTokenError {
+				handleInvalid(rw)
+				return
+			} else if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			// the refresh token is put back if it could not be used because
+			// of a temporary error, so that the client can try again instead
+			// of having to log in
+			restore := func(err error, exp int64) {
+				if restoreErr := a.tokenStore.RestoreRefreshToken(refreshToken, token, exp); restoreErr != nil {
+					a.logger.Errorf("could not restore refresh token: %s", restoreErr)
+				}
+				handleError(err, rw)
+			}
+
+			jwtResponse, err := a.tokenStore.GetToken(token)
+			if err == NoTokenError {
+				handleInvalid(rw)
+				return
+			} else if err != nil {
+				restore(err, 0)
+				return
+			}
+
+			refreshed, err := a.authHandler.Refresh(jwtResponse)
+			if err == InvalidCredentialsError || err == NoRefreshTokenError {
+				handleInvalid(rw)
+				return
+			} else if err != nil {
+				restore(err, jwtResponse.RefreshExpiresAt)
+				return
+			}
+
+			exp, err := a.tokenStore.SetToken(token, refreshed)
+			if err != nil {
+				restore(err, jwtResponse.RefreshExpiresAt)
+				return
+			}
+
+			newRefreshToken, err := a.tokenStore.AddRefreshToken(token, refreshed.RefreshExpiresAt)
+			if err != nil {
+				restore(err, refreshed.RefreshExpiresAt)
+				return
+			}
+
+			response := ExternalAuthenticationResponse{
+				Token:        token,
+				Expires:      time.Unix(exp, 0).Format(time.RFC3339),
+				RefreshToken: newRefreshToken,
+			}
+
+			// with cookie sessions, the session cookie is extended and the
+			// tokens are only sent in cookies
+			if a.authHandler.config.CookieSession.Enabled {
+				a.startCookieSession(rw, &response, exp)
+			}
+
+			jsonResponse, err := json.Marshal(&response)
+			if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			rw.Header().Set("Content-Type", "application/json;charset=utf8")
+			_, _ = rw.Write(jsonResponse)
+		},
+	)
+}
@@ -26,13 +26,17 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
-	"time"
+	"strconv"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/mittwald/servicegateway/config"
 	"github.com/op/go-logging"
 )
 
+// anonymousHeader is set on requests to applications with optional
+// authentication that were not authenticated.
+const anonymousHeader = "X-Anonymous"
+
 type RestAuthDecorator struct {
 	authHandler *AuthenticationHandler
 	tokenStore  TokenStore
@@ -46,8 +50,9 @@ type ExternalAuthenticationRequest struct {
 }
 
 type ExternalAuthenticationResponse struct {
-	Token   string `json:"token"`
-	Expires string `json:"expires,omitempty"`
+	Token        string `json:"token,omitempty"`
+	Expires      string `json:"expires,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
 func NewRestAuthDecorator(authHandler *AuthenticationHandler, tokenStore TokenStore, logger *logging.Logger) *RestAuthDecorator {
@@ -72,20 +77,55 @@ func (a *RestAuthDecorator) DecorateHandler(orig httprouter.Handle, appName stri
 	case "authorization":
 		writer = &AuthorizationTokenWriter{}
 	case "":
-		writer = &HeaderTokenWriter{HeaderName: "X-JWT"}
+		// gRPC services conventionally expect the token as "authorization"
+		// metadata
+		if appCfg.Grpc.Enabled {
+			writer = &AuthorizationTokenWriter{}
+		} else {
+			writer = &HeaderTokenWriter{HeaderName: "X-JWT"}
+		}
 	default:
 		writer = &HeaderTokenWriter{HeaderName: "X-JWT"}
 		a.logger.Errorf("bad token writer: %s", appCfg.Auth.Writer.Mode)
 	}
 
+	audience := appCfg.Auth.Audience
+	if audience == "" {
+		audience = appName
+	}
+
+	misconfigured := func(res http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		res.Header().Set("Content-Type", "application/json;charset=utf8")
+		res.WriteHeader(500)
+		_, _ = res.Write([]byte(`{"msg":"internal server error"}`))
+	}
+
+	authorizer, err := NewAuthorizer(&appCfg.Auth.Authorization)
+	if err != nil {
+		a.logger.Errorf("bad authorization rules for app %s: %s", appName, err)
+		return misconfigured
+	}
+
+	claimWriter, err := NewClaimHeaderWriter(appCfg.Auth.Writer.Claims)
+	if err != nil {
+		a.logger.Errorf("bad claim headers for app %s: %s", appName, err)
+		return misconfigured
+	}
+
 	return func(res http.ResponseWriter, req *http.Request, p httprouter.Params) {
 		if req.Method == "OPTIONS" {
 			orig(res, req, p)
 			return
 		}
 
+		providerApp := cfg.Authentication.ProviderConfig.Service == appName ||
+			(cfg.Applications[appName].Backend.Url != "" && cfg.Authentication.ProviderConfig.Url != "" &&
+				cfg.Applications[appName].Backend.Url == cfg.Authentication.ProviderConfig.Url)
+
 		responseRecorder := httptest.NewRecorder()
 
+		var authzResults []*ExternalAuthorizationResult
+
 		handleError := func(err error, rw http.ResponseWriter, statusCode int) {
 			a.logger.Errorf("error while handling authentication request: %s", err)
 			rw.Header().Set("Content-Type", "application/json;charset=utf8")
@@ -99,48 +139,121 @@ func (a *RestAuthDecorator) DecorateHandler(orig httprouter.Handle, appName stri
 			return
 		}
 
-		if cfg.Authentication.ProviderConfig.Service == appName ||
-			(cfg.Applications[appName].Backend.Url != "" && cfg.Authentication.ProviderConfig.Url != "" &&
-				cfg.Applications[appName].Backend.Url == cfg.Authentication.ProviderConfig.Url) {
+		if providerApp {
 			goto valid
 		}
 
 		if !authenticated {
+			if appCfg.Auth.Optional {
+				goto authorize
+			}
 			goto invalid
 		}
 
+		if token.ApiKey == nil && !a.checkCSRF(req) {
+			a.logger.Warningf("rejecting %s %s for app %s without valid CSRF token", req.Method, req.URL.Path, appName)
+			writeCSRFError(res)
+			return
+		}
+
 		if token.AllowedApplications != nil && len(token.AllowedApplications) > 0 {
-			for i := range token.AllowedApplications {
-				if token.AllowedApplications[i] == appName {
-					goto valid
-				}
+			if !containsString(token.AllowedApplications, appName) {
+				a.logger.Warningf("token is not whitelisted for app %s. whitelisted apps: %s", appName, token.AllowedApplications)
+				goto invalid
 			}
+		}
 
-			a.logger.Warningf("token is not whitelisted for app %s. whitelisted apps: %s", appName, token.AllowedApplications)
+		if token.Audience != nil && !containsString(token.Audience, audience) {
+			a.logger.Warningf("token audience %s does not include app %s", token.Audience, audience)
 			goto invalid
 		}
 
+	authorize:
+		if authorizer != nil {
+			var claims map[string]interface{}
+			if token != nil {
+				claims = token.Claims
+			}
+
+			if authErr := authorizer.Authorize(req, claims); authErr != nil {
+				a.logger.Warningf("denied %s %s for app %s: %s", req.Method, req.URL.Path, appName, authErr)
+				writeAuthorizationError(res, authErr)
+				return
+			}
+		}
+
+		for _, authorizer := range a.authHandler.requestAuthorizers {
+			authzResult, err := authorizer.Check(req, appName, token)
+			if err != nil {
+				handleError(err, res, 503)
+				return
+			}
+
+			if !authzResult.Allowed() {
+				a.logger.Warningf("external authorization denied %s %s for app %s", req.Method, req.URL.Path, appName)
+				writeExternalAuthorizationDenial(res, authzResult)
+				return
+			}
+
+			authzResults = append(authzResults, authzResult)
+		}
+
 	valid:
+		// the anonymity marker and claim headers must never be set by clients
+		// themselves
+		req.Header.Del(anonymousHeader)
+		claimWriter.RemoveClaimsFromRequest(req)
+
 		if token != nil {
-			_ = writer.WriteTokenToRequest(token.JWT, req)
+			if token.ApiKey != nil {
+				req = req.WithContext(contextWithApiKey(req.Context(), token.ApiKey))
+			}
+
+			if token.Issuer != "" {
+				req = req.WithContext(contextWithIssuer(req.Context(), token.Issuer))
+			}
+
+			if appCfg.Auth.Writer.OmitToken {
+				writer.RemoveTokenFromRequest(req)
+			} else if token.JWT != "" {
+				_ = writer.WriteTokenToRequest(token.JWT, req)
+			}
+
+			if token.Claims != nil {
+				req = req.WithContext(contextWithClaims(req.Context(), token.Claims))
+
+				if err := claimWriter.WriteClaimsToRequest(token.Claims, req); err != nil {
+					handleError(err, res, 500)
+					return
+				}
+			}
 
 			for i := range a.listeners {
 				a.listeners[i].OnAuthenticatedRequest(req, token.JWT)
 			}
+		} else if appCfg.Auth.Optional {
+			// make sure that upstreams cannot mistake a forged token for one
+			// that was verified by the gateway
+			writer.RemoveTokenFromRequest(req)
+			req.Header.Set(anonymousHeader, "true")
 		}
 
-		orig(responseRecorder, req, p)
+		for _, authzResult := range authzResults {
+			authzResult.Apply(req)
+		}
 
-		// if app was a provider app allow token rewrites
-		if cfg.Authentication.ProviderConfig.Service == appName ||
-			(cfg.Applications[appName].Backend.Url != "" && cfg.Authentication.ProviderConfig.Url != "" &&
-				cfg.Applications[appName].Backend.Url == cfg.Authentication.ProviderConfig.Url) {
-			err := rewriteAccessTokens(responseRecorder, req, a)
+		// only responses of the provider app need to be buffered (to allow
+		// token rewrites); all other responses are streamed to the client
+		if !providerApp {
+			orig(res, req, p)
+			return
+		}
 
-			if err != nil {
-				handleError(err, responseRecorder, 500)
-				return
-			}
+		orig(responseRecorder, req, p)
+
+		if err := rewriteAccessTokens(responseRecorder, req, a); err != nil {
+			handleError(err, responseRecorder, 500)
+			return
 		}
 
 		for headerName, values := range responseRecorder.Header() {
@@ -163,6 +276,14 @@ func (a *RestAuthDecorator) DecorateHandler(orig httprouter.Handle, appName stri
 }
 
 func (a *RestAuthDecorator) RegisterRoutes(mux *httprouter.Router) error {
+	if err := a.registerIntrospectionRoute(mux); err != nil {
+		return err
+	}
+
+	if err := a.registerImpersonationRoute(mux); err != nil {
+		return err
+	}
+
 	if !a.authHandler.config.ProviderConfig.AllowAuthentication {
 		return nil
 	}
@@ -179,18 +300,6 @@ func (a *RestAuthDecorator) RegisterRoutes(mux *httprouter.Router) error {
 		_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
 	}
 
-	handleIncompleteAuthentication := func(authenticationIncompleteErr *AuthenticationIncompleteError, rw http.ResponseWriter) error {
-		rw.Header().Set("Content-Type", "application/json;charset=utf8")
-		rw.WriteHeader(202)
-
-		jsonString, err := json.Marshal(authenticationIncompleteErr.AdditionalProperties)
-		if err != nil {
-			return err
-		}
-		_, _ = rw.Write(jsonString)
-		return nil
-	}
-
 	if a.authHandler.config.EnableCORS {
 		mux.OPTIONS(
 			uri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
@@ -225,14 +334,20 @@ func (a *RestAuthDecorator) RegisterRoutes(mux *httprouter.Router) error {
 				return
 			}
 
-			authResponse, err := a.authHandler.Authenticate(authRequest.Username, authRequest.Password, genericBody)
-			if err == InvalidCredentialsError {
+			authResponse, err := a.authHandler.AuthenticateClient(req, authRequest.Username, authRequest.Password, genericBody)
+			if throttled, ok := err.(LoginThrottledError); ok {
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.Header().Set("Retry-After", strconv.Itoa(int(throttled.RetryAfter.Seconds())+1))
+				rw.WriteHeader(429)
+				_, _ = rw.Write([]byte(`{"msg":"too many failed login attempts"}`))
+				return
+			} else if err == InvalidCredentialsError {
 				rw.Header().Set("Content-Type", "application/json;charset=utf8")
 				rw.WriteHeader(403)
 				_, _ = rw.Write([]byte(`{"msg":"invalid credentials"}`))
 				return
 			} else if errors.Is(err, AuthenticationIncompleteError{}) {
-				if innerErr := handleIncompleteAuthentication(err.(*AuthenticationIncompleteError), rw); innerErr != nil {
+				if innerErr := a.writeIncompleteAuthentication(err.(*AuthenticationIncompleteError), rw); innerErr != nil {
 					handleError(innerErr, rw)
 					return
 				}
@@ -242,17 +357,18 @@ func (a *RestAuthDecorator) RegisterRoutes(mux *httprouter.Router) error {
 				return
 			}
 
-			token, exp, err := a.tokenStore.AddToken(authResponse)
+			response, exp, err := a.issueToken(req, authResponse)
 			if err != nil {
 				handleError(err, rw)
 				return
 			}
 
-			response := ExternalAuthenticationResponse{
-				Token:   token,
-				Expires: time.Unix(exp, 0).Format(time.RFC3339),
+			// with cookie sessions, the tokens must not be exposed to scripts
+			if a.authHandler.config.CookieSession.Enabled {
+				a.startCookieSession(rw, response, exp)
 			}
-			jsonResponse, err := json.Marshal(&response)
+
+			jsonResponse, err := json.Marshal(response)
 			if err != nil {
 				handleError(err, rw)
 				return
@@ -263,9 +379,22 @@ func (a *RestAuthDecorator) RegisterRoutes(mux *httprouter.Router) error {
 		},
 	)
 
+	a.registerRefreshRoute(mux)
+	a.registerMfaRoute(mux)
+	a.registerLogoutRoute(mux)
+
 	return nil
 }
 
+func containsString(list []string, value string) bool {
+	for i := range list {
+		if list[i] == value {
+			return true
+		}
+	}
+	return false
+}
+
 func setCORSHeaders(headers http.Header) {
 	headers.Set("Access-Control-Allow-Methods", "POST, OPTIONS")
 	headers.Set("Access-Control-Allow-Headers", "X-Requested-With, Authorization, Content-Type")
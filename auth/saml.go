@@ -0,0 +1,395 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/crewjam/saml"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/audit"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+const samlRequestCookie = "saml_request"
+
+// SAMLServiceProvider lets users log in at a SAML 2.0 identity provider.
+// Since SAML identity providers do not issue JWTs, the token is issued and
+// signed by the gateway itself, using the assertion's subject and attributes
+// as claims.
+type SAMLServiceProvider struct {
+	config     *config.SAMLProviderConfig
+	signer     *JwtSigner
+	httpClient *http.Client
+	logger     *logging.Logger
+
+	sp     saml.ServiceProvider
+	spLock sync.Mutex
+}
+
+func NewSAMLServiceProvider(cfg *config.SAMLProviderConfig, signer *JwtSigner, httpClient *http.Client, logger *logging.Logger) (*SAMLServiceProvider, error) {
+	if signer == nil {
+		return nil, fmt.Errorf("SAML authentication requires a JWT signing key")
+	}
+
+	if cfg.IdPMetadataUrl == "" && cfg.IdPMetadataFile == "" {
+		return nil, fmt.Errorf("SAML authentication requires the metadata of an identity provider")
+	}
+
+	rootUrl, err := url.Parse(cfg.RootUrl)
+	if err != nil || rootUrl.Host == "" {
+		return nil, fmt.Errorf("SAML authentication requires the gateway's root URL: '%s' is invalid", cfg.RootUrl)
+	}
+
+	p := SAMLServiceProvider{
+		config:     cfg,
+		signer:     signer,
+		httpClient: httpClient,
+		logger:     logger,
+	}
+
+	p.sp = saml.ServiceProvider{
+		EntityID:          cfg.EntityID,
+		HTTPClient:        httpClient,
+		MetadataURL:       *rootUrl.ResolveReference(&url.URL{Path: p.MetadataUri()}),
+		AcsURL:            *rootUrl.ResolveReference(&url.URL{Path: p.AcsUri()}),
+		AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+		AllowIDPInitiated: cfg.AllowIdPInitiated,
+	}
+
+	if cfg.CertificateFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(cfg.CertificateFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load SAML service provider certificate: %s", err)
+		}
+
+		key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("SAML service provider key must be an RSA key")
+		}
+
+		p.sp.Key = key
+		p.sp.Certificate, err = x509.ParseCertificate(keyPair.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse SAML service provider certificate: %s", err)
+		}
+	}
+
+	if cfg.IdPMetadataFile != "" {
+		data, err := os.ReadFile(cfg.IdPMetadataFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read SAML identity provider metadata from '%s': %s", cfg.IdPMetadataFile, err)
+		}
+
+		p.sp.IDPMetadata, err = parseSAMLMetadata(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse SAML identity provider metadata from '%s': %s", cfg.IdPMetadataFile, err)
+		}
+	}
+
+	return &p, nil
+}
+
+func (p *SAMLServiceProvider) LoginUri() string {
+	if p.config.LoginUri == "" {
+		return "/auth/saml/login"
+	}
+	return p.config.LoginUri
+}
+
+func (p *SAMLServiceProvider) AcsUri() string {
+	if p.config.AcsUri == "" {
+		return "/auth/saml/acs"
+	}
+	return p.config.AcsUri
+}
+
+func (p *SAMLServiceProvider) MetadataUri() string {
+	if p.config.MetadataUri == "" {
+		return "/auth/saml/metadata"
+	}
+	return p.config.MetadataUri
+}
+
+// serviceProvider returns the SAML service provider, after loading the
+// identity provider's metadata if necessary.
+func (p *SAMLServiceProvider) serviceProvider() (*saml.ServiceProvider, error) {
+	p.spLock.Lock()
+	defer p.spLock.Unlock()
+
+	if p.sp.IDPMetadata != nil {
+		return &p.sp, nil
+	}
+
+	resp, err := p.httpClient.Get(p.config.IdPMetadataUrl)
+	if err != nil {
+		return nil, fmt.Errorf("could not load SAML identity provider metadata from '%s': %s", p.config.IdPMetadataUrl, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d while loading SAML identity provider metadata from '%s'", resp.StatusCode, p.config.IdPMetadataUrl)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	p.sp.IDPMetadata, err = parseSAMLMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse SAML identity provider metadata from '%s': %s", p.config.IdPMetadataUrl, err)
+	}
+
+	return &p.sp, nil
+}
+
+// parseSAMLMetadata reads an entity descriptor, which may also be wrapped in
+// an entities descriptor.
+func parseSAMLMetadata(data []byte) (*saml.EntityDescriptor, error) {
+	entity := saml.EntityDescriptor{}
+	if err := xml.Unmarshal(data, &entity); err == nil {
+		return &entity, nil
+	}
+
+	entities := saml.EntitiesDescriptor{}
+	if err := xml.Unmarshal(data, &entities); err != nil {
+		return nil, err
+	}
+
+	for i := range entities.EntityDescriptors {
+		if len(entities.EntityDescriptors[i].IDPSSODescriptors) > 0 {
+			return &entities.EntityDescriptors[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no identity provider found in metadata")
+}
+
+// Metadata returns the metadata of the gateway's service provider, which
+// needs to be registered with the identity provider.
+func (p *SAMLServiceProvider) Metadata() *saml.EntityDescriptor {
+	return p.sp.Metadata()
+}
+
+// AuthenticationRequestURL builds the URL of the identity provider that the
+// user agent should be redirected to, along with the ID of the request.
+func (p *SAMLServiceProvider) AuthenticationRequestURL() (string, string, error) {
+	sp, err := p.serviceProvider()
+	if err != nil {
+		return "", "", err
+	}
+
+	authnRequest, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", "", err
+	}
+
+	redirectUrl, err := authnRequest.Redirect("", sp)
+	if err != nil {
+		return "", "", err
+	}
+
+	return redirectUrl.String(), authnRequest.ID, nil
+}
+
+// Authenticate validates the SAML response posted to the assertion consumer
+// service and issues a new JWT for the asserted subject.
+func (p *SAMLServiceProvider) Authenticate(req *http.Request, requestIDs []string) (*JWTResponse, error) {
+	sp, err := p.serviceProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := req.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	assertion, err := sp.ParseResponse(req, requestIDs)
+	if err != nil {
+		var invalidResponse *saml.InvalidResponseError
+		if errors.As(err, &invalidResponse) {
+			p.logger.Warningf("rejecting SAML response: %s", invalidResponse.PrivateErr)
+		} else {
+			p.logger.Warningf("rejecting SAML response: %s", err)
+		}
+		return nil, InvalidCredentialsError
+	}
+
+	attributes := make(map[string][]string)
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			values := make([]string, 0, len(attribute.Values))
+			for _, value := range attribute.Values {
+				values = append(values, value.Value)
+			}
+
+			attributes[attribute.Name] = values
+			if attribute.FriendlyName != "" {
+				attributes[attribute.FriendlyName] = values
+			}
+		}
+	}
+
+	var subject string
+	if p.config.SubjectAttribute != "" {
+		if values := attributes[p.config.SubjectAttribute]; len(values) > 0 {
+			subject = values[0]
+		}
+	} else if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		subject = assertion.Subject.NameID.Value
+	}
+
+	if strings.TrimSpace(subject) == "" {
+		p.logger.Warningf("SAML assertion %s has no usable subject", assertion.ID)
+		return nil, InvalidCredentialsError
+	}
+
+	claims := map[string]interface{}{}
+	for claim, attribute := range p.config.AttributeClaims {
+		values := attributes[attribute]
+
+		switch len(values) {
+		case 0:
+		case 1:
+			claims[claim] = values[0]
+		default:
+			claims[claim] = values
+		}
+	}
+
+	p.logger.Infof("user %s authenticated by SAML identity provider %s", subject, assertion.Issuer.Value)
+
+	token, err := p.signer.Sign(subject, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTResponse{JWT: token}, nil
+}
+
+// SAMLAuthDecorator authenticates requests the same way as the REST decorator,
+// but delegates the login itself to a SAML identity provider.
+type SAMLAuthDecorator struct {
+	*RestAuthDecorator
+	provider *SAMLServiceProvider
+}
+
+func NewSAMLAuthDecorator(authHandler *AuthenticationHandler, tokenStore TokenStore, logger *logging.Logger) (*SAMLAuthDecorator, error) {
+	if authHandler.saml == nil {
+		return nil, fmt.Errorf("authentication handler has no SAML service provider configured")
+	}
+
+	return &SAMLAuthDecorator{
+		RestAuthDecorator: NewRestAuthDecorator(authHandler, tokenStore, logger),
+		provider:          authHandler.saml,
+	}, nil
+}
+
+func (a *SAMLAuthDecorator) RegisterRoutes(mux *httprouter.Router) error {
+	acsUri := a.provider.AcsUri()
+
+	handleError := func(err error, rw http.ResponseWriter) {
+		a.logger.Errorf("error while handling SAML authentication request: %s", err)
+		rw.Header().Set("Content-Type", "application/json;charset=utf8")
+		rw.WriteHeader(500)
+		_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
+	}
+
+	mux.GET(
+		a.provider.MetadataUri(), func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			metadata, err := xml.MarshalIndent(a.provider.Metadata(), "", "  ")
+			if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			rw.Header().Set("Content-Type", "application/samlmetadata+xml")
+			_, _ = rw.Write(metadata)
+		},
+	)
+
+	mux.GET(
+		a.provider.LoginUri(), func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			redirectUrl, requestID, err := a.provider.AuthenticationRequestURL()
+			if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			// the identity provider posts its response cross-site, so the
+			// cookie can only be sent along with SameSite=None
+			cookie := http.Cookie{
+				Name:     samlRequestCookie,
+				Value:    requestID,
+				Path:     acsUri,
+				MaxAge:   600,
+				HttpOnly: true,
+				Secure:   a.secureCookies(),
+				SameSite: http.SameSiteLaxMode,
+			}
+			if cookie.Secure {
+				cookie.SameSite = http.SameSiteNoneMode
+			}
+			http.SetCookie(rw, &cookie)
+
+			http.Redirect(rw, req, redirectUrl, http.StatusFound)
+		},
+	)
+
+	mux.POST(
+		acsUri, func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			var requestIDs []string
+			if requestCookie, err := req.Cookie(samlRequestCookie); err == nil && requestCookie.Value != "" {
+				requestIDs = append(requestIDs, requestCookie.Value)
+			}
+
+			http.SetCookie(rw, &http.Cookie{
+				Name:   samlRequestCookie,
+				Path:   acsUri,
+				MaxAge: -1,
+			})
+
+			authResponse, err := a.authHandler.AuthenticateSAMLResponse(req, requestIDs)
+			if err == InvalidCredentialsError {
+				a.authHandler.auditLogger.Log(audit.NewEvent(audit.LoginFailure, req, "").WithDetail("method", "saml"))
+
+				rw.Header().Set("Content-Type", "application/json;charset=utf8")
+				rw.WriteHeader(403)
+				_, _ = rw.Write([]byte(`{"msg":"authentication failed"}`))
+				return
+			} else if err != nil {
+				handleError(err, rw)
+				return
+			}
+
+			subject, _ := tokenSubject(authResponse.JWT)
+			a.authHandler.auditLogger.Log(audit.NewEvent(audit.LoginSuccess, req, subject).WithDetail("method", "saml"))
+
+			if err := a.completeBrowserLogin(rw, req, authResponse, a.provider.config.PostLoginRedirect); err != nil {
+				handleError(err, rw)
+				return
+			}
+		},
+	)
+
+	a.registerLogoutRoute(mux)
+
+	if err := a.registerImpersonationRoute(mux); err != nil {
+		return err
+	}
+
+	return a.registerIntrospectionRoute(mux)
+}
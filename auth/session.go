@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie = "ACCESSTOKEN"
+	refreshCookie = "REFRESHTOKEN"
+)
+
+// csrfTokenForSession derives the CSRF token of a session from its token.
+// Since it cannot be computed without knowing the session token, a CSRF token
+// that was planted by an attacker (for example, from a sibling domain) is
+// worthless, while the session token cannot be recovered from the CSRF
+// token, which is readable by scripts.
+func csrfTokenForSession(token string) string {
+	sum := sha256.Sum256([]byte("csrf:" + token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// sessionTokenFromCookie returns the token of a request that is
+// authenticated with a session cookie instead of an Authorization header.
+func sessionTokenFromCookie(req *http.Request) (string, bool) {
+	if req.Header.Get("Authorization") != "" {
+		return "", false
+	}
+
+	for _, name := range []string{sessionCookie, "access_token"} {
+		if cookie, err := req.Cookie(name); err == nil && cookie.Value != "" {
+			return cookie.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// SessionCookie returns the token of a request that is authenticated with a
+// session cookie, so that other modules (like the response cache) can tell
+// the requests of different sessions apart.
+func SessionCookie(req *http.Request) (string, bool) {
+	return sessionTokenFromCookie(req)
+}
+
+func (a *RestAuthDecorator) csrfCookieName() string {
+	if name := a.authHandler.config.CookieSession.CsrfCookie; name != "" {
+		return name
+	}
+	return "XSRF-TOKEN"
+}
+
+func (a *RestAuthDecorator) csrfHeaderName() string {
+	if name := a.authHandler.config.CookieSession.CsrfHeader; name != "" {
+		return name
+	}
+	return "X-XSRF-TOKEN"
+}
+
+// secureCookies reports whether the cookies set by the gateway carry the
+// Secure attribute. This does not depend on the scheme of the request, since
+// the gateway is usually run behind a load balancer terminating TLS.
+func (a *RestAuthDecorator) secureCookies() bool {
+	return !a.authHandler.config.CookieSession.Insecure
+}
+
+// checkCSRF verifies the CSRF token of state-changing requests that are
+// authenticated with a session cookie. Requests using other means of
+// authentication are not prone to CSRF and always pass.
+func (a *RestAuthDecorator) checkCSRF(req *http.Request) bool {
+	if !a.authHandler.config.CookieSession.Enabled {
+		return true
+	}
+
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+
+	token, ok := sessionTokenFromCookie(req)
+	if !ok {
+		return true
+	}
+
+	expected := csrfTokenForSession(token)
+	given := req.Header.Get(a.csrfHeaderName())
+
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// setSessionCookies stores a token in the session cookie. With cookie
+// sessions enabled, the CSRF token of the session is stored in a second
+// cookie that scripts can read and send back in a request header.
+func (a *RestAuthDecorator) setSessionCookies(rw http.ResponseWriter, token string, exp int64, persistent bool) {
+	cfg := &a.authHandler.config.CookieSession
+
+	cookie := http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   a.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if cfg.Enabled {
+		cookie.Domain = cfg.Domain
+
+		switch strings.ToLower(cfg.SameSite) {
+		case "strict":
+			cookie.SameSite = http.SameSiteStrictMode
+		case "none":
+			cookie.SameSite = http.SameSiteNoneMode
+			cookie.Secure = true
+		}
+	}
+
+	if exp > 0 && persistent {
+		cookie.Expires = time.Unix(exp, 0)
+	}
+
+	http.SetCookie(rw, &cookie)
+
+	if !cfg.Enabled {
+		return
+	}
+
+	csrfCookie := cookie
+	csrfCookie.Name = a.csrfCookieName()
+	csrfCookie.Value = csrfTokenForSession(token)
+	csrfCookie.HttpOnly = false
+
+	http.SetCookie(rw, &csrfCookie)
+}
+
+// setRefreshCookie stores a refresh token in a cookie that scripts cannot
+// read, and that user agents only send to the refresh endpoint. Like the
+// session cookie of a token that can be refreshed, it is kept until the user
+// agent is closed.
+func (a *RestAuthDecorator) setRefreshCookie(rw http.ResponseWriter, refreshToken string) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    refreshToken,
+		Path:     a.refreshUri(),
+		Domain:   a.authHandler.config.CookieSession.Domain,
+		HttpOnly: true,
+		Secure:   a.secureCookies(),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// startCookieSession stores the token and refresh token of a response in
+// cookies, and removes them from the response, so that they are not exposed
+// to scripts.
+func (a *RestAuthDecorator) startCookieSession(rw http.ResponseWriter, response *ExternalAuthenticationResponse, exp int64) {
+	a.setSessionCookies(rw, response.Token, exp, response.RefreshToken == "")
+	if response.RefreshToken != "" {
+		a.setRefreshCookie(rw, response.RefreshToken)
+	}
+
+	response.Token = ""
+	response.RefreshToken = ""
+}
+
+// clearSessionCookies removes the cookies set by setSessionCookies and
+// setRefreshCookie.
+func (a *RestAuthDecorator) clearSessionCookies(rw http.ResponseWriter) {
+	cfg := &a.authHandler.config.CookieSession
+
+	names := []string{sessionCookie}
+	domain := ""
+	if cfg.Enabled {
+		names = append(names, a.csrfCookieName())
+		domain = cfg.Domain
+	}
+
+	for _, name := range names {
+		http.SetCookie(rw, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			Domain:   domain,
+			MaxAge:   -1,
+			Secure:   a.secureCookies(),
+			HttpOnly: name == sessionCookie,
+		})
+	}
+
+	if cfg.Enabled {
+		http.SetCookie(rw, &http.Cookie{
+			Name:     refreshCookie,
+			Path:     a.refreshUri(),
+			Domain:   domain,
+			MaxAge:   -1,
+			Secure:   a.secureCookies(),
+			HttpOnly: true,
+		})
+	}
+}
+
+func writeCSRFError(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/json;charset=utf8")
+	rw.WriteHeader(403)
+	_, _ = rw.Write([]byte(`{"msg":"invalid CSRF token"}`))
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mittwald/servicegateway/config"
+)
+
+// JwtSigner issues JWTs that are signed with the gateway's own private key.
+// It is used by authentication providers that do not issue JWTs themselves.
+type JwtSigner struct {
+	key    *rsa.PrivateKey
+	keyID  string
+	issuer string
+	ttl    time.Duration
+}
+
+func NewJwtSigner(cfg *config.JwtIssuerConfig) (*JwtSigner, error) {
+	keyPEM := cfg.SigningKey
+	if len(keyPEM) == 0 && cfg.SigningKeyFile != "" {
+		var err error
+
+		keyPEM, err = os.ReadFile(cfg.SigningKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read signing key from '%s': %s", cfg.SigningKeyFile, err)
+		}
+	}
+
+	if len(keyPEM) == 0 {
+		return nil, fmt.Errorf("no JWT signing key configured")
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse JWT signing key: %s", err)
+	}
+
+	ttl := time.Hour
+	if cfg.TokenTtl != "" {
+		ttl, err = time.ParseDuration(cfg.TokenTtl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token TTL '%s': %s", cfg.TokenTtl, err)
+		}
+	}
+
+	keyID := cfg.KeyID
+	if keyID == "" {
+		keyID, err = publicKeyThumbprint(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	issuer := cfg.Issuer
+	if issuer == "" {
+		issuer = "servicegateway"
+	}
+
+	return &JwtSigner{
+		key:    key,
+		keyID:  keyID,
+		issuer: issuer,
+		ttl:    ttl,
+	}, nil
+}
+
+func publicKeyThumbprint(key *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:16]), nil
+}
+
+func (s *JwtSigner) KeyID() string {
+	return s.keyID
+}
+
+// Issuer returns the "iss" claim of the tokens issued by the signer.
+func (s *JwtSigner) Issuer() string {
+	return s.issuer
+}
+
+func (s *JwtSigner) PublicKey() *rsa.PublicKey {
+	return &s.key.PublicKey
+}
+
+// Sign issues a new JWT for the given subject. The standard claims "jti",
+// "iss", "sub", "iat" and "exp" are set by the signer and cannot be
+// overridden by the additional claims.
+func (s *JwtSigner) Sign(subject string, claims map[string]interface{}) (string, error) {
+	return s.SignWithTtl(subject, claims, s.ttl)
+}
+
+// SignWithTtl issues a new JWT like Sign, but with a custom lifetime.
+func (s *JwtSigner) SignWithTtl(subject string, claims map[string]interface{}, ttl time.Duration) (string, error) {
+	now := time.Now()
+
+	mapClaims := jwt.MapClaims{}
+	for k, v := range claims {
+		mapClaims[k] = v
+	}
+
+	jti, err := generateTokenString()
+	if err != nil {
+		return "", err
+	}
+
+	mapClaims["jti"] = jti
+	mapClaims["iss"] = s.issuer
+	mapClaims["sub"] = subject
+	mapClaims["iat"] = now.Unix()
+	mapClaims["exp"] = now.Add(ttl).Unix()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, mapClaims)
+	token.Header["kid"] = s.keyID
+
+	return token.SignedString(s.key)
+}
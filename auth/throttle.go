@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+// LoginThrottledError is returned for login attempts of users or from
+// clients that are temporarily locked out after too many failed logins.
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e LoginThrottledError) Error() string {
+	return fmt.Sprintf("too many failed login attempts; retry after %s", e.RetryAfter)
+}
+
+// LoginThrottle counts failed logins per user name and per client IP address
+// in Redis. Once a counter reaches its threshold, further logins are locked
+// out for an exponentially growing period of time.
+type LoginThrottle struct {
+	redisPool     RedisConnectionSource
+	logger        *logging.Logger
+	userThreshold int64
+	ipThreshold   int64
+	window        time.Duration
+	baseLockout   time.Duration
+	maxLockout    time.Duration
+}
+
+func NewLoginThrottle(cfg *config.LoginThrottlingConfig, redisPool RedisConnectionSource, logger *logging.Logger) (*LoginThrottle, error) {
+	t := LoginThrottle{
+		redisPool:     redisPool,
+		logger:        logger,
+		userThreshold: int64(cfg.UserThreshold),
+		ipThreshold:   int64(cfg.IpThreshold),
+		window:        15 * time.Minute,
+		baseLockout:   time.Second,
+		maxLockout:    15 * time.Minute,
+	}
+
+	if t.userThreshold == 0 {
+		t.userThreshold = 5
+	}
+
+	if t.ipThreshold == 0 {
+		t.ipThreshold = 20
+	}
+
+	durations := []struct {
+		value  string
+		target *time.Duration
+	}{
+		{cfg.Window, &t.window},
+		{cfg.BaseLockout, &t.baseLockout},
+		{cfg.MaxLockout, &t.maxLockout},
+	}
+
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid login throttling duration '%s': %s", d.value, err)
+		}
+		*d.target = parsed
+	}
+
+	return &t, nil
+}
+
+// Check returns a LoginThrottledError if logins for the given user or from
+// the given IP address are currently locked out.
+func (t *LoginThrottle) Check(username string, ip string) error {
+	conn := t.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	for _, key := range t.lockoutKeys(username, ip) {
+		ttl, err := redis.Int64(conn.Do("PTTL", key))
+		if err != nil {
+			return err
+		}
+
+		if ttl > 0 {
+			return LoginThrottledError{RetryAfter: time.Duration(ttl) * time.Millisecond}
+		}
+	}
+
+	return nil
+}
+
+// RecordFailure counts a failed login and locks out the user or IP address
+// if the respective threshold has been reached. It returns the longest
+// lockout that was imposed, or zero if the login was not locked out.
+func (t *LoginThrottle) RecordFailure(username string, ip string) (time.Duration, error) {
+	conn := t.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	counters := []struct {
+		kind      string
+		subject   string
+		threshold int64
+	}{
+		{"user", username, t.userThreshold},
+		{"ip", ip, t.ipThreshold},
+	}
+
+	var longestLockout time.Duration
+
+	for _, c := range counters {
+		if c.subject == "" {
+			continue
+		}
+
+		failures, err := redis.Int64(conn.Do("INCR", "loginfail_"+c.kind+"_"+c.subject))
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := conn.Do("PEXPIRE", "loginfail_"+c.kind+"_"+c.subject, t.window.Milliseconds()); err != nil {
+			return 0, err
+		}
+
+		if failures < c.threshold {
+			continue
+		}
+
+		lockout := t.lockoutDuration(failures - c.threshold)
+		if _, err := conn.Do("SET", "lockout_"+c.kind+"_"+c.subject, failures, "PX", lockout.Milliseconds()); err != nil {
+			return 0, err
+		}
+
+		t.logger.Warningf("security event: %d failed logins for %s %s; locking out for %s", failures, c.kind, c.subject, lockout)
+
+		if lockout > longestLockout {
+			longestLockout = lockout
+		}
+	}
+
+	return longestLockout, nil
+}
+
+// RecordSuccess resets the failed login counter of a user. The counter of
+// the IP address is kept, so that a single valid account cannot be used to
+// cover up guessing the passwords of other accounts.
+func (t *LoginThrottle) RecordSuccess(username string) error {
+	conn := t.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_, err := conn.Do("DEL", "loginfail_user_"+username)
+	return err
+}
+
+func (t *LoginThrottle) lockoutDuration(excess int64) time.Duration {
+	lockout := t.baseLockout
+	for i := int64(0); i < excess && lockout < t.maxLockout; i++ {
+		lockout *= 2
+	}
+
+	if lockout > t.maxLockout {
+		lockout = t.maxLockout
+	}
+
+	return lockout
+}
+
+func (t *LoginThrottle) lockoutKeys(username string, ip string) []string {
+	keys := make([]string, 0, 2)
+
+	if username != "" {
+		keys = append(keys, "lockout_user_"+username)
+	}
+
+	if ip != "" {
+		keys = append(keys, "lockout_ip_"+ip)
+	}
+
+	return keys
+}
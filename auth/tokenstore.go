@@ -2,17 +2,39 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/rediscluster"
+	"github.com/mittwald/servicegateway/redisconn"
+	"github.com/op/go-logging"
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type MappedToken struct {
-	Jwt   string
+	Jwt string
+
+	// ID identifies the mapping in the store, and can be used to remove it.
+	// Token is the opaque token itself; it is empty for stores that only
+	// keep the hash of the token.
+	ID    string
 	Token string
+
+	Applications []string
+
+	// ExpireAt is the time at which the mapping is removed from the store
+	// (0 if never). Sessions with an idle timeout may end earlier.
+	ExpireAt int64
 }
 
 type TokenStore interface {
@@ -20,28 +42,214 @@ type TokenStore interface {
 	SetToken(string, *JWTResponse) (int64, error)
 	GetToken(string) (*JWTResponse, error)
 	GetAllTokens() (<-chan MappedToken, error)
+	RemoveToken(string) error
+	RemoveTokenByID(string) error
+
+	AddRefreshToken(string, int64) (string, error)
+	TakeRefreshToken(string) (string, error)
+	RestoreRefreshToken(string, string, int64) error
+	RemoveRefreshToken(string) error
+
+	AddPendingAuthentication(*PendingAuthentication) (string, error)
+	TakePendingAuthentication(string) (*PendingAuthentication, error)
+
+	RevokeToken(string, int64) error
+	IsTokenRevoked(string) (bool, error)
+
+	TouchToken(string) error
+}
+
+// PendingAuthentication holds the state of a login that requires an
+// additional authentication factor.
+type PendingAuthentication struct {
+	Username            string                 `json:"username"`
+	AllowedApplications []string               `json:"applications,omitempty"`
+	Properties          map[string]interface{} `json:"properties,omitempty"`
 }
 
+// pendingAuthenticationTtl is the time a user has to complete a login that
+// requires an additional authentication factor.
+const pendingAuthenticationTtl = 5 * time.Minute
+
 type CacheDecorator struct {
 	wrapped    TokenStore
 	localCache *lru.Cache
 }
 
 type CacheRecord struct {
-	token *JWTResponse
-	exp   int64
+	token    *JWTResponse
+	exp      int64
+	cachedAt time.Time
+}
+
+// localCacheTtl bounds the time a token mapping is served from the local
+// cache of a CacheDecorator. Mappings that were removed on another gateway
+// instance (for example, by a logout) stop working here after this time.
+const localCacheTtl = 10 * time.Second
+
+// RedisConnectionSource provides Redis connections. It is implemented by
+// *redis.Pool, *rediscluster.Cluster and *redissentinel.Sentinel.
+type RedisConnectionSource interface {
+	Get() redis.Conn
 }
 
 type RedisTokenStore struct {
-	redisPool *redis.Pool
+	redisPool RedisConnectionSource
+	prefix    string
+	cipher    *TokenCipher
 	verifier  *JwtVerifier
+	sessions  *sessionToucher
 }
 
 type TokenStoreOptions struct {
 	LocalCacheBucketSize int
+	IdleTimeout          time.Duration
+
+	// Cipher encrypts the JWTs in remote token stores, if set.
+	Cipher *TokenCipher
+
+	// KeyPrefix is prepended to all keys of the Redis token store, so that
+	// multiple gateway instances or environments can share a Redis server.
+	KeyPrefix string
+
+	// Degradation enables the fallback to in-process storage while Redis
+	// is unavailable, if set.
+	Degradation *DegradationOptions
+}
+
+// sessionToucher implements sliding session expiration. To reduce the load
+// on the token store, a session's expiration is extended at most ten times
+// per idle timeout period.
+type sessionToucher struct {
+	idleTimeout time.Duration
+	touched     *gocache.Cache
+}
+
+func newSessionToucher(idleTimeout time.Duration) *sessionToucher {
+	t := sessionToucher{idleTimeout: idleTimeout}
+	if idleTimeout > 0 {
+		t.touched = gocache.New(idleTimeout/10, idleTimeout)
+	}
+	return &t
+}
+
+// needsTouch reports whether the session's expiration should be extended now.
+func (t *sessionToucher) needsTouch(token string) bool {
+	if t.idleTimeout == 0 {
+		return false
+	}
+
+	if _, ok := t.touched.Get(token); ok {
+		return false
+	}
+
+	t.touched.SetDefault(token, true)
+	return true
+}
+
+// expiry returns the time at which a session expires if it stays idle,
+// limited by the session's absolute expiration time (0 means never).
+func (t *sessionToucher) expiry(expireAt int64) int64 {
+	if t.idleTimeout == 0 {
+		return expireAt
+	}
+
+	idleAt := time.Now().Add(t.idleTimeout).Unix()
+	if expireAt == 0 || idleAt < expireAt {
+		return idleAt
+	}
+
+	return expireAt
+}
+
+// TokenStoreFromConfig builds the token store backend selected in the
+// configuration. Remote backends are wrapped in a local LRU cache. The gauge
+// is set to 1 while a Redis backend is unavailable and the store is
+// degraded.
+func TokenStoreFromConfig(cfg *config.TokenStoreConfiguration, redisPool RedisConnectionSource, verifier *JwtVerifier, degradedGauge prometheus.Gauge, logger *logging.Logger) (TokenStore, error) {
+	options := TokenStoreOptions{LocalCacheBucketSize: cfg.LocalCacheSize, KeyPrefix: cfg.KeyPrefix}
+
+	cipher, err := TokenCipherFromConfig(&cfg.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	options.Cipher = cipher
+
+	if cfg.Degradation.Enabled {
+		options.Degradation = &DegradationOptions{
+			FallbackSize: cfg.Degradation.FallbackSize,
+			AcceptJwts:   cfg.Degradation.AcceptJwts,
+			FailOpen:     cfg.Degradation.RevocationFailOpen,
+			Gauge:        degradedGauge,
+			Logger:       logger,
+		}
+
+		if cfg.Degradation.RetryInterval != "" {
+			retryInterval, err := time.ParseDuration(cfg.Degradation.RetryInterval)
+			if err != nil {
+				return nil, fmt.Errorf("invalid degradation retry interval '%s': %s", cfg.Degradation.RetryInterval, err)
+			}
+			options.Degradation.RetryInterval = retryInterval
+		}
+	}
+
+	if cfg.IdleTimeout != "" {
+		idleTimeout, err := time.ParseDuration(cfg.IdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid idle timeout '%s': %s", cfg.IdleTimeout, err)
+		}
+		options.IdleTimeout = idleTimeout
+	}
+
+	switch cfg.Type {
+	case "", "redis":
+		return NewTokenStore(redisPool, verifier, options)
+	case "redis-cluster":
+		if len(cfg.RedisCluster.Addresses) == 0 {
+			return nil, fmt.Errorf("no redis cluster addresses configured")
+		}
+
+		dialOpts, err := cfg.RedisCluster.DialOptions()
+		if err != nil {
+			return nil, err
+		}
+
+		cluster := rediscluster.NewCluster(cfg.RedisCluster.Addresses, dialOpts...)
+		return NewTokenStore(cluster, verifier, options)
+	case "memory":
+		return NewMemoryTokenStore(verifier, options), nil
+	case "etcd":
+		store, err := NewEtcdTokenStore(&cfg.Etcd, verifier, options)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewCacheDecorator(store, options)
+	}
+
+	return nil, fmt.Errorf("unsupported token store type: '%s'", cfg.Type)
 }
 
-func NewTokenStore(redisPool *redis.Pool, verifier *JwtVerifier, options TokenStoreOptions) (TokenStore, error) {
+func NewTokenStore(redisPool RedisConnectionSource, verifier *JwtVerifier, options TokenStoreOptions) (TokenStore, error) {
+	var store TokenStore = &RedisTokenStore{
+		redisPool: redisPool,
+		prefix:    options.KeyPrefix,
+		cipher:    options.Cipher,
+		verifier:  verifier,
+		sessions:  newSessionToucher(options.IdleTimeout),
+	}
+
+	if options.Degradation != nil {
+		var err error
+		if store, err = NewDegradingTokenStore(store, verifier, *options.Degradation); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewCacheDecorator(store, options)
+}
+
+func NewCacheDecorator(wrapped TokenStore, options TokenStoreOptions) (TokenStore, error) {
 	bucketSize := 128
 
 	if options.LocalCacheBucketSize != 0 {
@@ -54,53 +262,134 @@ func NewTokenStore(redisPool *redis.Pool, verifier *JwtVerifier, options TokenSt
 	}
 
 	return &CacheDecorator{
-		wrapped: &RedisTokenStore{
-			redisPool: redisPool,
-			verifier:  verifier,
-		},
+		wrapped:    wrapped,
 		localCache: cache,
 	}, nil
 }
 
-func (s *RedisTokenStore) SetToken(token string, jwt *JWTResponse) (int64, error) {
-	valid, stdClaims, _, err := s.verifier.VerifyToken(jwt.JWT)
+// tokenExpiry verifies a JWT and returns both the JWT's expiration time and
+// the time at which the stored token may be removed from the store (0 if the
+// token should be kept indefinitely).
+func tokenExpiry(verifier *JwtVerifier, jwt *JWTResponse) (int64, int64, error) {
+	valid, stdClaims, _, err := verifier.VerifyToken(jwt.JWT)
 	if !valid {
-		return 0, fmt.Errorf("JWT is invalid. Err: '%+v'", err)
+		return 0, 0, fmt.Errorf("JWT is invalid. Err: '%+v'", err)
+	}
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad JWT: %s", err)
+	}
+
+	exp := stdClaims.ExpiresAt
+	if jwt.ExpiresAt > 0 && (exp == 0 || jwt.ExpiresAt < exp) {
+		exp = jwt.ExpiresAt
+	}
+
+	// Tokens that can be refreshed need to outlive their JWT; they expire
+	// together with their refresh token instead.
+	expireAt := exp
+	if jwt.RefreshToken != "" {
+		expireAt = jwt.RefreshExpiresAt
+	}
+
+	return exp, expireAt, nil
+}
+
+func (s *RedisTokenStore) SetToken(token string, jwt *JWTResponse) (int64, error) {
+	exp, expireAt, err := tokenExpiry(s.verifier, jwt)
+	if err != nil {
+		return 0, err
+	}
+
+	id := tokenKey(token)
+
+	encryptedJwt, err := s.cipher.Encrypt(jwt.JWT, id)
+	if err != nil {
+		return 0, err
 	}
 
+	encryptedRefreshToken, err := s.cipher.Encrypt(jwt.RefreshToken, id)
 	if err != nil {
-		return 0, fmt.Errorf("bad JWT: %s", err)
+		return 0, err
 	}
 
-	key := "token_" + token
+	key := s.prefix + "token_" + id
 
 	conn := s.redisPool.Get()
 	defer conn.Close()
 
-	_, err = conn.Do("HMSET", key, "jwt", jwt.JWT, "token", token, "applications", strings.Join(jwt.AllowedApplications, ";"))
+	_, err = conn.Do(
+		"HMSET", key,
+		"jwt", encryptedJwt,
+		"applications", strings.Join(jwt.AllowedApplications, ";"),
+		"refresh_token", encryptedRefreshToken,
+		"refresh_expires", jwt.RefreshExpiresAt,
+		"expires", jwt.ExpiresAt,
+		"expire_at", expireAt,
+	)
 	if err != nil {
 		return 0, err
 	}
 
-	if stdClaims.ExpiresAt > 0 {
-		_, err = conn.Do("EXPIREAT", key, stdClaims.ExpiresAt)
+	expireAt = s.sessions.expiry(expireAt)
+	if expireAt > 0 {
+		_, err = conn.Do("EXPIREAT", key, expireAt)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		_, err = conn.Do("PERSIST", key)
 		if err != nil {
 			return 0, err
 		}
 	}
 
-	return stdClaims.ExpiresAt, nil
+	// mappings written by earlier versions are keyed by the token itself;
+	// they are replaced by the new mapping
+	if _, err := conn.Do("DEL", s.prefix+"token_"+token); err != nil {
+		return 0, err
+	}
+
+	return exp, nil
 }
 
-func (s *RedisTokenStore) AddToken(jwt *JWTResponse) (string, int64, error) {
+// escapeGlob escapes the special characters of Redis glob-style patterns.
+func escapeGlob(s string) string {
+	var escaped strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+func generateTokenString() (string, error) {
 	randomBytes := make([]byte, 32)
 
 	_, err := rand.Read(randomBytes)
 	if err != nil {
-		return "", 0, err
+		return "", err
 	}
 
-	tokenStr := base32.StdEncoding.EncodeToString(randomBytes)
+	return base32.StdEncoding.EncodeToString(randomBytes), nil
+}
+
+// tokenKey returns the key under which a token or refresh token is stored.
+// Stores only keep the SHA-256 hash of tokens, so that a dump of the store
+// (or a listing of its keys) does not contain any usable tokens. Since
+// tokens are random 256-bit values, the hash cannot be reversed.
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *RedisTokenStore) AddToken(jwt *JWTResponse) (string, int64, error) {
+	tokenStr, err := generateTokenString()
+	if err != nil {
+		return "", 0, err
+	}
 
 	exp, err := s.SetToken(tokenStr, jwt)
 	if err != nil {
@@ -114,44 +403,107 @@ func (s *RedisTokenStore) GetToken(token string) (*JWTResponse, error) {
 	conn := s.redisPool.Get()
 	defer conn.Close()
 
-	key := "token_" + token
+	response, err := s.loadToken(conn, tokenKey(token))
+	if err == NoTokenError {
+		// mappings written by earlier versions are keyed by the token itself
+		response, err = s.loadToken(conn, token)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	response.Token = token
+	return response, nil
+}
+
+// loadToken reads the mapping stored under the given ID. Its values are
+// encrypted for the ID.
+func (s *RedisTokenStore) loadToken(conn redis.Conn, id string) (*JWTResponse, error) {
+	key := s.prefix + "token_" + id
 	response := JWTResponse{}
 
-	results, err := redis.Strings(conn.Do("HMGET", key, "jwt", "applications"))
+	results, err := redis.Strings(conn.Do("HMGET", key, "jwt", "applications", "refresh_token", "refresh_expires", "expires"))
 	if err == redis.ErrNil {
 		return nil, NoTokenError
 	} else if err != nil {
 		return nil, err
+	} else if results[0] == "" {
+		return nil, NoTokenError
+	}
+
+	response.JWT, err = s.cipher.Decrypt(results[0], id)
+	if err != nil {
+		return nil, err
 	}
 
-	response.JWT = results[0]
 	if results[1] != "" {
 		response.AllowedApplications = strings.Split(results[1], ";")
 	}
 
+	response.RefreshToken, err = s.cipher.Decrypt(results[2], id)
+	if err != nil {
+		return nil, err
+	}
+	if results[3] != "" {
+		response.RefreshExpiresAt, _ = strconv.ParseInt(results[3], 10, 64)
+	}
+	if results[4] != "" {
+		response.ExpiresAt, _ = strconv.ParseInt(results[4], 10, 64)
+	}
+
 	return &response, nil
 }
 
-func (s *RedisTokenStore) GetAllTokens() (<-chan MappedToken, error) {
+func (s *RedisTokenStore) RemoveToken(token string) error {
+	if err := s.RemoveTokenByID(tokenKey(token)); err != nil {
+		return err
+	}
+
+	return s.RemoveTokenByID(token)
+}
+
+func (s *RedisTokenStore) RemoveTokenByID(id string) error {
 	conn := s.redisPool.Get()
+	defer conn.Close()
 
-	keys, err := redis.Strings(conn.Do("KEYS", "token_*"))
+	_, err := conn.Do("DEL", s.prefix+"token_"+id)
+	return err
+}
+
+func (s *RedisTokenStore) GetAllTokens() (<-chan MappedToken, error) {
+	keys, err := redisconn.Keys(s.redisPool, escapeGlob(s.prefix)+"token_*")
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
 
 	c := make(chan MappedToken)
 	if len(keys) == 0 {
 		close(c)
-		conn.Close()
 		return c, nil
 	}
 
+	conn := s.redisPool.Get()
+	prefix := s.prefix + "token_"
+
 	go func() {
 		for _, key := range keys {
 			values, _ := redis.StringMap(conn.Do("HGETALL", key))
-			c <- MappedToken{Jwt: values["jwt"], Token: values["token"]}
+
+			id := strings.TrimPrefix(key, prefix)
+			jwt, err := s.cipher.Decrypt(values["jwt"], id)
+			if err != nil {
+				continue
+			}
+
+			// only mappings written by earlier versions contain the token
+			mapped := MappedToken{Jwt: jwt, ID: id, Token: values["token"]}
+			if values["applications"] != "" {
+				mapped.Applications = strings.Split(values["applications"], ";")
+			}
+			mapped.ExpireAt, _ = strconv.ParseInt(values["expire_at"], 10, 64)
+
+			c <- mapped
 		}
 
 		conn.Close()
@@ -161,13 +513,208 @@ func (s *RedisTokenStore) GetAllTokens() (<-chan MappedToken, error) {
 	return c, nil
 }
 
+// AddRefreshToken issues a new refresh token for the given (opaque) token.
+// The refresh token expires at the given unix timestamp (or never, if 0).
+func (s *RedisTokenStore) AddRefreshToken(token string, exp int64) (string, error) {
+	refreshToken, err := generateTokenString()
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.RestoreRefreshToken(refreshToken, token, exp); err != nil {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+// RestoreRefreshToken stores a refresh token that was taken from the store
+// again, if it could not be used because of a temporary error.
+func (s *RedisTokenStore) RestoreRefreshToken(refreshToken string, token string, exp int64) error {
+	id := tokenKey(refreshToken)
+	key := s.prefix + "refresh_" + id
+
+	value, err := s.cipher.Encrypt(token, id)
+	if err != nil {
+		return err
+	}
+
+	conn := s.redisPool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("SET", key, value)
+	if err != nil {
+		return err
+	}
+
+	if exp > 0 {
+		_, err = conn.Do("EXPIREAT", key, exp)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// takeScript removes a key and returns its value. Unlike GETDEL, it works
+// with Redis versions before 6.2.
+var takeScript = redis.NewScript(1, `
+local value = redis.call("GET", KEYS[1])
+if value then
+	redis.call("DEL", KEYS[1])
+end
+return value
+`)
+
+// TakeRefreshToken returns the (opaque) token that a refresh token was issued
+// for and removes the refresh token. This happens atomically, so that a
+// refresh token can only be used once, even by concurrent requests.
+func (s *RedisTokenStore) TakeRefreshToken(refreshToken string) (string, error) {
+	conn := s.redisPool.Get()
+	defer conn.Close()
+
+	id := tokenKey(refreshToken)
+
+	value, err := redis.String(takeScript.Do(conn, s.prefix+"refresh_"+id))
+	if err == redis.ErrNil {
+		// refresh tokens issued by earlier versions are keyed by the
+		// refresh token itself, and hold the token unencrypted
+		value, err = redis.String(takeScript.Do(conn, s.prefix+"refresh_"+refreshToken))
+		id = refreshToken
+	}
+
+	if err == redis.ErrNil {
+		return "", NoTokenError
+	} else if err != nil {
+		return "", err
+	}
+
+	return s.cipher.Decrypt(value, id)
+}
+
+func (s *RedisTokenStore) RemoveRefreshToken(refreshToken string) error {
+	conn := s.redisPool.Get()
+	defer conn.Close()
+
+	for _, id := range []string{tokenKey(refreshToken), refreshToken} {
+		if _, err := conn.Do("DEL", s.prefix+"refresh_"+id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *RedisTokenStore) AddPendingAuthentication(pending *PendingAuthentication) (string, error) {
+	id, err := generateTokenString()
+	if err != nil {
+		return "", err
+	}
+
+	value, err := json.Marshal(pending)
+	if err != nil {
+		return "", err
+	}
+
+	conn := s.redisPool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("SET", s.prefix+"mfa_"+id, value, "EX", int(pendingAuthenticationTtl.Seconds()))
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// TakePendingAuthentication returns a pending authentication and removes it
+// atomically, so that each challenge can only be answered once, even by
+// concurrent requests.
+func (s *RedisTokenStore) TakePendingAuthentication(id string) (*PendingAuthentication, error) {
+	conn := s.redisPool.Get()
+	defer conn.Close()
+
+	value, err := redis.Bytes(takeScript.Do(conn, s.prefix+"mfa_"+id))
+	if err == redis.ErrNil {
+		return nil, NoTokenError
+	} else if err != nil {
+		return nil, err
+	}
+
+	pending := PendingAuthentication{}
+	if err := json.Unmarshal(value, &pending); err != nil {
+		return nil, err
+	}
+
+	return &pending, nil
+}
+
+// RevokeToken adds a token ID ("jti" claim) to the revocation list. The entry
+// can be removed once the token has expired at the given unix timestamp (it
+// is kept indefinitely if 0).
+func (s *RedisTokenStore) RevokeToken(jti string, exp int64) error {
+	key := s.prefix + "revoked_" + jti
+
+	conn := s.redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", key, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	if exp > 0 {
+		_, err = conn.Do("EXPIREAT", key, exp)
+	}
+
+	return err
+}
+
+func (s *RedisTokenStore) IsTokenRevoked(jti string) (bool, error) {
+	conn := s.redisPool.Get()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("EXISTS", s.prefix+"revoked_"+jti))
+}
+
+// TouchToken extends the expiration of an idle session. It returns a
+// NoTokenError if the session has already expired.
+func (s *RedisTokenStore) TouchToken(token string) error {
+	if !s.sessions.needsTouch(token) {
+		return nil
+	}
+
+	conn := s.redisPool.Get()
+	defer conn.Close()
+
+	// mappings written by earlier versions are keyed by the token itself
+	for _, id := range []string{tokenKey(token), token} {
+		key := s.prefix + "token_" + id
+
+		values, err := redis.Strings(conn.Do("HMGET", key, "jwt", "expire_at"))
+		if err != nil {
+			return err
+		} else if values[0] == "" {
+			continue
+		}
+
+		expireAt, _ := strconv.ParseInt(values[1], 10, 64)
+
+		_, err = conn.Do("EXPIREAT", key, s.sessions.expiry(expireAt))
+		return err
+	}
+
+	return NoTokenError
+}
+
 func (s *CacheDecorator) SetToken(token string, jwt *JWTResponse) (int64, error) {
 	exp, err := s.wrapped.SetToken(token, jwt)
 	if err != nil {
 		return 0, err
 	}
 
-	s.localCache.Add(token, &CacheRecord{token: jwt, exp: exp})
+	s.addToCache(token, jwt, exp)
 	return exp, nil
 }
 
@@ -177,18 +724,30 @@ func (s *CacheDecorator) AddToken(jwt *JWTResponse) (string, int64, error) {
 		return "", 0, err
 	}
 
-	s.localCache.Add(token, &CacheRecord{token: jwt, exp: exp})
+	s.addToCache(token, jwt, exp)
 	return token, exp, nil
 }
 
+func (s *CacheDecorator) addToCache(token string, jwt *JWTResponse, exp int64) {
+	record := *jwt
+	record.Token = token
+
+	s.localCache.Add(tokenKey(token), &CacheRecord{token: &record, exp: exp, cachedAt: time.Now()})
+}
+
 func (s *CacheDecorator) GetToken(token string) (*JWTResponse, error) {
-	jwt, ok := s.localCache.Get(token)
+	id := tokenKey(token)
+
+	jwt, ok := s.localCache.Get(id)
 	if ok {
 		switch t := jwt.(type) {
 		case string:
 			return &JWTResponse{JWT: t}, nil
 		case *CacheRecord:
-			return t.token, nil
+			if time.Since(t.cachedAt) < localCacheTtl {
+				return t.token, nil
+			}
+			s.localCache.Remove(id)
 		default:
 			return nil, fmt.Errorf("invalid data type for token %s", token)
 		}
@@ -197,6 +756,57 @@ func (s *CacheDecorator) GetToken(token string) (*JWTResponse, error) {
 	return s.wrapped.GetToken(token)
 }
 
+func (s *CacheDecorator) RemoveToken(token string) error {
+	s.localCache.Remove(tokenKey(token))
+	return s.wrapped.RemoveToken(token)
+}
+
+func (s *CacheDecorator) RemoveTokenByID(id string) error {
+	s.localCache.Remove(id)
+	return s.wrapped.RemoveTokenByID(id)
+}
+
 func (s *CacheDecorator) GetAllTokens() (<-chan MappedToken, error) {
 	return s.wrapped.GetAllTokens()
 }
+
+func (s *CacheDecorator) AddRefreshToken(token string, exp int64) (string, error) {
+	return s.wrapped.AddRefreshToken(token, exp)
+}
+
+func (s *CacheDecorator) TakeRefreshToken(refreshToken string) (string, error) {
+	return s.wrapped.TakeRefreshToken(refreshToken)
+}
+
+func (s *CacheDecorator) RestoreRefreshToken(refreshToken string, token string, exp int64) error {
+	return s.wrapped.RestoreRefreshToken(refreshToken, token, exp)
+}
+
+func (s *CacheDecorator) RemoveRefreshToken(refreshToken string) error {
+	return s.wrapped.RemoveRefreshToken(refreshToken)
+}
+
+func (s *CacheDecorator) AddPendingAuthentication(pending *PendingAuthentication) (string, error) {
+	return s.wrapped.AddPendingAuthentication(pending)
+}
+
+func (s *CacheDecorator) TakePendingAuthentication(id string) (*PendingAuthentication, error) {
+	return s.wrapped.TakePendingAuthentication(id)
+}
+
+func (s *CacheDecorator) RevokeToken(jti string, exp int64) error {
+	return s.wrapped.RevokeToken(jti, exp)
+}
+
+func (s *CacheDecorator) IsTokenRevoked(jti string) (bool, error) {
+	return s.wrapped.IsTokenRevoked(jti)
+}
+
+func (s *CacheDecorator) TouchToken(token string) error {
+	err := s.wrapped.TouchToken(token)
+	if err == NoTokenError {
+		s.localCache.Remove(tokenKey(token))
+	}
+
+	return err
+}
@@ -0,0 +1,414 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/mittwald/servicegateway/redisconn"
+	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DegradationOptions configure the fallback of a token store whose backend
+// is unavailable.
+type DegradationOptions struct {
+	RetryInterval time.Duration
+	FallbackSize  int
+	AcceptJwts    bool
+	Gauge         prometheus.Gauge
+	Logger        *logging.Logger
+
+	// FailOpen accepts tokens whose revocation cannot be checked while the
+	// backend is unavailable, instead of failing the check.
+	FailOpen bool
+}
+
+// TokenStoreUnavailableError is returned by operations that cannot be
+// performed safely while the backend of a token store is unavailable.
+var TokenStoreUnavailableError = errors.New("token store is unavailable")
+
+// DegradingTokenStore keeps the gateway operational while the backend of a
+// token store cannot be reached. In this degraded mode, tokens are stored in
+// a size-bounded in-process map (and revocations, refresh tokens and pending
+// authentications in a MemoryTokenStore); the backend is retried
+// periodically. Data written during the degraded mode is not synchronized to
+// the backend once it recovers.
+type DegradingTokenStore struct {
+	wrapped  TokenStore
+	verifier *JwtVerifier
+	options  DegradationOptions
+
+	tokens   *lru.Cache
+	fallback *MemoryTokenStore
+
+	degradedUntil time.Time
+	lock          sync.RWMutex
+}
+
+func NewDegradingTokenStore(wrapped TokenStore, verifier *JwtVerifier, options DegradationOptions) (*DegradingTokenStore, error) {
+	if options.FallbackSize == 0 {
+		options.FallbackSize = 1024
+	}
+
+	if options.RetryInterval == 0 {
+		options.RetryInterval = 10 * time.Second
+	}
+
+	tokens, err := lru.New(options.FallbackSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Gauge != nil {
+		options.Gauge.Set(0)
+	}
+
+	return &DegradingTokenStore{
+		wrapped:  wrapped,
+		verifier: verifier,
+		options:  options,
+		tokens:   tokens,
+		fallback: NewMemoryTokenStore(verifier, TokenStoreOptions{}),
+	}, nil
+}
+
+// Degraded reports whether the backend is currently considered unavailable.
+func (s *DegradingTokenStore) Degraded() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return time.Now().Before(s.degradedUntil)
+}
+
+// available reports whether an operation should be tried on the backend.
+// Once the retry interval has passed, the next operation is used to probe
+// the backend again.
+func (s *DegradingTokenStore) available() bool {
+	return !s.Degraded()
+}
+
+// unavailable reports whether an error returned by the backend indicates
+// that it cannot be reached, and enters the degraded mode if so. Only
+// network and connection errors count; other errors (like those reported by
+// Redis itself, or tokens that cannot be decrypted) are returned, so that
+// checks like the revocation of tokens do not fail open.
+func (s *DegradingTokenStore) unavailable(err error) bool {
+	if err == nil || err == NoTokenError {
+		s.recover()
+		return false
+	}
+
+	if !redisconn.IsUnavailable(err) {
+		return false
+	}
+
+	s.lock.Lock()
+	wasDegraded := !s.degradedUntil.IsZero()
+	s.degradedUntil = time.Now().Add(s.options.RetryInterval)
+	s.lock.Unlock()
+
+	if !wasDegraded {
+		s.options.Logger.Warningf("token store is unavailable; switching to degraded mode: %s", err)
+		if s.options.Gauge != nil {
+			s.options.Gauge.Set(1)
+		}
+	}
+
+	return true
+}
+
+func (s *DegradingTokenStore) recover() {
+	s.lock.RLock()
+	degraded := !s.degradedUntil.IsZero()
+	s.lock.RUnlock()
+
+	if !degraded {
+		return
+	}
+
+	s.lock.Lock()
+	wasDegraded := !s.degradedUntil.IsZero()
+	s.degradedUntil = time.Time{}
+	s.lock.Unlock()
+
+	if wasDegraded {
+		s.options.Logger.Noticef("token store is available again; leaving degraded mode")
+		if s.options.Gauge != nil {
+			s.options.Gauge.Set(0)
+		}
+	}
+}
+
+func (s *DegradingTokenStore) SetToken(token string, jwt *JWTResponse) (int64, error) {
+	if s.available() {
+		exp, err := s.wrapped.SetToken(token, jwt)
+		if !s.unavailable(err) {
+			return exp, err
+		}
+	}
+
+	return s.setFallbackToken(token, jwt)
+}
+
+func (s *DegradingTokenStore) setFallbackToken(token string, jwt *JWTResponse) (int64, error) {
+	exp, expireAt, err := tokenExpiry(s.verifier, jwt)
+	if err != nil {
+		return 0, err
+	}
+
+	record := memoryToken{response: *jwt, expireAt: expireAt}
+	record.response.Token = token
+
+	s.tokens.Add(tokenKey(token), &record)
+	return exp, nil
+}
+
+func (s *DegradingTokenStore) AddToken(jwt *JWTResponse) (string, int64, error) {
+	if s.available() {
+		token, exp, err := s.wrapped.AddToken(jwt)
+		if !s.unavailable(err) {
+			return token, exp, err
+		}
+	}
+
+	token, err := generateTokenString()
+	if err != nil {
+		return "", 0, err
+	}
+
+	exp, err := s.setFallbackToken(token, jwt)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return token, exp, nil
+}
+
+// fallbackToken looks up a token that was stored during the degraded mode,
+// by its ID.
+func (s *DegradingTokenStore) fallbackToken(id string) (*memoryToken, bool) {
+	record, ok := s.tokens.Get(id)
+	if !ok {
+		return nil, false
+	}
+
+	t := record.(*memoryToken)
+	if t.expireAt > 0 && t.expireAt < time.Now().Unix() {
+		s.tokens.Remove(id)
+		return nil, false
+	}
+
+	return t, true
+}
+
+func (s *DegradingTokenStore) GetToken(token string) (*JWTResponse, error) {
+	if s.available() {
+		response, err := s.wrapped.GetToken(token)
+		if err == nil {
+			return response, nil
+		} else if !s.unavailable(err) && err != NoTokenError {
+			return nil, err
+		}
+	}
+
+	// tokens issued during an earlier degradation are still valid
+	if record, ok := s.fallbackToken(tokenKey(token)); ok {
+		response := record.response
+		return &response, nil
+	}
+
+	if !s.Degraded() || !s.options.AcceptJwts || strings.Count(token, ".") != 2 {
+		return nil, NoTokenError
+	}
+
+	// clients may present the raw JWT instead of the unknown token; the JWT
+	// is verified before it is accepted
+	if _, err := s.setFallbackToken(token, &JWTResponse{JWT: token}); err != nil {
+		return nil, NoTokenError
+	}
+
+	return &JWTResponse{JWT: token, Token: token}, nil
+}
+
+// RemoveToken removes a token from the backend and the local fallback.
+// Tokens that were issued during the degraded mode only exist locally; other
+// tokens cannot be removed while the backend is unavailable, since they would
+// be valid again once it recovers.
+func (s *DegradingTokenStore) RemoveToken(token string) error {
+	return s.removeToken(tokenKey(token), func() error {
+		return s.wrapped.RemoveToken(token)
+	})
+}
+
+func (s *DegradingTokenStore) RemoveTokenByID(id string) error {
+	return s.removeToken(id, func() error {
+		return s.wrapped.RemoveTokenByID(id)
+	})
+}
+
+func (s *DegradingTokenStore) removeToken(id string, remove func() error) error {
+	_, local := s.fallbackToken(id)
+	s.tokens.Remove(id)
+
+	if s.available() {
+		if err := remove(); !s.unavailable(err) {
+			return err
+		}
+	}
+
+	if local {
+		return nil
+	}
+
+	return TokenStoreUnavailableError
+}
+
+func (s *DegradingTokenStore) GetAllTokens() (<-chan MappedToken, error) {
+	if s.available() {
+		tokens, err := s.wrapped.GetAllTokens()
+		if !s.unavailable(err) {
+			return tokens, err
+		}
+	}
+
+	keys := s.tokens.Keys()
+	c := make(chan MappedToken)
+
+	go func() {
+		for _, key := range keys {
+			if record, ok := s.fallbackToken(key.(string)); ok {
+				c <- MappedToken{
+					Jwt:          record.response.JWT,
+					ID:           key.(string),
+					Token:        record.response.Token,
+					Applications: record.response.AllowedApplications,
+					ExpireAt:     record.expireAt,
+				}
+			}
+		}
+
+		close(c)
+	}()
+
+	return c, nil
+}
+
+func (s *DegradingTokenStore) AddRefreshToken(token string, exp int64) (string, error) {
+	if s.available() {
+		refreshToken, err := s.wrapped.AddRefreshToken(token, exp)
+		if !s.unavailable(err) {
+			return refreshToken, err
+		}
+	}
+
+	return s.fallback.AddRefreshToken(token, exp)
+}
+
+func (s *DegradingTokenStore) TakeRefreshToken(refreshToken string) (string, error) {
+	if s.available() {
+		token, err := s.wrapped.TakeRefreshToken(refreshToken)
+		if err != NoTokenError && !s.unavailable(err) {
+			return token, err
+		}
+	}
+
+	return s.fallback.TakeRefreshToken(refreshToken)
+}
+
+func (s *DegradingTokenStore) RestoreRefreshToken(refreshToken string, token string, exp int64) error {
+	if s.available() {
+		err := s.wrapped.RestoreRefreshToken(refreshToken, token, exp)
+		if !s.unavailable(err) {
+			return err
+		}
+	}
+
+	return s.fallback.RestoreRefreshToken(refreshToken, token, exp)
+}
+
+func (s *DegradingTokenStore) RemoveRefreshToken(refreshToken string) error {
+	_ = s.fallback.RemoveRefreshToken(refreshToken)
+
+	if s.available() {
+		if err := s.wrapped.RemoveRefreshToken(refreshToken); !s.unavailable(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *DegradingTokenStore) AddPendingAuthentication(pending *PendingAuthentication) (string, error) {
+	if s.available() {
+		id, err := s.wrapped.AddPendingAuthentication(pending)
+		if !s.unavailable(err) {
+			return id, err
+		}
+	}
+
+	return s.fallback.AddPendingAuthentication(pending)
+}
+
+func (s *DegradingTokenStore) TakePendingAuthentication(id string) (*PendingAuthentication, error) {
+	if s.available() {
+		pending, err := s.wrapped.TakePendingAuthentication(id)
+		if err != NoTokenError && !s.unavailable(err) {
+			return pending, err
+		}
+	}
+
+	return s.fallback.TakePendingAuthentication(id)
+}
+
+func (s *DegradingTokenStore) RevokeToken(jti string, exp int64) error {
+	if s.available() {
+		if err := s.wrapped.RevokeToken(jti, exp); !s.unavailable(err) {
+			return err
+		}
+	}
+
+	return s.fallback.RevokeToken(jti, exp)
+}
+
+// IsTokenRevoked checks the revocation list of the backend, and the
+// revocations made during the degraded mode. While the backend is
+// unavailable, the check fails unless the store is configured to fail open,
+// since tokens may have been revoked on another gateway instance.
+func (s *DegradingTokenStore) IsTokenRevoked(jti string) (bool, error) {
+	// tokens revoked during an earlier degradation stay revoked
+	if revoked, _ := s.fallback.IsTokenRevoked(jti); revoked {
+		return true, nil
+	}
+
+	if s.available() {
+		revoked, err := s.wrapped.IsTokenRevoked(jti)
+		if !s.unavailable(err) {
+			return revoked, err
+		}
+	}
+
+	if s.options.FailOpen {
+		return false, nil
+	}
+
+	return false, TokenStoreUnavailableError
+}
+
+func (s *DegradingTokenStore) TouchToken(token string) error {
+	if _, ok := s.fallbackToken(tokenKey(token)); ok {
+		return nil
+	}
+
+	if s.available() {
+		if err := s.wrapped.TouchToken(token); !s.unavailable(err) {
+			return err
+		}
+	}
+
+	// sessions cannot be tracked while the backend is unavailable; the
+	// token has already been found in the local cache
+	return nil
+}
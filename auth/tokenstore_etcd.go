@@ -0,0 +1,337 @@
+package auth
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/etcd"
+)
+
+// EtcdTokenStore stores tokens in an etcd cluster. Expiration is implemented
+// using etcd leases.
+type EtcdTokenStore struct {
+	client   *etcd.Client
+	prefix   string
+	verifier *JwtVerifier
+	sessions *sessionToucher
+	cipher   *TokenCipher
+}
+
+type etcdTokenRecord struct {
+	Jwt            string   `json:"jwt"`
+	Applications   []string `json:"applications,omitempty"`
+	RefreshToken   string   `json:"refresh_token,omitempty"`
+	RefreshExpires int64    `json:"refresh_expires,omitempty"`
+	Expires        int64    `json:"expires,omitempty"`
+	ExpireAt       int64    `json:"expire_at,omitempty"`
+}
+
+func NewEtcdTokenStore(cfg *config.EtcdConfiguration, verifier *JwtVerifier, options TokenStoreOptions) (*EtcdTokenStore, error) {
+	client, err := etcd.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = "/servicegateway"
+	}
+
+	return &EtcdTokenStore{
+		client:   client,
+		prefix:   strings.TrimRight(prefix, "/") + "/",
+		verifier: verifier,
+		sessions: newSessionToucher(options.IdleTimeout),
+		cipher:   options.Cipher,
+	}, nil
+}
+
+func etcdTTL(expireAt int64) time.Duration {
+	if expireAt <= 0 {
+		return 0
+	}
+
+	ttl := time.Until(time.Unix(expireAt, 0))
+	if ttl < time.Second {
+		return time.Second
+	}
+
+	return ttl
+}
+
+func (s *EtcdTokenStore) SetToken(token string, jwt *JWTResponse) (int64, error) {
+	exp, expireAt, err := tokenExpiry(s.verifier, jwt)
+	if err != nil {
+		return 0, err
+	}
+
+	id := tokenKey(token)
+
+	encryptedJwt, err := s.cipher.Encrypt(jwt.JWT, id)
+	if err != nil {
+		return 0, err
+	}
+
+	encryptedRefreshToken, err := s.cipher.Encrypt(jwt.RefreshToken, id)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := json.Marshal(&etcdTokenRecord{
+		Jwt:            encryptedJwt,
+		Applications:   jwt.AllowedApplications,
+		RefreshToken:   encryptedRefreshToken,
+		RefreshExpires: jwt.RefreshExpiresAt,
+		Expires:        jwt.ExpiresAt,
+		ExpireAt:       expireAt,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.client.Put(s.prefix+"tokens/"+id, value, etcdTTL(s.sessions.expiry(expireAt))); err != nil {
+		return 0, err
+	}
+
+	// mappings written by earlier versions are keyed by the token itself;
+	// they are replaced by the new mapping
+	if err := s.client.Delete(s.prefix + "tokens/" + token); err != nil {
+		return 0, err
+	}
+
+	return exp, nil
+}
+
+func (s *EtcdTokenStore) AddToken(jwt *JWTResponse) (string, int64, error) {
+	tokenStr, err := generateTokenString()
+	if err != nil {
+		return "", 0, err
+	}
+
+	exp, err := s.SetToken(tokenStr, jwt)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return tokenStr, exp, nil
+}
+
+func (s *EtcdTokenStore) GetToken(token string) (*JWTResponse, error) {
+	id := tokenKey(token)
+
+	value, err := s.client.Get(s.prefix + "tokens/" + id)
+	if err == etcd.KeyNotFoundError {
+		// mappings written by earlier versions are keyed by the token itself
+		id = token
+		value, err = s.client.Get(s.prefix + "tokens/" + id)
+	}
+
+	if err == etcd.KeyNotFoundError {
+		return nil, NoTokenError
+	} else if err != nil {
+		return nil, err
+	}
+
+	record := etcdTokenRecord{}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	response := JWTResponse{
+		Token:               token,
+		AllowedApplications: record.Applications,
+		RefreshExpiresAt:    record.RefreshExpires,
+		ExpiresAt:           record.Expires,
+	}
+
+	if response.JWT, err = s.cipher.Decrypt(record.Jwt, id); err != nil {
+		return nil, err
+	}
+
+	if response.RefreshToken, err = s.cipher.Decrypt(record.RefreshToken, id); err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
+
+func (s *EtcdTokenStore) RemoveToken(token string) error {
+	if err := s.RemoveTokenByID(tokenKey(token)); err != nil {
+		return err
+	}
+
+	return s.RemoveTokenByID(token)
+}
+
+func (s *EtcdTokenStore) RemoveTokenByID(id string) error {
+	return s.client.Delete(s.prefix + "tokens/" + id)
+}
+
+// TouchToken extends the expiration of an idle session by re-writing it with
+// a new lease.
+func (s *EtcdTokenStore) TouchToken(token string) error {
+	if !s.sessions.needsTouch(token) {
+		return nil
+	}
+
+	key := s.prefix + "tokens/" + tokenKey(token)
+
+	value, err := s.client.Get(key)
+	if err == etcd.KeyNotFoundError {
+		// mappings written by earlier versions are keyed by the token itself
+		key = s.prefix + "tokens/" + token
+		value, err = s.client.Get(key)
+	}
+
+	if err == etcd.KeyNotFoundError {
+		return NoTokenError
+	} else if err != nil {
+		return err
+	}
+
+	record := etcdTokenRecord{}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return err
+	}
+
+	return s.client.Put(key, value, etcdTTL(s.sessions.expiry(record.ExpireAt)))
+}
+
+func (s *EtcdTokenStore) GetAllTokens() (<-chan MappedToken, error) {
+	prefix := s.prefix + "tokens/"
+
+	kvs, err := s.client.GetPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(chan MappedToken)
+
+	go func() {
+		for _, kv := range kvs {
+			record := etcdTokenRecord{}
+			_ = json.Unmarshal(kv.Value, &record)
+
+			id := strings.TrimPrefix(kv.Key, prefix)
+			jwt, err := s.cipher.Decrypt(record.Jwt, id)
+			if err != nil {
+				continue
+			}
+
+			c <- MappedToken{
+				Jwt:          jwt,
+				ID:           id,
+				Applications: record.Applications,
+				ExpireAt:     record.ExpireAt,
+			}
+		}
+
+		close(c)
+	}()
+
+	return c, nil
+}
+
+func (s *EtcdTokenStore) AddRefreshToken(token string, exp int64) (string, error) {
+	refreshToken, err := generateTokenString()
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.RestoreRefreshToken(refreshToken, token, exp); err != nil {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+func (s *EtcdTokenStore) RestoreRefreshToken(refreshToken string, token string, exp int64) error {
+	id := tokenKey(refreshToken)
+
+	value, err := s.cipher.Encrypt(token, id)
+	if err != nil {
+		return err
+	}
+
+	return s.client.Put(s.prefix+"refresh/"+id, []byte(value), etcdTTL(exp))
+}
+
+func (s *EtcdTokenStore) TakeRefreshToken(refreshToken string) (string, error) {
+	id := tokenKey(refreshToken)
+
+	value, err := s.client.Take(s.prefix + "refresh/" + id)
+	if err == etcd.KeyNotFoundError {
+		// refresh tokens issued by earlier versions are keyed by the
+		// refresh token itself, and hold the token unencrypted
+		id = refreshToken
+		value, err = s.client.Take(s.prefix + "refresh/" + id)
+	}
+
+	if err == etcd.KeyNotFoundError {
+		return "", NoTokenError
+	} else if err != nil {
+		return "", err
+	}
+
+	return s.cipher.Decrypt(string(value), id)
+}
+
+func (s *EtcdTokenStore) RemoveRefreshToken(refreshToken string) error {
+	if err := s.client.Delete(s.prefix + "refresh/" + tokenKey(refreshToken)); err != nil {
+		return err
+	}
+
+	return s.client.Delete(s.prefix + "refresh/" + refreshToken)
+}
+
+func (s *EtcdTokenStore) AddPendingAuthentication(pending *PendingAuthentication) (string, error) {
+	id, err := generateTokenString()
+	if err != nil {
+		return "", err
+	}
+
+	value, err := json.Marshal(pending)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.client.Put(s.prefix+"mfa/"+id, value, pendingAuthenticationTtl); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (s *EtcdTokenStore) TakePendingAuthentication(id string) (*PendingAuthentication, error) {
+	value, err := s.client.Take(s.prefix + "mfa/" + id)
+	if err == etcd.KeyNotFoundError {
+		return nil, NoTokenError
+	} else if err != nil {
+		return nil, err
+	}
+
+	pending := PendingAuthentication{}
+	if err := json.Unmarshal(value, &pending); err != nil {
+		return nil, err
+	}
+
+	return &pending, nil
+}
+
+func (s *EtcdTokenStore) RevokeToken(jti string, exp int64) error {
+	return s.client.Put(s.prefix+"revoked/"+jti, []byte(strconv.FormatInt(time.Now().Unix(), 10)), etcdTTL(exp))
+}
+
+func (s *EtcdTokenStore) IsTokenRevoked(jti string) (bool, error) {
+	_, err := s.client.Get(s.prefix + "revoked/" + jti)
+	if err == etcd.KeyNotFoundError {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
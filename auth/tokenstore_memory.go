@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// MemoryTokenStore keeps all tokens in process memory. Tokens are lost on
+// restart and are not shared between multiple gateway instances, so this
+// store is mostly useful for single-instance setups and development.
+type MemoryTokenStore struct {
+	tokens        *cache.Cache
+	refreshTokens *cache.Cache
+	takeLock      sync.Mutex
+	pending       *cache.Cache
+	revoked       *cache.Cache
+	verifier      *JwtVerifier
+	sessions      *sessionToucher
+}
+
+type memoryToken struct {
+	response JWTResponse
+	expireAt int64
+}
+
+func NewMemoryTokenStore(verifier *JwtVerifier, options TokenStoreOptions) *MemoryTokenStore {
+	return &MemoryTokenStore{
+		tokens:        cache.New(cache.NoExpiration, time.Minute),
+		refreshTokens: cache.New(cache.NoExpiration, time.Minute),
+		pending:       cache.New(pendingAuthenticationTtl, time.Minute),
+		revoked:       cache.New(cache.NoExpiration, time.Minute),
+		verifier:      verifier,
+		sessions:      &sessionToucher{idleTimeout: options.IdleTimeout},
+	}
+}
+
+func ttlUntil(expireAt int64) time.Duration {
+	if expireAt <= 0 {
+		return cache.NoExpiration
+	}
+
+	ttl := time.Until(time.Unix(expireAt, 0))
+	if ttl <= 0 {
+		// a non-positive TTL would be interpreted as "no expiration"
+		return time.Nanosecond
+	}
+
+	return ttl
+}
+
+func (s *MemoryTokenStore) SetToken(token string, jwt *JWTResponse) (int64, error) {
+	exp, expireAt, err := tokenExpiry(s.verifier, jwt)
+	if err != nil {
+		return 0, err
+	}
+
+	record := memoryToken{response: *jwt, expireAt: expireAt}
+	record.response.Token = token
+
+	s.tokens.Set(tokenKey(token), &record, ttlUntil(s.sessions.expiry(expireAt)))
+	return exp, nil
+}
+
+func (s *MemoryTokenStore) AddToken(jwt *JWTResponse) (string, int64, error) {
+	tokenStr, err := generateTokenString()
+	if err != nil {
+		return "", 0, err
+	}
+
+	exp, err := s.SetToken(tokenStr, jwt)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return tokenStr, exp, nil
+}
+
+func (s *MemoryTokenStore) GetToken(token string) (*JWTResponse, error) {
+	record, ok := s.tokens.Get(tokenKey(token))
+	if !ok {
+		return nil, NoTokenError
+	}
+
+	response := record.(*memoryToken).response
+	return &response, nil
+}
+
+func (s *MemoryTokenStore) RemoveToken(token string) error {
+	return s.RemoveTokenByID(tokenKey(token))
+}
+
+func (s *MemoryTokenStore) RemoveTokenByID(id string) error {
+	s.tokens.Delete(id)
+	return nil
+}
+
+func (s *MemoryTokenStore) TouchToken(token string) error {
+	if s.sessions.idleTimeout == 0 {
+		return nil
+	}
+
+	id := tokenKey(token)
+
+	record, ok := s.tokens.Get(id)
+	if !ok {
+		return NoTokenError
+	}
+
+	s.tokens.Set(id, record, ttlUntil(s.sessions.expiry(record.(*memoryToken).expireAt)))
+	return nil
+}
+
+func (s *MemoryTokenStore) GetAllTokens() (<-chan MappedToken, error) {
+	items := s.tokens.Items()
+	c := make(chan MappedToken)
+
+	go func() {
+		for id, item := range items {
+			record := item.Object.(*memoryToken)
+			c <- MappedToken{
+				Jwt:          record.response.JWT,
+				ID:           id,
+				Token:        record.response.Token,
+				Applications: record.response.AllowedApplications,
+				ExpireAt:     record.expireAt,
+			}
+		}
+
+		close(c)
+	}()
+
+	return c, nil
+}
+
+func (s *MemoryTokenStore) AddRefreshToken(token string, exp int64) (string, error) {
+	refreshToken, err := generateTokenString()
+	if err != nil {
+		return "", err
+	}
+
+	s.refreshTokens.Set(tokenKey(refreshToken), token, ttlUntil(exp))
+	return refreshToken, nil
+}
+
+func (s *MemoryTokenStore) RestoreRefreshToken(refreshToken string, token string, exp int64) error {
+	s.refreshTokens.Set(tokenKey(refreshToken), token, ttlUntil(exp))
+	return nil
+}
+
+func (s *MemoryTokenStore) TakeRefreshToken(refreshToken string) (string, error) {
+	s.takeLock.Lock()
+	defer s.takeLock.Unlock()
+
+	id := tokenKey(refreshToken)
+
+	token, ok := s.refreshTokens.Get(id)
+	if !ok {
+		return "", NoTokenError
+	}
+
+	s.refreshTokens.Delete(id)
+
+	return token.(string), nil
+}
+
+func (s *MemoryTokenStore) RemoveRefreshToken(refreshToken string) error {
+	s.refreshTokens.Delete(tokenKey(refreshToken))
+	return nil
+}
+
+func (s *MemoryTokenStore) AddPendingAuthentication(pending *PendingAuthentication) (string, error) {
+	id, err := generateTokenString()
+	if err != nil {
+		return "", err
+	}
+
+	s.pending.SetDefault(id, pending)
+	return id, nil
+}
+
+func (s *MemoryTokenStore) TakePendingAuthentication(id string) (*PendingAuthentication, error) {
+	s.takeLock.Lock()
+	defer s.takeLock.Unlock()
+
+	pending, ok := s.pending.Get(id)
+	if !ok {
+		return nil, NoTokenError
+	}
+
+	s.pending.Delete(id)
+	return pending.(*PendingAuthentication), nil
+}
+
+func (s *MemoryTokenStore) RevokeToken(jti string, exp int64) error {
+	s.revoked.Set(jti, true, ttlUntil(exp))
+	return nil
+}
+
+func (s *MemoryTokenStore) IsTokenRevoked(jti string) (bool, error) {
+	_, revoked := s.revoked.Get(jti)
+	return revoked, nil
+}
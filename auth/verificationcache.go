@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/mittwald/servicegateway/monitoring"
+)
+
+// verificationCache caches the results of JWT verifications, keyed by the
+// JWT. Its size is bounded; the least recently used JWTs are evicted first.
+// Entries are also indexed by token ID, so that they can be purged when a
+// token is revoked.
+type verificationCache struct {
+	cache   *lru.Cache
+	jtis    map[string]string
+	lock    sync.Mutex
+	metrics *monitoring.PromMetrics
+}
+
+func newVerificationCache(size int, metrics *monitoring.PromMetrics) (*verificationCache, error) {
+	if size == 0 {
+		size = 10000
+	}
+
+	c := verificationCache{
+		jtis:    make(map[string]string),
+		metrics: metrics,
+	}
+
+	cache, err := lru.NewWithEvict(size, c.removeFromIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	c.cache = cache
+	return &c, nil
+}
+
+// removeFromIndex is called by the LRU cache whenever an entry is evicted or
+// removed.
+func (c *verificationCache) removeFromIndex(key interface{}, value interface{}) {
+	jti := value.(*verifiedToken).jti
+	if jti == "" {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.jtis[jti] == key.(string) {
+		delete(c.jtis, jti)
+	}
+}
+
+func (c *verificationCache) Get(jwt string) (*verifiedToken, bool) {
+	value, ok := c.cache.Get(jwt)
+	if !ok {
+		if c.metrics != nil {
+			c.metrics.VerificationCacheMisses.Inc()
+		}
+		return nil, false
+	}
+
+	if c.metrics != nil {
+		c.metrics.VerificationCacheHits.Inc()
+	}
+
+	return value.(*verifiedToken), true
+}
+
+func (c *verificationCache) Set(jwt string, verified *verifiedToken) {
+	if verified.jti != "" {
+		c.lock.Lock()
+		c.jtis[verified.jti] = jwt
+		c.lock.Unlock()
+	}
+
+	if evicted := c.cache.Add(jwt, verified); evicted && c.metrics != nil {
+		c.metrics.VerificationCacheEvictions.Inc()
+	}
+}
+
+func (c *verificationCache) Delete(jwt string) {
+	c.cache.Remove(jwt)
+}
+
+// Invalidate purges the cached verification result of the JWT with the
+// given token ID.
+func (c *verificationCache) Invalidate(jti string) {
+	c.lock.Lock()
+	jwt, ok := c.jtis[jti]
+	c.lock.Unlock()
+
+	if ok {
+		c.cache.Remove(jwt)
+	}
+}
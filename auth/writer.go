@@ -4,6 +4,7 @@ import "net/http"
 
 type TokenWriter interface {
 	WriteTokenToRequest(string, *http.Request) error
+	RemoveTokenFromRequest(*http.Request)
 }
 
 type HeaderTokenWriter struct {
@@ -17,7 +18,15 @@ func (h *HeaderTokenWriter) WriteTokenToRequest(jwt string, req *http.Request) e
 	return nil
 }
 
+func (h *HeaderTokenWriter) RemoveTokenFromRequest(req *http.Request) {
+	req.Header.Del(h.HeaderName)
+}
+
 func (a *AuthorizationTokenWriter) WriteTokenToRequest(jwt string, req *http.Request) error {
 	req.Header.Set("Authorization", "Bearer "+jwt)
 	return nil
 }
+
+func (a *AuthorizationTokenWriter) RemoveTokenFromRequest(req *http.Request) {
+	req.Header.Del("Authorization")
+}
@@ -0,0 +1,356 @@
+package bots
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/clientip"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/statusrecorder"
+	"github.com/op/go-logging"
+)
+
+const (
+	ActionBlock  = "block"
+	ActionTarpit = "tarpit"
+	ActionLog    = "log"
+)
+
+// Rule is a compiled bot detection rule.
+type Rule struct {
+	Config  config.BotRule
+	Matches int64
+
+	userAgents []*regexp.Regexp
+	window     time.Duration
+	statuses   map[int]bool
+}
+
+// NewRule compiles a bot detection rule.
+func NewRule(cfg config.BotRule) (*Rule, error) {
+	r := Rule{Config: cfg, statuses: make(map[int]bool)}
+
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("bot detection rule has no name")
+	}
+
+	switch cfg.Action {
+	case ActionBlock, ActionTarpit, ActionLog:
+	default:
+		return nil, fmt.Errorf("unsupported action '%s' in bot detection rule %s", cfg.Action, cfg.Name)
+	}
+
+	if len(cfg.UserAgents) == 0 && cfg.Rate <= 0 {
+		return nil, fmt.Errorf("bot detection rule %s needs user agents or a rate", cfg.Name)
+	}
+
+	for _, pattern := range cfg.UserAgents {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user agent pattern '%s' in bot detection rule %s: %s", pattern, cfg.Name, err)
+		}
+		r.userAgents = append(r.userAgents, re)
+	}
+
+	if cfg.Rate > 0 {
+		window, err := time.ParseDuration(cfg.Window)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window of bot detection rule %s: %s", cfg.Name, err)
+		}
+		if window < time.Second {
+			return nil, fmt.Errorf("window of bot detection rule %s must be at least 1s", cfg.Name)
+		}
+		r.window = window
+	}
+
+	for _, status := range cfg.Statuses {
+		r.statuses[status] = true
+	}
+
+	return &r, nil
+}
+
+func (r *Rule) matchesAgent(req *http.Request) bool {
+	if len(r.userAgents) == 0 {
+		return true
+	}
+
+	userAgent := req.Header.Get("User-Agent")
+	for _, re := range r.userAgents {
+		if re.MatchString(userAgent) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Rule) counts(status int) bool {
+	return len(r.statuses) == 0 || r.statuses[status]
+}
+
+type counter struct {
+	count   int
+	resetAt time.Time
+}
+
+// Detector detects bots and scanners by their user agent and the shape of
+// their traffic. Request rates are counted per client address, in memory of
+// each gateway instance.
+type Detector struct {
+	rules  []*Rule
+	tarpit time.Duration
+	logger *logging.Logger
+
+	// tarpits limits the number of requests that are delayed at the same
+	// time, so that tarpitted clients cannot tie up the gateway's resources
+	tarpits chan struct{}
+
+	counters  map[string]*counter
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+func NewDetector(cfg *config.BotDetectionConfiguration, logger *logging.Logger) (*Detector, error) {
+	d := Detector{
+		tarpit:   10 * time.Second,
+		logger:   logger,
+		counters: make(map[string]*counter),
+	}
+
+	if cfg.TarpitDelay != "" {
+		delay, err := time.ParseDuration(cfg.TarpitDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tarpit delay: %s", err)
+		}
+		d.tarpit = delay
+	}
+
+	maxTarpits := cfg.MaxTarpits
+	if maxTarpits < 0 {
+		return nil, fmt.Errorf("max_tarpits must not be negative")
+	} else if maxTarpits == 0 {
+		maxTarpits = 100
+	}
+	d.tarpits = make(chan struct{}, maxTarpits)
+
+	for _, ruleCfg := range cfg.Rules {
+		rule, err := NewRule(ruleCfg)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := d.Rule(rule.Config.Name); ok {
+			return nil, fmt.Errorf("duplicate bot detection rule %s", rule.Config.Name)
+		}
+		d.rules = append(d.rules, rule)
+	}
+
+	return &d, nil
+}
+
+// Rules returns the rules in the order in which they are evaluated.
+func (d *Detector) Rules() []*Rule {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return append([]*Rule{}, d.rules...)
+}
+
+// Rule returns the rule with the given name.
+func (d *Detector) Rule(name string) (*Rule, bool) {
+	for _, rule := range d.Rules() {
+		if rule.Config.Name == name {
+			return rule, true
+		}
+	}
+
+	return nil, false
+}
+
+// SetRule replaces the rule with the same name, or adds the rule as the
+// last one.
+func (d *Detector) SetRule(rule *Rule) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	rules := make([]*Rule, 0, len(d.rules)+1)
+	replaced := false
+
+	for _, existing := range d.rules {
+		if existing.Config.Name == rule.Config.Name {
+			rules = append(rules, rule)
+			replaced = true
+		} else {
+			rules = append(rules, existing)
+		}
+	}
+
+	if !replaced {
+		rules = append(rules, rule)
+	}
+
+	d.rules = rules
+}
+
+// RemoveRule removes a rule, and reports whether it existed.
+func (d *Detector) RemoveRule(name string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for i, rule := range d.rules {
+		if rule.Config.Name == name {
+			d.rules = append(d.rules[:i:i], d.rules[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// exceeded checks whether a client sent more requests than a rule's rate
+// allows within the current window. Rules without a rate only depend on the
+// user agent.
+func (d *Detector) exceeded(rule *Rule, addr string) bool {
+	if rule.Config.Rate <= 0 {
+		return true
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c, ok := d.counters[rule.Config.Name+"|"+addr]
+	return ok && time.Now().Before(c.resetAt) && c.count >= rule.Config.Rate
+}
+
+// record counts a request of a client for the rate of a rule.
+func (d *Detector) record(rule *Rule, addr string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	d.sweep(now)
+
+	key := rule.Config.Name + "|" + addr
+	c, ok := d.counters[key]
+	if !ok || !now.Before(c.resetAt) {
+		c = &counter{resetAt: now.Add(rule.window)}
+		d.counters[key] = c
+	}
+
+	c.count++
+}
+
+// sweep removes the counters whose window has passed, at most once a minute.
+// The detector needs to be locked.
+func (d *Detector) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < time.Minute {
+		return
+	}
+
+	for key, c := range d.counters {
+		if !now.Before(c.resetAt) {
+			delete(d.counters, key)
+		}
+	}
+
+	d.lastSweep = now
+}
+
+// delay holds up a tarpitted request for the tarpit delay. Requests are
+// blocked instead while too many others are delayed, or when the client
+// gives up waiting.
+func (d *Detector) delay(req *http.Request) bool {
+	select {
+	case d.tarpits <- struct{}{}:
+	default:
+		return false
+	}
+
+	defer func() {
+		<-d.tarpits
+	}()
+
+	timer := time.NewTimer(d.tarpit)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+func block(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(403)
+	_, _ = rw.Write([]byte(`{"msg":"forbidden","reason":"request blocked by bot detection"}`))
+}
+
+// DecorateHandler applies the action of the first blocking or tarpitting
+// rule that a request matches; rules that only log do not stop the
+// evaluation. Detections are reported to the detected function.
+func (d *Detector) DecorateHandler(handler httprouter.Handle, detected func(rule string, action string)) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		addr := clientip.FromRequest(req)
+		rules := d.Rules()
+
+		var counted []*Rule
+		tarpit := false
+
+		for _, rule := range rules {
+			if !rule.matchesAgent(req) {
+				continue
+			}
+
+			if rule.Config.Rate > 0 {
+				counted = append(counted, rule)
+			}
+
+			if !d.exceeded(rule, addr) {
+				continue
+			}
+
+			atomic.AddInt64(&rule.Matches, 1)
+			detected(rule.Config.Name, rule.Config.Action)
+
+			if rule.Config.Action == ActionLog {
+				d.logger.Warningf("request from %s to %s matches bot detection rule %s", addr, req.URL.Path, rule.Config.Name)
+				continue
+			}
+
+			if rule.Config.Action == ActionBlock {
+				block(rw)
+				return
+			}
+
+			tarpit = true
+			break
+		}
+
+		if tarpit && !d.delay(req) {
+			block(rw)
+			return
+		}
+
+		if len(counted) == 0 {
+			handler(rw, req, params)
+			return
+		}
+
+		recorder := statusrecorder.New(rw)
+		handler(recorder, req, params)
+
+		for _, rule := range counted {
+			if rule.counts(recorder.Status()) {
+				d.record(rule, addr)
+			}
+		}
+	}
+}
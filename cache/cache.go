@@ -21,22 +21,68 @@ package cache
 
 import (
 	"bytes"
-	"fmt"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/bluele/gcache"
 	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/redisconn"
+	"github.com/op/go-logging"
 
 	"io/ioutil"
-	"net/http"
 )
 
 type CacheMiddleware interface {
-	DecorateHandler(handler httprouter.Handle) httprouter.Handle
-	DecorateUnsafeHandler(handler httprouter.Handle) httprouter.Handle
+	DecorateHandler(handler httprouter.Handle, appName string, cfg *config.Caching) (httprouter.Handle, error)
+	DecorateUnsafeHandler(handler httprouter.Handle, appName string) httprouter.Handle
+	Purge(selector Selector) (int, error)
 }
 
-type inMemoryCacheMiddleware struct {
-	cache gcache.Cache
+// Selector matches the cached responses that are purged together; those of
+// an application, those whose URL starts with a prefix, or those that were
+// tagged with a surrogate key. Responses have to match all criteria that
+// are set.
+type Selector struct {
+	Application  string
+	Prefix       string
+	SurrogateKey string
+}
+
+func (s Selector) matches(e *entry) bool {
+	if s.Application != "" && e.Application != s.Application {
+		return false
+	}
+
+	if s.Prefix != "" && !strings.HasPrefix(e.Path, s.Prefix) {
+		return false
+	}
+
+	if s.SurrogateKey == "" {
+		return true
+	}
+
+	for _, v := range e.Variants {
+		for _, key := range v.SurrogateKeys {
+			if key == s.SurrogateKey {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type cacheMiddleware struct {
+	store              store
+	maxBodySize        int64
+	surrogateKeyHeader string
+	refreshing         sync.Map
+	flights            flightGroup
+	logger             *logging.Logger
 }
 
 type ResponseBuffer struct {
@@ -85,72 +131,263 @@ func (r *ResponseBuffer) Dump(rw http.ResponseWriter) {
 	_, _ = rw.Write(r.body)
 }
 
-func NewCache(s int) CacheMiddleware {
-	c := new(inMemoryCacheMiddleware)
-	c.cache = gcache.New(s).LRU().Build()
-	return c
-}
+// NewCache builds the response cache. Responses are kept in memory, and
+// also in Redis if the Redis tier is enabled.
+func NewCache(cfg *config.CacheConfiguration, red redisconn.Source, logger *logging.Logger) CacheMiddleware {
+	size := cfg.Size
+	if size <= 0 {
+		size = 4096
+	}
 
-func (c *inMemoryCacheMiddleware) identifierForRequest(req *http.Request) string {
-	identifier := req.RequestURI
+	c := cacheMiddleware{
+		store:              newMemoryStore(size),
+		maxBodySize:        cfg.MaxBodySize,
+		surrogateKeyHeader: cfg.SurrogateKeyHeader,
+		logger:             logger,
+	}
+
+	if c.maxBodySize <= 0 {
+		c.maxBodySize = 1 << 20
+	}
+
+	if c.surrogateKeyHeader == "" {
+		c.surrogateKeyHeader = "Surrogate-Key"
+	}
 
-	if accept := req.Header.Get("Accept"); accept != "" {
-		identifier += "_" + accept
+	if cfg.Redis {
+		c.store = &tieredStore{
+			memory: c.store.(*memoryStore),
+			redis:  &redisStore{redisPool: red},
+			logger: logger,
+		}
 	}
 
-	return identifier
+	return &c
+}
+
+func (c *cacheMiddleware) keyForRequest(appName string, method string, req *http.Request) string {
+	return appName + " " + method + " " + req.Host + req.URL.RequestURI()
 }
 
-func (c *inMemoryCacheMiddleware) DecorateUnsafeHandler(handler httprouter.Handle) httprouter.Handle {
+func (c *cacheMiddleware) DecorateUnsafeHandler(handler httprouter.Handle, appName string) httprouter.Handle {
 	return func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
-		identifier := c.identifierForRequest(req)
-		c.cache.Remove(identifier)
+		keys := []string{c.keyForRequest(appName, http.MethodGet, req), c.keyForRequest(appName, http.MethodHead, req)}
+
+		// the responses cached for the user are purged as well
+		if user, _ := caller(req); user != "" {
+			keys = append(keys, keys[0]+" "+user, keys[1]+" "+user)
+		}
+
+		err := c.store.remove(keys...)
+		if err != nil {
+			c.logger.Warningf("error while purging cached responses: %s", err)
+		}
+
 		rw.Header().Add("X-Cache", "PURGED")
 		handler(rw, req, p)
 	}
 }
 
-func (c *inMemoryCacheMiddleware) DecorateHandler(handler httprouter.Handle) httprouter.Handle {
-	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
-		identifier := c.identifierForRequest(req)
+func (c *cacheMiddleware) DecorateHandler(handler httprouter.Handle, appName string, cfg *config.Caching) (httprouter.Handle, error) {
+	policy, err := NewPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-		useCache := true
-		if req.Header.Get("Cache-Control") == "no-cache" {
-			useCache = false
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			handler(rw, req, params)
+			return
 		}
 
-		entry, err := c.cache.Get(identifier)
-		if !useCache || err == gcache.KeyNotFoundError {
-			buf := NewResponseBuffer()
+		if policy.bypass(req) {
+			rw.Header().Add("X-Cache", "PASS")
+			handler(rw, req, params)
+			return
+		}
 
-			handler(buf, req, params)
-			buf.Complete()
+		now := time.Now()
+		key := c.keyForRequest(appName, req.Method, req)
 
-			if buf.status >= 400 {
-				useCache = false
+		// responses to requests with credentials are either cached for each
+		// user, or shared only if they are public
+		user, credentials := caller(req)
+		if credentials && policy.perUser {
+			if user == "" {
+				rw.Header().Add("X-Cache", "PASS")
+				handler(rw, req, params)
+				return
 			}
 
-			if useCache {
-				rw.Header().Add("X-Cache", "MISS")
-				_ = c.cache.Set(identifier, buf)
-			} else {
-				rw.Header().Add("X-Cache", "PASS")
+			// the user's own responses need not be public
+			key += " " + user
+			credentials = false
+		}
+
+		cached, err := c.store.get(key)
+		if err != nil {
+			c.logger.Warningf("error while reading cached response: %s", err)
+		}
+
+		v := cached.lookup(req, now)
+		if v != nil && credentials && !v.Public {
+			v = nil
+		}
+
+		if v != nil && now.Before(v.Expires) {
+			dumpVariant(rw, v, "HIT", now)
+			return
+		}
+
+		if v != nil && now.Before(v.StaleWhileRevalidate) {
+			c.revalidate(handler, policy, appName, key, req, params, credentials)
+			dumpVariant(rw, v, "STALE", now)
+			return
+		}
+
+		// concurrent misses for the same resource wait for a single upstream
+		// request; if its response could not be cached, or varies by other
+		// headers, they send their own
+		flightKey := key + "\x00" + policy.varyValues(req)
+		f, leader := c.flights.join(flightKey)
+
+		if !leader {
+			select {
+			case <-f.done:
+			case <-req.Context().Done():
 			}
 
-			buf.Dump(rw)
-		} else if err == nil {
-			switch entry := entry.(type) {
-			case *ResponseBuffer:
-				rw.Header().Add("X-Cache", "HIT")
-				entry.Dump(rw)
-			default:
-				fmt.Println("Unknown type in cache")
-				rw.WriteHeader(500)
-				_, _ = rw.Write([]byte("{\"msg\":\"internal server error\"}"))
+			if f.stored != nil && f.stored.matches(req) && (!credentials || f.stored.Public) {
+				dumpVariant(rw, f.stored, "HIT", time.Now())
+				return
 			}
+		}
+
+		landed := false
+		if leader {
+			// release the waiting requests even if the handler panics
+			defer func() {
+				if !landed {
+					c.flights.land(flightKey, f, nil)
+				}
+			}()
+		}
+
+		buf, stored := c.fetch(handler, policy, appName, key, cached, req, params, credentials)
+
+		if leader {
+			c.flights.land(flightKey, f, stored)
+			landed = true
+		}
+
+		if failed(buf) && v != nil && now.Before(v.StaleIfError) {
+			c.logger.Warningf("serving stale response to %s after upstream failed with status %d", req.URL.Path, buf.status)
+			dumpVariant(rw, v, "STALE", now)
+			return
+		}
+
+		if stored != nil {
+			rw.Header().Add("X-Cache", "MISS")
 		} else {
-			rw.WriteHeader(500)
-			_, _ = rw.Write([]byte("{\"msg\":\"internal server error\"}"))
+			rw.Header().Add("X-Cache", "PASS")
 		}
+
+		buf.Dump(rw)
+	}, nil
+}
+
+// fetch sends a request upstream, and stores the response if it may be
+// cached. It returns the stored variant, or nil if the response was not
+// stored.
+func (c *cacheMiddleware) fetch(handler httprouter.Handle, policy *Policy, appName string, key string, cached *entry, req *http.Request, params httprouter.Params, credentials bool) (*ResponseBuffer, *variant) {
+	buf := NewResponseBuffer()
+
+	handler(buf, req, params)
+	buf.Complete()
+
+	// surrogate keys are meant for the cache, not for clients
+	surrogateKeys := strings.Fields(buf.header.Get(c.surrogateKeyHeader))
+	buf.header.Del(c.surrogateKeyHeader)
+
+	l := policy.lifetimeFor(req, buf.status, buf.header, credentials)
+	if l.ttl <= 0 || int64(len(buf.body)) > c.maxBodySize || failed(buf) {
+		return buf, nil
+	}
+
+	now := time.Now()
+	v := variant{
+		Vary:                 make(map[string]string),
+		Status:               buf.status,
+		Header:               buf.header.Clone(),
+		Body:                 buf.body,
+		Stored:               now,
+		Expires:              now.Add(l.ttl),
+		StaleWhileRevalidate: now.Add(l.ttl + l.staleWhileRevalidate),
+		StaleIfError:         now.Add(l.ttl + l.staleIfError),
+		SurrogateKeys:        surrogateKeys,
+		Public:               l.public,
+	}
+
+	for _, name := range policy.varyBy(buf.header) {
+		v.Vary[name] = req.Header.Get(name)
+	}
+
+	updated := cached.with(appName, req.URL.RequestURI(), v, now)
+	if err := c.store.set(key, updated, time.Until(updated.expires())); err != nil {
+		c.logger.Warningf("error while storing cached response: %s", err)
 	}
+
+	return buf, &v
+}
+
+// revalidate refreshes a stale response in the background. Only one refresh
+// per cache key runs at a time.
+func (c *cacheMiddleware) revalidate(handler httprouter.Handle, policy *Policy, appName string, key string, req *http.Request, params httprouter.Params, credentials bool) {
+	if _, running := c.refreshing.LoadOrStore(key, true); running {
+		return
+	}
+
+	// the refresh must not be canceled when the client's request ends
+	refreshReq := req.Clone(context.WithoutCancel(req.Context()))
+
+	go func() {
+		defer c.refreshing.Delete(key)
+
+		cached, err := c.store.get(key)
+		if err != nil {
+			c.logger.Warningf("error while reading cached response: %s", err)
+		}
+
+		buf, _ := c.fetch(handler, policy, appName, key, cached, refreshReq, params, credentials)
+		if failed(buf) {
+			c.logger.Warningf("could not refresh stale response to %s: upstream failed with status %d", refreshReq.URL.Path, buf.status)
+		}
+	}()
+}
+
+// failed reports whether a response indicates that the upstream failed; by
+// a server error, or by the fallback response of an open circuit breaker
+// (which may have any status).
+func failed(buf *ResponseBuffer) bool {
+	return buf.status >= 500 || strings.HasPrefix(buf.header.Get("X-Circuit-Breaker"), "open")
+}
+
+// Purge removes the cached responses that a selector matches, and returns
+// how many entries were removed.
+func (c *cacheMiddleware) Purge(selector Selector) (int, error) {
+	return c.store.purge(selector)
+}
+
+func dumpVariant(rw http.ResponseWriter, v *variant, result string, now time.Time) {
+	rw.Header().Add("X-Cache", result)
+	rw.Header().Set("Age", strconv.Itoa(int(now.Sub(v.Stored)/time.Second)))
+
+	for key, values := range v.Header {
+		for _, value := range values {
+			rw.Header().Add(key, value)
+		}
+	}
+
+	rw.WriteHeader(v.Status)
+	_, _ = rw.Write(v.Body)
 }
@@ -0,0 +1,44 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/mittwald/servicegateway/auth"
+)
+
+// caller identifies the user that sent a request. It reports whether the
+// request carried credentials (an Authorization header, a session cookie or
+// an API key, or was authenticated otherwise), and returns an identifier of
+// the user: the subject of the verified token, the owner of the API key, or
+// a hash of the credentials. The identifier is empty if the request carried
+// credentials that do not identify a user.
+func caller(req *http.Request) (string, bool) {
+	ctx := req.Context()
+
+	key, hasKey := auth.ApiKeyFromContext(ctx)
+	claims, hasClaims := auth.ClaimsFromContext(ctx)
+	issuer, hasIssuer := auth.IssuerFromContext(ctx)
+	authorization := req.Header.Get("Authorization")
+	session, hasSession := auth.SessionCookie(req)
+
+	if !hasKey && !hasClaims && !hasIssuer && authorization == "" && !hasSession {
+		return "", false
+	}
+
+	if hasKey && key.Owner != "" {
+		return "key:" + key.Owner, true
+	}
+
+	if subject, ok := claims["sub"].(string); ok && subject != "" {
+		return "sub:" + issuer + " " + subject, true
+	}
+
+	if authorization == "" && session == "" {
+		return "", true
+	}
+
+	sum := sha256.Sum256([]byte(authorization + "\x00" + session))
+	return "credentials:" + hex.EncodeToString(sum[:]), true
+}
@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"sync"
+)
+
+// flight is a request to the upstream that concurrent requests for the same
+// resource wait for, instead of sending requests of their own.
+type flight struct {
+	done   chan struct{}
+	stored *variant
+}
+
+// flightGroup collapses concurrent cache misses for the same resource into
+// a single upstream request.
+type flightGroup struct {
+	lock    sync.Mutex
+	flights map[string]*flight
+}
+
+// join returns the flight for a key, and whether the caller started it (and
+// therefore has to land it).
+func (g *flightGroup) join(key string) (*flight, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if f, ok := g.flights[key]; ok {
+		return f, false
+	}
+
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+
+	return f, true
+}
+
+// land ends a flight with the response that was stored in the cache (nil
+// if the response could not be cached), and releases the waiting requests.
+func (g *flightGroup) land(key string, f *flight, stored *variant) {
+	g.lock.Lock()
+	delete(g.flights, key)
+	g.lock.Unlock()
+
+	f.stored = stored
+	close(f.done)
+}
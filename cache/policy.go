@@ -0,0 +1,250 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+const defaultTtl = 60 * time.Second
+
+// Policy decides which responses of an application are cached, for how
+// long, and which request headers they vary by.
+type Policy struct {
+	defaults lifetime
+	vary     []string
+	routes   []route
+	perUser  bool
+}
+
+// lifetime describes how long a response is fresh, and for how long after
+// that it may be served stale; while it is refreshed in the background, or
+// when the upstream fails.
+type lifetime struct {
+	ttl                  time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+
+	// public is set for responses that may also be served to requests with
+	// credentials
+	public bool
+}
+
+type route struct {
+	lifetime
+
+	path *regexp.Regexp
+}
+
+func seconds(s int) time.Duration {
+	return time.Duration(s) * time.Second
+}
+
+// NewPolicy compiles the caching configuration of an application.
+func NewPolicy(cfg *config.Caching) (*Policy, error) {
+	p := Policy{
+		defaults: lifetime{
+			ttl:                  seconds(cfg.Ttl),
+			staleWhileRevalidate: seconds(cfg.StaleWhileRevalidate),
+			staleIfError:         seconds(cfg.StaleIfError),
+		},
+		vary:    []string{"Accept"},
+		perUser: cfg.PerUser,
+	}
+
+	if cfg.Ttl < 0 || cfg.StaleWhileRevalidate < 0 || cfg.StaleIfError < 0 {
+		return nil, fmt.Errorf("cache ttl and stale periods must not be negative")
+	}
+
+	if p.defaults.ttl == 0 {
+		p.defaults.ttl = defaultTtl
+	}
+
+	if cfg.Vary != nil {
+		p.vary = make([]string, len(cfg.Vary))
+		for i, name := range cfg.Vary {
+			p.vary[i] = http.CanonicalHeaderKey(name)
+		}
+	}
+
+	for i, routeCfg := range cfg.Routes {
+		if routeCfg.Ttl < 0 || routeCfg.StaleWhileRevalidate < 0 || routeCfg.StaleIfError < 0 {
+			return nil, fmt.Errorf("ttl and stale periods of cache route %d must not be negative", i)
+		}
+
+		re, err := regexp.Compile(routeCfg.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path pattern '%s' in cache route %d: %s", routeCfg.Path, i, err)
+		}
+
+		p.routes = append(p.routes, route{
+			lifetime: lifetime{
+				ttl:                  seconds(routeCfg.Ttl),
+				staleWhileRevalidate: seconds(routeCfg.StaleWhileRevalidate),
+				staleIfError:         seconds(routeCfg.StaleIfError),
+			},
+			path: re,
+		})
+	}
+
+	return &p, nil
+}
+
+// bypass reports whether a client asked for a response that is not taken
+// from the cache.
+func (p *Policy) bypass(req *http.Request) bool {
+	directives := parseCacheControl(req.Header.Get("Cache-Control"))
+	if _, ok := directives["no-cache"]; ok {
+		return true
+	}
+
+	if _, ok := directives["no-store"]; ok {
+		return true
+	}
+
+	if maxAge, ok := directives["max-age"]; ok && maxAge == "0" {
+		return true
+	}
+
+	return strings.EqualFold(req.Header.Get("Pragma"), "no-cache")
+}
+
+// lifetimeFor returns how long a response may be cached. The first route
+// that matches the request overrides the lifetime given by the response's
+// Cache-Control header (max-age or s-maxage, stale-while-revalidate and
+// stale-if-error), which in turn overrides the defaults; routes without a
+// ttl or stale period leave it as it is. Responses that must not be stored
+// in a shared cache are not cached at all; neither are responses to requests
+// with credentials, unless the response is explicitly marked as shareable
+// with "public" or "s-maxage" (RFC 9111, section 3.5).
+func (p *Policy) lifetimeFor(req *http.Request, status int, header http.Header, credentials bool) lifetime {
+	if status >= 400 || status == http.StatusPartialContent {
+		return lifetime{}
+	}
+
+	if header.Get("Set-Cookie") != "" || header.Get("Vary") == "*" {
+		return lifetime{}
+	}
+
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return lifetime{}
+		}
+	}
+
+	_, public := directives["public"]
+	_, sMaxAge := directives["s-maxage"]
+	if credentials && !public && !sMaxAge {
+		return lifetime{}
+	}
+
+	var override lifetime
+	for _, r := range p.routes {
+		if r.path.MatchString(req.URL.Path) {
+			override = r.lifetime
+			break
+		}
+	}
+
+	l := p.defaults
+	l.public = public || sMaxAge
+
+	if override.ttl > 0 {
+		l.ttl = override.ttl
+	} else if value, ok := directives["s-maxage"]; ok {
+		l.ttl = directiveSeconds(value)
+	} else if value, ok := directives["max-age"]; ok {
+		l.ttl = directiveSeconds(value)
+	}
+
+	if l.ttl <= 0 {
+		return lifetime{}
+	}
+
+	if override.staleWhileRevalidate > 0 {
+		l.staleWhileRevalidate = override.staleWhileRevalidate
+	} else if value, ok := directives["stale-while-revalidate"]; ok {
+		l.staleWhileRevalidate = directiveSeconds(value)
+	}
+
+	if override.staleIfError > 0 {
+		l.staleIfError = override.staleIfError
+	} else if value, ok := directives["stale-if-error"]; ok {
+		l.staleIfError = directiveSeconds(value)
+	}
+
+	return l
+}
+
+// directiveSeconds parses the number of seconds of a Cache-Control
+// directive; invalid values count as zero.
+func directiveSeconds(value string) time.Duration {
+	s, err := strconv.Atoi(value)
+	if err != nil || s < 0 {
+		return 0
+	}
+
+	return seconds(s)
+}
+
+// varyBy returns the request headers that a response varies by; the
+// configured headers, and the ones listed in the response's Vary header.
+func (p *Policy) varyBy(header http.Header) []string {
+	names := append([]string{}, p.vary...)
+
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+// varyValues returns the values of the configured headers that responses
+// vary by, joined into a string.
+func (p *Policy) varyValues(req *http.Request) string {
+	values := make([]string, len(p.vary))
+	for i, name := range p.vary {
+		values[i] = req.Header.Get(name)
+	}
+
+	return strings.Join(values, "\x00")
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseCacheControl splits a Cache-Control header into its directives and
+// their (unquoted) values.
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, arg, _ := strings.Cut(part, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), "\"")
+	}
+
+	return directives
+}
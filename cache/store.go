@@ -0,0 +1,522 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mittwald/servicegateway/redisconn"
+	"github.com/op/go-logging"
+)
+
+const (
+	redisKeyPrefix = "CACHE_"
+
+	// the sets of the cached responses that are tagged with a surrogate
+	// key, and the counter of purges; their prefix is chosen so that they
+	// do not match redisKeyPrefix + "*"
+	redisSurrogateKeyPrefix = "CACHEIDX_"
+	redisGenerationKey      = "CACHEGEN"
+
+	// generationCheckInterval is how often an instance checks whether
+	// another one has purged cached responses
+	generationCheckInterval = time.Second
+)
+
+// variant is a cached response, together with the values of the request
+// headers that it varies by. After it expires, it may be served stale until
+// StaleWhileRevalidate while it is refreshed, and until StaleIfError when
+// the upstream fails.
+type variant struct {
+	Vary                 map[string]string `json:"vary"`
+	Status               int               `json:"status"`
+	Header               http.Header       `json:"header"`
+	Body                 []byte            `json:"body"`
+	Stored               time.Time         `json:"stored"`
+	Expires              time.Time         `json:"expires"`
+	StaleWhileRevalidate time.Time         `json:"stale_while_revalidate"`
+	StaleIfError         time.Time         `json:"stale_if_error"`
+	SurrogateKeys        []string          `json:"surrogate_keys,omitempty"`
+
+	// Public is set for responses that may also be served to requests with
+	// credentials.
+	Public bool `json:"public,omitempty"`
+}
+
+func (v *variant) matches(req *http.Request) bool {
+	for name, value := range v.Vary {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// keepUntil returns the time until which a variant may be served at all.
+func (v *variant) keepUntil() time.Time {
+	until := v.Expires
+	if v.StaleWhileRevalidate.After(until) {
+		until = v.StaleWhileRevalidate
+	}
+
+	if v.StaleIfError.After(until) {
+		until = v.StaleIfError
+	}
+
+	return until
+}
+
+// entry holds the cached variants of the responses to one method and URL of
+// an application. Entries are never modified once they are stored.
+type entry struct {
+	Application string    `json:"application"`
+	Path        string    `json:"path"`
+	Variants    []variant `json:"variants"`
+}
+
+// lookup returns the variant that was stored for the headers of a request,
+// or nil if there is none that may still be served. The variant may be
+// stale.
+func (e *entry) lookup(req *http.Request, now time.Time) *variant {
+	if e == nil {
+		return nil
+	}
+
+	for i := range e.Variants {
+		if now.Before(e.Variants[i].keepUntil()) && e.Variants[i].matches(req) {
+			return &e.Variants[i]
+		}
+	}
+
+	return nil
+}
+
+// with returns a copy of the entry in which a variant replaces the one for
+// the same header values. Variants that may no longer be served are left
+// out.
+func (e *entry) with(appName string, path string, v variant, now time.Time) *entry {
+	updated := entry{Application: appName, Path: path, Variants: []variant{v}}
+
+	if e == nil {
+		return &updated
+	}
+
+	for _, existing := range e.Variants {
+		if now.Before(existing.keepUntil()) && !sameVary(existing.Vary, v.Vary) {
+			updated.Variants = append(updated.Variants, existing)
+		}
+	}
+
+	return &updated
+}
+
+// expires returns the time until which the last variant of the entry may
+// be served.
+func (e *entry) expires() time.Time {
+	var expires time.Time
+	for i := range e.Variants {
+		if until := e.Variants[i].keepUntil(); until.After(expires) {
+			expires = until
+		}
+	}
+
+	return expires
+}
+
+// surrogateKeys returns the surrogate keys of all variants.
+func (e *entry) surrogateKeys() []string {
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+
+	for _, v := range e.Variants {
+		for _, key := range v.SurrogateKeys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys
+}
+
+func sameVary(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// store keeps cache entries by key. It returns nil for keys that it holds
+// no entry for.
+type store interface {
+	get(key string) (*entry, error)
+	set(key string, e *entry, ttl time.Duration) error
+	remove(keys ...string) error
+
+	// purge removes the entries that a selector matches, and returns how
+	// many were removed.
+	purge(selector Selector) (int, error)
+}
+
+type memoryStore struct {
+	cache gcache.Cache
+}
+
+func newMemoryStore(size int) *memoryStore {
+	return &memoryStore{cache: gcache.New(size).LRU().Build()}
+}
+
+func (m *memoryStore) get(key string) (*entry, error) {
+	value, err := m.cache.Get(key)
+	if err == gcache.KeyNotFoundError {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return value.(*entry), nil
+}
+
+func (m *memoryStore) set(key string, e *entry, ttl time.Duration) error {
+	return m.cache.SetWithExpire(key, e, ttl)
+}
+
+func (m *memoryStore) remove(keys ...string) error {
+	for _, key := range keys {
+		m.cache.Remove(key)
+	}
+
+	return nil
+}
+
+// clear removes all entries.
+func (m *memoryStore) clear() {
+	m.cache.Purge()
+}
+
+func (m *memoryStore) purge(selector Selector) (int, error) {
+	purged := 0
+
+	for _, key := range m.cache.Keys(true) {
+		value, err := m.cache.GetIFPresent(key)
+		if err != nil {
+			continue
+		}
+
+		if selector.matches(value.(*entry)) && m.cache.Remove(key) {
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// redisStore shares cache entries between all gateway instances.
+type redisStore struct {
+	redisPool redisconn.Source
+}
+
+// redisKey hashes a cache key, since URLs and header values can be long.
+func (r *redisStore) redisKey(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return redisKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+func (r *redisStore) get(key string) (*entry, error) {
+	conn := r.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	value, err := redis.Bytes(conn.Do("GET", r.redisKey(key)))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var e entry
+	if err := json.Unmarshal(value, &e); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (r *redisStore) set(key string, e *entry, ttl time.Duration) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	conn := r.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	redisKey := r.redisKey(key)
+	if _, err := conn.Do("SET", redisKey, value, "PX", int64(ttl/time.Millisecond)); err != nil {
+		return err
+	}
+
+	// entries are found by their surrogate keys when purging; the index is
+	// kept at least as long as the entries
+	for _, surrogateKey := range e.surrogateKeys() {
+		indexKey := r.surrogateKeyIndex(surrogateKey)
+		if _, err := conn.Do("SADD", indexKey, redisKey); err != nil {
+			return err
+		}
+
+		indexTtl, err := redis.Int64(conn.Do("PTTL", indexKey))
+		if err != nil {
+			return err
+		}
+
+		if indexTtl < int64(ttl/time.Millisecond) {
+			if _, err := conn.Do("PEXPIRE", indexKey, int64(ttl/time.Millisecond)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// surrogateKeyIndex returns the key of the set of the entries that are
+// tagged with a surrogate key.
+func (r *redisStore) surrogateKeyIndex(surrogateKey string) string {
+	sum := sha1.Sum([]byte(surrogateKey))
+	return redisSurrogateKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+func (r *redisStore) remove(keys ...string) error {
+	conn := r.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	for _, key := range keys {
+		if _, err := conn.Do("DEL", r.redisKey(key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// purge removes the entries that a selector matches. Entries with a
+// surrogate key are looked up in its index; otherwise, all entries are
+// scanned.
+func (r *redisStore) purge(selector Selector) (int, error) {
+	var (
+		keys []string
+		err  error
+	)
+
+	if selector.SurrogateKey != "" {
+		keys, err = r.indexed(selector.SurrogateKey)
+	} else {
+		keys, err = redisconn.Keys(r.redisPool, redisKeyPrefix+"*")
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	conn := r.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	purged := 0
+	for _, key := range keys {
+		value, err := redis.Bytes(conn.Do("GET", key))
+		if err == redis.ErrNil {
+			// expired or purged in the meantime
+			r.unindex(conn, selector.SurrogateKey, key)
+			continue
+		} else if err != nil {
+			return purged, err
+		}
+
+		var e entry
+		if err := json.Unmarshal(value, &e); err != nil || !selector.matches(&e) {
+			continue
+		}
+
+		if _, err := conn.Do("DEL", key); err != nil {
+			return purged, err
+		}
+		r.unindex(conn, selector.SurrogateKey, key)
+		purged++
+	}
+
+	return purged, nil
+}
+
+// indexed returns the keys of the entries that are tagged with a surrogate
+// key.
+func (r *redisStore) indexed(surrogateKey string) ([]string, error) {
+	conn := r.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	return redis.Strings(conn.Do("SMEMBERS", r.surrogateKeyIndex(surrogateKey)))
+}
+
+// unindex removes an entry that is gone from the index of a surrogate key.
+// Entries that are left in other indexes are skipped when these are
+// purged, and the indexes expire with the entries.
+func (r *redisStore) unindex(conn redis.Conn, surrogateKey string, key string) {
+	if surrogateKey != "" {
+		_, _ = conn.Do("SREM", r.surrogateKeyIndex(surrogateKey), key)
+	}
+}
+
+// generation returns the number of purges so far.
+func (r *redisStore) generation() (int64, error) {
+	conn := r.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	generation, err := redis.Int64(conn.Do("GET", redisGenerationKey))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+
+	return generation, err
+}
+
+// nextGeneration counts a purge, so that the other instances remove the
+// entries that they keep in memory.
+func (r *redisStore) nextGeneration() (int64, error) {
+	conn := r.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	return redis.Int64(conn.Do("INCR", redisGenerationKey))
+}
+
+// tieredStore looks up entries in memory first, and then in Redis. Entries
+// that are found in Redis are kept in memory until they expire, or until
+// any instance purges entries. Since the cache is an optimization, Redis
+// errors are logged and treated like missing entries.
+type tieredStore struct {
+	memory *memoryStore
+	redis  *redisStore
+	logger *logging.Logger
+
+	generation     int64
+	generationRead time.Time
+	generationLock sync.Mutex
+}
+
+// syncGeneration removes the entries in memory if entries were purged
+// since they were stored (by any instance). Purges are checked for at most
+// every generationCheckInterval.
+func (t *tieredStore) syncGeneration() {
+	t.generationLock.Lock()
+	defer t.generationLock.Unlock()
+
+	if time.Since(t.generationRead) < generationCheckInterval {
+		return
+	}
+
+	generation, err := t.redis.generation()
+	if err != nil {
+		t.logger.Warningf("error while reading cache generation from Redis: %s", err)
+		return
+	}
+
+	t.generationRead = time.Now()
+
+	if generation != t.generation {
+		t.generation = generation
+		t.memory.clear()
+	}
+}
+
+func (t *tieredStore) get(key string) (*entry, error) {
+	t.syncGeneration()
+
+	if e, err := t.memory.get(key); e != nil || err != nil {
+		return e, err
+	}
+
+	e, err := t.redis.get(key)
+	if err != nil {
+		t.logger.Warningf("error while reading cached response from Redis: %s", err)
+		return nil, nil
+	}
+
+	if e != nil {
+		if ttl := time.Until(e.expires()); ttl > 0 {
+			_ = t.memory.set(key, e, ttl)
+		}
+	}
+
+	return e, nil
+}
+
+func (t *tieredStore) set(key string, e *entry, ttl time.Duration) error {
+	if err := t.redis.set(key, e, ttl); err != nil {
+		t.logger.Warningf("error while writing cached response to Redis: %s", err)
+	}
+
+	return t.memory.set(key, e, ttl)
+}
+
+func (t *tieredStore) remove(keys ...string) error {
+	if err := t.redis.remove(keys...); err != nil {
+		t.logger.Warningf("error while removing cached response from Redis: %s", err)
+	}
+
+	return t.memory.remove(keys...)
+}
+
+// purge removes matching entries from both tiers. The other instances
+// remove all entries from memory once they notice the purge. Since the
+// entries in memory are mostly copies of those in Redis, the larger count
+// is returned.
+func (t *tieredStore) purge(selector Selector) (int, error) {
+	purged, err := t.redis.purge(selector)
+	if err != nil {
+		return purged, err
+	}
+
+	generation, err := t.redis.nextGeneration()
+	if err != nil {
+		return purged, err
+	}
+
+	purgedFromMemory, err := t.memory.purge(selector)
+	if purgedFromMemory > purged {
+		purged = purgedFromMemory
+	}
+
+	// the purge was applied to this instance already
+	t.generationLock.Lock()
+	if generation == t.generation+1 {
+		t.generation = generation
+	}
+	t.generationLock.Unlock()
+
+	return purged, err
+}
@@ -0,0 +1,253 @@
+package circuitbreaker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+
+	return "closed"
+}
+
+type bucket struct {
+	second   int64
+	requests int
+	failures int
+}
+
+// Breaker tracks the outcomes of the requests to an upstream service. When
+// the ratio of failed requests within a sliding window exceeds a threshold,
+// the breaker opens and requests are rejected without contacting the
+// upstream service. After a while, a limited number of probe requests is let
+// through (half-open state); the breaker closes again once they succeed.
+type Breaker struct {
+	cfg config.CircuitBreakerConfiguration
+
+	errorThreshold   float64
+	minRequests      int
+	latencyThreshold time.Duration
+	openDuration     time.Duration
+	halfOpenRequests int
+
+	state     State
+	openedAt  time.Time
+	probes    int
+	successes int
+	buckets   []bucket
+
+	onStateChange func(State)
+	lock          sync.Mutex
+}
+
+// Status is a snapshot of a breaker's state.
+type Status struct {
+	State    State
+	Requests int
+	Failures int
+	OpenedAt time.Time
+}
+
+func NewBreaker(cfg *config.CircuitBreakerConfiguration) (*Breaker, error) {
+	b := Breaker{
+		cfg:              *cfg,
+		errorThreshold:   cfg.ErrorThreshold,
+		minRequests:      cfg.MinRequests,
+		openDuration:     30 * time.Second,
+		halfOpenRequests: cfg.HalfOpenRequests,
+	}
+
+	if b.errorThreshold == 0 {
+		b.errorThreshold = 0.5
+	}
+
+	if b.minRequests == 0 {
+		b.minRequests = 20
+	}
+
+	if b.halfOpenRequests == 0 {
+		b.halfOpenRequests = 1
+	}
+
+	window := 10 * time.Second
+
+	durations := []struct {
+		value  string
+		target *time.Duration
+		name   string
+	}{
+		{cfg.Window, &window, "window"},
+		{cfg.LatencyThreshold, &b.latencyThreshold, "latency threshold"},
+		{cfg.OpenDuration, &b.openDuration, "open duration"},
+	}
+
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid circuit breaker %s: %s", d.name, err)
+		}
+
+		*d.target = duration
+	}
+
+	seconds := int(window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	b.buckets = make([]bucket, seconds)
+
+	return &b, nil
+}
+
+func (b *Breaker) setState(state State) {
+	if b.state == state {
+		return
+	}
+
+	b.state = state
+	if b.onStateChange != nil {
+		b.onStateChange(state)
+	}
+}
+
+func (b *Breaker) bucket(now int64) *bucket {
+	bk := &b.buckets[now%int64(len(b.buckets))]
+	if bk.second != now {
+		*bk = bucket{second: now}
+	}
+
+	return bk
+}
+
+func (b *Breaker) counts(now int64) (requests int, failures int) {
+	for _, bk := range b.buckets {
+		if bk.second > now-int64(len(b.buckets)) {
+			requests += bk.requests
+			failures += bk.failures
+		}
+	}
+
+	return
+}
+
+// Allow reports whether a request may be sent to the upstream service. If
+// it may, the request's outcome needs to be reported using Done.
+func (b *Breaker) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case Open:
+		if time.Since(b.openedAt) < b.openDuration {
+			return false
+		}
+
+		b.setState(HalfOpen)
+		b.probes = 0
+		b.successes = 0
+		fallthrough
+	case HalfOpen:
+		if b.probes >= b.halfOpenRequests {
+			return false
+		}
+
+		b.probes++
+	}
+
+	return true
+}
+
+// Done records the outcome of an allowed request.
+func (b *Breaker) Done(failed bool, latency time.Duration) {
+	if b.latencyThreshold > 0 && latency > b.latencyThreshold {
+		failed = true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case HalfOpen:
+		if failed {
+			b.trip()
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.halfOpenRequests {
+			for i := range b.buckets {
+				b.buckets[i] = bucket{}
+			}
+			b.setState(Closed)
+		}
+	case Closed:
+		now := time.Now().Unix()
+		bk := b.bucket(now)
+		bk.requests++
+		if failed {
+			bk.failures++
+		}
+
+		requests, failures := b.counts(now)
+		if requests >= b.minRequests && float64(failures)/float64(requests) >= b.errorThreshold {
+			b.trip()
+		}
+	}
+}
+
+func (b *Breaker) trip() {
+	b.openedAt = time.Now()
+	b.setState(Open)
+}
+
+// Reset closes the breaker and discards the recorded outcomes.
+func (b *Breaker) Reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for i := range b.buckets {
+		b.buckets[i] = bucket{}
+	}
+
+	b.setState(Closed)
+}
+
+func (b *Breaker) Status() Status {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	requests, failures := b.counts(time.Now().Unix())
+	status := Status{
+		State:    b.state,
+		Requests: requests,
+		Failures: failures,
+	}
+
+	if b.state != Closed {
+		status.OpenedAt = b.openedAt
+	}
+
+	return status
+}
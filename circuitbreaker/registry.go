@@ -0,0 +1,255 @@
+package circuitbreaker
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/statusrecorder"
+	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// responses up to this size are kept as fallback for when the breaker is
+// open
+const maxCachedResponseSize = 1 << 20
+
+// Registry manages the circuit breakers of all applications.
+type Registry struct {
+	breakers map[string]*Breaker
+	metrics  *monitoring.PromMetrics
+	logger   *logging.Logger
+	lock     sync.RWMutex
+}
+
+func NewRegistry(metrics *monitoring.PromMetrics, logger *logging.Logger) *Registry {
+	return &Registry{
+		breakers: make(map[string]*Breaker),
+		metrics:  metrics,
+		logger:   logger,
+	}
+}
+
+// Register creates the circuit breaker of an application, replacing any
+// previous one.
+func (r *Registry) Register(appName string, cfg *config.CircuitBreakerConfiguration) (*Breaker, error) {
+	breaker, err := NewBreaker(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	breaker.onStateChange = func(state State) {
+		r.logger.Warningf("circuit breaker of application %s is %s", appName, state)
+		if r.metrics != nil {
+			r.metrics.CircuitBreakerState.With(prometheus.Labels{"application": appName}).Set(float64(state))
+		}
+	}
+
+	if r.metrics != nil {
+		r.metrics.CircuitBreakerState.With(prometheus.Labels{"application": appName}).Set(float64(Closed))
+	}
+
+	r.lock.Lock()
+	r.breakers[appName] = breaker
+	r.lock.Unlock()
+
+	return breaker, nil
+}
+
+func (r *Registry) Get(appName string) (*Breaker, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	breaker, ok := r.breakers[appName]
+	return breaker, ok
+}
+
+// Applications returns the names of all applications with a circuit breaker.
+func (r *Registry) Applications() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := make([]string, 0, len(r.breakers))
+	for name := range r.breakers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// recordingResponseWriter records the status code and latency of a response
+// and, if requested, a copy of the response for use as fallback. The
+// response itself is passed through unchanged.
+type recordingResponseWriter struct {
+	*statusrecorder.Recorder
+	start   time.Time
+	latency time.Duration
+	cached  *cachedResponse
+}
+
+func (w *recordingResponseWriter) WriteHeader(code int) {
+	if !w.Recorder.WroteHeader() {
+		w.latency = time.Since(w.start)
+
+		if w.cached != nil {
+			w.cached.status = code
+			w.cached.header = w.Header().Clone()
+		}
+	}
+
+	w.Recorder.WriteHeader(code)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if !w.Recorder.WroteHeader() {
+		w.WriteHeader(200)
+	}
+
+	if w.cached != nil {
+		if len(w.cached.body)+len(b) > maxCachedResponseSize {
+			w.cached = nil
+		} else {
+			w.cached.body = append(w.cached.body, b...)
+		}
+	}
+
+	return w.Recorder.Write(b)
+}
+
+func (w *recordingResponseWriter) Flush() {
+	if !w.Recorder.WroteHeader() {
+		w.WriteHeader(200)
+	}
+
+	w.Recorder.Flush()
+}
+
+// cacheable checks whether the response to a request may be kept as
+// fallback. Responses to requests carrying credentials may be specific to
+// their user, and must not be served to anyone else.
+func cacheable(req *http.Request) bool {
+	if req.Method != "GET" || req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" {
+		return false
+	}
+
+	ctx := req.Context()
+	if _, ok := auth.ClaimsFromContext(ctx); ok {
+		return false
+	}
+	if _, ok := auth.ApiKeyFromContext(ctx); ok {
+		return false
+	}
+	if _, ok := auth.IssuerFromContext(ctx); ok {
+		return false
+	}
+
+	return true
+}
+
+func cacheKey(req *http.Request) string {
+	return req.RequestURI + "_" + req.Header.Get("Accept")
+}
+
+// DecorateHandler guards an application's handler by its circuit breaker.
+// While the breaker is open, requests are answered with the configured
+// fallback response, or with the last successful response to the same
+// request if caching is enabled.
+func (r *Registry) DecorateHandler(handler httprouter.Handle, appName string, cfg *config.CircuitBreakerConfiguration) (httprouter.Handle, error) {
+	// all routes of an application share its breaker; it is only replaced
+	// when the application is registered again with a different configuration
+	breaker, ok := r.Get(appName)
+	if !ok || !reflect.DeepEqual(breaker.cfg, *cfg) {
+		var err error
+		if breaker, err = r.Register(appName, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	var responses *lru.Cache
+	if cfg.Fallback.Cache {
+		var err error
+		if responses, err = lru.New(1024); err != nil {
+			return nil, err
+		}
+	}
+
+	status := cfg.Fallback.Status
+	if status == 0 {
+		status = 503
+	}
+
+	body := cfg.Fallback.Body
+	if body == "" && len(cfg.Fallback.Headers) == 0 {
+		body = `{"msg":"service unavailable","reason":"circuit breaker is open"}`
+	}
+
+	fallback := func(rw http.ResponseWriter, req *http.Request) {
+		if r.metrics != nil {
+			r.metrics.Errors.With(prometheus.Labels{"application": appName, "reason": "circuit_open"}).Inc()
+		}
+
+		if responses != nil && cacheable(req) {
+			if entry, ok := responses.Get(cacheKey(req)); ok {
+				cached := entry.(*cachedResponse)
+				for key, values := range cached.header {
+					rw.Header()[key] = values
+				}
+
+				rw.Header().Set("X-Circuit-Breaker", "open; cached")
+				rw.WriteHeader(cached.status)
+				_, _ = rw.Write(cached.body)
+				return
+			}
+		}
+
+		if len(cfg.Fallback.Headers) == 0 {
+			rw.Header().Set("Content-Type", "application/json")
+		}
+
+		for key, value := range cfg.Fallback.Headers {
+			rw.Header().Set(key, value)
+		}
+
+		rw.Header().Set("X-Circuit-Breaker", "open")
+		rw.WriteHeader(status)
+		_, _ = rw.Write([]byte(body))
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if !breaker.Allow() {
+			fallback(rw, req)
+			return
+		}
+
+		recorder := recordingResponseWriter{Recorder: statusrecorder.New(rw), start: time.Now()}
+		if responses != nil && cacheable(req) {
+			recorder.cached = &cachedResponse{}
+		}
+
+		handler(&recorder, req, params)
+
+		if !recorder.WroteHeader() {
+			recorder.WriteHeader(200)
+		}
+
+		breaker.Done(recorder.Status() >= 500, recorder.latency)
+
+		if recorder.cached != nil && recorder.Status() < 400 {
+			responses.Add(cacheKey(req), recorder.cached)
+		}
+	}, nil
+}
@@ -0,0 +1,139 @@
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+type contextKey int
+
+const clientIPContextKey contextKey = iota
+
+// Resolver determines the address of the client that sent a request. When
+// the request was sent by one of the trusted proxies, the client address is
+// taken from the header that the proxy set instead.
+type Resolver struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+func NewResolver(cfg *config.ClientIPConfiguration) (*Resolver, error) {
+	r := Resolver{
+		header: http.CanonicalHeaderKey(cfg.Header),
+	}
+
+	if r.header == "" {
+		r.header = "X-Forwarded-For"
+	}
+
+	trusted, err := ParseNetworks(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %s", err)
+	}
+	r.trusted = trusted
+
+	return &r, nil
+}
+
+// ParseNetworks parses a list of CIDR ranges. Single IP addresses are
+// accepted as well.
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %s", err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func (r *Resolver) isTrusted(ip net.IP) bool {
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsTrustedPeer checks whether a request was sent by one of the trusted
+// proxies.
+func (r *Resolver) IsTrustedPeer(req *http.Request) bool {
+	ip := net.ParseIP(remoteHost(req))
+	return ip != nil && r.isTrusted(ip)
+}
+
+// Resolve returns the client address of a request. The addresses in the
+// header are evaluated from right to left, since only the entries appended
+// by trusted proxies can be relied upon; the first untrusted address is the
+// client.
+func (r *Resolver) Resolve(req *http.Request) string {
+	client := remoteHost(req)
+
+	ip := net.ParseIP(client)
+	if ip == nil || !r.isTrusted(ip) {
+		return client
+	}
+
+	addresses := strings.Split(strings.Join(req.Header.Values(r.header), ","), ",")
+	for i := len(addresses) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(addresses[i]))
+		if ip == nil {
+			break
+		}
+
+		client = ip.String()
+		if !r.isTrusted(ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+// Decorate resolves the client address of each request, so that it can be
+// retrieved with FromRequest.
+func (r *Resolver) Decorate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), clientIPContextKey, r.Resolve(req))
+		handler.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+// FromRequest returns the client address of a request. If it was not
+// resolved, the request's remote address is used.
+func FromRequest(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+
+	return remoteHost(req)
+}
+
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
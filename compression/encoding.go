@@ -0,0 +1,121 @@
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEncoder(encoding string, w io.Writer, level int) (encoder, error) {
+	switch encoding {
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		} else if level > gzip.BestCompression {
+			level = gzip.BestCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "br":
+		// the default level of the brotli package is too slow for
+		// compressing responses on the fly
+		if level == 0 {
+			level = 4
+		}
+		return brotli.NewWriterLevel(w, level), nil
+	}
+
+	return nil, fmt.Errorf("unsupported encoding '%s'", encoding)
+}
+
+type gzipDecoder struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (d *gzipDecoder) Close() error {
+	_ = d.Reader.Close()
+	return d.body.Close()
+}
+
+type brotliDecoder struct {
+	*brotli.Reader
+	body io.ReadCloser
+}
+
+func (d *brotliDecoder) Close() error {
+	return d.body.Close()
+}
+
+// CanDecode checks whether bodies with the given content encoding can be
+// decompressed.
+func CanDecode(encoding string) bool {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	return encoding == "gzip" || encoding == "x-gzip" || encoding == "br"
+}
+
+// NewDecoder returns a reader that decompresses a body with the given
+// content encoding. Closing it closes the body.
+func NewDecoder(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		return &gzipDecoder{Reader: reader, body: body}, nil
+	case "br":
+		return &brotliDecoder{Reader: brotli.NewReader(body), body: body}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported encoding '%s'", encoding)
+}
+
+// negotiate selects the encoding for a response from the client's
+// Accept-Encoding header. Of the encodings with the highest quality, the one
+// that comes first in the list of supported encodings is used.
+func negotiate(acceptEncoding string, supported []string) string {
+	best, bestQuality := "", 0.0
+
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		qualities[name] = quality
+	}
+
+	for _, encoding := range supported {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality, ok = qualities["*"]
+		}
+
+		if ok && quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,190 @@
+package compression
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+)
+
+var defaultContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/javascript",
+	"application/xml",
+	"application/*+xml",
+	"image/svg+xml",
+}
+
+// Compressor compresses responses for clients that support it.
+type Compressor struct {
+	encodings    []string
+	contentTypes []string
+	minSize      int64
+	level        int
+}
+
+func NewCompressor(cfg *config.CompressionConfiguration) (*Compressor, error) {
+	c := Compressor{
+		contentTypes: cfg.ContentTypes,
+		minSize:      cfg.MinSize,
+		level:        cfg.Level,
+	}
+
+	encodings := cfg.Encodings
+	if len(encodings) == 0 {
+		encodings = []string{"br", "gzip"}
+	}
+
+	for _, encoding := range encodings {
+		encoding = strings.ToLower(encoding)
+		if encoding != "br" && encoding != "gzip" {
+			return nil, fmt.Errorf("unsupported encoding '%s'", encoding)
+		}
+		c.encodings = append(c.encodings, encoding)
+	}
+
+	if len(c.contentTypes) == 0 {
+		c.contentTypes = defaultContentTypes
+	}
+
+	if c.minSize == 0 {
+		c.minSize = 1024
+	}
+
+	return &c, nil
+}
+
+// matches checks whether responses with the given content type should be
+// compressed. Patterns may contain a wildcard for the subtype, like `text/*`
+// or `application/*+json`.
+func (c *Compressor) matches(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range c.contentTypes {
+		if i := strings.Index(pattern, "*"); i >= 0 {
+			if strings.HasPrefix(mediaType, pattern[:i]) && strings.HasSuffix(mediaType, pattern[i+1:]) {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DecorateHandler compresses the responses of a handler, using the best
+// encoding that the client accepts.
+func (c *Compressor) DecorateHandler(handler httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		encoding := ""
+		if req.Method != "HEAD" {
+			encoding = negotiate(req.Header.Get("Accept-Encoding"), c.encodings)
+		}
+
+		writer := &compressingResponseWriter{ResponseWriter: rw, compressor: c, encoding: encoding}
+		defer writer.Close()
+
+		handler(writer, req, params)
+	}
+}
+
+// compressingResponseWriter decides whether to compress a response once its
+// headers are written. Compressed responses are flushed through the encoder,
+// so that streaming responses are not held back.
+type compressingResponseWriter struct {
+	http.ResponseWriter
+	compressor  *Compressor
+	encoding    string
+	encoder     encoder
+	wroteHeader bool
+}
+
+func (w *compressingResponseWriter) compressible(code int) bool {
+	header := w.Header()
+
+	if code < 200 || code == 204 || code == 304 || header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	if !w.compressor.matches(header.Get("Content-Type")) {
+		return false
+	}
+
+	// caches need to know that the response depends on Accept-Encoding, even
+	// if this client does not support compression
+	header.Add("Vary", "Accept-Encoding")
+
+	if w.encoding == "" {
+		return false
+	}
+
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length < w.compressor.minSize {
+		return false
+	}
+
+	return true
+}
+
+func (w *compressingResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	if w.compressible(code) {
+		encoder, err := newEncoder(w.encoding, w.ResponseWriter, w.compressor.level)
+		if err == nil {
+			w.encoder = encoder
+			w.Header().Del("Content-Length")
+			w.Header().Set("Content-Encoding", w.encoding)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressingResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+
+	if w.encoder != nil {
+		_ = w.encoder.Flush()
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes the remainder of a compressed response.
+func (w *compressingResponseWriter) Close() error {
+	if w.encoder == nil {
+		return nil
+	}
+
+	return w.encoder.Close()
+}
@@ -0,0 +1,23 @@
+package config
+
+type AuditConfiguration struct {
+	Type string `json:"type"`
+
+	// Filename is used by the "file" sink.
+	Filename string `json:"filename"`
+
+	// Network, Address and Tag are used by the "syslog" sink. An empty
+	// address logs to the local syslog daemon.
+	Network string `json:"network"`
+	Address string `json:"address"`
+	Tag     string `json:"tag"`
+
+	// Url, Headers and Timeout are used by the "webhook" and "kafka" sinks.
+	// For "kafka", the URL refers to a Kafka REST proxy.
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Timeout string            `json:"timeout"`
+
+	// Topic is used by the "kafka" sink.
+	Topic string `json:"topic"`
+}
@@ -1,29 +1,226 @@
 package config
 
 type AuthWriterConfig struct {
-	Mode string `json:"mode"`
-	Name string `json:"name"`
+	Mode      string            `json:"mode"`
+	Name      string            `json:"name"`
+	OmitToken bool              `json:"omit_token"`
+	Claims    map[string]string `json:"claims"`
 }
 
 type ProviderAuthConfig struct {
-	Url                   string                 `json:"url"`
-	Parameters            map[string]interface{} `json:"parameters"`
-	PreAuthenticationHook string                 `json:"hook_pre_authentication"`
-	AllowAuthentication   bool                   `json:"allow_authentication"`
-	AuthenticationUri     string                 `json:"authentication_uri"`
-	Service               string                 `json:"service"`
+	Type                   string                 `json:"type"`
+	Url                    string                 `json:"url"`
+	Parameters             map[string]interface{} `json:"parameters"`
+	PreAuthenticationHook  string                 `json:"hook_pre_authentication"`
+	PostAuthenticationHook string                 `json:"hook_post_authentication"`
+	AllowAuthentication    bool                   `json:"allow_authentication"`
+	AuthenticationUri      string                 `json:"authentication_uri"`
+	AuthenticationUrl      string                 `json:"authentication_url"`
+	RefreshUri             string                 `json:"refresh_uri"`
+	RefreshUrl             string                 `json:"refresh_url"`
+	MfaUri                 string                 `json:"mfa_uri"`
+	MfaUrl                 string                 `json:"mfa_url"`
+	LogoutUri              string                 `json:"logout_uri"`
+	LogoutUrl              string                 `json:"logout_url"`
+	Service                string                 `json:"service"`
+	Request                ProviderRequestConfig  `json:"request"`
+	Response               ProviderResponseConfig `json:"response"`
+	LDAP                   LDAPProviderConfig     `json:"ldap"`
+}
+
+type ProviderResponseConfig struct {
+	TokenPath        string `json:"token_path"`
+	ExpiresInPath    string `json:"expires_in_path"`
+	RefreshTokenPath string `json:"refresh_token_path"`
+}
+
+type ProviderRequestConfig struct {
+	Format        string            `json:"format"`
+	UsernameField string            `json:"username_field"`
+	PasswordField string            `json:"password_field"`
+	Headers       map[string]string `json:"headers"`
+}
+
+type LDAPProviderConfig struct {
+	Url                string            `json:"url"`
+	StartTLS           bool              `json:"start_tls"`
+	InsecureSkipVerify bool              `json:"insecure_skip_verify"`
+	BindDN             string            `json:"bind_dn"`
+	BindPassword       string            `json:"bind_password"`
+	BaseDN             string            `json:"base_dn"`
+	UserFilter         string            `json:"user_filter"`
+	UserDNTemplate     string            `json:"user_dn_template"`
+	GroupAttribute     string            `json:"group_attribute"`
+	ClaimAttributes    map[string]string `json:"claim_attributes"`
+}
+
+type TrustedIssuerConfig struct {
+	Issuer             string            `json:"issuer"`
+	VerificationKey    []byte            `json:"verification_key"`
+	VerificationKeyUrl string            `json:"verification_key_url"`
+	JwksUrl            string            `json:"jwks_url"`
+	AllowedAlgorithms  []string          `json:"allowed_algorithms"`
+	ClaimsMapping      map[string]string `json:"claims_mapping"`
+}
+
+type JwtIssuerConfig struct {
+	SigningKey     []byte            `json:"signing_key"`
+	SigningKeyFile string            `json:"signing_key_file"`
+	KeyID          string            `json:"key_id"`
+	Issuer         string            `json:"issuer"`
+	TokenTtl       string            `json:"token_ttl"`
+	Resign         bool              `json:"resign"`
+	ClaimsMapping  map[string]string `json:"claims_mapping"`
+}
+
+type OIDCProviderConfig struct {
+	Issuer            string   `json:"issuer"`
+	ClientID          string   `json:"client_id"`
+	ClientSecret      string   `json:"client_secret"`
+	RedirectUrl       string   `json:"redirect_url"`
+	Scopes            []string `json:"scopes"`
+	LoginUri          string   `json:"login_uri"`
+	CallbackUri       string   `json:"callback_uri"`
+	PostLoginRedirect string   `json:"post_login_redirect"`
+	UseIDToken        bool     `json:"use_id_token"`
+}
+
+type SAMLProviderConfig struct {
+	EntityID          string            `json:"entity_id"`
+	RootUrl           string            `json:"root_url"`
+	IdPMetadataUrl    string            `json:"idp_metadata_url"`
+	IdPMetadataFile   string            `json:"idp_metadata_file"`
+	CertificateFile   string            `json:"certificate_file"`
+	KeyFile           string            `json:"key_file"`
+	LoginUri          string            `json:"login_uri"`
+	AcsUri            string            `json:"acs_uri"`
+	MetadataUri       string            `json:"metadata_uri"`
+	SubjectAttribute  string            `json:"subject_attribute"`
+	AttributeClaims   map[string]string `json:"attribute_claims"`
+	AllowIdPInitiated bool              `json:"allow_idp_initiated"`
+	PostLoginRedirect string            `json:"post_login_redirect"`
+}
+
+type LoginThrottlingConfig struct {
+	Enabled       bool   `json:"enabled"`
+	UserThreshold int    `json:"user_threshold"`
+	IpThreshold   int    `json:"ip_threshold"`
+	Window        string `json:"window"`
+	BaseLockout   string `json:"base_lockout"`
+	MaxLockout    string `json:"max_lockout"`
+}
+
+type ExternalAuthorizationConfig struct {
+	Url            string   `json:"url"`
+	Timeout        string   `json:"timeout"`
+	FailOpen       bool     `json:"fail_open"`
+	ForwardHeaders []string `json:"forward_headers"`
+}
+
+type OPAConfig struct {
+	DecisionPath   string   `json:"decision_path"`
+	PolicyFiles    []string `json:"policy_files"`
+	BundleUrl      string   `json:"bundle_url"`
+	ReloadInterval string   `json:"reload_interval"`
+	Timeout        string   `json:"timeout"`
+	FailOpen       bool     `json:"fail_open"`
+	ForwardHeaders []string `json:"forward_headers"`
+	LogDecisions   bool     `json:"log_decisions"`
+}
+
+type ClientCertificateAuthConfig struct {
+	CAFile          string            `json:"ca_file"`
+	SubjectSource   string            `json:"subject_source"`
+	Claims          map[string]string `json:"claims"`
+	ForwardedHeader string            `json:"forwarded_header"`
+	TrustedProxies  []string          `json:"trusted_proxies"`
+}
+
+type ApiKeyConfig struct {
+	Enabled    bool              `json:"enabled"`
+	Header     string            `json:"header"`
+	QueryParam string            `json:"query_param"`
+	Redis      bool              `json:"redis"`
+	Keys       map[string]ApiKey `json:"keys"`
+}
+
+type BasicAuthConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Passthrough bool   `json:"passthrough"`
+	CacheTtl    string `json:"cache_ttl"`
+}
+
+type CookieSessionConfig struct {
+	Enabled    bool   `json:"enabled"`
+	SameSite   string `json:"same_site"`
+	Domain     string `json:"domain"`
+	CsrfCookie string `json:"csrf_cookie"`
+	CsrfHeader string `json:"csrf_header"`
+	Insecure   bool   `json:"insecure"`
+}
+
+type ImpersonationConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Uri        string `json:"uri"`
+	AdminClaim string `json:"admin_claim"`
+	TokenTtl   string `json:"token_ttl"`
+}
+
+type IntrospectionConfig struct {
+	Enabled bool              `json:"enabled"`
+	Uri     string            `json:"uri"`
+	Clients map[string]string `json:"clients"`
+}
+
+type ApiKey struct {
+	Owner               string   `json:"owner"`
+	AllowedApplications []string `json:"allowed_applications"`
+	RateLimitTier       string   `json:"rate_limit_tier"`
 }
 
 type ApplicationAuth struct {
-	Disable bool             `json:"disable"`
-	Writer  AuthWriterConfig `json:"writer"`
+	Disable       bool                `json:"disable"`
+	Optional      bool                `json:"optional"`
+	Audience      string              `json:"audience"`
+	Writer        AuthWriterConfig    `json:"writer"`
+	Authorization AuthorizationConfig `json:"authorization"`
+}
+
+type AuthorizationConfig struct {
+	ScopeClaim string              `json:"scope_claim"`
+	RoleClaim  string              `json:"role_claim"`
+	Rules      []AuthorizationRule `json:"rules"`
+}
+
+type AuthorizationRule struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+	Scopes  []string `json:"scopes"`
+	Roles   []string `json:"roles"`
 }
 
 type GlobalAuth struct {
-	Mode               string             `json:"mode"`
-	ProviderConfig     ProviderAuthConfig `json:"provider"`
-	VerificationKey    []byte             `json:"verification_key"`
-	VerificationKeyUrl string             `json:"verification_key_url"`
-	KeyCacheTtl        string             `json:"key_cache_ttl"`
-	EnableCORS         bool               `json:"enable_cors"`
+	Mode                  string                      `json:"mode"`
+	ProviderConfig        ProviderAuthConfig          `json:"provider"`
+	OIDC                  OIDCProviderConfig          `json:"oidc"`
+	SAML                  SAMLProviderConfig          `json:"saml"`
+	ClientCertificate     ClientCertificateAuthConfig `json:"client_certificate"`
+	ApiKeys               ApiKeyConfig                `json:"api_keys"`
+	BasicAuth             BasicAuthConfig             `json:"basic_auth"`
+	Introspection         IntrospectionConfig         `json:"introspection"`
+	CookieSession         CookieSessionConfig         `json:"cookie_session"`
+	Impersonation         ImpersonationConfig         `json:"impersonation"`
+	LoginThrottling       LoginThrottlingConfig       `json:"login_throttling"`
+	ExternalAuthz         ExternalAuthorizationConfig `json:"ext_authz"`
+	OPA                   OPAConfig                   `json:"opa"`
+	VerificationKey       []byte                      `json:"verification_key"`
+	VerificationKeyUrl    string                      `json:"verification_key_url"`
+	JwksUrl               string                      `json:"jwks_url"`
+	AllowedAlgorithms     []string                    `json:"allowed_algorithms"`
+	TrustedIssuers        []TrustedIssuerConfig       `json:"trusted_issuers"`
+	JwtIssuer             JwtIssuerConfig             `json:"jwt_issuer"`
+	AudienceClaim         string                      `json:"audience_claim"`
+	KeyCacheTtl           string                      `json:"key_cache_ttl"`
+	VerificationCacheSize int                         `json:"verification_cache_size"`
+	EnableCORS            bool                        `json:"enable_cors"`
 }
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"strings"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/hashicorp/consul/api"
@@ -27,42 +31,514 @@ import (
  */
 
 type Configuration struct {
-	Applications   map[string]Application `json:"applications"`
-	RateLimiting   RateLimiting           `json:"rate_limiting"`
-	Authentication GlobalAuth             `json:"authentication"`
-	Consul         ConsulConfiguration    `json:"consul"`
-	Proxy          ProxyConfiguration     `json:"proxy"`
-	Redis          RedisConfiguration     `json:"redis"`
-	Logging        []LoggingConfiguration `json:"logging"`
+	Applications   map[string]Application    `json:"applications"`
+	RateLimiting   RateLimiting              `json:"rate_limiting"`
+	Quotas         QuotaConfiguration        `json:"quotas"`
+	Cache          CacheConfiguration        `json:"cache"`
+	IPFilter       IPFilterConfiguration     `json:"ip_filter"`
+	Waf            WafConfiguration          `json:"waf"`
+	BotDetection   BotDetectionConfiguration `json:"bot_detection"`
+	Authentication GlobalAuth                `json:"authentication"`
+	Consul         ConsulConfiguration       `json:"consul"`
+	Proxy          ProxyConfiguration        `json:"proxy"`
+	Redis          RedisConfiguration        `json:"redis"`
+	TokenStore     TokenStoreConfiguration   `json:"token_store"`
+	Logging        []LoggingConfiguration    `json:"logging"`
+	Audit          []AuditConfiguration      `json:"audit"`
+	ClientIP       ClientIPConfiguration     `json:"client_ip"`
+	RequestId      RequestIdConfiguration    `json:"request_id"`
+	Tracing        TracingConfiguration      `json:"tracing"`
+	LogRedaction   LogRedactionConfiguration `json:"log_redaction"`
+	Admin          AdminConfiguration        `json:"admin"`
+	Kubernetes     KubernetesConfiguration   `json:"kubernetes"`
+	Etcd           EtcdConfiguration         `json:"etcd"`
+	TLS            TLSConfiguration          `json:"tls"`
+	Shutdown       ShutdownConfiguration     `json:"shutdown"`
+	Vault          VaultConfiguration        `json:"vault"`
+	Include        []string                  `json:"include"`
+}
+
+type ShutdownConfiguration struct {
+	DrainTimeout string `json:"drain_timeout"`
+	ReusePort    bool   `json:"reuse_port"`
+}
+
+type VaultConfiguration struct {
+	Address         string `json:"address"`
+	Namespace       string `json:"namespace"`
+	CaFile          string `json:"ca_file"`
+	AuthMethod      string `json:"auth_method"`
+	AuthMount       string `json:"auth_mount"`
+	Token           string `json:"token"`
+	RoleId          string `json:"role_id"`
+	SecretId        string `json:"secret_id"`
+	Role            string `json:"role"`
+	RefreshInterval string `json:"refresh_interval"`
+}
+
+type TLSConfiguration struct {
+	Certificates   []TLSCertificate  `json:"certificates"`
+	MinVersion     string            `json:"min_version"`
+	CipherSuites   []string          `json:"cipher_suites"`
+	ReloadInterval string            `json:"reload_interval"`
+	Acme           AcmeConfiguration `json:"acme"`
+}
+
+type AcmeConfiguration struct {
+	Hosts        []string `json:"hosts"`
+	Email        string   `json:"email"`
+	DirectoryUrl string   `json:"directory_url"`
+	Storage      string   `json:"storage"`
+	Directory    string   `json:"directory"`
+	HttpAddress  string   `json:"http_address"`
+}
+
+type TLSCertificate struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+type AdminConfiguration struct {
+	Tokens []string `json:"tokens"`
+}
+
+type TracingConfiguration struct {
+	Enabled     bool              `json:"enabled"`
+	Endpoint    string            `json:"endpoint"`
+	Insecure    bool              `json:"insecure"`
+	Headers     map[string]string `json:"headers"`
+	ServiceName string            `json:"service_name"`
+	SampleRatio *float64          `json:"sample_ratio"`
+}
+
+type RequestIdConfiguration struct {
+	Header string `json:"header"`
+}
+
+type ClientIPConfiguration struct {
+	TrustedProxies []string `json:"trusted_proxies"`
+	Header         string   `json:"header"`
 }
 
 type Application struct {
-	Routing      Routing         `json:"routing"`
-	Backend      Backend         `json:"backend"`
-	Auth         ApplicationAuth `json:"auth"`
-	Caching      Caching         `json:"caching"`
-	RateLimiting bool            `json:"rate_limiting"`
+	Routing      Routing                     `json:"routing"`
+	Backend      Backend                     `json:"backend"`
+	Auth         ApplicationAuth             `json:"auth"`
+	Caching      Caching                     `json:"caching"`
+	RateLimiting bool                        `json:"rate_limiting"`
+	RateLimitKey RateLimitKey                `json:"rate_limit_key"`
+	RateLimits   []RateLimitOverride         `json:"rate_limit_overrides"`
+	Exemptions   RateLimitExemptions         `json:"rate_limit_exemptions"`
+	Quota        bool                        `json:"quota"`
+	Grpc         GrpcConfiguration           `json:"grpc"`
+	Retries      RetryConfiguration          `json:"retries"`
+	Breaker      CircuitBreakerConfiguration `json:"circuit_breaker"`
+	Headers      HeaderTransformation        `json:"headers"`
+	Body         BodyTransformation          `json:"body_transform"`
+	RequestBody  RequestBodyConfiguration    `json:"request_body"`
+	Compression  CompressionConfiguration    `json:"compression"`
+	Cors         CorsConfiguration           `json:"cors"`
+	Security     SecurityHeaders             `json:"security_headers"`
+	IPFilter     IPFilterConfiguration       `json:"ip_filter"`
+	Waf          WafConfiguration            `json:"waf"`
+	Bots         bool                        `json:"bot_detection"`
+	Critical     bool                        `json:"critical"`
+	Response     StaticResponse              `json:"response"`
+	Redirect     RedirectConfiguration       `json:"redirect"`
+	Maintenance  MaintenanceConfiguration    `json:"maintenance"`
+	Composite    CompositeConfiguration      `json:"composite"`
+	OpenAPI      OpenAPIConfiguration        `json:"openapi"`
+}
+
+// OpenAPIConfiguration validates the requests to an application against an
+// OpenAPI 3 document (in JSON or YAML). The paths of the document are
+// relative to the base path, which defaults to the path of path routing.
+type OpenAPIConfiguration struct {
+	Spec        string `json:"spec"`
+	BasePath    string `json:"base_path"`
+	MaxBodySize int64  `json:"max_body_size"`
+}
+
+// CompositeConfiguration composes the responses to an application's requests
+// from the JSON responses of several endpoints, which are requested in
+// parallel. Without a template, the responses are merged into an object with
+// a property for each endpoint.
+type CompositeConfiguration struct {
+	Endpoints   map[string]CompositeEndpoint `json:"endpoints"`
+	Template    string                       `json:"template"`
+	Timeout     string                       `json:"timeout"`
+	MaxBodySize int64                        `json:"max_body_size"`
+}
+
+// CompositeEndpoint is an endpoint that a composite application requests
+// with GET. The URL may contain the parameters of the route (like `${id}`).
+// Unless the endpoint is optional, the whole request fails when it fails.
+type CompositeEndpoint struct {
+	Url            string            `json:"url"`
+	Headers        map[string]string `json:"headers"`
+	ForwardHeaders []string          `json:"forward_headers"`
+	Optional       bool              `json:"optional"`
+}
+
+// MaintenanceConfiguration puts an application into maintenance mode, in
+// which its requests are answered with a 503 status (and the given page)
+// instead of being proxied. Maintenance mode can also be toggled at runtime.
+type MaintenanceConfiguration struct {
+	Enabled     bool   `json:"enabled"`
+	RetryAfter  string `json:"retry_after"`
+	ContentType string `json:"content_type"`
+	Body        string `json:"body"`
+}
+
+// StaticResponse is the fixed response that an application without an
+// upstream answers all of its requests with, like a maintenance page. The
+// status defaults to 200 and the content type to plain text.
+type StaticResponse struct {
+	Status      int               `json:"status"`
+	ContentType string            `json:"content_type"`
+	Body        string            `json:"body"`
+	Headers     map[string]string `json:"headers"`
+}
+
+// RedirectConfiguration redirects all requests to an application without an
+// upstream, like legacy URLs. The URL may contain the parameters of the
+// route (like `${id}`, or `${path}` for the rest of the path of path and
+// host routing). The status defaults to 301.
+type RedirectConfiguration struct {
+	Url       string `json:"url"`
+	Status    int    `json:"status"`
+	KeepQuery bool   `json:"keep_query"`
+}
+
+// HasBackend reports whether an application proxies its requests to the
+// upstreams of its backend. Applications with a static response, a redirect
+// or composite responses have no backend.
+func (a *Application) HasBackend() bool {
+	return !a.Static() && len(a.Composite.Endpoints) == 0
+}
+
+// Static reports whether an application answers requests by itself (with a
+// static response or a redirect) instead of proxying them to upstreams.
+func (a *Application) Static() bool {
+	return a.Redirect.Url != "" || a.Response.Status != 0 || a.Response.Body != ""
+}
+
+// BotDetectionConfiguration contains the rules that detect bots and
+// scanners, and the delay of tarpitted requests.
+type BotDetectionConfiguration struct {
+	Rules       []BotRule `json:"rules"`
+	TarpitDelay string    `json:"tarpit_delay"`
+	MaxTarpits  int       `json:"max_tarpits"`
+}
+
+// BotRule matches clients by their user agent and by the rate at which they
+// send requests (optionally only counting responses with some statuses,
+// like the 404s caused by scanners). The action is one of block, tarpit or
+// log.
+type BotRule struct {
+	Name       string   `json:"name"`
+	UserAgents []string `json:"user_agents"`
+	Rate       int      `json:"rate"`
+	Window     string   `json:"window"`
+	Statuses   []int    `json:"statuses"`
+	Action     string   `json:"action"`
+}
+
+// WafConfiguration contains rules that block obviously malicious requests.
+// Denied URL patterns are matched against the path and query of requests,
+// and denied body patterns against the first MaxBodyScan bytes of the body.
+type WafConfiguration struct {
+	BlockedMethods []string `json:"blocked_methods"`
+	MaxHeaders     int      `json:"max_headers"`
+	MaxHeaderSize  int      `json:"max_header_size"`
+	DeniedUrls     []string `json:"denied_urls"`
+	DeniedBodies   []string `json:"denied_bodies"`
+	MaxBodyScan    int64    `json:"max_body_scan"`
+}
+
+// IPFilterConfiguration lists the networks (as IP addresses or CIDR ranges)
+// that requests are allowed from or denied from.
+type IPFilterConfiguration struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// SecurityHeaders configures the security-related headers that are added
+// to the responses of an application. Empty values use the defaults, and
+// the value "-" omits a header.
+type SecurityHeaders struct {
+	Enabled                 bool   `json:"enabled"`
+	StrictTransportSecurity string `json:"strict_transport_security"`
+	ContentTypeOptions      string `json:"content_type_options"`
+	FrameOptions            string `json:"frame_options"`
+	ReferrerPolicy          string `json:"referrer_policy"`
+	ContentSecurityPolicy   string `json:"content_security_policy"`
+	Override                bool   `json:"override"`
+}
+
+// CorsConfiguration lets the gateway answer CORS preflight requests to an
+// application itself, and add the CORS headers to its responses.
+type CorsConfiguration struct {
+	Enabled          bool     `json:"enabled"`
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           int      `json:"max_age"`
+}
+
+type CompressionConfiguration struct {
+	Enabled      bool     `json:"enabled"`
+	Encodings    []string `json:"encodings"`
+	ContentTypes []string `json:"content_types"`
+	MinSize      int64    `json:"min_size"`
+	Level        int      `json:"level"`
+	Decompress   bool     `json:"decompress"`
+}
+
+type RequestBodyConfiguration struct {
+	MaxSize   int64  `json:"max_size"`
+	Buffering string `json:"buffering"`
+}
+
+type BodyTransformation struct {
+	Request     string `json:"request"`
+	Response    string `json:"response"`
+	MaxBodySize int64  `json:"max_body_size"`
+	Timeout     string `json:"timeout"`
+}
+
+type HeaderTransformation struct {
+	Request  []HeaderRule `json:"request"`
+	Response []HeaderRule `json:"response"`
+}
+
+type HeaderRule struct {
+	Action  string `json:"action"`
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	To      string `json:"to"`
+	Pattern string `json:"pattern"`
 }
 
 type Routing struct {
-	Type     string            `json:"type"`
-	Path     string            `json:"path"`
-	Patterns map[string]string `json:"patterns"`
-	Hostname string            `json:"hostname"`
+	Type     string                          `json:"type"`
+	Path     string                          `json:"path"`
+	Patterns map[string]string               `json:"patterns"`
+	Hostname string                          `json:"hostname"`
+	Hosts    []string                        `json:"hosts"`
+	Match    RouteMatch                      `json:"match"`
+	Priority int                             `json:"priority"`
+	Methods  map[string][]string             `json:"methods"`
+	Timeouts map[string]TimeoutConfiguration `json:"timeouts"`
+	Rewrites []RewriteRule                   `json:"rewrites"`
+}
+
+// RouteMatch restricts the routes of an application to requests with
+// certain methods, headers or query parameters, so that several
+// applications can share a route (like for API versions).
+type RouteMatch struct {
+	Methods []string          `json:"methods"`
+	Headers map[string]string `json:"headers"`
+	Query   map[string]string `json:"query"`
+}
+
+// HostNames returns the host names that the routes of an application are
+// restricted to (from both `hostname` and `hosts`), in lower case. Without
+// host names, the routes are used for any host.
+func (r *Routing) HostNames() []string {
+	hosts := make([]string, 0, len(r.Hosts)+1)
+	if r.Hostname != "" {
+		hosts = append(hosts, strings.ToLower(r.Hostname))
+	}
+
+	for _, host := range r.Hosts {
+		hosts = append(hosts, strings.ToLower(host))
+	}
+
+	return hosts
+}
+
+type RewriteRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	MatchQuery  bool   `json:"match_query"`
+	Last        bool   `json:"last"`
 }
 
 type Backend struct {
-	Url      string `json:"url"`
-	Service  string `json:"service"`
-	Tag      string `json:"tag"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Url           string                     `json:"url"`
+	Upstreams     []Upstream                 `json:"upstreams"`
+	LoadBalancing LoadBalancingConfiguration `json:"load_balancing"`
+	Service       string                     `json:"service"`
+	Tag           string                     `json:"tag"`
+	Username      string                     `json:"username"`
+	Password      string                     `json:"password"`
+	FlushInterval string                     `json:"flush_interval"`
+	Transport     BackendTransport           `json:"transport"`
+	HealthCheck   HealthCheckConfiguration   `json:"health_check"`
+	Timeouts      TimeoutConfiguration       `json:"timeouts"`
+	Mirror        MirrorConfiguration        `json:"mirror"`
+	Groups        []UpstreamGroup            `json:"groups"`
+	Kubernetes    KubernetesBackend          `json:"kubernetes"`
+	Dns           DnsBackend                 `json:"dns"`
+	Concurrency   ConcurrencyConfiguration   `json:"concurrency"`
+}
+
+// ConcurrencyConfiguration limits the number of requests that are proxied
+// to each upstream at the same time. Requests that exceed the limit wait in
+// a queue for a free slot.
+type ConcurrencyConfiguration struct {
+	MaxInFlight  int    `json:"max_in_flight"`
+	QueueSize    int    `json:"queue_size"`
+	QueueTimeout string `json:"queue_timeout"`
+}
+
+// DnsBackend selects a DNS name whose records are the upstreams of an
+// application.
+type DnsBackend struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Port   int    `json:"port"`
+	Scheme string `json:"scheme"`
+	Ttl    string `json:"ttl"`
+}
+
+type MirrorConfiguration struct {
+	Url           string  `json:"url"`
+	Percentage    float64 `json:"percentage"`
+	Timeout       string  `json:"timeout"`
+	MaxBodySize   int64   `json:"max_body_size"`
+	MaxConcurrent int     `json:"max_concurrent"`
+}
+
+type TimeoutConfiguration struct {
+	Connect        string `json:"connect"`
+	ResponseHeader string `json:"response_header"`
+	Total          string `json:"total"`
+}
+
+// Merge returns a copy of the timeouts in which the timeouts that are set in
+// the override replace the original ones.
+func (t TimeoutConfiguration) Merge(override TimeoutConfiguration) TimeoutConfiguration {
+	if override.Connect != "" {
+		t.Connect = override.Connect
+	}
+
+	if override.ResponseHeader != "" {
+		t.ResponseHeader = override.ResponseHeader
+	}
+
+	if override.Total != "" {
+		t.Total = override.Total
+	}
+
+	return t
+}
+
+type UpstreamGroup struct {
+	Name      string            `json:"name"`
+	Weight    float64           `json:"weight"`
+	Url       string            `json:"url"`
+	Upstreams []Upstream        `json:"upstreams"`
+	Headers   map[string]string `json:"headers"`
+	Claims    map[string]string `json:"claims"`
+}
+
+type Upstream struct {
+	Url    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+type LoadBalancingConfiguration struct {
+	Strategy   string `json:"strategy"`
+	HashHeader string `json:"hash_header"`
+	HashClaim  string `json:"hash_claim"`
+	Discover   bool   `json:"discover"`
+}
+
+type HealthCheckConfiguration struct {
+	Enabled            bool   `json:"enabled"`
+	Path               string `json:"path"`
+	ExpectedStatus     int    `json:"expected_status"`
+	Interval           string `json:"interval"`
+	Timeout            string `json:"timeout"`
+	HealthyThreshold   int    `json:"healthy_threshold"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold"`
+}
+
+type BackendTransport struct {
+	Protocol            string `json:"protocol"`
+	DialTimeout         string `json:"dial_timeout"`
+	IdleConnTimeout     string `json:"idle_conn_timeout"`
+	MaxIdleConnsPerHost int    `json:"max_idle_conns_per_host"`
+	CaFile              string `json:"ca_file"`
+	CertFile            string `json:"cert_file"`
+	KeyFile             string `json:"key_file"`
+	Cert                string `json:"cert"`
+	Key                 string `json:"key"`
+	ServerName          string `json:"server_name"`
+	InsecureSkipVerify  bool   `json:"insecure_skip_verify"`
 }
 
 type RedisConfiguration struct {
-	Address  string `json:"address"`
-	Password string `json:"password"`
-	Database int    `json:"database"`
+	Mode             string                `json:"mode"`
+	Address          string                `json:"address"`
+	Addresses        []string              `json:"addresses"`
+	MasterName       string                `json:"master_name"`
+	Username         string                `json:"username"`
+	Password         string                `json:"password"`
+	SentinelPassword string                `json:"sentinel_password"`
+	Database         int                   `json:"database"`
+	TLS              RedisTLSConfiguration `json:"tls"`
+}
+
+type RedisTLSConfiguration struct {
+	Enabled            bool   `json:"enabled"`
+	CaFile             string `json:"ca_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+type TokenStoreConfiguration struct {
+	Type           string                       `json:"type"`
+	LocalCacheSize int                          `json:"local_cache_size"`
+	KeyPrefix      string                       `json:"key_prefix"`
+	IdleTimeout    string                       `json:"idle_timeout"`
+	RedisCluster   RedisClusterConfiguration    `json:"redis_cluster"`
+	Etcd           EtcdConfiguration            `json:"etcd"`
+	Degradation    DegradationConfiguration     `json:"degradation"`
+	Encryption     TokenEncryptionConfiguration `json:"encryption"`
+}
+
+type TokenEncryptionConfiguration struct {
+	Keys []string `json:"keys"`
+}
+
+type DegradationConfiguration struct {
+	Enabled       bool   `json:"enabled"`
+	RetryInterval string `json:"retry_interval"`
+	FallbackSize  int    `json:"fallback_size"`
+	AcceptJwts    bool   `json:"accept_jwts"`
+
+	// RevocationFailOpen accepts tokens whose revocation cannot be checked
+	// while the store is degraded. By default, they are rejected.
+	RevocationFailOpen bool `json:"revocation_fail_open"`
+}
+
+type RedisClusterConfiguration struct {
+	Addresses []string              `json:"addresses"`
+	Username  string                `json:"username"`
+	Password  string                `json:"password"`
+	TLS       RedisTLSConfiguration `json:"tls"`
+}
+
+type EtcdConfiguration struct {
+	Endpoints []string `json:"endpoints"`
+	Username  string   `json:"username"`
+	Password  string   `json:"password"`
+	Prefix    string   `json:"prefix"`
 }
 
 type ConsulConfiguration struct {
@@ -83,13 +559,104 @@ func (c *ConsulConfiguration) BuildConsulClient() (*api.Client, error) {
 	return api.NewClient(c.BuildConsulConfig())
 }
 
-func (c RedisConfiguration) DialOptions() []redis.DialOption {
+// DialOptions returns the options for connections to the Redis server (or,
+// in sentinel mode, the master).
+func (c RedisConfiguration) DialOptions() ([]redis.DialOption, error) {
 	var dialOpts []redis.DialOption
-	dialOpts = append(dialOpts, redis.DialDatabase(c.Database))
+	if c.Mode != "cluster" {
+		dialOpts = append(dialOpts, redis.DialDatabase(c.Database))
+	}
+	if len(c.Username) > 0 {
+		dialOpts = append(dialOpts, redis.DialUsername(c.Username))
+	}
 	if len(c.Password) > 0 {
 		dialOpts = append(dialOpts, redis.DialPassword(c.Password))
 	}
-	return dialOpts
+	return c.TLS.appendDialOptions(dialOpts)
+}
+
+// SentinelDialOptions returns the options for connections to the sentinels.
+func (c RedisConfiguration) SentinelDialOptions() ([]redis.DialOption, error) {
+	var dialOpts []redis.DialOption
+	if len(c.SentinelPassword) > 0 {
+		dialOpts = append(dialOpts, redis.DialPassword(c.SentinelPassword))
+	}
+	return c.TLS.appendDialOptions(dialOpts)
+}
+
+func (c RedisClusterConfiguration) DialOptions() ([]redis.DialOption, error) {
+	var dialOpts []redis.DialOption
+	if len(c.Username) > 0 {
+		dialOpts = append(dialOpts, redis.DialUsername(c.Username))
+	}
+	if len(c.Password) > 0 {
+		dialOpts = append(dialOpts, redis.DialPassword(c.Password))
+	}
+	return c.TLS.appendDialOptions(dialOpts)
+}
+
+func (c RedisTLSConfiguration) appendDialOptions(dialOpts []redis.DialOption) ([]redis.DialOption, error) {
+	if !c.Enabled {
+		return dialOpts, nil
+	}
+
+	tlsConfig := tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CaFile != "" {
+		caPEM, err := ioutil.ReadFile(c.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read redis CA file: %s", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in redis CA file %s", c.CaFile)
+		}
+	}
+
+	dialOpts = append(dialOpts, redis.DialUseTLS(true), redis.DialTLSConfig(&tlsConfig))
+	return dialOpts, nil
+}
+
+func (c BackendTransport) TLSConfig() (*tls.Config, error) {
+	tlsConfig := tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CaFile != "" {
+		caPEM, err := ioutil.ReadFile(c.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read backend CA file: %s", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in backend CA file %s", c.CaFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load backend client certificate: %s", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if c.Cert != "" || c.Key != "" {
+		// PEM content, for example from a secret in Vault
+		cert, err := tls.X509KeyPair([]byte(c.Cert), []byte(c.Key))
+		if err != nil {
+			return nil, fmt.Errorf("could not load backend client certificate: %s", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &tlsConfig, nil
 }
 
 func (c ConsulConfiguration) Address() string {
@@ -97,21 +664,183 @@ func (c ConsulConfiguration) Address() string {
 }
 
 type ProxyConfiguration struct {
-	StripResponseHeaders map[string]bool      `json:"strip_res_headers"`
-	SetResponseHeaders   map[string]string    `json:"set_res_headers"`
-	SetRequestHeaders    map[string]string    `json:"set_req_headers"`
-	OptionsConfiguration OptionsConfiguration `json:"options"`
+	StripResponseHeaders map[string]bool        `json:"strip_res_headers"`
+	SetResponseHeaders   map[string]string      `json:"set_res_headers"`
+	SetRequestHeaders    map[string]string      `json:"set_req_headers"`
+	OptionsConfiguration OptionsConfiguration   `json:"options"`
+	FlushInterval        string                 `json:"flush_interval"`
+	Http2                bool                   `json:"http2"`
+	Forwarded            ForwardedConfiguration `json:"forwarded"`
+}
+
+type ForwardedConfiguration struct {
+	Mode           string   `json:"mode"`
+	TrustedProxies []string `json:"trusted_proxies"`
+	Rfc7239        bool     `json:"rfc7239"`
+}
+
+type RetryConfiguration struct {
+	Attempts      int                      `json:"attempts"`
+	Methods       []string                 `json:"methods"`
+	Statuses      []int                    `json:"statuses"`
+	Backoff       string                   `json:"backoff"`
+	MaxBackoff    string                   `json:"max_backoff"`
+	PerTryTimeout string                   `json:"per_try_timeout"`
+	Budget        RetryBudgetConfiguration `json:"budget"`
+}
+
+type RetryBudgetConfiguration struct {
+	Ratio        float64 `json:"ratio"`
+	MinPerSecond int     `json:"min_per_second"`
+}
+
+type CircuitBreakerConfiguration struct {
+	Enabled          bool                   `json:"enabled"`
+	ErrorThreshold   float64                `json:"error_threshold"`
+	MinRequests      int                    `json:"min_requests"`
+	Window           string                 `json:"window"`
+	LatencyThreshold string                 `json:"latency_threshold"`
+	OpenDuration     string                 `json:"open_duration"`
+	HalfOpenRequests int                    `json:"half_open_requests"`
+	Fallback         CircuitBreakerFallback `json:"fallback"`
+}
+
+type CircuitBreakerFallback struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	Cache   bool              `json:"cache"`
+}
+
+type GrpcConfiguration struct {
+	Enabled bool `json:"enabled"`
+	Web     bool `json:"web"`
+}
+
+// GrpcEnabled reports whether any application is proxied via gRPC.
+func (c *Configuration) GrpcEnabled() bool {
+	for _, app := range c.Applications {
+		if app.Grpc.Enabled {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Http2Enabled reports whether HTTP/2 should be served to clients.
+func (c *Configuration) Http2Enabled() bool {
+	return c.Proxy.Http2 || c.GrpcEnabled()
 }
 
 type Caching struct {
-	Enabled   bool `json:"enabled"`
-	Ttl       int  `json:"ttl"`
-	AutoFlush bool `json:"auto_flush"`
+	Enabled              bool         `json:"enabled"`
+	Ttl                  int          `json:"ttl"`
+	AutoFlush            bool         `json:"auto_flush"`
+	Vary                 []string     `json:"vary"`
+	Routes               []CacheRoute `json:"routes"`
+	StaleWhileRevalidate int          `json:"stale_while_revalidate"`
+	StaleIfError         int          `json:"stale_if_error"`
+
+	// PerUser caches the responses to requests with credentials separately
+	// for each user, instead of only caching them if they are public.
+	PerUser bool `json:"per_user"`
+}
+
+// CacheRoute overrides the time-to-live of the cached responses to the
+// requests that match a path pattern, and how long they may be served
+// stale.
+type CacheRoute struct {
+	Path                 string `json:"path"`
+	Ttl                  int    `json:"ttl"`
+	StaleWhileRevalidate int    `json:"stale_while_revalidate"`
+	StaleIfError         int    `json:"stale_if_error"`
+}
+
+// CacheConfiguration configures the storage of cached responses: an
+// in-memory tier in each gateway instance, and optionally a Redis tier that
+// is shared by all instances.
+type CacheConfiguration struct {
+	Size               int    `json:"size"`
+	MaxBodySize        int64  `json:"max_body_size"`
+	Redis              bool   `json:"redis"`
+	SurrogateKeyHeader string `json:"surrogate_key_header"`
 }
 
 type RateLimiting struct {
-	Burst  int    `json:"burst"`
-	Window string `json:"window"`
+	Burst     int                `json:"burst"`
+	Window    string             `json:"window"`
+	Algorithm string             `json:"algorithm"`
+	Rejection RateLimitRejection `json:"rejection"`
+	Fallback  RateLimitFallback  `json:"fallback"`
+}
+
+// RateLimitFallback enables an in-memory rate limiter that is used while
+// Redis cannot be reached.
+type RateLimitFallback struct {
+	Enabled       bool   `json:"enabled"`
+	RetryInterval string `json:"retry_interval"`
+	Instances     int    `json:"instances"`
+}
+
+// RateLimitRejection is the response to requests that exceed the rate
+// limit.
+type RateLimitRejection struct {
+	ContentType string `json:"content_type"`
+	Body        string `json:"body"`
+}
+
+// RateLimitExemptions lists the clients whose requests to an application
+// are not rate limited, like monitoring probes or internal batch jobs.
+type RateLimitExemptions struct {
+	Networks []string          `json:"networks"`
+	Claims   map[string]string `json:"claims"`
+	ApiKeys  []string          `json:"api_keys"`
+}
+
+// RequiresAuthentication reports whether some of the exemptions are taken
+// from the result of the authentication.
+func (e *RateLimitExemptions) RequiresAuthentication() bool {
+	return len(e.Claims) > 0 || len(e.ApiKeys) > 0
+}
+
+// QuotaConfiguration defines the usage plans that limit the requests of
+// API keys and users per day and month.
+type QuotaConfiguration struct {
+	Plans       map[string]QuotaPlan `json:"plans"`
+	DefaultPlan string               `json:"default_plan"`
+	PlanClaim   string               `json:"plan_claim"`
+	Timezone    string               `json:"timezone"`
+}
+
+type QuotaPlan struct {
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+}
+
+// RateLimitKey determines which rate-limit bucket the requests to an
+// application are counted in.
+type RateLimitKey struct {
+	Type   string `json:"type"`
+	Claim  string `json:"claim"`
+	Header string `json:"header"`
+}
+
+// RequiresAuthentication reports whether the key is taken from the result
+// of the authentication, so that requests can only be counted after they
+// were authenticated.
+func (k *RateLimitKey) RequiresAuthentication() bool {
+	return k.Type == "subject" || k.Type == "claim" || k.Type == "api_key"
+}
+
+// RateLimitOverride replaces the burst and window of the default rate
+// limit for the requests to an application that match its path pattern and
+// methods.
+type RateLimitOverride struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+	Burst   int      `json:"burst"`
+	Window  string   `json:"window"`
 }
 
 type OptionsConfiguration struct {
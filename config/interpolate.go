@@ -0,0 +1,253 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	// only references with one of these prefixes are replaced, so that
+	// other values with `${...}` (like the references to capture groups and
+	// route parameters in rewrite rules, redirects and composites) are kept
+	referencePattern = regexp.MustCompile(`\$?\$\{(?:env|file|base64file|vault|base64vault):[^}]*\}`)
+	envNamePattern   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// SecretSource reads secrets from a secret store like Vault.
+type SecretSource interface {
+	// Secret returns the value of a key of the secret at the given path.
+	Secret(path string, key string) (string, error)
+}
+
+// SecretSourceFactory connects to the secret store that is configured in
+// the `vault` section. It is only called when the configuration references
+// secrets in Vault.
+type SecretSourceFactory func(cfg *VaultConfiguration) (SecretSource, error)
+
+// Interpolate replaces references in the string values of a JSON
+// configuration document:
+//
+//   - `${env:NAME}` with the value of an environment variable,
+//   - `${file:/path}` with the content of a file (like a Docker or
+//     Kubernetes secret), without trailing line breaks,
+//   - `${base64file:/path}` with the base64-encoded content of a file, for
+//     values that are decoded as bytes (like `verification_key`),
+//   - `${vault:path#key}` with a key of a secret in Vault, and
+//     `${base64vault:path#key}` with its base64-encoded value.
+//
+// Other `${...}` are kept, and `$${env:NAME}` (and so on) stands for a
+// literal `${env:NAME}`. Since the values are replaced after the
+// document was parsed, they do not need to be escaped for JSON. The `vault`
+// section is interpolated first (without Vault references), since it is
+// needed to connect to Vault.
+func Interpolate(content []byte, secrets SecretSourceFactory) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	i := interpolator{factory: secrets}
+
+	sections, ok := document.(map[string]interface{})
+	if !ok {
+		document, err := i.value(document)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(document)
+	}
+
+	if vault, ok := sections["vault"]; ok {
+		vault, err := i.value(vault)
+		if err != nil {
+			return nil, fmt.Errorf("vault: %s", err)
+		}
+		sections["vault"] = vault
+
+		vaultJson, err := json.Marshal(vault)
+		if err != nil {
+			return nil, err
+		}
+
+		i.vaultCfg = &VaultConfiguration{}
+		if err := json.Unmarshal(vaultJson, i.vaultCfg); err != nil {
+			return nil, fmt.Errorf("vault: %s", err)
+		}
+	}
+
+	for key, section := range sections {
+		if key == "vault" {
+			continue
+		}
+
+		interpolated, err := i.value(section)
+		if err != nil {
+			return nil, err
+		}
+		sections[key] = interpolated
+	}
+
+	return json.Marshal(sections)
+}
+
+// InterpolateIncluded replaces references in a document that is included
+// by a configuration (like an application definition), using the `vault`
+// section of that configuration to read secrets in Vault.
+func InterpolateIncluded(content []byte, vaultCfg *VaultConfiguration, secrets SecretSourceFactory) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	i := interpolator{factory: secrets, vaultCfg: vaultCfg}
+
+	document, err := i.value(document)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(document)
+}
+
+type interpolator struct {
+	factory  SecretSourceFactory
+	vaultCfg *VaultConfiguration
+	secrets  SecretSource
+}
+
+func (i *interpolator) value(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return i.string(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			interpolated, err := i.value(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = interpolated
+		}
+	case []interface{}:
+		for n, item := range v {
+			interpolated, err := i.value(item)
+			if err != nil {
+				return nil, err
+			}
+			v[n] = interpolated
+		}
+	}
+
+	return value, nil
+}
+
+func (i *interpolator) string(value string) (string, error) {
+	var err error
+
+	result := referencePattern.ReplaceAllStringFunc(value, func(reference string) string {
+		if strings.HasPrefix(reference, "$$") {
+			return reference[1:]
+		}
+
+		resolved, resolveErr := i.resolve(reference[2 : len(reference)-1])
+		if resolveErr != nil && err == nil {
+			err = resolveErr
+		}
+
+		return resolved
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return result, nil
+}
+
+func (i *interpolator) resolve(reference string) (string, error) {
+	if path, ok := strings.CutPrefix(reference, "file:"); ok {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("could not read secret file '%s': %s", path, err)
+		}
+
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	if path, ok := strings.CutPrefix(reference, "base64file:"); ok {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("could not read secret file '%s': %s", path, err)
+		}
+
+		return base64.StdEncoding.EncodeToString(content), nil
+	}
+
+	if secret, ok := strings.CutPrefix(reference, "vault:"); ok {
+		return i.vault(secret)
+	}
+
+	if secret, ok := strings.CutPrefix(reference, "base64vault:"); ok {
+		value, err := i.vault(secret)
+		if err != nil {
+			return "", err
+		}
+
+		return base64.StdEncoding.EncodeToString([]byte(value)), nil
+	}
+
+	name := strings.TrimPrefix(reference, "env:")
+	if !envNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid reference '${%s}' in configuration", reference)
+	}
+
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s referenced in configuration is not set", name)
+	}
+
+	return value, nil
+}
+
+// vault resolves a reference to a secret in Vault (`path#key`), and
+// connects to Vault on the first one.
+func (i *interpolator) vault(secret string) (string, error) {
+	hash := strings.LastIndex(secret, "#")
+	if hash <= 0 || hash == len(secret)-1 {
+		return "", fmt.Errorf("invalid vault reference '%s' in configuration (expected path#key)", secret)
+	}
+
+	if i.secrets == nil {
+		if i.vaultCfg == nil || i.vaultCfg.Address == "" {
+			return "", fmt.Errorf("vault secret '%s' referenced in configuration, but no vault address is configured", secret)
+		}
+
+		if i.factory == nil {
+			return "", fmt.Errorf("vault secret '%s' cannot be referenced here", secret)
+		}
+
+		secrets, err := i.factory(i.vaultCfg)
+		if err != nil {
+			return "", fmt.Errorf("could not connect to Vault: %s", err)
+		}
+		i.secrets = secrets
+	}
+
+	value, err := i.secrets.Secret(secret[:hash], secret[hash+1:])
+	if err != nil {
+		return "", fmt.Errorf("could not read vault secret '%s': %s", secret, err)
+	}
+
+	return value, nil
+}
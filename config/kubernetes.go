@@ -0,0 +1,19 @@
+package config
+
+type KubernetesConfiguration struct {
+	Enabled      bool   `json:"enabled"`
+	ApiServer    string `json:"api_server"`
+	TokenFile    string `json:"token_file"`
+	CaFile       string `json:"ca_file"`
+	Namespace    string `json:"namespace"`
+	Routes       string `json:"routes"`
+	IngressClass string `json:"ingress_class"`
+}
+
+// KubernetesBackend selects the Kubernetes service whose endpoints are the
+// upstreams of an application.
+type KubernetesBackend struct {
+	Service   string `json:"service"`
+	Namespace string `json:"namespace"`
+	Port      string `json:"port"`
+}
@@ -10,8 +10,21 @@ type ApacheLoggingConfiguration struct {
 	Filename string `json:"filename"`
 }
 
+type JsonLoggingConfiguration struct {
+	MaxSize    int    `json:"max_size"`
+	MaxBackups int    `json:"max_backups"`
+	UserClaim  string `json:"user_claim"`
+}
+
 type LoggingConfiguration struct {
 	Type string `json:"type"`
 	AmqpLoggingConfiguration
 	ApacheLoggingConfiguration
+	JsonLoggingConfiguration
+}
+
+type LogRedactionConfiguration struct {
+	Headers         []string `json:"headers"`
+	QueryParameters []string `json:"query_parameters"`
+	JsonFields      []string `json:"json_fields"`
 }
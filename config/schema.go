@@ -0,0 +1,235 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// defaults are the values that the gateway uses for properties that are not
+// set, by the name of the type that declares the property and its JSON
+// name. They are included in the JSON schema.
+var defaults = map[string]interface{}{
+	"AcmeConfiguration.storage":                      "redis",
+	"ApiKeyConfig.header":                            "X-API-Key",
+	"ApiKeyConfig.query_param":                       "api_key",
+	"AuditConfiguration.tag":                         "servicegateway",
+	"AuditConfiguration.timeout":                     "5s",
+	"AuthorizationConfig.role_claim":                 "roles",
+	"AuthorizationConfig.scope_claim":                "scope",
+	"BackendTransport.max_idle_conns_per_host":       2,
+	"BackendTransport.protocol":                      "auto",
+	"BasicAuthConfig.cache_ttl":                      "5m",
+	"BodyTransformation.max_body_size":               1048576,
+	"BodyTransformation.timeout":                     "100ms",
+	"BotDetectionConfiguration.max_tarpits":          100,
+	"BotDetectionConfiguration.tarpit_delay":         "10s",
+	"CacheConfiguration.max_body_size":               1048576,
+	"CacheConfiguration.size":                        4096,
+	"CacheConfiguration.surrogate_key_header":        "Surrogate-Key",
+	"Caching.ttl":                                    60,
+	"Caching.vary":                                   []string{"Accept"},
+	"CircuitBreakerConfiguration.error_threshold":    0.5,
+	"CircuitBreakerConfiguration.half_open_requests": 1,
+	"CircuitBreakerConfiguration.min_requests":       20,
+	"CircuitBreakerConfiguration.open_duration":      "30s",
+	"CircuitBreakerConfiguration.window":             "10s",
+	"CircuitBreakerFallback.status":                  503,
+	"ClientCertificateAuthConfig.subject_source":     "cn",
+	"ClientIPConfiguration.header":                   "X-Forwarded-For",
+	"CompositeConfiguration.max_body_size":           1048576,
+	"CompositeConfiguration.timeout":                 "10s",
+	"CompressionConfiguration.encodings":             []string{"br", "gzip"},
+	"CompressionConfiguration.min_size":              1024,
+	"ConcurrencyConfiguration.queue_timeout":         "5s",
+	"CookieSessionConfig.csrf_cookie":                "XSRF-TOKEN",
+	"CookieSessionConfig.csrf_header":                "X-XSRF-TOKEN",
+	"CookieSessionConfig.same_site":                  "lax",
+	"CorsConfiguration.allowed_headers":              []string{"Accept", "Authorization", "Content-Type", "X-Requested-With"},
+	"CorsConfiguration.allowed_methods":              []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+	"DnsBackend.scheme":                              "http",
+	"DnsBackend.ttl":                                 "30s",
+	"DnsBackend.type":                                "srv",
+	"ExternalAuthorizationConfig.timeout":            "5s",
+	"ForwardedConfiguration.mode":                    "append",
+	"GlobalAuth.verification_cache_size":             10000,
+	"HealthCheckConfiguration.healthy_threshold":     2,
+	"HealthCheckConfiguration.interval":              "10s",
+	"HealthCheckConfiguration.path":                  "/",
+	"HealthCheckConfiguration.timeout":               "2s",
+	"HealthCheckConfiguration.unhealthy_threshold":   3,
+	"ImpersonationConfig.admin_claim":                "admin",
+	"ImpersonationConfig.token_ttl":                  "15m",
+	"ImpersonationConfig.uri":                        "/auth/impersonate",
+	"IntrospectionConfig.uri":                        "/auth/introspect",
+	"JsonLoggingConfiguration.max_backups":           5,
+	"JsonLoggingConfiguration.user_claim":            "sub",
+	"JwtIssuerConfig.issuer":                         "servicegateway",
+	"JwtIssuerConfig.token_ttl":                      "1h",
+	"KubernetesConfiguration.ingress_class":          "servicegateway",
+	"LoadBalancingConfiguration.strategy":            "round_robin",
+	"LoginThrottlingConfig.base_lockout":             "1s",
+	"LoginThrottlingConfig.ip_threshold":             20,
+	"LoginThrottlingConfig.max_lockout":              "15m",
+	"LoginThrottlingConfig.user_threshold":           5,
+	"LoginThrottlingConfig.window":                   "15m",
+	"MirrorConfiguration.max_body_size":              1048576,
+	"MirrorConfiguration.max_concurrent":             100,
+	"MirrorConfiguration.timeout":                    "10s",
+	"OIDCProviderConfig.callback_uri":                "/auth/oidc/callback",
+	"OIDCProviderConfig.login_uri":                   "/auth/oidc/login",
+	"OIDCProviderConfig.scopes":                      []string{"openid", "profile", "email"},
+	"OPAConfig.decision_path":                        "servicegateway/allow",
+	"OPAConfig.reload_interval":                      "30s",
+	"OPAConfig.timeout":                              "5s",
+	"OpenAPIConfiguration.max_body_size":             1048576,
+	"ProviderAuthConfig.authentication_uri":          "/authenticate",
+	"ProviderAuthConfig.logout_uri":                  "/auth/logout",
+	"ProviderAuthConfig.mfa_uri":                     "/auth/mfa",
+	"ProviderAuthConfig.refresh_uri":                 "/auth/refresh",
+	"ProviderAuthConfig.type":                        "rest",
+	"ProviderRequestConfig.format":                   "json",
+	"ProviderRequestConfig.password_field":           "password",
+	"ProviderRequestConfig.username_field":           "username",
+	"QuotaConfiguration.plan_claim":                  "rate_limit_tier",
+	"QuotaConfiguration.timezone":                    "UTC",
+	"RateLimitKey.type":                              "authorization",
+	"RateLimitRejection.body":                        `{"msg":"rate limit exceeded"}`,
+	"RateLimitRejection.content_type":                "application/json",
+	"RateLimiting.algorithm":                         "fixed_window",
+	"RedirectConfiguration.status":                   301,
+	"RedisConfiguration.mode":                        "standalone",
+	"RequestBodyConfiguration.buffering":             "auto",
+	"RequestIdConfiguration.header":                  "X-Request-Id",
+	"RetryBudgetConfiguration.min_per_second":        10,
+	"RetryBudgetConfiguration.ratio":                 0.2,
+	"RetryConfiguration.backoff":                     "25ms",
+	"RetryConfiguration.max_backoff":                 "250ms",
+	"RetryConfiguration.methods":                     []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE"},
+	"RetryConfiguration.statuses":                    []int{502, 503, 504},
+	"SAMLProviderConfig.acs_uri":                     "/auth/saml/acs",
+	"SAMLProviderConfig.login_uri":                   "/auth/saml/login",
+	"SAMLProviderConfig.metadata_uri":                "/auth/saml/metadata",
+	"SecurityHeaders.content_security_policy":        "default-src 'none'; frame-ancestors 'none'",
+	"SecurityHeaders.content_type_options":           "nosniff",
+	"SecurityHeaders.frame_options":                  "DENY",
+	"SecurityHeaders.referrer_policy":                "strict-origin-when-cross-origin",
+	"SecurityHeaders.strict_transport_security":      "max-age=31536000; includeSubDomains",
+	"ShutdownConfiguration.drain_timeout":            "30s",
+	"StaticResponse.content_type":                    "text/plain; charset=utf-8",
+	"StaticResponse.status":                          200,
+	"TLSConfiguration.min_version":                   "1.2",
+	"TLSConfiguration.reload_interval":               "30s",
+	"TokenStoreConfiguration.local_cache_size":       128,
+	"TokenStoreConfiguration.type":                   "redis",
+	"TracingConfiguration.endpoint":                  "localhost:4318",
+	"TracingConfiguration.sample_ratio":              1,
+	"TracingConfiguration.service_name":              "servicegateway",
+	"Upstream.weight":                                1,
+	"VaultConfiguration.auth_method":                 "token",
+	"VaultConfiguration.refresh_interval":            "5m",
+	"WafConfiguration.max_body_scan":                 65536,
+}
+
+// Schema describes the JSON documents that the given configuration type
+// (like Configuration, or Application for application definitions) is
+// decoded from as JSON schema (draft 7), including the default values of
+// its properties. Unknown properties are not allowed by the schema.
+func Schema(v interface{}) map[string]interface{} {
+	g := schemaGenerator{definitions: make(map[string]interface{})}
+	t := reflect.TypeOf(v)
+
+	schema := g.structSchema(t)
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "servicegateway " + t.Name()
+
+	if len(g.definitions) > 0 {
+		schema["definitions"] = g.definitions
+	}
+
+	return schema
+}
+
+type schemaGenerator struct {
+	definitions map[string]interface{}
+}
+
+func (g *schemaGenerator) typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		// byte values are base64-encoded, like keys
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.typeSchema(t.Elem())}
+	case reflect.Struct:
+		// named types are described once, and referenced
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+
+		if _, ok := g.definitions[t.Name()]; !ok {
+			g.definitions[t.Name()] = nil
+			g.definitions[t.Name()] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	}
+
+	// any value
+	return map[string]interface{}{}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	g.addProperties(t, properties)
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// addProperties adds the properties of a struct, including those of
+// embedded structs, which are decoded from the same JSON object.
+func (g *schemaGenerator) addProperties(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			g.addProperties(field.Type, properties)
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		property := g.typeSchema(field.Type)
+		if value, ok := defaults[t.Name()+"."+name]; ok {
+			property["default"] = value
+		}
+		properties[name] = property
+	}
+}
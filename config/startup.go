@@ -5,8 +5,11 @@ type Startup struct {
 	ConfigFile      string
 	DispatchingMode string
 	ConsulBaseKey   string
+	EtcdPrefix      string
 	UiDir           string
 	Port            int
+	TlsCertFile     string
+	TlsKeyFile      string
 	AdminAddress    string
 	AdminPort       int
 	MonitorAddress  string
@@ -18,3 +21,7 @@ type Startup struct {
 func (s *Startup) IsConsulConfig() bool {
 	return len(s.ConsulBaseKey) > 0
 }
+
+func (s *Startup) IsEtcdConfig() bool {
+	return len(s.EtcdPrefix) > 0
+}
@@ -0,0 +1,247 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// maxYAMLDepth limits the nesting of mappings and sequences.
+	maxYAMLDepth = 100
+
+	// maxYAMLAliasNodes limits the values that are produced by expanding
+	// aliases, so that a document with nested aliases (like "billion
+	// laughs") cannot exhaust the memory.
+	maxYAMLAliasNodes = 100000
+)
+
+// yamlConverter converts YAML nodes into the values of a JSON document.
+type yamlConverter struct {
+	depth      int
+	aliases    int
+	aliasNodes int
+}
+
+// YAMLToJSON converts a YAML document to JSON, so that it is decoded (and
+// interpolated) like a JSON configuration. Anchors, aliases and merge keys
+// (`<<`) are resolved; duplicate keys, keys that are not strings and
+// multiple documents are rejected, as are documents whose aliases expand to
+// too many values or that are nested too deeply. Top-level keys that start
+// with `x-` are removed, so that they can hold anchors without being
+// rejected as unknown properties.
+func YAMLToJSON(content []byte) ([]byte, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+
+	var document yaml.Node
+	if err := decoder.Decode(&document); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("empty YAML document")
+		}
+		return nil, err
+	}
+
+	var next yaml.Node
+	if err := decoder.Decode(&next); err != io.EOF {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("yaml: line %d: only one document is supported", next.Line)
+	}
+
+	var converter yamlConverter
+	value, err := converter.value(&document)
+	if err != nil {
+		return nil, err
+	}
+
+	if mapping, ok := value.(map[string]interface{}); ok {
+		for key := range mapping {
+			if strings.HasPrefix(key, "x-") {
+				delete(mapping, key)
+			}
+		}
+	}
+
+	return json.Marshal(value)
+}
+
+func (c *yamlConverter) value(node *yaml.Node) (interface{}, error) {
+	if c.aliases > 0 {
+		c.aliasNodes++
+		if c.aliasNodes > maxYAMLAliasNodes {
+			return nil, fmt.Errorf("yaml: line %d: aliases expand to more than %d values", node.Line, maxYAMLAliasNodes)
+		}
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return c.value(node.Content[0])
+	case yaml.AliasNode:
+		c.aliases++
+		defer func() { c.aliases-- }()
+
+		return c.value(node.Alias)
+	case yaml.MappingNode:
+		if err := c.enter(node); err != nil {
+			return nil, err
+		}
+		defer c.leave()
+
+		return c.mapping(node)
+	case yaml.SequenceNode:
+		if err := c.enter(node); err != nil {
+			return nil, err
+		}
+		defer c.leave()
+
+		values := make([]interface{}, len(node.Content))
+		for i, item := range node.Content {
+			value, err := c.value(item)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	case yaml.ScalarNode:
+		return yamlScalar(node)
+	}
+
+	return nil, fmt.Errorf("yaml: line %d: unsupported node", node.Line)
+}
+
+func (c *yamlConverter) enter(node *yaml.Node) error {
+	c.depth++
+	if c.depth > maxYAMLDepth {
+		return fmt.Errorf("yaml: line %d: values are nested deeper than %d levels", node.Line, maxYAMLDepth)
+	}
+
+	return nil
+}
+
+func (c *yamlConverter) leave() {
+	c.depth--
+}
+
+// mapping converts a mapping. Keys of merged mappings do not override
+// the keys of the mapping itself, and earlier merged mappings take
+// precedence over later ones.
+func (c *yamlConverter) mapping(node *yaml.Node) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(node.Content)/2)
+	var merged []*yaml.Node
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		if key.Kind == yaml.ScalarNode && key.ShortTag() == "!!merge" {
+			if value.Kind == yaml.SequenceNode {
+				merged = append(merged, value.Content...)
+			} else {
+				merged = append(merged, value)
+			}
+			continue
+		}
+
+		if key.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("yaml: line %d: keys must be strings", key.Line)
+		}
+
+		if _, ok := values[key.Value]; ok {
+			return nil, fmt.Errorf("yaml: line %d: duplicate key '%s'", key.Line, key.Value)
+		}
+
+		converted, err := c.value(value)
+		if err != nil {
+			return nil, err
+		}
+		values[key.Value] = converted
+	}
+
+	for _, m := range merged {
+		converted, err := c.value(m)
+		if err != nil {
+			return nil, err
+		}
+
+		mapping, ok := converted.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("yaml: line %d: only mappings can be merged", m.Line)
+		}
+
+		for key, value := range mapping {
+			if _, ok := values[key]; !ok {
+				values[key] = value
+			}
+		}
+	}
+
+	return values, nil
+}
+
+func yamlScalar(node *yaml.Node) (interface{}, error) {
+	switch node.ShortTag() {
+	case "!!null":
+		return nil, nil
+	case "!!bool":
+		var b bool
+		err := node.Decode(&b)
+		return b, err
+	case "!!int":
+		var i int64
+		if err := node.Decode(&i); err == nil {
+			return i, nil
+		}
+
+		var u uint64
+		err := node.Decode(&u)
+		return u, err
+	case "!!float":
+		var f float64
+		if err := node.Decode(&f); err != nil {
+			return nil, err
+		}
+
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("yaml: line %d: %s cannot be used in the configuration", node.Line, node.Value)
+		}
+		return f, nil
+	}
+
+	// timestamps are kept as they were written, and binary values are
+	// already base64-encoded, like the byte values of JSON configurations
+	return node.Value, nil
+}
+
+// DecodeStrict decodes a JSON document, and rejects properties that the
+// target does not have.
+func DecodeStrict(content []byte, target interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(target)
+}
+
+// DecodeApplication decodes an application definition, which may be given
+// as JSON or YAML. YAML definitions are decoded strictly; JSON definitions
+// are not, so that existing definitions keep working.
+func DecodeApplication(content []byte, app *Application) error {
+	if json.Valid(content) {
+		return json.Unmarshal(content, app)
+	}
+
+	converted, err := YAMLToJSON(content)
+	if err != nil {
+		return err
+	}
+
+	return DecodeStrict(converted, app)
+}
@@ -0,0 +1,292 @@
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+)
+
+var defaultMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+var defaultHeaders = []string{"Accept", "Authorization", "Content-Type", "X-Requested-With"}
+
+// grpcWebHeaders are the request headers that gRPC-Web clients send, and
+// grpcWebExposedHeaders the response headers that they need to read.
+var (
+	grpcWebHeaders        = []string{"Grpc-Timeout", "X-Grpc-Web", "X-User-Agent"}
+	grpcWebExposedHeaders = []string{"Grpc-Status", "Grpc-Message"}
+)
+
+// Policy answers CORS preflight requests to an application, and adds the
+// CORS headers to the responses to cross-origin requests.
+type Policy struct {
+	anyOrigin   bool
+	origins     []*regexp.Regexp
+	methods     []string
+	anyHeader   bool
+	headers     map[string]bool
+	allowHeader string
+	exposed     string
+	credentials bool
+	maxAge      int
+}
+
+// NewPolicy compiles the CORS configuration of an application. Allowed
+// origins may contain `*` as a wildcard (like `https://*.example.com`), or
+// be regular expressions if they start with `^`.
+func NewPolicy(cfg *config.CorsConfiguration) (*Policy, error) {
+	p := Policy{
+		headers:     make(map[string]bool),
+		exposed:     strings.Join(cfg.ExposedHeaders, ", "),
+		credentials: cfg.AllowCredentials,
+		maxAge:      cfg.MaxAge,
+	}
+
+	if len(cfg.AllowedOrigins) == 0 {
+		return nil, fmt.Errorf("cors requires at least one allowed origin")
+	}
+
+	if cfg.MaxAge < 0 {
+		return nil, fmt.Errorf("cors max_age must not be negative")
+	}
+
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			// browsers do not send credentials to a wildcard origin, and
+			// echoing every origin instead would let any site read the
+			// responses to its users' credentialed requests
+			if cfg.AllowCredentials {
+				return nil, fmt.Errorf("cors allowed origin '*' cannot be combined with allow_credentials")
+			}
+
+			p.anyOrigin = true
+			continue
+		}
+
+		pattern := origin
+		if !strings.HasPrefix(origin, "^") {
+			pattern = "^" + strings.ReplaceAll(regexp.QuoteMeta(origin), `\*`, `[^/]*`) + "$"
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed origin '%s': %s", origin, err)
+		}
+		p.origins = append(p.origins, re)
+	}
+
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultMethods
+	}
+
+	for _, method := range methods {
+		p.methods = append(p.methods, strings.ToUpper(method))
+	}
+
+	allowedHeaders := cfg.AllowedHeaders
+	if len(allowedHeaders) == 0 {
+		allowedHeaders = defaultHeaders
+	}
+
+	for _, header := range allowedHeaders {
+		if header == "*" {
+			p.anyHeader = true
+			continue
+		}
+		p.headers[http.CanonicalHeaderKey(header)] = true
+	}
+
+	p.allowHeader = strings.Join(allowedHeaders, ", ")
+
+	return &p, nil
+}
+
+// AllowGrpcWeb additionally allows the headers of the gRPC-Web protocol, so
+// that gRPC-Web clients work with the origins, methods and credentials
+// settings of the policy.
+func (p *Policy) AllowGrpcWeb() {
+	if !p.anyHeader {
+		for _, header := range grpcWebHeaders {
+			if !p.headers[header] {
+				p.headers[header] = true
+				p.allowHeader += ", " + header
+			}
+		}
+	}
+
+	exposed := grpcWebExposedHeaders
+	if p.exposed != "" {
+		exposed = append([]string{p.exposed}, exposed...)
+	}
+	p.exposed = strings.Join(exposed, ", ")
+}
+
+func (p *Policy) originAllowed(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+
+	for _, re := range p.origins {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Policy) methodAllowed(method string) bool {
+	for _, m := range p.methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headersAllowed checks the headers that a preflight request announces.
+func (p *Policy) headersAllowed(requested string) bool {
+	if p.anyHeader {
+		return true
+	}
+
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !p.headers[http.CanonicalHeaderKey(header)] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setOrigin allows an origin to read a response.
+func (p *Policy) setOrigin(header http.Header, origin string) {
+	if p.anyOrigin {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if p.credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// preflight answers a preflight request. Requests from origins, or for
+// methods or headers that are not allowed, are rejected.
+func (p *Policy) preflight(rw http.ResponseWriter, req *http.Request, origin string) {
+	method := req.Header.Get("Access-Control-Request-Method")
+	requested := req.Header.Get("Access-Control-Request-Headers")
+
+	rw.Header().Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+
+	if !p.originAllowed(origin) || !p.methodAllowed(method) || !p.headersAllowed(requested) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(403)
+		_, _ = rw.Write([]byte(`{"msg":"cross-origin request not allowed"}`))
+		return
+	}
+
+	p.setOrigin(rw.Header(), origin)
+	rw.Header().Set("Access-Control-Allow-Methods", strings.Join(p.methods, ", "))
+
+	if requested != "" {
+		if p.anyHeader {
+			rw.Header().Set("Access-Control-Allow-Headers", requested)
+		} else {
+			rw.Header().Set("Access-Control-Allow-Headers", p.allowHeader)
+		}
+	}
+
+	if p.maxAge > 0 {
+		rw.Header().Set("Access-Control-Max-Age", strconv.Itoa(p.maxAge))
+	}
+
+	rw.WriteHeader(204)
+}
+
+// DecorateHandler answers preflight requests without passing them on, and
+// adds the CORS headers to the responses to other cross-origin requests.
+// CORS headers that the upstream sets are replaced.
+func (p *Policy) DecorateHandler(handler httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			handler(rw, req, params)
+			return
+		}
+
+		if req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != "" {
+			p.preflight(rw, req, origin)
+			return
+		}
+
+		handler(&corsResponseWriter{ResponseWriter: rw, policy: p, origin: origin}, req, params)
+	}
+}
+
+// corsResponseWriter replaces the CORS headers of a response once its
+// headers are written.
+type corsResponseWriter struct {
+	http.ResponseWriter
+	policy      *Policy
+	origin      string
+	wroteHeader bool
+}
+
+func (w *corsResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	header := w.Header()
+	for key := range header {
+		if strings.HasPrefix(key, "Access-Control-") {
+			header.Del(key)
+		}
+	}
+
+	// the response depends on the origin, unless every origin gets the
+	// same wildcard
+	if !w.policy.anyOrigin {
+		header.Add("Vary", "Origin")
+	}
+
+	if w.policy.originAllowed(w.origin) {
+		w.policy.setOrigin(header, w.origin)
+
+		if w.policy.exposed != "" {
+			header.Set("Access-Control-Expose-Headers", w.policy.exposed)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *corsResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *corsResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
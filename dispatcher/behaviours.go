@@ -20,48 +20,112 @@ package dispatcher
  */
 
 import (
+	"fmt"
+	"net/http"
+
 	"github.com/julienschmidt/httprouter"
 	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/bots"
 	"github.com/mittwald/servicegateway/cache"
+	"github.com/mittwald/servicegateway/circuitbreaker"
+	"github.com/mittwald/servicegateway/compression"
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/cors"
+	"github.com/mittwald/servicegateway/ipfilter"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/openapi"
+	"github.com/mittwald/servicegateway/quota"
 	"github.com/mittwald/servicegateway/ratelimit"
+	"github.com/mittwald/servicegateway/secheaders"
+	"github.com/mittwald/servicegateway/tracing"
+	"github.com/mittwald/servicegateway/waf"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type cachingBehaviour struct {
-	cache cache.CacheMiddleware
+	cache   cache.CacheMiddleware
+	metrics *monitoring.PromMetrics
 }
 
 type authBehaviour struct {
-	auth auth.AuthDecorator
+	auth    auth.AuthDecorator
+	metrics *monitoring.PromMetrics
 }
 
 type ratelimitBehaviour struct {
-	rlim ratelimit.RateLimitingMiddleware
+	rlim          ratelimit.RateLimitingMiddleware
+	metrics       *monitoring.PromMetrics
+	authenticated bool
+}
+
+type quotaBehaviour struct {
+	quotas  *quota.Manager
+	metrics *monitoring.PromMetrics
+}
+
+type ipFilterBehaviour struct {
+	global  *ipfilter.Filter
+	metrics *monitoring.PromMetrics
+}
+
+type wafBehaviour struct {
+	global  *waf.Filter
+	metrics *monitoring.PromMetrics
 }
 
-func NewCachingBehaviour(c cache.CacheMiddleware) Behavior {
-	return &cachingBehaviour{c}
+type openAPIBehaviour struct {
+	metrics *monitoring.PromMetrics
+}
+
+type botBehaviour struct {
+	detector *bots.Detector
+	metrics  *monitoring.PromMetrics
+}
+
+type circuitBreakerBehaviour struct {
+	breakers *circuitbreaker.Registry
+}
+
+type compressionBehaviour struct{}
+
+type corsBehaviour struct{}
+
+type securityHeadersBehaviour struct{}
+
+func NewCachingBehaviour(c cache.CacheMiddleware, metrics *monitoring.PromMetrics) Behavior {
+	return &cachingBehaviour{c, metrics}
 }
 
-func (c *cachingBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, _ string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+func (c *cachingBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
 	if app.Caching.Enabled {
-		safe = c.cache.DecorateHandler(safe)
+		cached, err := c.cache.DecorateHandler(tracing.EndLayer(safe), appName, &app.Caching)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error while configuring caching: %s", err)
+		}
+
+		results := c.metrics.CacheRequests.MustCurryWith(prometheus.Labels{"application": appName})
+		safe = countCacheResults(results, tracing.StartLayer("cache", cached))
 
 		if app.Caching.AutoFlush {
-			unsafe = c.cache.DecorateUnsafeHandler(unsafe)
+			unsafe = tracing.StartLayer("cache", c.cache.DecorateUnsafeHandler(tracing.EndLayer(unsafe), appName))
 		}
 	}
 	return safe, unsafe, nil
 }
 
-func NewAuthenticationBehaviour(a auth.AuthDecorator) Behavior {
-	return &authBehaviour{a}
+func NewAuthenticationBehaviour(a auth.AuthDecorator, metrics *monitoring.PromMetrics) Behavior {
+	return &authBehaviour{a, metrics}
 }
 
 func (a *authBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
 	if !app.Auth.Disable {
-		safe = a.auth.DecorateHandler(safe, appName, app, config)
-		unsafe = a.auth.DecorateHandler(unsafe, appName, app, config)
+		decorate := func(handler httprouter.Handle) httprouter.Handle {
+			return tracing.StartLayer("auth", a.auth.DecorateHandler(tracing.EndLayer(handler), appName, app, config))
+		}
+
+		failures := a.metrics.AuthFailures.WithLabelValues(appName)
+		safe = countRejections(failures, decorate, safe, 401, 403)
+		unsafe = countRejections(failures, decorate, unsafe, 401, 403)
 	}
 	return safe, unsafe, nil
 }
@@ -70,14 +134,245 @@ func (a *authBehaviour) AddRoutes(mux *httprouter.Router) error {
 	return a.auth.RegisterRoutes(mux)
 }
 
-func NewRatelimitBehaviour(rlim ratelimit.RateLimitingMiddleware) Behavior {
-	return &ratelimitBehaviour{rlim}
+// NewRatelimitBehaviour limits the requests to the applications whose rate
+// limit key and exemptions do not depend on the authentication. It needs to be added after
+// the authentication behaviour, so that requests are counted before they are
+// authenticated.
+func NewRatelimitBehaviour(rlim ratelimit.RateLimitingMiddleware, metrics *monitoring.PromMetrics) Behavior {
+	return &ratelimitBehaviour{rlim, metrics, false}
+}
+
+// NewAuthenticatedRatelimitBehaviour limits the requests to the applications
+// whose rate limit key or exemptions are taken from the authentication (like
+// the subject of the token). It needs to be added before the authentication
+// behaviour, so that requests are counted after they were authenticated.
+func NewAuthenticatedRatelimitBehaviour(rlim ratelimit.RateLimitingMiddleware, metrics *monitoring.PromMetrics) Behavior {
+	return &ratelimitBehaviour{rlim, metrics, true}
+}
+
+func (r *ratelimitBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	// requests are counted after the authentication when their key or the
+	// exemptions depend on it
+	authenticated := app.RateLimitKey.RequiresAuthentication() || app.Exemptions.RequiresAuthentication()
+
+	if app.RateLimiting && authenticated == r.authenticated {
+		identify, err := ratelimit.NewClientIdentifier(&app.RateLimitKey)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		overrides, err := ratelimit.NewOverrides(appName, app.RateLimits)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		exemptions, err := ratelimit.NewExemptions(&app.Exemptions)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		decorate := func(handler httprouter.Handle) httprouter.Handle {
+			limited := tracing.StartLayer("ratelimit", r.rlim.DecorateHandler(tracing.EndLayer(handler), identify, overrides))
+			if exemptions == nil {
+				return limited
+			}
+
+			return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+				if exemptions.Exempt(req) {
+					handler(rw, req, params)
+				} else {
+					limited(rw, req, params)
+				}
+			}
+		}
+
+		rejections := r.metrics.RateLimitRejections.WithLabelValues(appName)
+		safe = countRejections(rejections, decorate, safe, 429)
+		unsafe = countRejections(rejections, decorate, unsafe, 429)
+	}
+	return safe, unsafe, nil
+}
+
+// NewQuotaBehaviour enforces the daily and monthly quotas of API keys and
+// users. It needs to be added before the authentication behaviour, so that
+// the quotas are only counted for authenticated requests.
+func NewQuotaBehaviour(quotas *quota.Manager, metrics *monitoring.PromMetrics) Behavior {
+	return &quotaBehaviour{quotas, metrics}
+}
+
+func (q *quotaBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	if app.Quota {
+		decorate := func(handler httprouter.Handle) httprouter.Handle {
+			return tracing.StartLayer("quota", q.quotas.DecorateHandler(tracing.EndLayer(handler)))
+		}
+
+		rejections := q.metrics.QuotaRejections.WithLabelValues(appName)
+		safe = countRejections(rejections, decorate, safe, 429)
+		unsafe = countRejections(rejections, decorate, unsafe, 429)
+	}
+	return safe, unsafe, nil
+}
+
+func NewIPFilterBehaviour(global *ipfilter.Filter, metrics *monitoring.PromMetrics) Behavior {
+	return &ipFilterBehaviour{global, metrics}
+}
+
+func (f *ipFilterBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	filter, err := ipfilter.NewFilter(&app.IPFilter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if f.global == nil && filter == nil {
+		return safe, unsafe, nil
+	}
+
+	decorate := func(handler httprouter.Handle) httprouter.Handle {
+		return tracing.StartLayer("ipfilter", ipfilter.DecorateHandler(tracing.EndLayer(handler), f.global, filter))
+	}
+
+	blocked := f.metrics.BlockedRequests.WithLabelValues(appName)
+	safe = countRejections(blocked, decorate, safe, 403)
+	unsafe = countRejections(blocked, decorate, unsafe, 403)
+
+	return safe, unsafe, nil
+}
+
+func NewWafBehaviour(global *waf.Filter, metrics *monitoring.PromMetrics) Behavior {
+	return &wafBehaviour{global, metrics}
+}
+
+func (w *wafBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	filter, err := waf.NewFilter(&app.Waf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if w.global == nil && filter == nil {
+		return safe, unsafe, nil
+	}
+
+	blocked := w.metrics.WafBlocked.MustCurryWith(prometheus.Labels{"application": appName})
+	count := func(rule string) {
+		blocked.With(prometheus.Labels{"rule": rule}).Inc()
+	}
+
+	safe = tracing.StartLayer("waf", waf.DecorateHandler(tracing.EndLayer(safe), count, w.global, filter))
+	unsafe = tracing.StartLayer("waf", waf.DecorateHandler(tracing.EndLayer(unsafe), count, w.global, filter))
+
+	return safe, unsafe, nil
+}
+
+func NewOpenAPIBehaviour(metrics *monitoring.PromMetrics) Behavior {
+	return &openAPIBehaviour{metrics}
+}
+
+func (o *openAPIBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	validator, err := openapi.NewValidator(app)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if validator == nil {
+		return safe, unsafe, nil
+	}
+
+	rejections := o.metrics.OpenAPIRejected.MustCurryWith(prometheus.Labels{"application": appName})
+	rejected := func(reason string) {
+		rejections.With(prometheus.Labels{"reason": reason}).Inc()
+	}
+
+	safe = tracing.StartLayer("openapi", openapi.DecorateHandler(tracing.EndLayer(safe), rejected, validator))
+	unsafe = tracing.StartLayer("openapi", openapi.DecorateHandler(tracing.EndLayer(unsafe), rejected, validator))
+
+	return safe, unsafe, nil
+}
+
+func NewBotBehaviour(detector *bots.Detector, metrics *monitoring.PromMetrics) Behavior {
+	return &botBehaviour{detector, metrics}
 }
 
-func (r *ratelimitBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, _ string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
-	if app.RateLimiting {
-		safe = r.rlim.DecorateHandler(safe)
-		unsafe = r.rlim.DecorateHandler(unsafe)
+func (b *botBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	if app.Bots {
+		detections := b.metrics.BotDetections.MustCurryWith(prometheus.Labels{"application": appName})
+		detected := func(rule string, action string) {
+			detections.With(prometheus.Labels{"rule": rule, "action": action}).Inc()
+		}
+
+		safe = tracing.StartLayer("bots", b.detector.DecorateHandler(tracing.EndLayer(safe), detected))
+		unsafe = tracing.StartLayer("bots", b.detector.DecorateHandler(tracing.EndLayer(unsafe), detected))
+	}
+	return safe, unsafe, nil
+}
+
+func NewCircuitBreakerBehaviour(breakers *circuitbreaker.Registry) Behavior {
+	return &circuitBreakerBehaviour{breakers}
+}
+
+func (c *circuitBreakerBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, appName string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	if app.Breaker.Enabled {
+		var err error
+		if safe, err = c.breakers.DecorateHandler(tracing.EndLayer(safe), appName, &app.Breaker); err != nil {
+			return nil, nil, err
+		}
+		if unsafe, err = c.breakers.DecorateHandler(tracing.EndLayer(unsafe), appName, &app.Breaker); err != nil {
+			return nil, nil, err
+		}
+
+		safe = tracing.StartLayer("circuitbreaker", safe)
+		unsafe = tracing.StartLayer("circuitbreaker", unsafe)
+	}
+	return safe, unsafe, nil
+}
+
+func NewCorsBehaviour() Behavior {
+	return &corsBehaviour{}
+}
+
+func (c *corsBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, _ string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	if app.Cors.Enabled {
+		policy, err := cors.NewPolicy(&app.Cors)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if app.Grpc.Web {
+			policy.AllowGrpcWeb()
+		}
+
+		safe = policy.DecorateHandler(safe)
+		unsafe = policy.DecorateHandler(unsafe)
+	}
+	return safe, unsafe, nil
+}
+
+func NewSecurityHeadersBehaviour() Behavior {
+	return &securityHeadersBehaviour{}
+}
+
+func (s *securityHeadersBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, _ string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	if app.Security.Enabled {
+		injector := secheaders.NewInjector(&app.Security)
+
+		safe = injector.DecorateHandler(safe)
+		unsafe = injector.DecorateHandler(unsafe)
+	}
+	return safe, unsafe, nil
+}
+
+func NewCompressionBehaviour() Behavior {
+	return &compressionBehaviour{}
+}
+
+func (c *compressionBehaviour) Apply(safe httprouter.Handle, unsafe httprouter.Handle, d Dispatcher, _ string, app *config.Application, config *config.Configuration) (httprouter.Handle, httprouter.Handle, error) {
+	if app.Compression.Enabled {
+		compressor, err := compression.NewCompressor(&app.Compression)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		safe = compressor.DecorateHandler(safe)
+		unsafe = compressor.DecorateHandler(unsafe)
 	}
 	return safe, unsafe, nil
 }
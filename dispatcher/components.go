@@ -0,0 +1,166 @@
+package dispatcher
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mittwald/servicegateway/admin"
+	"github.com/mittwald/servicegateway/audit"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/bots"
+	"github.com/mittwald/servicegateway/cache"
+	"github.com/mittwald/servicegateway/circuitbreaker"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/httplogging"
+	"github.com/mittwald/servicegateway/ipfilter"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/proxy"
+	"github.com/mittwald/servicegateway/quota"
+	"github.com/mittwald/servicegateway/ratelimit"
+	"github.com/mittwald/servicegateway/redisconn"
+	"github.com/mittwald/servicegateway/waf"
+	"github.com/op/go-logging"
+)
+
+// components are the parts of a gateway that are built from its
+// configuration, regardless of where the applications are read from.
+type components struct {
+	tokenStore    auth.TokenStore
+	tokenVerifier *auth.JwtVerifier
+	auditLogger   *audit.Logger
+	metrics       *monitoring.PromMetrics
+
+	authHandler   *auth.AuthenticationHandler
+	authDecorator auth.AuthDecorator
+	rlim          ratelimit.RateLimitingMiddleware
+	quotas        *quota.Manager
+	ipFilter      *ipfilter.Filter
+	wafFilter     *waf.Filter
+	detector      *bots.Detector
+	cch           cache.CacheMiddleware
+	breakers      *circuitbreaker.Registry
+}
+
+func buildComponents(
+	startup *config.Startup,
+	cfg *config.Configuration,
+	rpool redisconn.Source,
+	logger *logging.Logger,
+	tokenStore auth.TokenStore,
+	tokenVerifier *auth.JwtVerifier,
+	auditLogger *audit.Logger,
+	metrics *monitoring.PromMetrics,
+) (c *components, err error) {
+	c = &components{
+		tokenStore:    tokenStore,
+		tokenVerifier: tokenVerifier,
+		auditLogger:   auditLogger,
+		metrics:       metrics,
+	}
+
+	c.authHandler, err = auth.NewAuthenticationHandler(&cfg.Authentication, rpool, tokenStore, tokenVerifier, auditLogger, metrics, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = c.authHandler.Close()
+		}
+	}()
+
+	c.authDecorator, err = auth.NewAuthDecorator(&cfg.Authentication, rpool, logging.MustGetLogger("auth"), c.authHandler, tokenStore, startup.UiDir)
+	if err != nil {
+		return nil, err
+	}
+
+	c.rlim, err = ratelimit.NewRateLimiter(cfg.RateLimiting, rpool, metrics.RateLimitFallback, logging.MustGetLogger("ratelimiter"))
+	if err != nil {
+		return nil, fmt.Errorf("error while configuring rate limiting: %s", err)
+	}
+
+	c.quotas, err = quota.NewManager(&cfg.Quotas, rpool, logging.MustGetLogger("quota"))
+	if err != nil {
+		return nil, fmt.Errorf("error while configuring quotas: %s", err)
+	}
+
+	c.ipFilter, err = ipfilter.NewFilter(&cfg.IPFilter)
+	if err != nil {
+		return nil, fmt.Errorf("error while configuring IP filter: %s", err)
+	}
+
+	c.wafFilter, err = waf.NewFilter(&cfg.Waf)
+	if err != nil {
+		return nil, fmt.Errorf("error while configuring WAF rules: %s", err)
+	}
+
+	c.detector, err = bots.NewDetector(&cfg.BotDetection, logging.MustGetLogger("bots"))
+	if err != nil {
+		return nil, fmt.Errorf("error while configuring bot detection: %s", err)
+	}
+
+	c.cch = cache.NewCache(&cfg.Cache, rpool, logging.MustGetLogger("cache"))
+	c.breakers = circuitbreaker.NewRegistry(metrics, logging.MustGetLogger("circuitbreaker"))
+
+	return c, nil
+}
+
+// close stops the background tasks of the components, if the gateway could
+// not be built.
+func (c *components) close() error {
+	return c.authHandler.Close()
+}
+
+// addBehaviours adds the behaviours of all applications to a dispatcher.
+func (c *components) addBehaviours(disp Dispatcher) {
+	// Order is important here! Behaviors will be called in LIFO order;
+	// behaviors that are added last will be called first!
+	disp.AddBehaviour(NewCircuitBreakerBehaviour(c.breakers))
+	disp.AddBehaviour(NewCachingBehaviour(c.cch, c.metrics))
+	disp.AddBehaviour(NewOpenAPIBehaviour(c.metrics))
+	disp.AddBehaviour(NewQuotaBehaviour(c.quotas, c.metrics))
+	disp.AddBehaviour(NewAuthenticatedRatelimitBehaviour(c.rlim, c.metrics))
+	disp.AddBehaviour(NewAuthenticationBehaviour(c.authDecorator, c.metrics))
+	disp.AddBehaviour(NewRatelimitBehaviour(c.rlim, c.metrics))
+	disp.AddBehaviour(NewBotBehaviour(c.detector, c.metrics))
+	disp.AddBehaviour(NewWafBehaviour(c.wafFilter, c.metrics))
+	disp.AddBehaviour(NewIPFilterBehaviour(c.ipFilter, c.metrics))
+	disp.AddBehaviour(NewCompressionBehaviour())
+	disp.AddBehaviour(NewCorsBehaviour())
+	disp.AddBehaviour(NewSecurityHeadersBehaviour())
+}
+
+// gateway builds the admin API and wraps the dispatcher into the HTTP
+// loggers, once all applications were registered with it.
+func (c *components) gateway(
+	disp Dispatcher,
+	cfg *config.Configuration,
+	handler *proxy.ProxyHandler,
+	httpLoggers []httplogging.HttpLogger,
+	reload func() error,
+) (*Gateway, error) {
+	adminLogger, err := logging.GetLogger("admin-api")
+	if err != nil {
+		return nil, err
+	}
+
+	adminServer, err := admin.NewAdminServer(&cfg.Admin, c.tokenStore, c.tokenVerifier, c.authHandler, c.breakers, handler, c.rlim, c.quotas, c.cch, c.detector, reload, c.auditLogger, adminLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	var server http.Handler = disp
+
+	for _, httpLogger := range httpLoggers {
+		if listener, ok := httpLogger.(auth.AuthRequestListener); ok {
+			c.authDecorator.RegisterRequestListener(listener)
+		}
+
+		server, err = httpLogger.Wrap(server)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Gateway{Proxy: server, Admin: adminServer, dispatcher: disp, authHandler: c.authHandler}, nil
+}
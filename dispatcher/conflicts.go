@@ -0,0 +1,178 @@
+package dispatcher
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+type registeredRoute struct {
+	appName string
+	routing *config.Routing
+	pattern string
+}
+
+// RouteConflicts reports the routes of applications that cannot be
+// registered together; routes that overlap (like `/users/:id` and
+// `/users/new`, or `/api/*path` and `/api/users`), and routes that are
+// shared by applications that are not ordered by their priority or by
+// the headers and query parameters that they require. Applications are
+// checked in the order of their names, so that the same conflicts are
+// reported each time.
+func RouteConflicts(apps map[string]config.Application) []error {
+	names := make([]string, 0, len(apps))
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// routes only conflict with the routes of the same router, for the
+	// same method
+	routes := make(map[string][]registeredRoute)
+	reported := make(map[string]bool)
+
+	var errs []error
+
+	for _, name := range names {
+		appCfg := apps[name]
+
+		hosts := appCfg.Routing.HostNames()
+		if len(hosts) == 0 {
+			hosts = []string{""}
+		}
+
+		for _, host := range hosts {
+			for _, pattern := range routePatterns(&appCfg) {
+				route := registeredRoute{appName: name, routing: &appCfg.Routing, pattern: pattern}
+
+				for _, method := range RouteMethods(&appCfg, pattern) {
+					key := host + " " + method
+
+					for _, other := range routes[key] {
+						err := routeConflict(route, other)
+						if err == nil {
+							continue
+						}
+
+						if host != "" {
+							err = fmt.Errorf("host '%s': %s", host, err)
+						}
+
+						// each pair of applications is reported once
+						pair := host + " " + name + " " + other.appName
+						if name == other.appName {
+							pair += " " + pattern + " " + other.pattern
+						}
+
+						if !reported[pair] {
+							reported[pair] = true
+							errs = append(errs, err)
+						}
+					}
+
+					routes[key] = append(routes[key], route)
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// checkRoutes checks the routes of the applications that are about to be
+// registered, so that conflicts are reported at once (instead of the first
+// one that the router finds, depending on the order of registration).
+func checkRoutes(appCfgs ...map[string]config.Application) error {
+	apps := make(map[string]config.Application)
+	for _, appCfg := range appCfgs {
+		for name, app := range appCfg {
+			apps[name] = app
+		}
+	}
+
+	errs := RouteConflicts(apps)
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("conflicting routes:\n%s", errors.Join(errs...))
+}
+
+func routeConflict(route registeredRoute, other registeredRoute) error {
+	if route.pattern == other.pattern {
+		if route.appName != other.appName && ambiguous(route.routing, other.routing) {
+			return fmt.Errorf("application %s: route '%s' is already used by application %s (with the same priority and matching headers and query parameters)", route.appName, route.pattern, other.appName)
+		}
+		return nil
+	}
+
+	// extended patterns are matched after the other routes, in the order
+	// of their priority
+	if extendedPattern(route.pattern) || extendedPattern(other.pattern) {
+		return nil
+	}
+
+	if routesOverlap(route.pattern, other.pattern) {
+		return fmt.Errorf("application %s: route '%s' overlaps with route '%s' of application %s", route.appName, route.pattern, other.pattern, other.appName)
+	}
+
+	return nil
+}
+
+// routePatterns returns the router patterns of the routes of an
+// application.
+func routePatterns(appCfg *config.Application) []string {
+	switch appCfg.Routing.Type {
+	case "path":
+		path := strings.TrimRight(appCfg.Routing.Path, "/")
+		if path == "" {
+			return []string{"/*path"}
+		}
+		return []string{path, path + "/*path"}
+	case "host":
+		return []string{"/*path"}
+	}
+
+	patterns := make([]string, 0, len(appCfg.Routing.Patterns))
+	for pattern := range appCfg.Routing.Patterns {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	return patterns
+}
+
+// routesOverlap reports whether two different router patterns cannot be
+// registered at the same router. This is the case if a request path could
+// match both of them, and if they have differently named parameters at
+// the same position.
+func routesOverlap(a string, b string) bool {
+	segmentsA := strings.Split(strings.TrimPrefix(a, "/"), "/")
+	segmentsB := strings.Split(strings.TrimPrefix(b, "/"), "/")
+
+	for i := 0; i < len(segmentsA) && i < len(segmentsB); i++ {
+		segmentA, segmentB := segmentsA[i], segmentsB[i]
+
+		// catch-all parameters match any rest of the path
+		if strings.HasPrefix(segmentA, "*") || strings.HasPrefix(segmentB, "*") {
+			return true
+		}
+
+		paramA, paramB := strings.HasPrefix(segmentA, ":"), strings.HasPrefix(segmentB, ":")
+		if paramA || paramB {
+			if segmentA != segmentB {
+				return true
+			}
+			continue
+		}
+
+		if segmentA != segmentB {
+			return false
+		}
+	}
+
+	return len(segmentsA) == len(segmentsB)
+}
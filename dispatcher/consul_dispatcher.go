@@ -4,21 +4,19 @@ import (
 	"encoding/json"
 	"fmt"
 
-	"github.com/gomodule/redigo/redis"
 	"github.com/hashicorp/consul/api"
 	"github.com/julienschmidt/httprouter"
-	"github.com/mittwald/servicegateway/admin"
+	"github.com/mittwald/servicegateway/audit"
 	"github.com/mittwald/servicegateway/auth"
-	"github.com/mittwald/servicegateway/cache"
 	"github.com/mittwald/servicegateway/config"
 	"github.com/mittwald/servicegateway/httplogging"
+	"github.com/mittwald/servicegateway/monitoring"
 	"github.com/mittwald/servicegateway/proxy"
-	"github.com/mittwald/servicegateway/ratelimit"
+	"github.com/mittwald/servicegateway/redisconn"
 	"github.com/op/go-logging"
 
-	"net/http"
-	"regexp"
 	"strings"
+	"sync"
 )
 
 func BuildConsulDispatcher(
@@ -26,15 +24,16 @@ func BuildConsulDispatcher(
 	cfg *config.Configuration,
 	consul *api.Client,
 	handler *proxy.ProxyHandler,
-	rpool *redis.Pool,
+	rpool redisconn.Source,
 	logger *logging.Logger,
 	tokenStore auth.TokenStore,
 	tokenVerifier *auth.JwtVerifier,
 	httpLoggers []httplogging.HttpLogger,
-) (http.Handler, http.Handler, error) {
+	auditLogger *audit.Logger,
+	metrics *monitoring.PromMetrics,
+	reload func() error,
+) (gateway *Gateway, err error) {
 	var disp Dispatcher
-	var err error
-	var configs api.KVPairs
 	var localCfg = *cfg
 	var appCfgs = make(map[string]config.Application)
 
@@ -42,21 +41,29 @@ func BuildConsulDispatcher(
 
 	switch startup.DispatchingMode {
 	case "path":
-		disp, err = buildConsulPathDispatcher(&localCfg, dispLogger, handler)
+		disp, err = buildConsulPathDispatcher(&localCfg, dispLogger, handler, consul, metrics)
 	default:
 		err = fmt.Errorf("unsupported dispatching mode: '%s'", startup.DispatchingMode)
 	}
 
 	if err != nil {
-		return nil, nil, fmt.Errorf("error while creating proxy builder: %s", err)
+		return nil, fmt.Errorf("error while creating proxy builder: %s", err)
 	}
 
+	// the upstreams of the applications that were registered are no
+	// longer watched if the gateway could not be built
+	defer func() {
+		if err != nil {
+			_ = disp.Close()
+		}
+	}()
+
 	applicationConfigBase := startup.ConsulBaseKey + "/applications"
 
 	logger.Infof("loading gateway config from KV %s", startup.ConsulBaseKey)
-	configs, _, err = consul.KV().List(startup.ConsulBaseKey, &api.QueryOptions{})
+	configs, meta, err := consul.KV().List(startup.ConsulBaseKey, &api.QueryOptions{})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	for _, cfgKVPair := range configs {
@@ -65,194 +72,142 @@ func BuildConsulDispatcher(
 		switch strings.TrimPrefix(startup.ConsulBaseKey+"/", cfgKVPair.Key) {
 		case "rate_limiting":
 			if err := json.Unmarshal(cfgKVPair.Value, &localCfg.RateLimiting); err != nil {
-				return nil, nil, fmt.Errorf("JSON error on consul KV pair '%s': %s", cfgKVPair.Key, err)
+				return nil, fmt.Errorf("JSON error on consul KV pair '%s': %s", cfgKVPair.Key, err)
 			}
 		}
 
-		if strings.HasPrefix(cfgKVPair.Key, applicationConfigBase) {
+		if strings.HasPrefix(cfgKVPair.Key, applicationConfigBase+"/") && !strings.HasSuffix(cfgKVPair.Key, "/") {
 			var appCfg config.Application
 
-			if err := json.Unmarshal(cfgKVPair.Value, &appCfg); err != nil {
-				return nil, nil, fmt.Errorf("JSON error on consul KV pair '%s': %s", cfgKVPair.Key, err)
+			name := strings.TrimPrefix(cfgKVPair.Key, applicationConfigBase+"/")
+
+			err := config.DecodeApplication(cfgKVPair.Value, &appCfg)
+			if err == nil {
+				err = ValidateApplication(&appCfg)
+			}
+
+			// an invalid definition does not replace the one that is
+			// currently active
+			if err != nil {
+				if previous, ok := handler.PreviousApplication(name); ok {
+					logger.Errorf("invalid application '%s' in consul KV pair '%s', keeping previous definition: %s", name, cfgKVPair.Key, err)
+					appCfgs[name] = previous
+				} else {
+					logger.Errorf("invalid application '%s' in consul KV pair '%s', skipping: %s", name, cfgKVPair.Key, err)
+				}
+				continue
 			}
 
-			name := strings.TrimPrefix(cfgKVPair.Key, applicationConfigBase+"/")
 			appCfgs[name] = appCfg
 		}
 	}
 
-	authHandler, err := auth.NewAuthenticationHandler(&localCfg.Authentication, rpool, tokenStore, tokenVerifier, logger)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	authDecorator, err := auth.NewAuthDecorator(&localCfg.Authentication, rpool, logging.MustGetLogger("auth"), authHandler, tokenStore, startup.UiDir)
+	comps, err := buildComponents(startup, &localCfg, rpool, logger, tokenStore, tokenVerifier, auditLogger, metrics)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	rlim, err := ratelimit.NewRateLimiter(localCfg.RateLimiting, rpool, logging.MustGetLogger("ratelimiter"))
-	if err != nil {
-		logger.Fatalf("error while configuring rate limiting: %s", err)
-	}
+	defer func() {
+		if err != nil {
+			_ = comps.close()
+		}
+	}()
 
-	cch := cache.NewCache(4096)
+	comps.addBehaviours(disp)
 
-	// Order is important here! Behaviors will be called in LIFO order;
-	// behaviors that are added last will be called first!
-	disp.AddBehaviour(NewCachingBehaviour(cch))
-	disp.AddBehaviour(NewAuthenticationBehaviour(authDecorator))
-	disp.AddBehaviour(NewRatelimitBehaviour(rlim))
+	if err := checkRoutes(appCfgs, localCfg.Applications); err != nil {
+		return nil, err
+	}
 
 	for name, appCfg := range appCfgs {
 		logger.Infof("registering application '%s' from Consul", name)
-		if err := disp.RegisterApplication(name, appCfg, cfg); err != nil {
-			return nil, nil, err
+		if err := registerApplication(disp, name, appCfg, cfg); err != nil {
+			return nil, err
 		}
 	}
 
 	for name, appCfg := range localCfg.Applications {
 		logger.Infof("registering application '%s' from local config", name)
-		if err := disp.RegisterApplication(name, appCfg, cfg); err != nil {
-			return nil, nil, err
+		if err := registerApplication(disp, name, appCfg, cfg); err != nil {
+			return nil, err
 		}
 	}
 
 	if err = disp.Initialize(); err != nil {
-		return nil, nil, err
-	}
-
-	adminLogger, err := logging.GetLogger("admin-api")
-	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	adminServer, err := admin.NewAdminServer(tokenStore, tokenVerifier, authHandler, adminLogger)
+	gateway, err = comps.gateway(disp, &localCfg, handler, httpLoggers, reload)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	var server http.Handler = disp
-
-	for _, httpLogger := range httpLoggers {
-		if listener, ok := httpLogger.(auth.AuthRequestListener); ok {
-			authDecorator.RegisterRequestListener(listener)
-		}
-
-		server, err = httpLogger.Wrap(server)
-		if err != nil {
-			return nil, nil, err
-		}
+	// changes in Consul are applied by rebuilding the gateway
+	if consulDisp, ok := disp.(*consulPathDispatcher); ok {
+		consulDisp.configWatch = consulDisp.watchConfiguration(startup.ConsulBaseKey, meta.LastIndex, reload)
 	}
 
-	return server, adminServer, nil
+	return gateway, nil
 }
 
 type consulPathDispatcher struct {
 	*abstractPathBasedDispatcher
+
+	consul        *api.Client
+	discoveries   map[string]chan struct{}
+	discoveryLock sync.Mutex
+
+	configWatch chan struct{}
 }
 
 func buildConsulPathDispatcher(
 	cfg *config.Configuration,
 	log *logging.Logger,
 	prx *proxy.ProxyHandler,
+	consul *api.Client,
+	metrics *monitoring.PromMetrics,
 ) (*consulPathDispatcher, error) {
 	dispatcher := &consulPathDispatcher{
 		abstractPathBasedDispatcher: &abstractPathBasedDispatcher{
 			abstractDispatcher: abstractDispatcher{},
 		},
+		consul:      consul,
+		discoveries: make(map[string]chan struct{}),
 	}
 	dispatcher.cfg = cfg
 	dispatcher.mux = httprouter.New()
 	dispatcher.log = log
 	dispatcher.prx = prx
+	dispatcher.metrics = metrics
 	dispatcher.behaviors = make([]Behavior, 0, 8)
 
 	return dispatcher, nil
 }
 
-func (c *consulPathDispatcher) RegisterApplication(name string, appCfg config.Application, config *config.Configuration) error {
-	routes := make(map[string]httprouter.Handle)
-
-	backendUrl := appCfg.Backend.Url
-	if backendUrl == "" && appCfg.Backend.Service != "" {
-		if appCfg.Backend.Tag != "" {
-			backendUrl = fmt.Sprintf("http://%s.%s.service.consul", appCfg.Backend.Tag, appCfg.Backend.Service)
-		} else {
-			backendUrl = fmt.Sprintf("http://%s.service.consul", appCfg.Backend.Service)
-		}
+// Close stops watching the configuration and the upstreams of the
+// applications.
+func (c *consulPathDispatcher) Close() error {
+	if c.configWatch != nil {
+		close(c.configWatch)
+		c.configWatch = nil
 	}
 
-	var rewriter proxy.HostRewriter
-
-	if appCfg.Routing.Type == "path" {
-		path := strings.TrimRight(appCfg.Routing.Path, "/")
-		mapping := map[string]string{
-			"/(?P<path>.*)": path + "/:path",
-		}
-
-		rewriter, _ = proxy.NewHostRewriter(backendUrl, mapping, c.log)
-
-		closure := new(PathClosure)
-		closure.backendUrl = backendUrl
-		closure.appName = name
-		closure.appCfg = &appCfg
-		closure.proxy = c.prx
-
-		routes[path] = closure.Handle
-		routes[path+"/*path"] = closure.Handle
-	} else if appCfg.Routing.Type == "pattern" {
-		re := regexp.MustCompile(":([a-zA-Z0-9]+)")
-		mapping := make(map[string]string)
-
-		for pattern, target := range appCfg.Routing.Patterns {
-			targetPattern := "^" + re.ReplaceAllString(target, "(?P<$1>[^/]+?)") + "$"
-			mapping[targetPattern] = pattern
-
-			parameters := re.FindAllStringSubmatch(pattern, -1)
+	c.discoveryLock.Lock()
+	defer c.discoveryLock.Unlock()
 
-			closure := new(PatternClosure)
-			closure.targetUrl = backendUrl + target
-			closure.parameters = parameters
-			closure.appName = name
-			closure.appCfg = &appCfg
-			closure.proxy = c.prx
-
-			routes[pattern] = closure.Handle
-		}
-
-		rewriter, _ = proxy.NewHostRewriter(backendUrl, mapping, c.log)
+	for name, stop := range c.discoveries {
+		close(stop)
+		delete(c.discoveries, name)
 	}
 
-	for route, handler := range routes {
-		handler = rewriter.Decorate(handler)
-
-		safeHandler := handler
-		unsafeHandler := handler
-
-		for _, behavior := range c.behaviors {
-			var err error
-			safeHandler, unsafeHandler, err = behavior.Apply(safeHandler, unsafeHandler, c, name, &appCfg, config)
-			if err != nil {
-				return err
-			}
-		}
+	return c.abstractDispatcher.Close()
+}
 
-		c.mux.GET(route, safeHandler)
-		c.mux.HEAD(route, safeHandler)
-		c.mux.POST(route, unsafeHandler)
-		c.mux.PUT(route, unsafeHandler)
-		c.mux.PATCH(route, unsafeHandler)
-		c.mux.DELETE(route, unsafeHandler)
-
-		// Register a dedicated OPTIONS handler if it was enabled.
-		// If no OPTIONS handler was enabled, simply proxy OPTIONS request through to the backend servers.
-		if c.cfg.Proxy.OptionsConfiguration.Enabled {
-			c.mux.OPTIONS(route, c.buildOptionsHandler(safeHandler))
-		} else {
-			c.mux.OPTIONS(route, safeHandler)
-		}
+func (c *consulPathDispatcher) RegisterApplication(name string, appCfg config.Application, config *config.Configuration) error {
+	upstreams, err := c.resolveUpstreams(name, &appCfg)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return c.registerRoutes(c, name, appCfg, upstreams, config)
 }
@@ -0,0 +1,255 @@
+package dispatcher
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/mittwald/servicegateway/cache"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/cors"
+	"github.com/mittwald/servicegateway/ipfilter"
+	"github.com/mittwald/servicegateway/openapi"
+	"github.com/mittwald/servicegateway/proxy"
+	"github.com/mittwald/servicegateway/ratelimit"
+	"github.com/mittwald/servicegateway/waf"
+)
+
+// ValidateApplication checks an application definition before its routes
+// are registered, so that a broken definition in Consul does not replace a
+// working one.
+func ValidateApplication(appCfg *config.Application) error {
+	switch appCfg.Routing.Type {
+	case "path":
+		if appCfg.Routing.Path == "" {
+			return fmt.Errorf("routing.path must be set for path routing")
+		}
+	case "pattern":
+		if len(appCfg.Routing.Patterns) == 0 {
+			return fmt.Errorf("routing.patterns must be set for pattern routing")
+		}
+
+		for pattern := range appCfg.Routing.Patterns {
+			if extendedPattern(pattern) {
+				if _, err := compilePattern(pattern); err != nil {
+					return err
+				}
+			}
+		}
+	case "host":
+		if len(appCfg.Routing.HostNames()) == 0 {
+			return fmt.Errorf("routing.hostname or routing.hosts must be set for host routing")
+		}
+	default:
+		return fmt.Errorf("unsupported routing type: '%s'", appCfg.Routing.Type)
+	}
+
+	for _, method := range appCfg.Routing.Match.Methods {
+		if !slices.Contains(routeMethods, method) {
+			return fmt.Errorf("unsupported method '%s' in routing.match.methods", method)
+		}
+	}
+
+	for pattern, methods := range appCfg.Routing.Methods {
+		if _, ok := appCfg.Routing.Patterns[pattern]; !ok {
+			return fmt.Errorf("routing.methods: '%s' is not a pattern of the application", pattern)
+		}
+
+		for _, method := range methods {
+			if !slices.Contains(routeMethods, method) {
+				return fmt.Errorf("unsupported method '%s' in routing.methods", method)
+			}
+		}
+	}
+
+	for name := range appCfg.Routing.Match.Headers {
+		if name == "" {
+			return fmt.Errorf("empty header name in routing.match.headers")
+		}
+	}
+
+	for name := range appCfg.Routing.Match.Query {
+		if name == "" {
+			return fmt.Errorf("empty parameter name in routing.match.query")
+		}
+	}
+
+	for _, host := range appCfg.Routing.HostNames() {
+		name := strings.TrimPrefix(host, "*.")
+		if name == "" || strings.ContainsAny(name, "*:/ ") {
+			return fmt.Errorf("invalid host name '%s' in routing (expected a name like 'api.example.com' or '*.example.com')", host)
+		}
+	}
+
+	if appCfg.RateLimiting {
+		if _, err := ratelimit.NewClientIdentifier(&appCfg.RateLimitKey); err != nil {
+			return err
+		}
+
+		if _, err := ratelimit.NewOverrides("", appCfg.RateLimits); err != nil {
+			return err
+		}
+
+		if _, err := ratelimit.NewExemptions(&appCfg.Exemptions); err != nil {
+			return err
+		}
+	}
+
+	if appCfg.Caching.Enabled {
+		if _, err := cache.NewPolicy(&appCfg.Caching); err != nil {
+			return err
+		}
+	}
+
+	if appCfg.Cors.Enabled {
+		if _, err := cors.NewPolicy(&appCfg.Cors); err != nil {
+			return err
+		}
+	}
+
+	if _, err := ipfilter.NewFilter(&appCfg.IPFilter); err != nil {
+		return err
+	}
+
+	if _, err := waf.NewFilter(&appCfg.Waf); err != nil {
+		return err
+	}
+
+	if _, err := openapi.NewValidator(appCfg); err != nil {
+		return err
+	}
+
+	if appCfg.Maintenance.RetryAfter != "" {
+		if retryAfter, err := time.ParseDuration(appCfg.Maintenance.RetryAfter); err != nil {
+			return fmt.Errorf("bad maintenance.retry_after: %s", err)
+		} else if retryAfter < 0 {
+			return fmt.Errorf("bad maintenance.retry_after: must not be negative")
+		}
+	}
+
+	if !appCfg.HasBackend() {
+		return validateWithoutBackend(appCfg)
+	}
+
+	if appCfg.Backend.Dns.Name != "" {
+		return nil
+	}
+
+	for _, upstream := range backendUpstreams(appCfg) {
+		if upstream.Url == "" {
+			return fmt.Errorf("backend.url, backend.upstreams, backend.service or backend.dns must be set")
+		}
+	}
+
+	return nil
+}
+
+// validateWithoutBackend checks the static response, the redirect or the
+// composite responses of an application without a backend.
+func validateWithoutBackend(appCfg *config.Application) error {
+	if len(appCfg.Backend.Upstreams) > 0 || appCfg.Backend.Url != "" || appCfg.Backend.Service != "" || appCfg.Backend.Dns.Name != "" || appCfg.Backend.Kubernetes.Service != "" {
+		return fmt.Errorf("response, redirect and composite cannot be used together with a backend")
+	}
+
+	if len(appCfg.Composite.Endpoints) > 0 {
+		if appCfg.Static() {
+			return fmt.Errorf("composite cannot be used together with response or redirect")
+		}
+
+		return proxy.ValidateComposite(&appCfg.Composite)
+	}
+
+	if appCfg.Redirect.Url != "" {
+		if appCfg.Response.Status != 0 || appCfg.Response.Body != "" {
+			return fmt.Errorf("response and redirect cannot be used together")
+		}
+
+		switch appCfg.Redirect.Status {
+		case 0, 301, 302, 303, 307, 308:
+		default:
+			return fmt.Errorf("unsupported redirect.status %d (expected 301, 302, 303, 307 or 308)", appCfg.Redirect.Status)
+		}
+
+		return nil
+	}
+
+	if appCfg.Response.Status != 0 && (appCfg.Response.Status < 100 || appCfg.Response.Status > 599) {
+		return fmt.Errorf("invalid response.status %d", appCfg.Response.Status)
+	}
+
+	return nil
+}
+
+// registerApplication registers an application, turning the panics of the
+// router (like on conflicting routes) into errors.
+func registerApplication(disp Dispatcher, name string, appCfg config.Application, cfg *config.Configuration) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not register routes of application %s: %v", name, r)
+		}
+	}()
+
+	return disp.RegisterApplication(name, appCfg, cfg)
+}
+
+// watchConfiguration waits for changes of the configuration below a Consul
+// KV prefix, and calls the changed function after each change, until the
+// returned channel is closed.
+func (c *consulPathDispatcher) watchConfiguration(prefix string, index uint64, changed func() error) chan struct{} {
+	stop := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			_, meta, err := c.consul.KV().List(prefix, &api.QueryOptions{
+				WaitIndex: index,
+				WaitTime:  5 * time.Minute,
+			})
+			if err != nil {
+				c.log.Errorf("error while watching configuration in Consul: %s", err)
+
+				select {
+				case <-time.After(5 * time.Second):
+				case <-stop:
+				}
+				continue
+			}
+
+			// the index is reset when the Consul cluster was restored
+			// from a snapshot
+			if meta.LastIndex < index {
+				index = 0
+				continue
+			}
+
+			if meta.LastIndex == index {
+				continue
+			}
+
+			index = meta.LastIndex
+
+			// keys are often written in quick succession (like when an
+			// application registers several routes), so that they are
+			// applied at once
+			select {
+			case <-time.After(time.Second):
+			case <-stop:
+				return
+			}
+
+			c.log.Noticef("configuration in Consul changed")
+			if err := changed(); err != nil {
+				c.log.Errorf("could not apply configuration from Consul: %s", err)
+			}
+		}
+	}()
+
+	return stop
+}
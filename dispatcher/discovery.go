@@ -0,0 +1,126 @@
+package dispatcher
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/mittwald/servicegateway/config"
+)
+
+// discoverUpstreams looks up the healthy instances of an application's
+// Consul service. The returned index can be used to wait for changes.
+func (c *consulPathDispatcher) discoverUpstreams(appCfg *config.Application, index uint64) ([]config.Upstream, uint64, error) {
+	entries, meta, err := c.consul.Health().Service(appCfg.Backend.Service, appCfg.Backend.Tag, true, &api.QueryOptions{
+		WaitIndex: index,
+		WaitTime:  5 * time.Minute,
+	})
+	if err != nil {
+		return nil, index, err
+	}
+
+	upstreams := make([]config.Upstream, 0, len(entries))
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+
+		upstreams = append(upstreams, config.Upstream{
+			Url:    "http://" + net.JoinHostPort(address, strconv.Itoa(entry.Service.Port)),
+			Weight: entry.Service.Weights.Passing,
+		})
+	}
+
+	sort.Slice(upstreams, func(i, j int) bool { return upstreams[i].Url < upstreams[j].Url })
+
+	return upstreams, meta.LastIndex, nil
+}
+
+// watchUpstreams keeps the upstreams of an application in sync with the
+// instances of its Consul service, until the returned channel is closed.
+func (c *consulPathDispatcher) watchUpstreams(name string, appCfg config.Application, upstreams []config.Upstream, index uint64) chan struct{} {
+	stop := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			discovered, newIndex, err := c.discoverUpstreams(&appCfg, index)
+			if err != nil {
+				c.log.Errorf("error while discovering upstreams of application %s: %s", name, err)
+
+				select {
+				case <-time.After(5 * time.Second):
+				case <-stop:
+				}
+				continue
+			}
+
+			index = newIndex
+
+			// the last known upstreams are kept when all instances are gone,
+			// so that requests fail on connecting instead of being rejected
+			if len(discovered) == 0 || reflect.DeepEqual(discovered, upstreams) {
+				continue
+			}
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			c.log.Infof("upstreams of application %s changed: %d instances", name, len(discovered))
+
+			upstreams = discovered
+			if err := c.prx.RegisterUpstreams(name, upstreams, &appCfg); err != nil {
+				c.log.Errorf("error while updating upstreams of application %s: %s", name, err)
+			}
+		}
+	}()
+
+	return stop
+}
+
+// resolveUpstreams determines the upstreams of an application. If discovery
+// is enabled, they are watched for changes in the background.
+func (c *consulPathDispatcher) resolveUpstreams(name string, appCfg *config.Application) ([]config.Upstream, error) {
+	c.discoveryLock.Lock()
+	defer c.discoveryLock.Unlock()
+
+	if stop, ok := c.discoveries[name]; ok {
+		close(stop)
+		delete(c.discoveries, name)
+	}
+
+	upstreams, err := c.resolveDnsUpstreams(name, appCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if !appCfg.Backend.LoadBalancing.Discover || appCfg.Backend.Service == "" || appCfg.Backend.Dns.Name != "" {
+		return upstreams, nil
+	}
+
+	discovered, index, err := c.discoverUpstreams(appCfg, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error while discovering upstreams of application %s: %s", name, err)
+	}
+
+	if len(discovered) > 0 {
+		upstreams = discovered
+	}
+
+	c.discoveries[name] = c.watchUpstreams(name, *appCfg, upstreams, index)
+
+	return upstreams, nil
+}
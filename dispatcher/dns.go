@@ -0,0 +1,168 @@
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+// lookupDns resolves the DNS records of a backend into upstreams. Of the SRV
+// records, only those with the lowest priority are used; the others are
+// meant as fallback.
+func lookupDns(ctx context.Context, backend *config.DnsBackend) ([]config.Upstream, error) {
+	scheme := backend.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	upstreams := make([]config.Upstream, 0)
+
+	switch backend.Type {
+	case "", "srv":
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", backend.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			if record.Priority != records[0].Priority {
+				continue
+			}
+
+			host := strings.TrimSuffix(record.Target, ".")
+			upstreams = append(upstreams, config.Upstream{
+				Url:    scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(record.Port))),
+				Weight: int(record.Weight),
+			})
+		}
+	case "a":
+		port := backend.Port
+		if port == 0 && scheme == "https" {
+			port = 443
+		} else if port == 0 {
+			port = 80
+		}
+
+		addresses, err := net.DefaultResolver.LookupIPAddr(ctx, backend.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, address := range addresses {
+			upstreams = append(upstreams, config.Upstream{
+				Url: scheme + "://" + net.JoinHostPort(address.IP.String(), strconv.Itoa(port)),
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported DNS record type: '%s'", backend.Type)
+	}
+
+	sort.Slice(upstreams, func(i, j int) bool { return upstreams[i].Url < upstreams[j].Url })
+
+	return upstreams, nil
+}
+
+// watchDns resolves the upstreams of an application again after each TTL,
+// until the returned channel is closed.
+func (d *abstractDispatcher) watchDns(name string, appCfg config.Application, upstreams []config.Upstream, ttl time.Duration) chan struct{} {
+	stop := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(ttl)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), ttl)
+			resolved, err := lookupDns(ctx, &appCfg.Backend.Dns)
+			cancel()
+
+			if err != nil {
+				d.log.Errorf("error while resolving upstreams of application %s: %s", name, err)
+				continue
+			}
+
+			// the last known upstreams are kept when no records are left,
+			// so that requests fail on connecting instead of being rejected
+			if len(resolved) == 0 || reflect.DeepEqual(resolved, upstreams) {
+				continue
+			}
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			d.log.Infof("upstreams of application %s changed: %d records", name, len(resolved))
+
+			upstreams = resolved
+			if err := d.prx.RegisterUpstreams(name, upstreams, &appCfg); err != nil {
+				d.log.Errorf("error while updating upstreams of application %s: %s", name, err)
+			}
+		}
+	}()
+
+	return stop
+}
+
+// resolveDnsUpstreams determines the upstreams of an application. If the
+// backend is a DNS name, it is resolved again in the background after each
+// TTL.
+func (d *abstractDispatcher) resolveDnsUpstreams(name string, appCfg *config.Application) ([]config.Upstream, error) {
+	d.dnsLock.Lock()
+	defer d.dnsLock.Unlock()
+
+	if d.dnsWatches == nil {
+		d.dnsWatches = make(map[string]chan struct{})
+	}
+
+	if stop, ok := d.dnsWatches[name]; ok {
+		close(stop)
+		delete(d.dnsWatches, name)
+	}
+
+	if appCfg.Backend.Dns.Name == "" {
+		return backendUpstreams(appCfg), nil
+	}
+
+	ttl := 30 * time.Second
+	if appCfg.Backend.Dns.Ttl != "" {
+		var err error
+		if ttl, err = time.ParseDuration(appCfg.Backend.Dns.Ttl); err != nil {
+			return nil, fmt.Errorf("bad DNS TTL of application %s: %s", name, err)
+		}
+
+		if ttl <= 0 {
+			return nil, fmt.Errorf("bad DNS TTL of application %s: must be positive", name)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	upstreams, err := lookupDns(ctx, &appCfg.Backend.Dns)
+	if err != nil {
+		return nil, fmt.Errorf("error while resolving upstreams of application %s: %s", name, err)
+	}
+
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no DNS records found for upstreams of application %s", name)
+	}
+
+	d.dnsWatches[name] = d.watchDns(name, *appCfg, upstreams, ttl)
+
+	return upstreams, nil
+}
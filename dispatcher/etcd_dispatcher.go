@@ -0,0 +1,249 @@
+package dispatcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mittwald/servicegateway/audit"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/etcd"
+	"github.com/mittwald/servicegateway/httplogging"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/proxy"
+	"github.com/mittwald/servicegateway/redisconn"
+	"github.com/op/go-logging"
+)
+
+func BuildEtcdDispatcher(
+	startup *config.Startup,
+	cfg *config.Configuration,
+	client *etcd.Client,
+	handler *proxy.ProxyHandler,
+	rpool redisconn.Source,
+	logger *logging.Logger,
+	tokenStore auth.TokenStore,
+	tokenVerifier *auth.JwtVerifier,
+	httpLoggers []httplogging.HttpLogger,
+	auditLogger *audit.Logger,
+	metrics *monitoring.PromMetrics,
+	reload func() error,
+) (gateway *Gateway, err error) {
+	var disp Dispatcher
+	var localCfg = *cfg
+	var appCfgs = make(map[string]config.Application)
+
+	dispLogger := logging.MustGetLogger("dispatch")
+
+	switch startup.DispatchingMode {
+	case "path":
+		disp, err = buildEtcdPathDispatcher(&localCfg, dispLogger, handler, client, metrics)
+	default:
+		err = fmt.Errorf("unsupported dispatching mode: '%s'", startup.DispatchingMode)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error while creating proxy builder: %s", err)
+	}
+
+	// the upstreams of the applications that were registered are no
+	// longer resolved if the gateway could not be built
+	defer func() {
+		if err != nil {
+			_ = disp.Close()
+		}
+	}()
+
+	prefix := strings.TrimRight(startup.EtcdPrefix, "/")
+	applicationConfigBase := prefix + "/applications/"
+
+	logger.Infof("loading gateway config from etcd prefix %s", prefix)
+	configs, revision, err := client.ListPrefix(prefix + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kv := range configs {
+		logger.Debugf("found etcd key '%s'", kv.Key)
+
+		if kv.Key == prefix+"/rate_limiting" {
+			if err := json.Unmarshal(kv.Value, &localCfg.RateLimiting); err != nil {
+				return nil, fmt.Errorf("JSON error on etcd key '%s': %s", kv.Key, err)
+			}
+		}
+
+		if strings.HasPrefix(kv.Key, applicationConfigBase) && !strings.HasSuffix(kv.Key, "/") {
+			var appCfg config.Application
+
+			name := strings.TrimPrefix(kv.Key, applicationConfigBase)
+
+			err := config.DecodeApplication(kv.Value, &appCfg)
+			if err == nil {
+				err = ValidateApplication(&appCfg)
+			}
+
+			// an invalid definition does not replace the one that is
+			// currently active
+			if err != nil {
+				if previous, ok := handler.PreviousApplication(name); ok {
+					logger.Errorf("invalid application '%s' in etcd key '%s', keeping previous definition: %s", name, kv.Key, err)
+					appCfgs[name] = previous
+				} else {
+					logger.Errorf("invalid application '%s' in etcd key '%s', skipping: %s", name, kv.Key, err)
+				}
+				continue
+			}
+
+			appCfgs[name] = appCfg
+		}
+	}
+
+	comps, err := buildComponents(startup, &localCfg, rpool, logger, tokenStore, tokenVerifier, auditLogger, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = comps.close()
+		}
+	}()
+
+	comps.addBehaviours(disp)
+
+	if err := checkRoutes(appCfgs, localCfg.Applications); err != nil {
+		return nil, err
+	}
+
+	for name, appCfg := range appCfgs {
+		logger.Infof("registering application '%s' from etcd", name)
+		if err := registerApplication(disp, name, appCfg, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, appCfg := range localCfg.Applications {
+		logger.Infof("registering application '%s' from local config", name)
+		if err := registerApplication(disp, name, appCfg, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = disp.Initialize(); err != nil {
+		return nil, err
+	}
+
+	gateway, err = comps.gateway(disp, &localCfg, handler, httpLoggers, reload)
+	if err != nil {
+		return nil, err
+	}
+
+	// changes in etcd are applied by rebuilding the gateway
+	if etcdDisp, ok := disp.(*etcdPathDispatcher); ok {
+		etcdDisp.configWatch = etcdDisp.watchConfiguration(prefix+"/", revision, reload)
+	}
+
+	return gateway, nil
+}
+
+// etcdPathDispatcher registers applications like the dispatcher without
+// integration, and additionally watches their configuration in etcd.
+type etcdPathDispatcher struct {
+	*noIntegrationPathDispatcher
+
+	etcd        *etcd.Client
+	configWatch chan struct{}
+}
+
+func buildEtcdPathDispatcher(
+	cfg *config.Configuration,
+	log *logging.Logger,
+	prx *proxy.ProxyHandler,
+	client *etcd.Client,
+	metrics *monitoring.PromMetrics,
+) (*etcdPathDispatcher, error) {
+	noIntegration, err := buildNoIntegrationPathDispatcher(cfg, log, prx, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdPathDispatcher{
+		noIntegrationPathDispatcher: noIntegration,
+		etcd:                        client,
+	}, nil
+}
+
+// Close stops watching the configuration and resolving the upstreams of the
+// applications.
+func (e *etcdPathDispatcher) Close() error {
+	if e.configWatch != nil {
+		close(e.configWatch)
+		e.configWatch = nil
+	}
+
+	return e.noIntegrationPathDispatcher.Close()
+}
+
+// watchConfiguration waits for changes of the configuration below an etcd
+// prefix, and calls the changed function after each change, until the
+// returned channel is closed.
+func (e *etcdPathDispatcher) watchConfiguration(prefix string, revision int64, changed func() error) chan struct{} {
+	stop := make(chan struct{})
+
+	go func() {
+		ctx, cancel := stopContext(stop)
+		defer cancel()
+
+		for ctx.Err() == nil {
+			waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Minute)
+			hasChanged, err := e.etcd.WaitPrefix(waitCtx, prefix, revision)
+			waitCancel()
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err == etcd.CompactedError {
+				// the configuration may have changed in the meantime
+				hasChanged = true
+			} else if err != nil {
+				e.log.Errorf("error while watching configuration in etcd: %s", err)
+
+				select {
+				case <-time.After(5 * time.Second):
+				case <-stop:
+				}
+				continue
+			}
+
+			if !hasChanged {
+				continue
+			}
+
+			// keys are often written in quick succession (like when an
+			// application registers several routes), so that they are
+			// applied at once
+			select {
+			case <-time.After(time.Second):
+			case <-stop:
+				return
+			}
+
+			e.log.Noticef("configuration in etcd changed")
+			if err := changed(); err != nil {
+				e.log.Errorf("could not apply configuration from etcd: %s", err)
+
+				// the watch continues from the current state, since the
+				// changes up to now were rejected
+				if _, current, err := e.etcd.ListPrefix(prefix); err == nil {
+					revision = current
+				}
+			}
+		}
+	}()
+
+	return stop
+}
@@ -21,9 +21,11 @@ package dispatcher
 
 import (
 	"net/http"
+	"sync"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
 	"github.com/mittwald/servicegateway/proxy"
 	"github.com/op/go-logging"
 )
@@ -33,6 +35,7 @@ type Dispatcher interface {
 	RegisterApplication(string, config.Application, *config.Configuration) error
 	Initialize() error
 	AddBehaviour(...Behavior)
+	Close() error
 }
 
 type Behavior interface {
@@ -51,7 +54,11 @@ type abstractDispatcher struct {
 	prx *proxy.ProxyHandler
 	log *logging.Logger
 
+	metrics   *monitoring.PromMetrics
 	behaviors []Behavior
+
+	dnsWatches map[string]chan struct{}
+	dnsLock    sync.Mutex
 }
 
 func (d *abstractDispatcher) setProxy(p *proxy.ProxyHandler) {
@@ -61,3 +68,16 @@ func (d *abstractDispatcher) setProxy(p *proxy.ProxyHandler) {
 func (d *abstractDispatcher) AddBehaviour(behaviors ...Behavior) {
 	d.behaviors = append(d.behaviors, behaviors...)
 }
+
+// Close stops re-resolving the upstreams of the applications.
+func (d *abstractDispatcher) Close() error {
+	d.dnsLock.Lock()
+	defer d.dnsLock.Unlock()
+
+	for name, stop := range d.dnsWatches {
+		close(stop)
+		delete(d.dnsWatches, name)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/kubernetes"
+)
+
+// stopContext returns a context that is cancelled when the stop channel is
+// closed, so that waiting for changes is interrupted.
+func stopContext(stop chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// watchEndpoints keeps the upstreams of an application in sync with the
+// ready endpoints of its Kubernetes service, until the returned channel is
+// closed.
+func (k *kubernetesPathDispatcher) watchEndpoints(name string, appCfg config.Application, q *kubernetes.EndpointsQuery, upstreams []config.Upstream, resourceVersion string) chan struct{} {
+	stop := make(chan struct{})
+
+	go func() {
+		ctx, cancel := stopContext(stop)
+		defer cancel()
+
+		for ctx.Err() == nil {
+			changed, err := k.kube.WaitForEndpoints(ctx, q, resourceVersion)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err != nil && err != kubernetes.ExpiredError {
+				k.log.Errorf("error while watching endpoints of application %s: %s", name, err)
+
+				select {
+				case <-time.After(5 * time.Second):
+				case <-stop:
+				}
+				continue
+			}
+
+			// the endpoints are listed again when they changed, or when
+			// the resource version has expired
+			if !changed && err == nil {
+				continue
+			}
+
+			discovered, newResourceVersion, err := k.kube.Endpoints(ctx, q)
+			if err != nil {
+				if ctx.Err() == nil {
+					k.log.Errorf("error while discovering endpoints of application %s: %s", name, err)
+				}
+				continue
+			}
+
+			resourceVersion = newResourceVersion
+
+			// the last known upstreams are kept when all endpoints are
+			// gone, so that requests fail on connecting instead of being
+			// rejected
+			if len(discovered) == 0 || reflect.DeepEqual(discovered, upstreams) {
+				continue
+			}
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			k.log.Infof("endpoints of application %s changed: %d endpoints", name, len(discovered))
+
+			upstreams = discovered
+			if err := k.prx.RegisterUpstreams(name, upstreams, &appCfg); err != nil {
+				k.log.Errorf("error while updating upstreams of application %s: %s", name, err)
+			}
+		}
+	}()
+
+	return stop
+}
+
+// resolveUpstreams determines the upstreams of an application. If the
+// backend is a Kubernetes service, its endpoints are watched for changes in
+// the background.
+func (k *kubernetesPathDispatcher) resolveUpstreams(name string, appCfg *config.Application) ([]config.Upstream, error) {
+	k.discoveryLock.Lock()
+	defer k.discoveryLock.Unlock()
+
+	if stop, ok := k.discoveries[name]; ok {
+		close(stop)
+		delete(k.discoveries, name)
+	}
+
+	upstreams, err := k.resolveDnsUpstreams(name, appCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if appCfg.Backend.Kubernetes.Service == "" || len(appCfg.Backend.Upstreams) > 0 || appCfg.Backend.Url != "" || appCfg.Backend.Dns.Name != "" {
+		return upstreams, nil
+	}
+
+	q := kubernetes.NewEndpointsQuery(&appCfg.Backend.Kubernetes, k.kube.Namespace())
+
+	discovered, resourceVersion, err := k.kube.Endpoints(context.Background(), q)
+	if err != nil {
+		return nil, fmt.Errorf("error while discovering endpoints of application %s: %s", name, err)
+	}
+
+	if len(discovered) > 0 {
+		upstreams = discovered
+	}
+
+	k.discoveries[name] = k.watchEndpoints(name, *appCfg, q, upstreams, resourceVersion)
+
+	return upstreams, nil
+}
+
+// watchRoutes waits for changes of the resources that define applications,
+// and calls the changed function after each change, until the returned
+// channel is closed.
+func (k *kubernetesPathDispatcher) watchRoutes(resourceVersion string, changed func() error) chan struct{} {
+	stop := make(chan struct{})
+
+	go func() {
+		ctx, cancel := stopContext(stop)
+		defer cancel()
+
+		for ctx.Err() == nil {
+			hasChanged, err := k.kube.WaitForRoutes(ctx, resourceVersion)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err == kubernetes.ExpiredError {
+				// the routes may have changed in the meantime
+				hasChanged = true
+			} else if err != nil {
+				k.log.Errorf("error while watching routes in Kubernetes: %s", err)
+
+				select {
+				case <-time.After(5 * time.Second):
+				case <-stop:
+				}
+				continue
+			}
+
+			if !hasChanged {
+				continue
+			}
+
+			// resources are often changed in quick succession (like on a
+			// deployment), so that they are applied at once
+			select {
+			case <-time.After(time.Second):
+			case <-stop:
+				return
+			}
+
+			k.log.Noticef("routes in Kubernetes changed")
+			if err := changed(); err != nil {
+				k.log.Errorf("could not apply routes from Kubernetes: %s", err)
+
+				// the watch continues from the current state, since the
+				// changes up to now were rejected
+				if _, current, err := k.kube.Routes(ctx); err == nil {
+					resourceVersion = current
+				}
+			}
+		}
+	}()
+
+	return stop
+}
@@ -0,0 +1,200 @@
+package dispatcher
+
+import (
+	"fmt"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/audit"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/httplogging"
+	"github.com/mittwald/servicegateway/kubernetes"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/proxy"
+	"github.com/mittwald/servicegateway/redisconn"
+	"github.com/op/go-logging"
+
+	"context"
+	"sync"
+)
+
+func BuildKubernetesDispatcher(
+	startup *config.Startup,
+	cfg *config.Configuration,
+	kube *kubernetes.Client,
+	handler *proxy.ProxyHandler,
+	rpool redisconn.Source,
+	logger *logging.Logger,
+	tokenStore auth.TokenStore,
+	tokenVerifier *auth.JwtVerifier,
+	httpLoggers []httplogging.HttpLogger,
+	auditLogger *audit.Logger,
+	metrics *monitoring.PromMetrics,
+	reload func() error,
+) (gateway *Gateway, err error) {
+	var disp Dispatcher
+	var localCfg = *cfg
+	var appCfgs = make(map[string]config.Application)
+	var resourceVersion string
+
+	dispLogger := logging.MustGetLogger("dispatch")
+
+	switch startup.DispatchingMode {
+	case "path":
+		disp, err = buildKubernetesPathDispatcher(&localCfg, dispLogger, handler, kube, metrics)
+	default:
+		err = fmt.Errorf("unsupported dispatching mode: '%s'", startup.DispatchingMode)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error while creating proxy builder: %s", err)
+	}
+
+	// the endpoints of the applications that were registered are no
+	// longer watched if the gateway could not be built
+	defer func() {
+		if err != nil {
+			_ = disp.Close()
+		}
+	}()
+
+	if kube.RoutesEnabled() {
+		var routes []kubernetes.Route
+
+		logger.Infof("loading routes from Kubernetes (%s)", localCfg.Kubernetes.Routes)
+		routes, resourceVersion, err = kube.Routes(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("could not load routes from Kubernetes: %s", err)
+		}
+
+		for _, route := range routes {
+			err := route.Err
+			if err == nil {
+				err = ValidateApplication(&route.Application)
+			}
+
+			// an invalid definition does not replace the one that is
+			// currently active
+			if err != nil {
+				if previous, ok := handler.PreviousApplication(route.Name); ok {
+					logger.Errorf("invalid Kubernetes route '%s', keeping previous definition: %s", route.Name, err)
+					appCfgs[route.Name] = previous
+				} else {
+					logger.Errorf("invalid Kubernetes route '%s', skipping: %s", route.Name, err)
+				}
+				continue
+			}
+
+			appCfgs[route.Name] = route.Application
+		}
+	}
+
+	comps, err := buildComponents(startup, &localCfg, rpool, logger, tokenStore, tokenVerifier, auditLogger, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = comps.close()
+		}
+	}()
+
+	comps.addBehaviours(disp)
+
+	if err := checkRoutes(appCfgs, localCfg.Applications); err != nil {
+		return nil, err
+	}
+
+	for name, appCfg := range appCfgs {
+		logger.Infof("registering application '%s' from Kubernetes", name)
+		if err := registerApplication(disp, name, appCfg, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, appCfg := range localCfg.Applications {
+		logger.Infof("registering application '%s' from local config", name)
+		if err := registerApplication(disp, name, appCfg, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = disp.Initialize(); err != nil {
+		return nil, err
+	}
+
+	gateway, err = comps.gateway(disp, &localCfg, handler, httpLoggers, reload)
+	if err != nil {
+		return nil, err
+	}
+
+	// changes of the routes in the cluster are applied by rebuilding the
+	// gateway
+	if kubeDisp, ok := disp.(*kubernetesPathDispatcher); ok && kube.RoutesEnabled() {
+		kubeDisp.routeWatch = kubeDisp.watchRoutes(resourceVersion, reload)
+	}
+
+	return gateway, nil
+}
+
+type kubernetesPathDispatcher struct {
+	*abstractPathBasedDispatcher
+
+	kube          *kubernetes.Client
+	discoveries   map[string]chan struct{}
+	discoveryLock sync.Mutex
+
+	routeWatch chan struct{}
+}
+
+func buildKubernetesPathDispatcher(
+	cfg *config.Configuration,
+	log *logging.Logger,
+	prx *proxy.ProxyHandler,
+	kube *kubernetes.Client,
+	metrics *monitoring.PromMetrics,
+) (*kubernetesPathDispatcher, error) {
+	dispatcher := &kubernetesPathDispatcher{
+		abstractPathBasedDispatcher: &abstractPathBasedDispatcher{
+			abstractDispatcher: abstractDispatcher{},
+		},
+		kube:        kube,
+		discoveries: make(map[string]chan struct{}),
+	}
+	dispatcher.cfg = cfg
+	dispatcher.mux = httprouter.New()
+	dispatcher.log = log
+	dispatcher.prx = prx
+	dispatcher.metrics = metrics
+	dispatcher.behaviors = make([]Behavior, 0, 8)
+
+	return dispatcher, nil
+}
+
+// Close stops watching the routes and the endpoints of the applications.
+func (k *kubernetesPathDispatcher) Close() error {
+	if k.routeWatch != nil {
+		close(k.routeWatch)
+		k.routeWatch = nil
+	}
+
+	k.discoveryLock.Lock()
+	defer k.discoveryLock.Unlock()
+
+	for name, stop := range k.discoveries {
+		close(stop)
+		delete(k.discoveries, name)
+	}
+
+	return k.abstractDispatcher.Close()
+}
+
+func (k *kubernetesPathDispatcher) RegisterApplication(name string, appCfg config.Application, config *config.Configuration) error {
+	upstreams, err := k.resolveUpstreams(name, &appCfg)
+	if err != nil {
+		return err
+	}
+
+	return k.registerRoutes(k, name, appCfg, upstreams, config)
+}
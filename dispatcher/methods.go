@@ -0,0 +1,71 @@
+package dispatcher
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+// routeMethods are the methods that routes are registered for.
+var routeMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// RouteMethods returns the methods that a route of an application is
+// registered for; those that are configured for its pattern, those that
+// the application is restricted to, or all methods. Routes for GET are
+// registered for HEAD as well, and routes of applications with CORS for
+// OPTIONS, so that preflight requests are answered.
+func RouteMethods(appCfg *config.Application, pattern string) []string {
+	methods, ok := appCfg.Routing.Methods[pattern]
+	if !ok || len(methods) == 0 {
+		methods = appCfg.Routing.Match.Methods
+	}
+
+	if len(methods) == 0 {
+		return routeMethods
+	}
+
+	methods = slices.Clone(methods)
+
+	if slices.Contains(methods, "GET") && !slices.Contains(methods, "HEAD") {
+		methods = append(methods, "HEAD")
+	}
+
+	if appCfg.Cors.Enabled && !slices.Contains(methods, "OPTIONS") {
+		methods = append(methods, "OPTIONS")
+	}
+
+	return methods
+}
+
+// methodNotAllowed answers requests with a method that the route does not
+// allow. The router has set the Allow header already.
+func methodNotAllowed(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusMethodNotAllowed)
+	_, _ = rw.Write([]byte(`{"msg":"method not allowed"}`))
+}
+
+// allowHeader returns the Allow header for a route with the given methods;
+// like the router, OPTIONS is always allowed, since it is answered by the
+// gateway if it is not routed.
+func allowHeader(methods []string) string {
+	allowed := append(slices.Clone(methods), "OPTIONS")
+	slices.Sort(allowed)
+
+	return strings.Join(slices.Compact(allowed), ", ")
+}
+
+// hostMethodNotAllowed answers requests for a route of a host with a
+// method that its applications do not allow. Requests that a route for
+// any host allows are routed like requests for other hosts, though.
+func (d *abstractPathBasedDispatcher) hostMethodNotAllowed(rw http.ResponseWriter, req *http.Request) {
+	if handle, _, _ := d.mux.Lookup(req.Method, req.URL.Path); handle != nil {
+		rw.Header().Del("Allow")
+		d.mux.ServeHTTP(rw, req)
+		return
+	}
+
+	methodNotAllowed(rw, req)
+}
@@ -0,0 +1,77 @@
+package dispatcher
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/statusrecorder"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type contextKey int
+
+const passedContextKey contextKey = iota
+
+// instrument records the number and duration of the requests to a route.
+func (d *abstractDispatcher) instrument(appName string, route string, handler httprouter.Handle) httprouter.Handle {
+	requests := d.metrics.Requests.MustCurryWith(prometheus.Labels{"application": appName, "route": route})
+	durations := d.metrics.RequestDurations.MustCurryWith(prometheus.Labels{"application": appName, "route": route})
+
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		start := time.Now()
+		writer := statusrecorder.New(rw)
+
+		handler(writer, req, params)
+
+		status := strconv.Itoa(writer.Status())
+		requests.With(prometheus.Labels{"method": req.Method, "status": status}).Inc()
+		durations.With(prometheus.Labels{"status": status}).Observe(time.Since(start).Seconds())
+	}
+}
+
+// countRejections counts the requests that a middleware answers with one of
+// the given status codes by itself, instead of passing them on to the
+// handler.
+func countRejections(counter prometheus.Counter, decorate func(httprouter.Handle) httprouter.Handle, handler httprouter.Handle, statuses ...int) httprouter.Handle {
+	decorated := decorate(func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if passed, ok := req.Context().Value(passedContextKey).(*bool); ok {
+			*passed = true
+		}
+
+		handler(rw, req, params)
+	})
+
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		passed := false
+		writer := statusrecorder.New(rw)
+
+		decorated(writer, req.WithContext(context.WithValue(req.Context(), passedContextKey, &passed)), params)
+
+		if passed {
+			return
+		}
+
+		for _, status := range statuses {
+			if writer.Status() == status {
+				counter.Inc()
+				return
+			}
+		}
+	}
+}
+
+// countCacheResults counts the requests answered by the cache, using the
+// X-Cache header that the cache sets.
+func countCacheResults(results *prometheus.CounterVec, handler httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		handler(rw, req, params)
+
+		if result := rw.Header().Get("X-Cache"); result != "" {
+			results.With(prometheus.Labels{"result": strings.ToLower(result)}).Inc()
+		}
+	}
+}
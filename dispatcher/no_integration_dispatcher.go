@@ -3,107 +3,88 @@ package dispatcher
 import (
 	"fmt"
 
-	"github.com/gomodule/redigo/redis"
 	"github.com/julienschmidt/httprouter"
-	"github.com/mittwald/servicegateway/admin"
+	"github.com/mittwald/servicegateway/audit"
 	"github.com/mittwald/servicegateway/auth"
-	"github.com/mittwald/servicegateway/cache"
 	"github.com/mittwald/servicegateway/config"
 	"github.com/mittwald/servicegateway/httplogging"
+	"github.com/mittwald/servicegateway/monitoring"
 	"github.com/mittwald/servicegateway/proxy"
-	"github.com/mittwald/servicegateway/ratelimit"
+	"github.com/mittwald/servicegateway/redisconn"
 	"github.com/op/go-logging"
-
-	"net/http"
-	"regexp"
-	"strings"
 )
 
 func BuildNoIntegrationDispatcher(
 	startup *config.Startup,
 	cfg *config.Configuration,
 	handler *proxy.ProxyHandler,
-	rpool *redis.Pool,
+	rpool redisconn.Source,
 	logger *logging.Logger,
 	tokenStore auth.TokenStore,
 	tokenVerifier *auth.JwtVerifier,
 	httpLoggers []httplogging.HttpLogger,
-) (http.Handler, http.Handler, error) {
+	auditLogger *audit.Logger,
+	metrics *monitoring.PromMetrics,
+	reload func() error,
+) (gateway *Gateway, err error) {
 	var disp Dispatcher
-	var err error
 	var localCfg = *cfg
 
 	dispLogger := logging.MustGetLogger("dispatch")
 
 	switch startup.DispatchingMode {
 	case "path":
-		disp, err = buildNoIntegrationPathDispatcher(&localCfg, dispLogger, handler)
+		disp, err = buildNoIntegrationPathDispatcher(&localCfg, dispLogger, handler, metrics)
 	default:
 		err = fmt.Errorf("unsupported dispatching mode: '%s'", startup.DispatchingMode)
 	}
 
 	if err != nil {
-		return nil, nil, fmt.Errorf("error while creating proxy builder: %s", err)
+		return nil, fmt.Errorf("error while creating proxy builder: %s", err)
 	}
 
-	authHandler, err := auth.NewAuthenticationHandler(&localCfg.Authentication, rpool, tokenStore, tokenVerifier, logger)
-	if err != nil {
-		return nil, nil, err
-	}
+	// the upstreams of the applications that were registered are no
+	// longer resolved if the gateway could not be built
+	defer func() {
+		if err != nil {
+			_ = disp.Close()
+		}
+	}()
 
-	authDecorator, err := auth.NewAuthDecorator(&localCfg.Authentication, rpool, logging.MustGetLogger("auth"), authHandler, tokenStore, startup.UiDir)
+	comps, err := buildComponents(startup, &localCfg, rpool, logger, tokenStore, tokenVerifier, auditLogger, metrics)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	rlim, err := ratelimit.NewRateLimiter(localCfg.RateLimiting, rpool, logging.MustGetLogger("ratelimiter"))
-	if err != nil {
-		logger.Fatalf("error while configuring rate limiting: %s", err)
-	}
+	defer func() {
+		if err != nil {
+			_ = comps.close()
+		}
+	}()
 
-	cch := cache.NewCache(4096)
+	comps.addBehaviours(disp)
 
-	// Order is important here! Behaviors will be called in LIFO order;
-	// behaviors that are added last will be called first!
-	disp.AddBehaviour(NewCachingBehaviour(cch))
-	disp.AddBehaviour(NewAuthenticationBehaviour(authDecorator))
-	disp.AddBehaviour(NewRatelimitBehaviour(rlim))
+	if err := checkRoutes(localCfg.Applications); err != nil {
+		return nil, err
+	}
 
 	for name, appCfg := range localCfg.Applications {
 		logger.Infof("registering application '%s' from local config", name)
-		if err := disp.RegisterApplication(name, appCfg, cfg); err != nil {
-			return nil, nil, err
+		if err := registerApplication(disp, name, appCfg, cfg); err != nil {
+			return nil, err
 		}
 	}
 
 	if err = disp.Initialize(); err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	adminLogger, err := logging.GetLogger("admin-api")
+	gateway, err = comps.gateway(disp, &localCfg, handler, httpLoggers, reload)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	adminServer, err := admin.NewAdminServer(tokenStore, tokenVerifier, authHandler, adminLogger)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	var server http.Handler = disp
-
-	for _, httpLogger := range httpLoggers {
-		if listener, ok := httpLogger.(auth.AuthRequestListener); ok {
-			authDecorator.RegisterRequestListener(listener)
-		}
-
-		server, err = httpLogger.Wrap(server)
-		if err != nil {
-			return nil, nil, err
-		}
-	}
-
-	return server, adminServer, nil
+	return gateway, nil
 }
 
 type noIntegrationPathDispatcher struct {
@@ -114,6 +95,7 @@ func buildNoIntegrationPathDispatcher(
 	cfg *config.Configuration,
 	log *logging.Logger,
 	prx *proxy.ProxyHandler,
+	metrics *monitoring.PromMetrics,
 ) (*noIntegrationPathDispatcher, error) {
 	dispatcher := &noIntegrationPathDispatcher{
 		abstractPathBasedDispatcher: &abstractPathBasedDispatcher{
@@ -124,93 +106,17 @@ func buildNoIntegrationPathDispatcher(
 	dispatcher.mux = httprouter.New()
 	dispatcher.log = log
 	dispatcher.prx = prx
+	dispatcher.metrics = metrics
 	dispatcher.behaviors = make([]Behavior, 0, 8)
 
 	return dispatcher, nil
 }
 
 func (n *noIntegrationPathDispatcher) RegisterApplication(name string, appCfg config.Application, config *config.Configuration) error {
-	routes := make(map[string]httprouter.Handle)
-
-	backendUrl := appCfg.Backend.Url
-	if backendUrl == "" && appCfg.Backend.Service != "" {
-		if appCfg.Backend.Tag != "" {
-			backendUrl = fmt.Sprintf("http://%s.%s.service.consul", appCfg.Backend.Tag, appCfg.Backend.Service)
-		} else {
-			backendUrl = fmt.Sprintf("http://%s.service.consul", appCfg.Backend.Service)
-		}
-	}
-
-	var rewriter proxy.HostRewriter
-
-	if appCfg.Routing.Type == "path" {
-		path := strings.TrimRight(appCfg.Routing.Path, "/")
-		mapping := map[string]string{
-			"/(?P<path>.*)": path + "/:path",
-		}
-
-		rewriter, _ = proxy.NewHostRewriter(backendUrl, mapping, n.log)
-
-		closure := new(PathClosure)
-		closure.backendUrl = backendUrl
-		closure.appName = name
-		closure.appCfg = &appCfg
-		closure.proxy = n.prx
-
-		routes[path] = closure.Handle
-		routes[path+"/*path"] = closure.Handle
-	} else if appCfg.Routing.Type == "pattern" {
-		re := regexp.MustCompile(":([a-zA-Z0-9]+)")
-		mapping := make(map[string]string)
-
-		for pattern, target := range appCfg.Routing.Patterns {
-			targetPattern := "^" + re.ReplaceAllString(target, "(?P<$1>[^/]+?)") + "$"
-			mapping[targetPattern] = pattern
-
-			parameters := re.FindAllStringSubmatch(pattern, -1)
-
-			closure := new(PatternClosure)
-			closure.targetUrl = backendUrl + target
-			closure.parameters = parameters
-			closure.appName = name
-			closure.appCfg = &appCfg
-			closure.proxy = n.prx
-
-			routes[pattern] = closure.Handle
-		}
-
-		rewriter, _ = proxy.NewHostRewriter(backendUrl, mapping, n.log)
-	}
-
-	for route, handler := range routes {
-		handler = rewriter.Decorate(handler)
-
-		safeHandler := handler
-		unsafeHandler := handler
-
-		for _, behavior := range n.behaviors {
-			var err error
-			safeHandler, unsafeHandler, err = behavior.Apply(safeHandler, unsafeHandler, n, name, &appCfg, config)
-			if err != nil {
-				return err
-			}
-		}
-
-		n.mux.GET(route, safeHandler)
-		n.mux.HEAD(route, safeHandler)
-		n.mux.POST(route, unsafeHandler)
-		n.mux.PUT(route, unsafeHandler)
-		n.mux.PATCH(route, unsafeHandler)
-		n.mux.DELETE(route, unsafeHandler)
-
-		// Register a dedicated OPTIONS handler if it was enabled.
-		// If no OPTIONS handler was enabled, simply proxy OPTIONS request through to the backend servers.
-		if n.cfg.Proxy.OptionsConfiguration.Enabled {
-			n.mux.OPTIONS(route, n.buildOptionsHandler(safeHandler))
-		} else {
-			n.mux.OPTIONS(route, safeHandler)
-		}
+	upstreams, err := n.resolveDnsUpstreams(name, &appCfg)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return n.registerRoutes(n, name, appCfg, upstreams, config)
 }
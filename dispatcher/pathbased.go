@@ -27,17 +27,29 @@ import (
 	"github.com/mittwald/servicegateway/proxy"
 
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"strings"
 )
 
 type abstractPathBasedDispatcher struct {
 	abstractDispatcher
+
+	// hosts are the routers of applications that are restricted to host
+	// names, by host name (like `api.example.com` or `*.example.com`)
+	hosts map[string]*httprouter.Router
+
+	// routes are the applications that share each registered route
+	routes map[routeKey]*routeCandidates
+
+	// regexRoutes are the routes with extended patterns of each router
+	regexRoutes map[*httprouter.Router][]*regexRoute
 }
 
 type PatternClosure struct {
-	targetUrl  string
+	targetPath string
 	parameters [][]string
 	appName    string
 	appCfg     *config.Application
@@ -45,10 +57,23 @@ type PatternClosure struct {
 }
 
 type PathClosure struct {
-	backendUrl string
-	appName    string
-	appCfg     *config.Application
-	proxy      *proxy.ProxyHandler
+	appName string
+	appCfg  *config.Application
+	proxy   *proxy.ProxyHandler
+}
+
+// routeConfig returns the configuration of an application for one of its
+// route patterns, taking route-specific timeouts into account.
+func routeConfig(appCfg *config.Application, pattern string) *config.Application {
+	override, ok := appCfg.Routing.Timeouts[pattern]
+	if !ok {
+		return appCfg
+	}
+
+	routeCfg := *appCfg
+	routeCfg.Backend.Timeouts = appCfg.Backend.Timeouts.Merge(override)
+
+	return &routeCfg
 }
 
 func (d *abstractPathBasedDispatcher) ServeHTTP(res http.ResponseWriter, req *http.Request) {
@@ -56,23 +81,82 @@ func (d *abstractPathBasedDispatcher) ServeHTTP(res http.ResponseWriter, req *ht
 	//		res.Header.Set(k, v)
 	//	}
 
-	d.mux.ServeHTTP(res, req)
+	d.hostRouter(req.Host).ServeHTTP(res, req)
+}
+
+// routers returns the routers that the routes of an application are added
+// to; the router of each of its host names, or the router for any host.
+func (d *abstractPathBasedDispatcher) routers(appCfg *config.Application) []*httprouter.Router {
+	hosts := appCfg.Routing.HostNames()
+	if len(hosts) == 0 {
+		return []*httprouter.Router{d.mux}
+	}
+
+	if d.hosts == nil {
+		d.hosts = make(map[string]*httprouter.Router)
+	}
+
+	routers := make([]*httprouter.Router, 0, len(hosts))
+	for _, host := range hosts {
+		router, ok := d.hosts[host]
+		if !ok {
+			// requests that match none of the routes of the host are
+			// routed like requests for other hosts
+			router = httprouter.New()
+			router.NotFound = d.mux
+			router.MethodNotAllowed = http.HandlerFunc(d.hostMethodNotAllowed)
+			d.hosts[host] = router
+		}
+		routers = append(routers, router)
+	}
+
+	return routers
+}
+
+// hostRouter returns the router for the host of a request. Host names are
+// matched exactly first, and then by wildcard (`*.example.com` matches
+// `api.example.com`, but neither `example.com` nor `v1.api.example.com`).
+func (d *abstractPathBasedDispatcher) hostRouter(host string) *httprouter.Router {
+	if len(d.hosts) == 0 {
+		return d.mux
+	}
+
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if router, ok := d.hosts[host]; ok {
+		return router
+	}
+
+	if dot := strings.Index(host, "."); dot > 0 {
+		if router, ok := d.hosts["*"+host[dot:]]; ok {
+			return router
+		}
+	}
+
+	return d.mux
 }
 
 func (p *PatternClosure) Handle(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	targetUrl := p.targetUrl
+	targetPath := p.targetPath
+	routeParams := make(map[string]string, len(p.parameters))
 	for _, paramName := range p.parameters {
-		targetUrl = strings.Replace(targetUrl, paramName[0], params.ByName(paramName[1]), -1)
+		targetPath = strings.Replace(targetPath, paramName[0], params.ByName(paramName[1]), -1)
+		routeParams[paramName[1]] = params.ByName(paramName[1])
 	}
 
-	p.proxy.HandleProxyRequest(rw, req, targetUrl, p.appName, p.appCfg)
+	p.proxy.HandleProxyRequest(rw, proxy.WithRouteParams(req, routeParams), targetPath, p.appName, p.appCfg)
 }
 
 func (p *PathClosure) Handle(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	sanitizedPath := strings.Replace(req.URL.Path, p.appCfg.Routing.Path, "", 1)
-	proxyUrl := p.backendUrl + sanitizedPath
 
-	p.proxy.HandleProxyRequest(rw, req, proxyUrl, p.appName, p.appCfg)
+	// the rest of the path can be used in redirects
+	req = proxy.WithRouteParams(req, map[string]string{"path": sanitizedPath})
+
+	p.proxy.HandleProxyRequest(rw, req, sanitizedPath, p.appName, p.appCfg)
 }
 
 func (d *abstractPathBasedDispatcher) buildOptionsHandler(inner httprouter.Handle) httprouter.Handle {
@@ -129,6 +213,8 @@ func (d *abstractPathBasedDispatcher) buildOptionsHandler(inner httprouter.Handl
 }
 
 func (d *abstractPathBasedDispatcher) Initialize() error {
+	d.mux.MethodNotAllowed = http.HandlerFunc(methodNotAllowed)
+
 	for _, behavior := range d.behaviors {
 		switch t := behavior.(type) {
 		case RoutingBehaviour:
@@ -140,3 +226,95 @@ func (d *abstractPathBasedDispatcher) Initialize() error {
 
 	return nil
 }
+
+// registerRoutes registers an application with the proxy handler and adds
+// its routes, once its upstreams have been resolved.
+func (d *abstractPathBasedDispatcher) registerRoutes(disp Dispatcher, name string, appCfg config.Application, upstreams []config.Upstream, config *config.Configuration) error {
+	routes := make(map[string]httprouter.Handle)
+
+	backendUrl := upstreams[0].Url
+
+	if !appCfg.HasBackend() {
+		// static responses, redirects and composite responses have no backend
+		if err := d.prx.RegisterStatic(name, &appCfg); err != nil {
+			return fmt.Errorf("could not register application %s: %s", name, err)
+		}
+	} else if err := d.prx.RegisterUpstreams(name, upstreams, &appCfg); err != nil {
+		return fmt.Errorf("could not register upstreams of application %s: %s", name, err)
+	}
+
+	var rewriter proxy.HostRewriter
+
+	if appCfg.Routing.Type == "path" || appCfg.Routing.Type == "host" {
+		// applications that are routed by host receive all paths
+		path := ""
+		if appCfg.Routing.Type == "path" {
+			path = strings.TrimRight(appCfg.Routing.Path, "/")
+		}
+
+		mapping := map[string]string{
+			"/(?P<path>.*)": path + "/:path",
+		}
+
+		rewriter, _ = proxy.NewHostRewriter(backendUrl, mapping, d.log)
+
+		closure := new(PathClosure)
+		closure.appName = name
+		closure.appCfg = &appCfg
+		closure.proxy = d.prx
+
+		if path != "" {
+			routes[path] = closure.Handle
+		}
+		routes[path+"/*path"] = closure.Handle
+	} else if appCfg.Routing.Type == "pattern" {
+		re := regexp.MustCompile(":([a-zA-Z0-9]+)")
+		mapping := make(map[string]string)
+
+		for pattern, target := range appCfg.Routing.Patterns {
+			targetPattern := "^" + re.ReplaceAllString(target, "(?P<$1>[^/]+?)") + "$"
+			mapping[targetPattern] = publicPattern(pattern)
+
+			parameters := patternParameters(pattern)
+
+			closure := new(PatternClosure)
+			closure.targetPath = target
+			closure.parameters = parameters
+			closure.appName = name
+			closure.appCfg = routeConfig(&appCfg, pattern)
+			closure.proxy = d.prx
+
+			routes[pattern] = closure.Handle
+		}
+
+		rewriter, _ = proxy.NewHostRewriter(backendUrl, mapping, d.log)
+	}
+
+	routers := d.routers(&appCfg)
+
+	for route, handler := range routes {
+		if appCfg.HasBackend() {
+			handler = rewriter.Decorate(handler)
+		}
+
+		safeHandler := handler
+		unsafeHandler := handler
+
+		for _, behavior := range d.behaviors {
+			var err error
+			safeHandler, unsafeHandler, err = behavior.Apply(safeHandler, unsafeHandler, disp, name, &appCfg, config)
+			if err != nil {
+				return err
+			}
+		}
+
+		safeHandler = d.instrument(name, route, d.prx.DecorateEnabled(name, &appCfg, safeHandler))
+		unsafeHandler = d.instrument(name, route, d.prx.DecorateEnabled(name, &appCfg, unsafeHandler))
+
+		for _, mux := range routers {
+			d.handle(mux, route, name, &appCfg, safeHandler, unsafeHandler)
+		}
+	}
+
+	return nil
+}
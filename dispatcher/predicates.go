@@ -0,0 +1,202 @@
+package dispatcher
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+)
+
+type routeKey struct {
+	mux    *httprouter.Router
+	method string
+	route  string
+}
+
+type routeCandidate struct {
+	appName string
+	routing *config.Routing
+	handler httprouter.Handle
+}
+
+// before reports whether a candidate is tried before another one; those
+// with a higher priority first, and then those that require more headers
+// and query parameters.
+func (c *routeCandidate) before(other *routeCandidate) bool {
+	if c.routing.Priority != other.routing.Priority {
+		return c.routing.Priority > other.routing.Priority
+	}
+
+	if predicates(c.routing) != predicates(other.routing) {
+		return predicates(c.routing) > predicates(other.routing)
+	}
+
+	return c.appName < other.appName
+}
+
+// predicates returns the number of headers and query parameters that the
+// routes of an application require.
+func predicates(routing *config.Routing) int {
+	return len(routing.Match.Headers) + len(routing.Match.Query)
+}
+
+// ambiguous reports whether a request could be routed to either of two
+// applications that share a route, since neither of them is tried first
+// and they may both match.
+func ambiguous(a *config.Routing, b *config.Routing) bool {
+	if a.Priority != b.Priority || predicates(a) != predicates(b) {
+		return false
+	}
+
+	for name, value := range a.Match.Headers {
+		for otherName, otherValue := range b.Match.Headers {
+			if http.CanonicalHeaderKey(name) == http.CanonicalHeaderKey(otherName) && value != "" && otherValue != "" && value != otherValue {
+				return false
+			}
+		}
+	}
+
+	for name, value := range a.Match.Query {
+		if otherValue, ok := b.Match.Query[name]; ok && value != "" && otherValue != "" && value != otherValue {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *routeCandidate) matches(req *http.Request) bool {
+	for name, value := range c.routing.Match.Headers {
+		if !matchValues(req.Header.Values(name), value) {
+			return false
+		}
+	}
+
+	if len(c.routing.Match.Query) > 0 {
+		query := req.URL.Query()
+		for name, value := range c.routing.Match.Query {
+			if !matchValues(query[name], value) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// matchValues reports whether one of the values of a header or query
+// parameter equals the expected value. An empty expected value only
+// requires the header or query parameter to be present.
+func matchValues(values []string, expected string) bool {
+	if expected == "" {
+		return len(values) > 0
+	}
+
+	for _, value := range values {
+		if value == expected {
+			return true
+		}
+	}
+
+	return false
+}
+
+// routeCandidates are the applications that share a route (with the same
+// method); the request is handled by the first one whose headers and query
+// parameters match, in the order of their priority.
+type routeCandidates struct {
+	mux        *httprouter.Router
+	candidates []*routeCandidate
+}
+
+func (r *routeCandidates) add(candidate *routeCandidate, route string) {
+	for _, other := range r.candidates {
+		if ambiguous(candidate.routing, other.routing) {
+			panic(fmt.Sprintf("route '%s' is already used by application %s", route, other.appName))
+		}
+	}
+
+	r.candidates = append(r.candidates, candidate)
+
+	sort.SliceStable(r.candidates, func(i, j int) bool {
+		return r.candidates[i].before(r.candidates[j])
+	})
+}
+
+func (r *routeCandidates) Handle(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if r.serve(rw, req, params) {
+		return
+	}
+
+	// like requests for which no route matches at all
+	if r.mux.NotFound != nil {
+		r.mux.NotFound.ServeHTTP(rw, req)
+		return
+	}
+	http.NotFound(rw, req)
+}
+
+// serve handles a request with the first candidate that matches it, and
+// reports whether there was one.
+func (r *routeCandidates) serve(rw http.ResponseWriter, req *http.Request, params httprouter.Params) bool {
+	for _, candidate := range r.candidates {
+		if candidate.matches(req) {
+			candidate.handler(rw, req, params)
+			return true
+		}
+	}
+
+	return false
+}
+
+// handle registers the handlers of a route of an application, for the
+// methods that the application is restricted to. Applications that require
+// headers or query parameters can share a route with other applications.
+func (d *abstractPathBasedDispatcher) handle(mux *httprouter.Router, route string, appName string, appCfg *config.Application, safeHandler httprouter.Handle, unsafeHandler httprouter.Handle) {
+	handlers := map[string]httprouter.Handle{
+		"GET":    safeHandler,
+		"HEAD":   safeHandler,
+		"POST":   unsafeHandler,
+		"PUT":    unsafeHandler,
+		"PATCH":  unsafeHandler,
+		"DELETE": unsafeHandler,
+	}
+
+	// Register a dedicated OPTIONS handler if it was enabled.
+	// If no OPTIONS handler was enabled, simply proxy OPTIONS request through to the backend servers.
+	if d.cfg.Proxy.OptionsConfiguration.Enabled {
+		handlers["OPTIONS"] = d.buildOptionsHandler(safeHandler)
+	} else {
+		handlers["OPTIONS"] = safeHandler
+	}
+
+	if d.routes == nil {
+		d.routes = make(map[routeKey]*routeCandidates)
+	}
+
+	for _, method := range RouteMethods(appCfg, route) {
+		handler, ok := handlers[method]
+		if !ok {
+			continue
+		}
+
+		key := routeKey{mux: mux, method: method, route: route}
+		candidates, ok := d.routes[key]
+		if !ok {
+			candidates = &routeCandidates{mux: mux}
+			d.routes[key] = candidates
+
+			if extendedPattern(route) {
+				d.addRegexRoute(mux, route, method, candidates, appCfg.Routing.Priority)
+			} else {
+				mux.Handle(method, route, candidates.Handle)
+			}
+		} else if extendedPattern(route) {
+			d.addRegexRoute(mux, route, method, candidates, appCfg.Routing.Priority)
+		}
+
+		candidates.add(&routeCandidate{appName: appName, routing: &appCfg.Routing, handler: handler}, route)
+	}
+}
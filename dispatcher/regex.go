@@ -0,0 +1,303 @@
+package dispatcher
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	parameterPattern     = regexp.MustCompile(":([a-zA-Z0-9]+)")
+	parameterNamePattern = regexp.MustCompile("^[a-zA-Z0-9]+$")
+)
+
+// extendedPattern reports whether a route pattern cannot be registered at
+// the router, since it contains regular expressions (`{name:regex}`) or a
+// catch-all parameter that is not at its end (like `/repos/*path/blob`).
+// These patterns are matched by a regular expression instead.
+func extendedPattern(pattern string) bool {
+	if strings.Contains(pattern, "{") {
+		return true
+	}
+
+	catchAll := strings.Index(pattern, "/*")
+	return catchAll >= 0 && strings.Contains(pattern[catchAll+2:], "/")
+}
+
+type patternToken struct {
+	literal string
+	name    string
+	regex   string
+}
+
+// parsePattern splits an extended route pattern into literal text and
+// parameters; `:name` matches one segment, `*name` any number of segments
+// and `{name:regex}` (which may be part of a segment) the regular
+// expression. `{name}` is the same as `:name`.
+func parsePattern(pattern string) ([]patternToken, error) {
+	var tokens []patternToken
+
+	for i := 0; i < len(pattern); {
+		segmentStart := i == 0 || pattern[i-1] == '/'
+
+		switch {
+		case pattern[i] == '{':
+			end, depth := -1, 0
+			for j := i; j < len(pattern) && end < 0; j++ {
+				switch pattern[j] {
+				case '\\':
+					j++
+				case '{':
+					depth++
+				case '}':
+					depth--
+					if depth == 0 {
+						end = j
+					}
+				}
+			}
+
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed '{' in route pattern '%s'", pattern)
+			}
+
+			name, regex, ok := strings.Cut(pattern[i+1:end], ":")
+			if !ok {
+				regex = "[^/]+"
+			}
+
+			tokens = append(tokens, patternToken{name: name, regex: regex})
+			i = end + 1
+		case segmentStart && (pattern[i] == ':' || pattern[i] == '*'):
+			end := strings.Index(pattern[i:], "/")
+			if end < 0 {
+				end = len(pattern)
+			} else {
+				end += i
+			}
+
+			regex := "[^/]+"
+			if pattern[i] == '*' {
+				regex = ".*"
+			}
+
+			tokens = append(tokens, patternToken{name: pattern[i+1 : end], regex: regex})
+			i = end
+		default:
+			if n := len(tokens); n > 0 && tokens[n-1].name == "" {
+				tokens[n-1].literal += pattern[i : i+1]
+			} else {
+				tokens = append(tokens, patternToken{literal: pattern[i : i+1]})
+			}
+			i++
+		}
+	}
+
+	for _, token := range tokens {
+		if token.literal == "" && !parameterNamePattern.MatchString(token.name) {
+			return nil, fmt.Errorf("invalid parameter name '%s' in route pattern '%s'", token.name, pattern)
+		}
+	}
+
+	return tokens, nil
+}
+
+// compilePattern returns the regular expression that matches the paths of
+// an extended route pattern, with a named capture group for each of its
+// parameters.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	tokens, err := parsePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	expr := strings.Builder{}
+	expr.WriteString("^")
+	for _, token := range tokens {
+		if token.name == "" {
+			expr.WriteString(regexp.QuoteMeta(token.literal))
+			continue
+		}
+		expr.WriteString("(?P<" + token.name + ">" + token.regex + ")")
+	}
+	expr.WriteString("$")
+
+	regex, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid route pattern '%s': %s", pattern, err)
+	}
+
+	return regex, nil
+}
+
+// patternParameters returns the parameters of a route pattern, each as its
+// placeholder in target patterns (`:name`) and its name.
+func patternParameters(pattern string) [][]string {
+	if !extendedPattern(pattern) {
+		return parameterPattern.FindAllStringSubmatch(pattern, -1)
+	}
+
+	tokens, err := parsePattern(pattern)
+	if err != nil {
+		return nil
+	}
+
+	var parameters [][]string
+	for _, token := range tokens {
+		if token.name != "" {
+			parameters = append(parameters, []string{":" + token.name, token.name})
+		}
+	}
+
+	return parameters
+}
+
+// publicPattern returns a route pattern with its parameters written as
+// `:name`, like the links of upstream responses are rewritten.
+func publicPattern(pattern string) string {
+	if !extendedPattern(pattern) {
+		return pattern
+	}
+
+	tokens, err := parsePattern(pattern)
+	if err != nil {
+		return pattern
+	}
+
+	public := strings.Builder{}
+	for _, token := range tokens {
+		if token.name == "" {
+			public.WriteString(token.literal)
+			continue
+		}
+		public.WriteString(":" + token.name)
+	}
+
+	return public.String()
+}
+
+// regexRoute is a route with an extended pattern. Regex routes are matched
+// when none of the routes of the router matched, in the order of their
+// priority, and then from the longest to the shortest pattern.
+type regexRoute struct {
+	pattern  string
+	regex    *regexp.Regexp
+	priority int
+	methods  map[string]*routeCandidates
+}
+
+// addRegexRoute adds the candidates of an extended route pattern for a
+// method to a router.
+func (d *abstractPathBasedDispatcher) addRegexRoute(mux *httprouter.Router, pattern string, method string, candidates *routeCandidates, priority int) {
+	if d.regexRoutes == nil {
+		d.regexRoutes = make(map[*httprouter.Router][]*regexRoute)
+	}
+
+	routes, ok := d.regexRoutes[mux]
+	if !ok {
+		fallback := mux.NotFound
+		mux.NotFound = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			served, allowed := d.serveRegexRoutes(mux, rw, req)
+			if served {
+				return
+			}
+
+			// like the router, for routes that do not allow the method
+			if len(allowed) > 0 {
+				rw.Header().Set("Allow", allowHeader(allowed))
+				if req.Method != "OPTIONS" {
+					methodNotAllowed(rw, req)
+				}
+				return
+			}
+
+			if fallback != nil {
+				fallback.ServeHTTP(rw, req)
+				return
+			}
+			http.NotFound(rw, req)
+		})
+	}
+
+	for _, route := range routes {
+		if route.pattern == pattern {
+			route.methods[method] = candidates
+			if priority > route.priority {
+				route.priority = priority
+			}
+			d.sortRegexRoutes(mux)
+			return
+		}
+	}
+
+	regex, err := compilePattern(pattern)
+	if err != nil {
+		// like the router, for patterns that it cannot register
+		panic(err.Error())
+	}
+
+	route := &regexRoute{
+		pattern:  pattern,
+		regex:    regex,
+		priority: priority,
+		methods:  map[string]*routeCandidates{method: candidates},
+	}
+
+	d.regexRoutes[mux] = append(routes, route)
+	d.sortRegexRoutes(mux)
+}
+
+func (d *abstractPathBasedDispatcher) sortRegexRoutes(mux *httprouter.Router) {
+	routes := d.regexRoutes[mux]
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].priority != routes[j].priority {
+			return routes[i].priority > routes[j].priority
+		}
+
+		if len(routes[i].pattern) != len(routes[j].pattern) {
+			return len(routes[i].pattern) > len(routes[j].pattern)
+		}
+
+		return routes[i].pattern < routes[j].pattern
+	})
+}
+
+// serveRegexRoutes handles a request with the first regex route of a
+// router that matches it, and reports whether there was one. Otherwise, it
+// returns the methods of the routes that match the path of the request.
+func (d *abstractPathBasedDispatcher) serveRegexRoutes(mux *httprouter.Router, rw http.ResponseWriter, req *http.Request) (bool, []string) {
+	var allowed []string
+
+	for _, route := range d.regexRoutes[mux] {
+		match := route.regex.FindStringSubmatch(req.URL.Path)
+		if match == nil {
+			continue
+		}
+
+		candidates, ok := route.methods[req.Method]
+		if !ok {
+			for method := range route.methods {
+				allowed = append(allowed, method)
+			}
+			continue
+		}
+
+		params := make(httprouter.Params, 0, len(match)-1)
+		for i, name := range route.regex.SubexpNames() {
+			if name != "" {
+				params = append(params, httprouter.Param{Key: name, Value: match[i]})
+			}
+		}
+
+		if candidates.serve(rw, req, params) {
+			return true, nil
+		}
+	}
+
+	return false, allowed
+}
@@ -0,0 +1,91 @@
+package dispatcher
+
+import (
+	"net/http"
+
+	"github.com/mittwald/servicegateway/auth"
+	"sync"
+	"sync/atomic"
+)
+
+// Gateway holds the handlers that were built from a configuration.
+type Gateway struct {
+	Proxy http.Handler
+	Admin http.Handler
+
+	dispatcher  Dispatcher
+	authHandler *auth.AuthenticationHandler
+}
+
+// Close stops the background tasks of the gateway's dispatcher (like the
+// discovery of upstreams) and of its authentication handler, once the
+// gateway has been replaced.
+func (g *Gateway) Close() error {
+	if err := g.dispatcher.Close(); err != nil {
+		return err
+	}
+
+	return g.authHandler.Close()
+}
+
+type generation struct {
+	handler  http.Handler
+	active   int64
+	retired  int32
+	drained  chan struct{}
+	drainOne sync.Once
+}
+
+func (g *generation) done() {
+	if atomic.AddInt64(&g.active, -1) == 0 && atomic.LoadInt32(&g.retired) == 1 {
+		g.drainOne.Do(func() { close(g.drained) })
+	}
+}
+
+// ReloadableHandler passes requests on to a handler that can be replaced at
+// runtime. Requests that are in flight when the handler is replaced are
+// still completed by the previous handler.
+type ReloadableHandler struct {
+	current atomic.Value
+}
+
+func NewReloadableHandler(handler http.Handler) *ReloadableHandler {
+	r := ReloadableHandler{}
+	r.current.Store(&generation{handler: handler, drained: make(chan struct{})})
+	return &r
+}
+
+// Swap replaces the handler. The returned channel is closed once all
+// requests to the previous handler have completed.
+func (r *ReloadableHandler) Swap(handler http.Handler) <-chan struct{} {
+	previous := r.current.Load().(*generation)
+	r.current.Store(&generation{handler: handler, drained: make(chan struct{})})
+
+	atomic.StoreInt32(&previous.retired, 1)
+	if atomic.LoadInt64(&previous.active) == 0 {
+		previous.drainOne.Do(func() { close(previous.drained) })
+	}
+
+	return previous.drained
+}
+
+func (r *ReloadableHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// the request is counted before the generation is checked, so that a
+	// concurrent Swap cannot consider the generation drained while the
+	// request is starting; if it was retired in the meantime, the request
+	// goes to the new generation instead
+	for {
+		g := r.current.Load().(*generation)
+
+		atomic.AddInt64(&g.active, 1)
+		if atomic.LoadInt32(&g.retired) == 1 {
+			g.done()
+			continue
+		}
+
+		defer g.done()
+
+		g.handler.ServeHTTP(rw, req)
+		return
+	}
+}
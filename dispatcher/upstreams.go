@@ -0,0 +1,40 @@
+package dispatcher
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+// backendUpstreams returns the upstream services of an application. Backends
+// that are identified by a Consul service are resolved via Consul DNS, and
+// Kubernetes services via cluster DNS.
+func backendUpstreams(appCfg *config.Application) []config.Upstream {
+	if len(appCfg.Backend.Upstreams) > 0 {
+		return appCfg.Backend.Upstreams
+	}
+
+	backendUrl := appCfg.Backend.Url
+	if backendUrl == "" && appCfg.Backend.Service != "" {
+		if appCfg.Backend.Tag != "" {
+			backendUrl = fmt.Sprintf("http://%s.%s.service.consul", appCfg.Backend.Tag, appCfg.Backend.Service)
+		} else {
+			backendUrl = fmt.Sprintf("http://%s.service.consul", appCfg.Backend.Service)
+		}
+	}
+
+	// without discovered endpoints, requests are sent to the service's
+	// cluster address
+	if backendUrl == "" && appCfg.Backend.Kubernetes.Service != "" {
+		backendUrl = "http://" + appCfg.Backend.Kubernetes.Service
+		if appCfg.Backend.Kubernetes.Namespace != "" {
+			backendUrl += "." + appCfg.Backend.Kubernetes.Namespace + ".svc"
+		}
+		if _, err := strconv.Atoi(appCfg.Backend.Kubernetes.Port); err == nil {
+			backendUrl += ":" + appCfg.Backend.Kubernetes.Port
+		}
+	}
+
+	return []config.Upstream{{Url: backendUrl}}
+}
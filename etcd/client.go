@@ -0,0 +1,191 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var KeyNotFoundError = errors.New("key not found")
+
+// CompactedError is returned when changes are waited for since a revision
+// that etcd has already compacted. The keys need to be read again.
+var CompactedError = errors.New("revision compacted")
+
+// requestTimeout limits the duration of requests other than watches.
+const requestTimeout = 10 * time.Second
+
+type KeyValue struct {
+	Key         string
+	Value       []byte
+	ModRevision int64
+}
+
+// Client wraps the etcd v3 client with the operations that the gateway
+// needs (for its token store and application definitions).
+type Client struct {
+	client *clientv3.Client
+}
+
+func NewClient(cfg *config.EtcdConfiguration) (*Client, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, fmt.Errorf("no etcd endpoints configured")
+	}
+
+	endpoints := make([]string, len(cfg.Endpoints))
+	for i := range cfg.Endpoints {
+		endpoints[i] = strings.TrimRight(cfg.Endpoints[i], "/")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		DialTimeout: requestTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create etcd client: %s", err)
+	}
+
+	return &Client{client: client}, nil
+}
+
+// Close closes the connections to etcd.
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+func requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), requestTimeout)
+}
+
+// Put stores a value. If ttl is greater than zero, the key is attached to a
+// lease and will be removed by etcd after the TTL has passed.
+func (c *Client) Put(key string, value []byte, ttl time.Duration) error {
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	var opts []clientv3.OpOption
+	if ttl > 0 {
+		seconds := int64(ttl.Seconds())
+		if seconds < 1 {
+			seconds = 1
+		}
+
+		lease, err := c.client.Grant(ctx, seconds)
+		if err != nil {
+			return err
+		}
+
+		opts = append(opts, clientv3.WithLease(lease.ID))
+	}
+
+	_, err := c.client.Put(ctx, key, string(value), opts...)
+	return err
+}
+
+func (c *Client) Get(key string) ([]byte, error) {
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	response, err := c.client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response.Kvs) == 0 {
+		return nil, KeyNotFoundError
+	}
+
+	return response.Kvs[0].Value, nil
+}
+
+// GetPrefix returns all keys (and their values) starting with the given prefix.
+func (c *Client) GetPrefix(prefix string) ([]KeyValue, error) {
+	result, _, err := c.ListPrefix(prefix)
+	return result, err
+}
+
+// ListPrefix returns all keys (and their values) starting with the given
+// prefix, together with the revision of the store that they were read at.
+// The revision can be used to wait for changes.
+func (c *Client) ListPrefix(prefix string) ([]KeyValue, int64, error) {
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	response, err := c.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result := make([]KeyValue, 0, len(response.Kvs))
+	for _, kv := range response.Kvs {
+		result = append(result, KeyValue{Key: string(kv.Key), Value: kv.Value, ModRevision: kv.ModRevision})
+	}
+
+	return result, response.Header.Revision, nil
+}
+
+// WaitPrefix waits until a key with the given prefix changes after the given
+// revision, or until the context is done. It reports whether a change
+// occurred.
+func (c *Client) WaitPrefix(ctx context.Context, prefix string, revision int64) (bool, error) {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+
+	for response := range c.client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(revision+1)) {
+		if ctx.Err() != nil {
+			return false, nil
+		}
+
+		if response.CompactRevision != 0 {
+			return false, CompactedError
+		}
+
+		if err := response.Err(); err != nil {
+			if err == rpctypes.ErrCompacted {
+				return false, CompactedError
+			}
+			return false, fmt.Errorf("etcd watch failed: %s", err)
+		}
+
+		if len(response.Events) > 0 {
+			return true, nil
+		}
+	}
+
+	// the watch channel is closed when the context is done
+	return false, nil
+}
+
+// Take removes a key and returns the value it had, in a single request, so
+// that concurrent callers cannot both read the value.
+func (c *Client) Take(key string) ([]byte, error) {
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	response, err := c.client.Delete(ctx, key, clientv3.WithPrevKV())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response.PrevKvs) == 0 {
+		return nil, KeyNotFoundError
+	}
+
+	return response.PrevKvs[0].Value, nil
+}
+
+func (c *Client) Delete(key string) error {
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	_, err := c.client.Delete(ctx, key)
+	return err
+}
@@ -0,0 +1,337 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TargetStatus is a snapshot of the health of an upstream.
+type TargetStatus struct {
+	Url       string
+	Healthy   bool
+	LastCheck time.Time
+	LastError string
+}
+
+type target struct {
+	url       string
+	healthy   bool
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+type watch struct {
+	cfg     config.HealthCheckConfiguration
+	urls    []string
+	targets map[string]*target
+
+	path               string
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+
+	client *http.Client
+	stop   chan struct{}
+}
+
+// Monitor actively checks the health of upstream services, so that
+// unhealthy upstreams can be taken out of rotation before clients notice.
+// Upstreams are considered healthy until they fail their health checks.
+type Monitor struct {
+	watches map[string]*watch
+	metrics *monitoring.PromMetrics
+	logger  *logging.Logger
+	lock    sync.RWMutex
+}
+
+func NewMonitor(metrics *monitoring.PromMetrics, logger *logging.Logger) *Monitor {
+	return &Monitor{
+		watches: make(map[string]*watch),
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+func newWatch(urls []string, cfg *config.HealthCheckConfiguration, transport http.RoundTripper) (*watch, error) {
+	w := watch{
+		cfg:                *cfg,
+		urls:               urls,
+		targets:            make(map[string]*target, len(urls)),
+		path:               cfg.Path,
+		interval:           10 * time.Second,
+		timeout:            2 * time.Second,
+		healthyThreshold:   cfg.HealthyThreshold,
+		unhealthyThreshold: cfg.UnhealthyThreshold,
+		stop:               make(chan struct{}),
+	}
+
+	if w.path == "" {
+		w.path = "/"
+	} else if !strings.HasPrefix(w.path, "/") {
+		w.path = "/" + w.path
+	}
+
+	if w.healthyThreshold == 0 {
+		w.healthyThreshold = 2
+	}
+
+	if w.unhealthyThreshold == 0 {
+		w.unhealthyThreshold = 3
+	}
+
+	if cfg.Interval != "" {
+		interval, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check interval: %s", err)
+		}
+		w.interval = interval
+	}
+
+	if cfg.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check timeout: %s", err)
+		}
+		w.timeout = timeout
+	}
+
+	// redirects are not followed, so that they can be expected
+	w.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for _, url := range urls {
+		w.targets[url] = &target{url: url, healthy: true}
+	}
+
+	return &w, nil
+}
+
+// Validate checks the settings of health checks, so that they can be
+// rejected before any checks are started.
+func Validate(cfg *config.HealthCheckConfiguration) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	_, err := newWatch(nil, cfg, nil)
+	return err
+}
+
+// Watch starts checking the upstreams of an application, replacing the
+// previous health checks of the application. Health checks are stopped if
+// they are not enabled in the configuration. The health checks are sent
+// using the given transport (or the default transport if it is nil).
+func (m *Monitor) Watch(appName string, urls []string, cfg *config.HealthCheckConfiguration, transport http.RoundTripper) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	existing, ok := m.watches[appName]
+	if ok && existing.cfg.Enabled && reflect.DeepEqual(existing.cfg, *cfg) && reflect.DeepEqual(existing.urls, urls) {
+		return nil
+	}
+
+	if ok {
+		close(existing.stop)
+		delete(m.watches, appName)
+
+		if m.metrics != nil {
+			for _, url := range existing.urls {
+				m.metrics.UpstreamHealthy.Delete(prometheus.Labels{"application": appName, "upstream": url})
+			}
+		}
+	}
+
+	if !cfg.Enabled {
+		return nil
+	}
+
+	w, err := newWatch(urls, cfg, transport)
+	if err != nil {
+		return err
+	}
+
+	m.watches[appName] = w
+
+	for _, t := range w.targets {
+		if m.metrics != nil {
+			m.metrics.UpstreamHealthy.With(prometheus.Labels{"application": appName, "upstream": t.url}).Set(1)
+		}
+
+		go m.run(appName, w, t)
+	}
+
+	return nil
+}
+
+func (m *Monitor) run(appName string, w *watch, t *target) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		m.check(appName, w, t)
+
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (m *Monitor) probe(w *watch, t *target) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(t.url, "/")+w.path, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("User-Agent", "servicegateway-healthcheck")
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+
+	if w.cfg.ExpectedStatus != 0 && res.StatusCode != w.cfg.ExpectedStatus {
+		return fmt.Errorf("unexpected status %d (expected %d)", res.StatusCode, w.cfg.ExpectedStatus)
+	} else if w.cfg.ExpectedStatus == 0 && (res.StatusCode < 200 || res.StatusCode >= 300) {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func (m *Monitor) check(appName string, w *watch, t *target) {
+	err := m.probe(w, t)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	t.lastCheck = time.Now()
+	wasHealthy := t.healthy
+
+	if err != nil {
+		t.lastError = err.Error()
+		t.successes = 0
+		t.failures++
+		if t.failures >= w.unhealthyThreshold {
+			t.healthy = false
+		}
+	} else {
+		t.lastError = ""
+		t.failures = 0
+		t.successes++
+		if t.successes >= w.healthyThreshold {
+			t.healthy = true
+		}
+	}
+
+	if t.healthy == wasHealthy {
+		return
+	}
+
+	// the watch may have been replaced while the check was running
+	select {
+	case <-w.stop:
+		return
+	default:
+	}
+
+	if t.healthy {
+		m.logger.Noticef("upstream %s of application %s is healthy again", t.url, appName)
+	} else {
+		m.logger.Warningf("upstream %s of application %s is unhealthy: %s", t.url, appName, t.lastError)
+	}
+
+	if m.metrics != nil {
+		value := 0.0
+		if t.healthy {
+			value = 1
+		}
+		m.metrics.UpstreamHealthy.With(prometheus.Labels{"application": appName, "upstream": t.url}).Set(value)
+	}
+}
+
+// Healthy reports whether an upstream of an application passes its health
+// checks. Upstreams without health checks are always considered healthy.
+func (m *Monitor) Healthy(appName string, url string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	w, ok := m.watches[appName]
+	if !ok {
+		return true
+	}
+
+	t, ok := w.targets[url]
+	return !ok || t.healthy
+}
+
+// Available reports whether at least one upstream of an application is
+// healthy.
+func (m *Monitor) Available(appName string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	w, ok := m.watches[appName]
+	if !ok {
+		return true
+	}
+
+	for _, t := range w.targets {
+		if t.healthy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Status returns the health of all checked upstreams, by application.
+func (m *Monitor) Status() map[string][]TargetStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	status := make(map[string][]TargetStatus, len(m.watches))
+	for appName, w := range m.watches {
+		targets := make([]TargetStatus, 0, len(w.targets))
+		for _, t := range w.targets {
+			targets = append(targets, TargetStatus{
+				Url:       t.url,
+				Healthy:   t.healthy,
+				LastCheck: t.lastCheck,
+				LastError: t.lastError,
+			})
+		}
+
+		sort.Slice(targets, func(i, j int) bool { return targets[i].Url < targets[j].Url })
+		status[appName] = targets
+	}
+
+	return status
+}
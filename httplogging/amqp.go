@@ -8,7 +8,10 @@ import (
 	"time"
 
 	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/clientip"
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/redact"
+	"github.com/mittwald/servicegateway/requestid"
 	"github.com/op/go-logging"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -21,14 +24,16 @@ type AmqpLoggingBehaviour struct {
 	connection *amqp.Connection
 	channel    *amqp.Channel
 	verifier   *auth.JwtVerifier
+	redactor   *redact.Redactor
 }
 
-func NewAmqpLoggingBehaviour(cfg *config.LoggingConfiguration, logger *logging.Logger, tokenVerifier *auth.JwtVerifier) (*AmqpLoggingBehaviour, error) {
+func NewAmqpLoggingBehaviour(cfg *config.LoggingConfiguration, logger *logging.Logger, tokenVerifier *auth.JwtVerifier, redactor *redact.Redactor) (*AmqpLoggingBehaviour, error) {
 	c := &AmqpLoggingBehaviour{
 		Config:     cfg,
 		OnlyUnsafe: cfg.UnsafeOnly,
 		logger:     logger,
 		verifier:   tokenVerifier,
+		redactor:   redactor,
 	}
 
 	err := c.connect()
@@ -97,6 +102,7 @@ type AuditLogMessage struct {
 	Auth      AuditLogAuth      `json:"auth"`
 	Action    string            `json:"action"`
 	Timestamp time.Time         `json:"timestamp"`
+	RequestId string            `json:"request_id,omitempty"`
 	Data      map[string]string `json:"data"`
 }
 
@@ -130,12 +136,13 @@ func (c *AmqpLoggingBehaviour) OnAuthenticatedRequest(req *http.Request, jwt str
 				Auth: AuditLogAuth{
 					Sub:  sub,
 					Sudo: sudo,
-					Ip:   req.RemoteAddr,
+					Ip:   clientip.FromRequest(req),
 				},
 				Action:    "api.request." + strings.ToLower(req.Method),
 				Timestamp: time.Now(),
+				RequestId: requestid.FromRequest(req),
 				Data: map[string]string{
-					"url": req.URL.String(),
+					"url": c.redactor.String(req.URL.String()),
 				},
 			}
 
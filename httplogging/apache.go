@@ -2,20 +2,51 @@ package httplogging
 
 import (
 	"github.com/gorilla/handlers"
+	"github.com/mittwald/servicegateway/clientip"
+	"github.com/mittwald/servicegateway/redact"
 
+	"io"
 	"net/http"
 	"os"
+	"sync"
 )
 
 type ApacheLoggingBehaviour struct {
 	Filename string
+	Redactor *redact.Redactor
+
+	// the log file is opened once, and shared by all handlers that are
+	// wrapped when the configuration is reloaded
+	writer io.Writer
+	lock   sync.Mutex
 }
 
 func (c *ApacheLoggingBehaviour) Wrap(wrapped http.Handler) (http.Handler, error) {
-	writer, err := os.OpenFile(c.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return nil, err
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.writer == nil {
+		file, err := os.OpenFile(c.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		// query strings and referrers may contain tokens
+		c.writer = redact.Writer(file, c.Redactor)
 	}
 
-	return handlers.CombinedLoggingHandler(writer, wrapped), nil
+	writer := c.writer
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// the log shows the resolved client address, but the request is
+		// passed on unchanged
+		logged := *req
+		logged.RemoteAddr = clientip.FromRequest(req)
+
+		handler := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			wrapped.ServeHTTP(rw, req)
+		})
+
+		handlers.CombinedLoggingHandler(writer, handler).ServeHTTP(rw, &logged)
+	}), nil
 }
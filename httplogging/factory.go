@@ -6,6 +6,7 @@ import (
 
 	"github.com/mittwald/servicegateway/auth"
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/redact"
 	"github.com/op/go-logging"
 )
 
@@ -13,14 +14,17 @@ type HttpLogger interface {
 	Wrap(http.Handler) (http.Handler, error)
 }
 
-func LoggerFromConfig(config *config.LoggingConfiguration, logger *logging.Logger, verifier *auth.JwtVerifier) (HttpLogger, error) {
+func LoggerFromConfig(config *config.LoggingConfiguration, logger *logging.Logger, verifier *auth.JwtVerifier, redactor *redact.Redactor) (HttpLogger, error) {
 	switch config.Type {
 	case "amqp":
-		return NewAmqpLoggingBehaviour(config, logger, verifier)
+		return NewAmqpLoggingBehaviour(config, logger, verifier, redactor)
 	case "apache":
 		return &ApacheLoggingBehaviour{
 			Filename: config.Filename,
+			Redactor: redactor,
 		}, nil
+	case "json":
+		return NewJsonLoggingBehaviour(config, logger)
 	default:
 		return nil, fmt.Errorf("unsupported logging type: '%s'", config.Type)
 	}
@@ -0,0 +1,152 @@
+package httplogging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/clientip"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/statusrecorder"
+	"github.com/op/go-logging"
+)
+
+type contextKey int
+
+const detailsContextKey contextKey = iota
+
+// RequestDetails holds the parts of an access log entry that are only known
+// to the handlers further down the chain.
+type RequestDetails struct {
+	Application string
+	Upstream    string
+	User        string
+}
+
+// DetailsFromRequest returns the access log details of a request, which the
+// handlers of the request may fill in. It returns nil if the request is not
+// logged.
+func DetailsFromRequest(req *http.Request) *RequestDetails {
+	details, _ := req.Context().Value(detailsContextKey).(*RequestDetails)
+	return details
+}
+
+type JsonLogEntry struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Status      int       `json:"status"`
+	Latency     float64   `json:"latency_ms"`
+	Bytes       int64     `json:"bytes"`
+	ClientIP    string    `json:"client_ip"`
+	RequestId   string    `json:"request_id,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Application string    `json:"application,omitempty"`
+	Upstream    string    `json:"upstream,omitempty"`
+}
+
+// JsonLoggingBehaviour writes an access log with one JSON document per
+// request, either to stdout or to a file that is rotated by size.
+type JsonLoggingBehaviour struct {
+	userClaim string
+
+	logger *logging.Logger
+	writer io.Writer
+	lock   sync.Mutex
+}
+
+func NewJsonLoggingBehaviour(cfg *config.LoggingConfiguration, logger *logging.Logger) (*JsonLoggingBehaviour, error) {
+	c := JsonLoggingBehaviour{
+		userClaim: cfg.UserClaim,
+		logger:    logger,
+		writer:    os.Stdout,
+	}
+
+	if c.userClaim == "" {
+		c.userClaim = "sub"
+	}
+
+	if cfg.Filename != "" && cfg.Filename != "-" {
+		maxBackups := cfg.MaxBackups
+		if maxBackups <= 0 {
+			maxBackups = 5
+		}
+
+		file, err := openRotatingFile(cfg.Filename, int64(cfg.MaxSize)<<20, maxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("could not open access log: %s", err)
+		}
+		c.writer = file
+	}
+
+	return &c, nil
+}
+
+// OnAuthenticatedRequest records the user that a request was authenticated
+// as.
+func (c *JsonLoggingBehaviour) OnAuthenticatedRequest(req *http.Request, token string) {
+	details := DetailsFromRequest(req)
+	if details == nil {
+		return
+	}
+
+	claims, ok := auth.ClaimsFromContext(req.Context())
+	if !ok {
+		mapClaims := jwt.MapClaims{}
+		if _, _, err := new(jwt.Parser).ParseUnverified(token, mapClaims); err != nil {
+			return
+		}
+		claims = mapClaims
+	}
+
+	if user, ok := claims[c.userClaim]; ok {
+		details.User = fmt.Sprintf("%v", user)
+	}
+}
+
+func (c *JsonLoggingBehaviour) Wrap(wrapped http.Handler) (http.Handler, error) {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		details := RequestDetails{}
+		writer := statusrecorder.New(rw)
+
+		wrapped.ServeHTTP(writer, req.WithContext(context.WithValue(req.Context(), detailsContextKey, &details)))
+
+		c.log(&JsonLogEntry{
+			Time:        start,
+			Method:      req.Method,
+			Path:        req.URL.Path,
+			Status:      writer.Status(),
+			Latency:     float64(time.Since(start).Microseconds()) / 1000,
+			Bytes:       writer.Bytes(),
+			ClientIP:    clientip.FromRequest(req),
+			RequestId:   requestid.FromRequest(req),
+			User:        details.User,
+			Application: details.Application,
+			Upstream:    details.Upstream,
+		})
+	}), nil
+}
+
+func (c *JsonLoggingBehaviour) log(entry *JsonLogEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		c.logger.Errorf("could not encode access log entry: %s", err)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, err := c.writer.Write(append(b, '\n')); err != nil {
+		c.logger.Errorf("could not write access log entry: %s", err)
+	}
+}
@@ -0,0 +1,90 @@
+package httplogging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file that is moved aside once it exceeds its maximum
+// size. The previous files are kept as `<filename>.1`, `<filename>.2` and so
+// on, with `.1` being the most recent one.
+type rotatingFile struct {
+	filename   string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+	lock sync.Mutex
+}
+
+func openRotatingFile(filename string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := rotatingFile{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", f.filename, f.maxBackups))
+
+	for i := f.maxBackups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", f.filename, i), fmt.Sprintf("%s.%d", f.filename, i+1))
+	}
+
+	if f.maxBackups > 0 {
+		if err := os.Rename(f.filename, f.filename+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.filename); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+// Write appends to the log file, after rotating it if the data would
+// exceed its maximum size.
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, fmt.Errorf("could not rotate log file %s: %s", f.filename, err)
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
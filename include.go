@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+const includeWatchInterval = 5 * time.Second
+
+type includedFile struct {
+	modTime time.Time
+	size    int64
+}
+
+// includedFiles loads the application definitions from the files that a
+// configuration includes (like a conf.d directory), and remembers them, so
+// that the configuration can be reloaded when they change.
+type includedFiles struct {
+	lock     sync.Mutex
+	patterns []string
+	files    map[string]includedFile
+}
+
+// load adds the applications that are defined in the included files to the
+// configuration. Each file defines one application, which is named after
+// the file (without its extension).
+func (i *includedFiles) load(cfg *config.Configuration, filename string, secrets config.SecretSourceFactory) error {
+	patterns := make([]string, len(cfg.Include))
+	for n, pattern := range cfg.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		patterns[n] = pattern
+	}
+
+	files, err := matchIncludes(patterns)
+
+	// the files are remembered even if they are invalid, so that they are
+	// not loaded again until they were modified
+	i.lock.Lock()
+	i.patterns = patterns
+	i.files = statIncludes(files)
+	i.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	sources := make(map[string]string, len(files))
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+
+		if _, ok := cfg.Applications[name]; ok {
+			source, ok := sources[name]
+			if !ok {
+				source = filename
+			}
+			return fmt.Errorf("%s: application '%s' is already defined in %s", file, name, source)
+		}
+
+		content, err := renderFile(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+
+		content, err = config.InterpolateIncluded(content, &cfg.Vault, secrets)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+
+		app := config.Application{}
+		if err := config.DecodeStrict(content, &app); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+
+		if cfg.Applications == nil {
+			cfg.Applications = make(map[string]config.Application)
+		}
+
+		cfg.Applications[name] = app
+		sources[name] = file
+	}
+
+	return nil
+}
+
+// matchIncludes lists the files that match the include patterns, in
+// lexical order. Directories match the JSON and YAML files in them, except
+// for hidden files (like the internal links of Kubernetes config maps).
+func matchIncludes(patterns []string) ([]string, error) {
+	found := make(map[string]bool)
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include '%s': %s", pattern, err)
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, fmt.Errorf("could not read included file: %s", err)
+			}
+
+			if !info.IsDir() {
+				found[match] = true
+				continue
+			}
+
+			entries, err := os.ReadDir(match)
+			if err != nil {
+				return nil, fmt.Errorf("could not read included directory: %s", err)
+			}
+
+			for _, entry := range entries {
+				name := entry.Name()
+				if entry.IsDir() || strings.HasPrefix(name, ".") {
+					continue
+				}
+
+				switch strings.ToLower(filepath.Ext(name)) {
+				case ".json", ".yaml", ".yml":
+					found[filepath.Join(match, name)] = true
+				}
+			}
+		}
+	}
+
+	files := make([]string, 0, len(found))
+	for file := range found {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+func statIncludes(files []string) map[string]includedFile {
+	states := make(map[string]includedFile, len(files))
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			states[file] = includedFile{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+
+	return states
+}
+
+// changed reports whether included files were added, modified or removed
+// since they were loaded.
+func (i *includedFiles) changed() bool {
+	i.lock.Lock()
+	patterns, loaded := i.patterns, i.files
+	i.lock.Unlock()
+
+	files, err := matchIncludes(patterns)
+	if err != nil {
+		return false
+	}
+
+	return !maps.Equal(statIncludes(files), loaded)
+}
+
+// watch checks the included files for changes, and reloads the
+// configuration when they were changed.
+func (i *includedFiles) watch(reload func() error, logger *logging.Logger) {
+	ticker := time.NewTicker(includeWatchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !i.changed() {
+			continue
+		}
+
+		logger.Notice("included configuration files changed")
+		if err := reload(); err != nil {
+			logger.Errorf("could not reload configuration: %s", err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/clientip"
+	"github.com/mittwald/servicegateway/config"
+)
+
+// Filter decides by client address whether requests may pass. Denied
+// networks take precedence over allowed ones; if networks are allowed,
+// requests from all other addresses are blocked.
+type Filter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewFilter compiles an IP filter configuration. It returns nil if neither
+// networks are allowed nor denied.
+func NewFilter(cfg *config.IPFilterConfiguration) (*Filter, error) {
+	if len(cfg.Allow) == 0 && len(cfg.Deny) == 0 {
+		return nil, nil
+	}
+
+	allow, err := clientip.ParseNetworks(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed network: %s", err)
+	}
+
+	deny, err := clientip.ParseNetworks(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid denied network: %s", err)
+	}
+
+	return &Filter{allow: allow, deny: deny}, nil
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check returns the reason why requests from an address are blocked, or an
+// empty string if they may pass. Requests without a valid address are only
+// blocked if networks are allowed.
+func (f *Filter) check(addr string) string {
+	if f == nil {
+		return ""
+	}
+
+	ip := net.ParseIP(addr)
+
+	if ip != nil && contains(f.deny, ip) {
+		return "client address is denied"
+	}
+
+	if len(f.allow) > 0 && (ip == nil || !contains(f.allow, ip)) {
+		return "client address is not allowed"
+	}
+
+	return ""
+}
+
+// DecorateHandler blocks the requests that one of the filters does not let
+// pass; usually the global filter and the filter of an application. Nil
+// filters let all requests pass.
+func DecorateHandler(handler httprouter.Handle, filters ...*Filter) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		addr := clientip.FromRequest(req)
+
+		for _, filter := range filters {
+			if reason := filter.check(addr); reason != "" {
+				rw.Header().Set("Content-Type", "application/json")
+				rw.WriteHeader(403)
+				_, _ = rw.Write([]byte(`{"msg":"forbidden","reason":"` + reason + `"}`))
+				return
+			}
+		}
+
+		handler(rw, req, params)
+	}
+}
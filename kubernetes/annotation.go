@@ -0,0 +1,93 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+// annotationFields are the settings of an application that can be given in
+// the annotation of an Ingress resource, by property, along with the nested
+// properties that are allowed (or nil for all of them). Anyone who can
+// create an Ingress can set the annotation, so that settings which weaken
+// authentication, point requests at other backends or run scripts in the
+// gateway are left to the configuration and Route resources.
+var annotationFields = map[string]map[string]bool{
+	"routing":              {"match": true, "methods": true, "timeouts": true, "rewrites": true},
+	"backend":              {"load_balancing": true, "flush_interval": true, "timeouts": true, "health_check": true, "concurrency": true},
+	"auth":                 {"audience": true, "authorization": true},
+	"caching":              nil,
+	"rate_limiting":        nil,
+	"rate_limit_key":       nil,
+	"rate_limit_overrides": nil,
+	"quota":                nil,
+	"grpc":                 nil,
+	"retries":              nil,
+	"circuit_breaker":      nil,
+	"headers":              nil,
+	"request_body":         nil,
+	"compression":          nil,
+	"cors":                 nil,
+	"security_headers":     nil,
+	"ip_filter":            nil,
+	"waf":                  nil,
+	"bot_detection":        nil,
+	"maintenance":          nil,
+	"response":             nil,
+	"redirect":             nil,
+}
+
+// decodeAnnotation decodes the application settings of an Ingress resource
+// (as JSON or YAML), and rejects settings that are not allowed there.
+func decodeAnnotation(annotation string, app *config.Application) error {
+	content := []byte(annotation)
+	if !json.Valid(content) {
+		converted, err := config.YAMLToJSON(content)
+		if err != nil {
+			return err
+		}
+
+		content = converted
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return err
+	}
+
+	for _, name := range sortedKeys(fields) {
+		nested, ok := annotationFields[name]
+		if !ok {
+			return fmt.Errorf("property '%s' is not allowed", name)
+		}
+
+		if nested == nil {
+			continue
+		}
+
+		nestedFields := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(fields[name], &nestedFields); err != nil {
+			return fmt.Errorf("property '%s': %s", name, err)
+		}
+
+		for _, nestedName := range sortedKeys(nestedFields) {
+			if !nested[nestedName] {
+				return fmt.Errorf("property '%s.%s' is not allowed", name, nestedName)
+			}
+		}
+	}
+
+	return config.DecodeStrict(content, app)
+}
+
+func sortedKeys(fields map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,154 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCaFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	watchTimeout = 5 * time.Minute
+)
+
+// ExpiredError is returned when changes are waited for since a resource
+// version that the API server no longer knows. The resources need to be
+// listed again.
+var ExpiredError = errors.New("resource version expired")
+
+// Client reads resources from the Kubernetes API and waits for them to
+// change.
+type Client struct {
+	cfg     *config.KubernetesConfiguration
+	core    clientset.Interface
+	dynamic dynamic.Interface
+}
+
+// NewClient creates a client for the Kubernetes API. Unless configured
+// otherwise, the API server and the credentials of the pod's service account
+// are used.
+func NewClient(cfg *config.KubernetesConfiguration) (*Client, error) {
+	restCfg, err := restConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	core, err := clientset.NewForConfig(restCfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Kubernetes client: %s", err)
+	}
+
+	dyn, err := dynamic.NewForConfig(restCfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Kubernetes client: %s", err)
+	}
+
+	return &Client{cfg: cfg, core: core, dynamic: dyn}, nil
+}
+
+func restConfig(cfg *config.KubernetesConfiguration) (*rest.Config, error) {
+	if cfg.ApiServer == "" {
+		restCfg, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("api_server must be set when not running in a Kubernetes cluster: %s", err)
+		}
+
+		if cfg.TokenFile != "" {
+			restCfg.BearerToken = ""
+			restCfg.BearerTokenFile = cfg.TokenFile
+		}
+
+		if cfg.CaFile != "" {
+			restCfg.TLSClientConfig.CAFile = cfg.CaFile
+		}
+
+		return restCfg, nil
+	}
+
+	restCfg := rest.Config{
+		Host:            cfg.ApiServer,
+		BearerTokenFile: cfg.TokenFile,
+	}
+
+	restCfg.TLSClientConfig.CAFile = cfg.CaFile
+
+	// outside of the cluster, the service account's credentials are only
+	// used if they exist
+	if restCfg.BearerTokenFile == "" && fileExists(serviceAccountTokenFile) {
+		restCfg.BearerTokenFile = serviceAccountTokenFile
+	}
+
+	if restCfg.TLSClientConfig.CAFile == "" && fileExists(serviceAccountCaFile) {
+		restCfg.TLSClientConfig.CAFile = serviceAccountCaFile
+	}
+
+	return &restCfg, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Namespace returns the namespace that resources are read from, or an empty
+// string for all namespaces.
+func (c *Client) Namespace() string {
+	return c.cfg.Namespace
+}
+
+// watchOptions selects the changes of resources after the given resource
+// version.
+func watchOptions(opts metav1.ListOptions, resourceVersion string) metav1.ListOptions {
+	timeout := int64(watchTimeout.Seconds())
+
+	opts.ResourceVersion = resourceVersion
+	opts.AllowWatchBookmarks = true
+	opts.TimeoutSeconds = &timeout
+
+	return opts
+}
+
+// waitForChange waits until one of the watched resources changes, or until
+// the API server closes the watch after its timeout. It reports whether a
+// change occurred.
+func waitForChange(ctx context.Context, what string, w watch.Interface, err error) (bool, error) {
+	if err != nil {
+		if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+			return false, ExpiredError
+		}
+
+		return false, fmt.Errorf("error while watching %s: %s", what, err)
+	}
+
+	defer w.Stop()
+
+	for event := range w.ResultChan() {
+		switch event.Type {
+		case watch.Bookmark:
+			continue
+		case watch.Error:
+			err := apierrors.FromObject(event.Object)
+			if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+				return false, ExpiredError
+			}
+
+			return false, fmt.Errorf("error while watching %s: %s", what, err)
+		default:
+			return true, nil
+		}
+	}
+
+	return false, ctx.Err()
+}
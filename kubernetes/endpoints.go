@@ -0,0 +1,109 @@
+package kubernetes
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/mittwald/servicegateway/config"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EndpointsQuery selects the endpoint slices of a service.
+type EndpointsQuery struct {
+	namespace string
+	opts      metav1.ListOptions
+	port      string
+}
+
+// NewEndpointsQuery selects the endpoint slices of the service that is
+// configured as backend of an application. The namespace defaults to the
+// given one.
+func NewEndpointsQuery(backend *config.KubernetesBackend, namespace string) *EndpointsQuery {
+	if backend.Namespace != "" {
+		namespace = backend.Namespace
+	}
+
+	return &EndpointsQuery{
+		namespace: namespace,
+		opts:      metav1.ListOptions{LabelSelector: discoveryv1.LabelServiceName + "=" + backend.Service},
+		port:      backend.Port,
+	}
+}
+
+// Endpoints returns the ready endpoints of a service as upstreams. The
+// returned resource version can be used to wait for changes.
+func (c *Client) Endpoints(ctx context.Context, q *EndpointsQuery) ([]config.Upstream, string, error) {
+	list, err := c.core.DiscoveryV1().EndpointSlices(q.namespace).List(ctx, q.opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	upstreams := make([]config.Upstream, 0)
+	seen := make(map[string]bool)
+
+	for i := range list.Items {
+		slice := &list.Items[i]
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 && slice.AddressType != discoveryv1.AddressTypeIPv6 {
+			continue
+		}
+
+		port, scheme, ok := q.selectPort(slice)
+		if !ok {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			// endpoints without a ready condition are considered ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+
+			for _, address := range endpoint.Addresses {
+				u := scheme + "://" + net.JoinHostPort(address, strconv.Itoa(port))
+				if !seen[u] {
+					seen[u] = true
+					upstreams = append(upstreams, config.Upstream{Url: u})
+				}
+			}
+		}
+	}
+
+	sort.Slice(upstreams, func(i, j int) bool { return upstreams[i].Url < upstreams[j].Url })
+
+	return upstreams, list.ResourceVersion, nil
+}
+
+// WaitForEndpoints waits until the endpoints of a service change.
+func (c *Client) WaitForEndpoints(ctx context.Context, q *EndpointsQuery, resourceVersion string) (bool, error) {
+	w, err := c.core.DiscoveryV1().EndpointSlices(q.namespace).Watch(ctx, watchOptions(q.opts, resourceVersion))
+	return waitForChange(ctx, "endpoints", w, err)
+}
+
+// selectPort picks the port of an endpoint slice by its name or number. If
+// no port is configured, the first one is used.
+func (q *EndpointsQuery) selectPort(slice *discoveryv1.EndpointSlice) (int, string, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+
+		name, port := "", int(*p.Port)
+		if p.Name != nil {
+			name = *p.Name
+		}
+
+		if q.port == "" || q.port == name || q.port == strconv.Itoa(port) {
+			scheme := "http"
+			if name == "https" || port == 443 {
+				scheme = "https"
+			}
+
+			return port, scheme, true
+		}
+	}
+
+	return 0, "", false
+}
@@ -0,0 +1,213 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mittwald/servicegateway/config"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	defaultIngressClass   = "servicegateway"
+	applicationAnnotation = "servicegateway.mittwald.de/application"
+)
+
+// routeResource is the custom resource that defines applications; see
+// deploy/helm-chart/servicegateway/crds/routes.yaml.
+var routeResource = schema.GroupVersionResource{Group: "servicegateway.mittwald.de", Version: "v1", Resource: "routes"}
+
+// Route is an application that is defined by a Kubernetes resource. Err is
+// set if the resource does not describe a valid application.
+type Route struct {
+	Name        string
+	Application config.Application
+	Err         error
+}
+
+// RoutesEnabled reports whether applications are read from Kubernetes
+// resources.
+func (c *Client) RoutesEnabled() bool {
+	return c.cfg.Routes != ""
+}
+
+// Routes returns the applications that are defined by Route resources or by
+// Ingress resources, depending on the configuration. The returned resource
+// version can be used to wait for changes.
+func (c *Client) Routes(ctx context.Context) ([]Route, string, error) {
+	switch c.cfg.Routes {
+	case "crd":
+		return c.crdRoutes(ctx)
+	case "ingress":
+		return c.ingressRoutes(ctx)
+	default:
+		return nil, "", fmt.Errorf("unsupported route source: '%s'", c.cfg.Routes)
+	}
+}
+
+func (c *Client) crdRoutes(ctx context.Context) ([]Route, string, error) {
+	list, err := c.dynamic.Resource(routeResource).Namespace(c.cfg.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+
+	routes := make([]Route, 0, len(list.Items))
+	for _, item := range list.Items {
+		route := Route{Name: item.GetNamespace() + "." + item.GetName()}
+
+		spec, err := json.Marshal(item.Object["spec"])
+		if err == nil {
+			err = json.Unmarshal(spec, &route.Application)
+		}
+		route.Err = err
+
+		if route.Application.Backend.Kubernetes.Namespace == "" {
+			route.Application.Backend.Kubernetes.Namespace = item.GetNamespace()
+		}
+
+		routes = append(routes, route)
+	}
+
+	return routes, list.GetResourceVersion(), nil
+}
+
+func (c *Client) ingressRoutes(ctx context.Context) ([]Route, string, error) {
+	list, err := c.core.NetworkingV1().Ingresses(c.cfg.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+
+	class := c.cfg.IngressClass
+	if class == "" {
+		class = defaultIngressClass
+	}
+
+	routes := make([]Route, 0)
+	for _, item := range list.Items {
+		if !ingressHasClass(item.Spec.IngressClassName, item.Annotations, class) {
+			continue
+		}
+
+		// some other settings of the applications (like authorization
+		// rules) can be given as annotation
+		base := config.Application{}
+		var baseErr error
+		if annotation, ok := item.Annotations[applicationAnnotation]; ok {
+			if err := decodeAnnotation(annotation, &base); err != nil {
+				baseErr = fmt.Errorf("invalid annotation %s: %s", applicationAnnotation, err)
+			}
+		}
+
+		name := item.Namespace + "." + item.Name
+		index := 0
+
+		for _, rule := range item.Spec.Rules {
+			if rule.HTTP == nil {
+				continue
+			}
+
+			for _, path := range rule.HTTP.Paths {
+				route := Route{
+					Name:        name + "." + strconv.Itoa(index),
+					Application: base,
+					Err:         baseErr,
+				}
+				index++
+
+				if err := setIngressRouting(&route.Application.Routing, path.Path, path.PathType); err != nil && route.Err == nil {
+					route.Err = err
+				}
+
+				if rule.Host != "" {
+					route.Application.Routing.Hostname = rule.Host
+				}
+
+				if path.Backend.Service == nil {
+					if route.Err == nil {
+						route.Err = fmt.Errorf("only service backends are supported")
+					}
+				} else {
+					port := path.Backend.Service.Port.Name
+					if port == "" && path.Backend.Service.Port.Number != 0 {
+						port = strconv.Itoa(int(path.Backend.Service.Port.Number))
+					}
+
+					route.Application.Backend.Kubernetes = config.KubernetesBackend{
+						Service:   path.Backend.Service.Name,
+						Namespace: item.Namespace,
+						Port:      port,
+					}
+				}
+
+				routes = append(routes, route)
+			}
+		}
+
+		// an Ingress with a single path is named like the Ingress itself
+		if index == 1 {
+			routes[len(routes)-1].Name = name
+		}
+	}
+
+	return routes, list.ResourceVersion, nil
+}
+
+// setIngressRouting routes the requests for a path of an Ingress rule.
+// Paths of type Exact only match the path itself; paths of type Prefix (and
+// ImplementationSpecific) also match the paths below it, like path routing.
+func setIngressRouting(routing *config.Routing, path string, pathType *networkingv1.PathType) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("path '%s' is not absolute", path)
+	}
+
+	if pathType != nil && *pathType == networkingv1.PathTypeExact {
+		if strings.ContainsAny(path, ":*") {
+			return fmt.Errorf("exact path '%s' must not contain ':' or '*'", path)
+		}
+
+		// like with path routing, the path is removed from the request
+		// that is sent to the upstream
+		routing.Type = "pattern"
+		routing.Patterns = map[string]string{path: "/"}
+		return nil
+	}
+
+	routing.Type = "path"
+	routing.Path = path
+	return nil
+}
+
+// WaitForRoutes waits until the resources that define applications change.
+func (c *Client) WaitForRoutes(ctx context.Context, resourceVersion string) (bool, error) {
+	opts := watchOptions(metav1.ListOptions{}, resourceVersion)
+
+	var (
+		w   watch.Interface
+		err error
+	)
+
+	switch c.cfg.Routes {
+	case "crd":
+		w, err = c.dynamic.Resource(routeResource).Namespace(c.cfg.Namespace).Watch(ctx, opts)
+	case "ingress":
+		w, err = c.core.NetworkingV1().Ingresses(c.cfg.Namespace).Watch(ctx, opts)
+	default:
+		return false, fmt.Errorf("unsupported route source: '%s'", c.cfg.Routes)
+	}
+
+	return waitForChange(ctx, "routes", w, err)
+}
+
+func ingressHasClass(className *string, annotations map[string]string, class string) bool {
+	if className != nil {
+		return *className == class
+	}
+
+	return annotations["kubernetes.io/ingress.class"] == class
+}
@@ -0,0 +1,63 @@
+package listeners
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// firstInheritedFd is the first file descriptor that a service manager
+// passes sockets in; following stdin, stdout and stderr.
+const firstInheritedFd = 3
+
+// Listen opens a TCP listener. With reusePort, the address can be bound by
+// several processes at the same time (SO_REUSEPORT), so that a new gateway
+// process can start accepting connections while the previous one is still
+// draining its requests.
+func Listen(addr string, reusePort bool) (net.Listener, error) {
+	listenConfig := net.ListenConfig{}
+	if reusePort {
+		listenConfig.Control = reusePortControl
+	}
+
+	return listenConfig.Listen(context.Background(), "tcp", addr)
+}
+
+// Inherited returns the listening sockets that the process was started
+// with by a service manager (as with systemd's socket activation), in the
+// order in which they were passed. Since the service manager keeps the
+// sockets open, connections are queued while the gateway restarts.
+func Inherited() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	// the sockets are meant for this process only, not for its children
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(name)
+	}
+
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		file := os.NewFile(uintptr(firstInheritedFd+i), fmt.Sprintf("inherited-%d", i))
+
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("could not use inherited socket %d: %s", i, err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
@@ -21,41 +21,74 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime/pprof"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	texttemplate "text/template"
+	"time"
 
 	"github.com/braintree/manners"
-	"github.com/gomodule/redigo/redis"
 	"github.com/hashicorp/consul/api"
+	"github.com/mittwald/servicegateway/audit"
 	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/clientip"
 	"github.com/mittwald/servicegateway/config"
 	"github.com/mittwald/servicegateway/dispatcher"
+	"github.com/mittwald/servicegateway/etcd"
 	"github.com/mittwald/servicegateway/httplogging"
+	"github.com/mittwald/servicegateway/kubernetes"
+	"github.com/mittwald/servicegateway/listeners"
 	"github.com/mittwald/servicegateway/monitoring"
 	"github.com/mittwald/servicegateway/proxy"
+	"github.com/mittwald/servicegateway/redact"
+	"github.com/mittwald/servicegateway/redisconn"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/tlsconfig"
+	"github.com/mittwald/servicegateway/tracing"
+	"github.com/mittwald/servicegateway/vault"
 	"github.com/op/go-logging"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		os.Exit(runSchema(os.Args[2:]))
+	}
+
 	startup := config.Startup{}
 
 	flag.StringVar(&startup.ConfigFile, "config", "/etc/servicegateway.json", "configuration file")
 	flag.StringVar(&startup.DispatchingMode, "dispatch", "path", "dispatching mode ('path' or 'host')")
 	flag.IntVar(&startup.Port, "port", 8080, "HTTP port to listen on")
+	flag.StringVar(&startup.TlsCertFile, "tls-cert", "", "TLS certificate file (enables HTTPS on the HTTP port)")
+	flag.StringVar(&startup.TlsKeyFile, "tls-key", "", "TLS private key file")
 	flag.StringVar(&startup.AdminAddress, "admin-addr", "127.0.0.1", "Address to listen on (administration port)")
 	flag.IntVar(&startup.AdminPort, "admin-port", 8081, "HTTP port to listen on (administration port)")
 	flag.StringVar(&startup.MonitorAddress, "monitor-addr", "0.0.0.0", "Address to listen on (monitoring port)")
 	flag.IntVar(&startup.MonitorPort, "monitor-port", 8082, "HTTP port to listen on (monitoring port)")
 	flag.BoolVar(&startup.Debug, "debug", false, "enable to add debug information to each request")
 	flag.StringVar(&startup.ConsulBaseKey, "consul-base", "", "base key name for configuration")
+	flag.StringVar(&startup.EtcdPrefix, "etcd-prefix", "", "etcd key prefix for configuration")
 	flag.StringVar(&startup.UiDir, "ui-dir", "/usr/share/servicegateway", "directory in which UI files can be found")
 
 	flag.StringVar(&startup.ProfileCpu, "cpu-profile", "", "write CPU profile to file")
@@ -86,57 +119,39 @@ func main() {
 		}()
 	}
 
-	logging.SetBackend(logging.NewBackendFormatter(backend, format))
+	// credentials are masked with the default rules until the configuration
+	// has been loaded
+	redactingBackend := redact.NewBackend(logging.NewBackendFormatter(backend, format), redact.NewRedactor(&config.LogRedactionConfiguration{}))
+
+	logging.SetBackend(redactingBackend)
 	if !startup.Debug {
 		logging.SetLevel(logging.INFO, "")
 	}
 	logger.Info("Completed startup")
 
-	// read in config file to get raw content
-	rawCfgContent, err := ioutil.ReadFile(startup.ConfigFile)
-	if err != nil {
-		logger.Fatal(err)
-	}
-
-	// create a new template from the raw content of our config file
-	var tpl *template.Template
-	tpl, err = template.New("").Parse(string(rawCfgContent))
-	if err != nil {
-		logger.Fatal(err)
-	}
-
-	// prepare template data
-	type templateData struct {
-		Env map[string]string
-	}
-
-	data := templateData{
-		Env: make(map[string]string),
-	}
-
-	// load all env-vars into template data
-	for _, e := range os.Environ() {
-		e := strings.SplitN(e, "=", 2)
-		if len(e) > 1 {
-			data.Env[e[0]] = e[1]
+	// secrets in Vault are read through the same client on every reload,
+	// which connects to Vault when the first secret is referenced
+	var vaultClient *vault.Client
+	vaultSecrets := func(vaultCfg *config.VaultConfiguration) (config.SecretSource, error) {
+		if vaultClient == nil {
+			client, err := vault.NewClient(vaultCfg, logging.MustGetLogger("vault"))
+			if err != nil {
+				return nil, err
+			}
+			vaultClient = client
 		}
+		return vaultClient, nil
 	}
 
-	// render the raw config in order to replace env-variables (if given)
-	renderedCfgContent := new(bytes.Buffer)
-	err = tpl.Execute(renderedCfgContent, &data)
-	if err != nil {
-		logger.Fatal(err)
-	}
+	included := &includedFiles{}
 
-	// unmarshal rendered config to proper json
-	cfg := config.Configuration{}
-	err = json.Unmarshal(renderedCfgContent.Bytes(), &cfg)
+	cfg, err := loadConfiguration(startup.ConfigFile, vaultSecrets, included)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	logger.Debugf("%s", cfg)
+	redactor := redact.NewRedactor(&cfg.LogRedaction)
+	redactingBackend.SetRedactor(redactor)
 
 	var monitoringController monitoring.Controller
 	monitoringLogger := logging.MustGetLogger("monitoring")
@@ -174,16 +189,15 @@ func main() {
 		logger.Fatal(err)
 	}
 
-	redisPool := &redis.Pool{
-		MaxIdle: 8,
-		Dial: func() (redis.Conn, error) {
-			conn, err := redis.Dial("tcp", cfg.Redis.Address, cfg.Redis.DialOptions()...)
-			if err != nil {
-				return nil, err
-			}
+	redisPool, err := redisconn.FromConfig(&cfg.Redis)
+	if err != nil {
+		logger.Fatal(err)
+	}
 
-			return conn, nil
-		},
+	if pool, ok := redisPool.(monitoring.RedisPool); ok {
+		if err := metrics.WatchRedisPool(pool); err != nil {
+			logger.Fatal(err)
+		}
 	}
 
 	tokenVerifier, err := auth.NewJwtVerifier(&cfg.Authentication)
@@ -191,39 +205,89 @@ func main() {
 		logger.Panic(err)
 	}
 
-	tokenStore, err := auth.NewTokenStore(redisPool, tokenVerifier, auth.TokenStoreOptions{})
+	tokenStore, err := auth.TokenStoreFromConfig(&cfg.TokenStore, redisPool, tokenVerifier, metrics.TokenStoreDegraded, logging.MustGetLogger("tokenstore"))
+	if err != nil {
+		logger.Panic(err)
+	}
+
+	httpLoggers, err := buildLoggers(&cfg, tokenVerifier, redactor)
+	if err != nil {
+		logger.Panic(err)
+	}
+
+	auditLogger, err := audit.LoggerFromConfig(cfg.Audit, logging.MustGetLogger("audit"))
+	if err != nil {
+		logger.Panic(err)
+	}
+
+	tlsConfig, err := buildTLSConfig(&cfg, &startup, redisPool, logger)
+	if err != nil {
+		logger.Panic(err)
+	}
+
+	clientIPs, err := clientip.NewResolver(&cfg.ClientIP)
 	if err != nil {
 		logger.Panic(err)
 	}
 
-	httpLoggers, err := buildLoggers(&cfg, tokenVerifier)
+	requestIDs := requestid.NewGenerator(&cfg.RequestId, clientIPs)
+
+	shutdownTracing, err := tracing.Setup(&cfg.Tracing)
 	if err != nil {
 		logger.Panic(err)
 	}
 
-	handler := proxy.NewProxyHandler(logging.MustGetLogger("proxy"), &cfg, metrics)
+	// each reload builds a new proxy handler, which replaces the active one
+	var activeHandler atomic.Pointer[proxy.ProxyHandler]
+	activeHandler.Store(proxy.NewProxyHandler(logging.MustGetLogger("proxy"), &cfg, metrics))
+
+	addReadinessChecks(monitoringController.Readiness(), &cfg, redisPool, activeHandler.Load)
 
 	listenAddress := fmt.Sprintf(":%d", startup.Port)
 	adminListenAddress := fmt.Sprintf("%s:%d", startup.AdminAddress, startup.AdminPort)
 
+	drainTimeout := 30 * time.Second
+	if cfg.Shutdown.DrainTimeout != "" {
+		if drainTimeout, err = time.ParseDuration(cfg.Shutdown.DrainTimeout); err != nil {
+			logger.Panicf("invalid drain timeout: %s", err)
+		}
+	}
+
+	proxyListener, adminListener, err := openListeners(&cfg, listenAddress, adminListenAddress)
+	if err != nil {
+		logger.Panic(err)
+	}
+
+	if err := checkAdminExposure(&cfg, adminListener.Addr()); err != nil {
+		logger.Fatal(err)
+	}
+
 	done := make(chan bool)
 	serverShutdown := make(chan bool)
 	serverShutdownComplete := make(chan bool)
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for range c {
-			logger.Notice("received interrupt signal")
-			monitoringController.SendShutdown()
-			serverShutdown <- true
-		}
+		sig := <-c
+		logger.Noticef("received %s signal", sig)
+		monitoringController.SendShutdown()
+		serverShutdown <- true
+
+		// a second signal cuts draining short
+		sig = <-c
+		logger.Warningf("received %s signal while draining. exiting immediately.", sig)
+		os.Exit(1)
 	}()
 
 	go func() {
 		monitoringController.WaitForShutdown()
 		<-serverShutdownComplete
 
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Errorf("error while flushing traces: %s", err)
+		}
+
 		logger.Notice("everything has shut down. exiting process.")
 
 		done <- true
@@ -245,69 +309,288 @@ func main() {
 			}
 		}
 
+		// draining stops accepting new connections, and waits for the
+		// requests in flight to complete. Connections that are still open
+		// after the drain timeout are closed.
+		drainServers := func() {
+			drained := make(chan bool)
+			go func() {
+				for _, server := range []*manners.GracefulServer{proxyServer, adminServer} {
+					if server != nil {
+						server.BlockingClose()
+					}
+				}
+				close(drained)
+			}()
+
+			select {
+			case <-drained:
+				logger.Notice("all in-flight requests have completed")
+			case <-time.After(drainTimeout):
+				logger.Warningf("in-flight requests did not complete within %s. closing their connections.", drainTimeout)
+				for _, server := range []*manners.GracefulServer{proxyServer, adminServer} {
+					if server != nil {
+						_ = server.Server.Close()
+					}
+				}
+			}
+		}
+
 		go func() {
 			<-serverShutdown
 
-			logger.Noticef("received server shutdown request. stopping creating new servers")
-			shutdownServers()
+			logger.Noticef("received server shutdown request. draining in-flight requests for up to %s", drainTimeout)
+			drainServers()
 			serverShutdownComplete <- true
 		}()
 
-		var disp http.Handler
-		var adminHandler http.Handler
+		var consulClient *api.Client
+		var etcdClient *etcd.Client
+		var kubeClient *kubernetes.Client
 
 		if startup.IsConsulConfig() {
-			var consulClient *api.Client
 			consulClient, err = cfg.Consul.BuildConsulClient()
 			if err != nil {
 				logger.Error(err.Error())
 				return
 			}
 
-			disp, adminHandler, err = dispatcher.BuildConsulDispatcher(
-				&startup,
-				&cfg,
-				consulClient,
-				handler,
-				redisPool,
-				logger,
-				tokenStore,
-				tokenVerifier,
-				httpLoggers,
-			)
-		} else {
-			disp, adminHandler, err = dispatcher.BuildNoIntegrationDispatcher(
-				&startup,
-				&cfg,
-				handler,
-				redisPool,
-				logger,
-				tokenStore,
-				tokenVerifier,
-				httpLoggers,
-			)
+			monitoringController.Readiness().AddCheck("consul", func(ctx context.Context) error {
+				_, err := consulClient.Status().Leader()
+				return err
+			})
+		} else if startup.IsEtcdConfig() {
+			etcdClient, err = etcd.NewClient(&cfg.Etcd)
+			if err != nil {
+				logger.Error(err.Error())
+				return
+			}
+		} else if cfg.Kubernetes.Enabled {
+			kubeClient, err = kubernetes.NewClient(&cfg.Kubernetes)
+			if err != nil {
+				logger.Error(err.Error())
+				return
+			}
+		}
+
+		var reload func() error
+
+		// the admin API triggers reloads through the gateway that is
+		// currently active
+		triggerReload := func() error {
+			return reload()
+		}
+
+		build := func(cfg *config.Configuration, handler *proxy.ProxyHandler, tokenVerifier *auth.JwtVerifier) (*dispatcher.Gateway, error) {
+			var gateway *dispatcher.Gateway
+			var err error
+
+			if startup.IsConsulConfig() {
+				gateway, err = dispatcher.BuildConsulDispatcher(
+					&startup,
+					cfg,
+					consulClient,
+					handler,
+					redisPool,
+					logger,
+					tokenStore,
+					tokenVerifier,
+					httpLoggers,
+					auditLogger,
+					metrics,
+					triggerReload,
+				)
+			} else if etcdClient != nil {
+				gateway, err = dispatcher.BuildEtcdDispatcher(
+					&startup,
+					cfg,
+					etcdClient,
+					handler,
+					redisPool,
+					logger,
+					tokenStore,
+					tokenVerifier,
+					httpLoggers,
+					auditLogger,
+					metrics,
+					triggerReload,
+				)
+			} else if kubeClient != nil {
+				gateway, err = dispatcher.BuildKubernetesDispatcher(
+					&startup,
+					cfg,
+					kubeClient,
+					handler,
+					redisPool,
+					logger,
+					tokenStore,
+					tokenVerifier,
+					httpLoggers,
+					auditLogger,
+					metrics,
+					triggerReload,
+				)
+			} else {
+				gateway, err = dispatcher.BuildNoIntegrationDispatcher(
+					&startup,
+					cfg,
+					handler,
+					redisPool,
+					logger,
+					tokenStore,
+					tokenVerifier,
+					httpLoggers,
+					auditLogger,
+					metrics,
+					triggerReload,
+				)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			// the client address and request ID are determined before the
+			// request is logged
+			gateway.Proxy = requestIDs.Decorate(clientIPs.Decorate(tracing.Decorate(gateway.Proxy)))
+			return gateway, nil
 		}
 
+		gateway, err := build(&cfg, activeHandler.Load(), tokenVerifier)
 		if err != nil {
 			logger.Error(err.Error())
 			return
 		}
 
+		proxyHandler := dispatcher.NewReloadableHandler(gateway.Proxy)
+		adminHandler := dispatcher.NewReloadableHandler(gateway.Admin)
+
+		// a reload builds a new gateway from the configuration file, and
+		// replaces the current one once it was built successfully. Requests
+		// that are in flight are completed by the previous gateway and its
+		// proxy handler; applications that were removed from the
+		// configuration are unregistered with the swap.
+		var reloadLock sync.Mutex
+		reload = func() error {
+			reloadLock.Lock()
+			defer reloadLock.Unlock()
+
+			logger.Noticef("reloading configuration from %s", startup.ConfigFile)
+
+			newCfg, err := loadConfiguration(startup.ConfigFile, vaultSecrets, included)
+			if err != nil {
+				return fmt.Errorf("could not load configuration: %s", err)
+			}
+
+			if err := checkAdminExposure(&newCfg, adminListener.Addr()); err != nil {
+				return err
+			}
+
+			// the gateway is built into a new proxy handler, with new keys
+			// (that may have been rotated, for example in Vault), so that
+			// nothing changes if it cannot be built
+			newVerifier, err := auth.NewJwtVerifier(&newCfg.Authentication)
+			if err != nil {
+				return fmt.Errorf("could not update JWT keys: %s", err)
+			}
+
+			previousHandler := activeHandler.Load()
+			newHandler := previousHandler.Derive(&newCfg)
+
+			newGateway, err := build(&newCfg, newHandler, newVerifier)
+			if err != nil {
+				return fmt.Errorf("could not build gateway: %s", err)
+			}
+
+			proxyDrained := proxyHandler.Swap(newGateway.Proxy)
+			adminDrained := adminHandler.Swap(newGateway.Admin)
+
+			tokenVerifier.Replace(newVerifier)
+			activeHandler.Store(newHandler)
+			for _, name := range newHandler.Activate(previousHandler) {
+				logger.Noticef("removed application '%s'", name)
+			}
+
+			redactingBackend.SetRedactor(redact.NewRedactor(&newCfg.LogRedaction))
+
+			previous := gateway
+			gateway = newGateway
+
+			// the previous gateway is closed once the requests that are
+			// still using it have completed, or after the drain timeout
+			go func() {
+				timeout := time.NewTimer(drainTimeout)
+				defer timeout.Stop()
+
+				for _, drained := range []<-chan struct{}{proxyDrained, adminDrained} {
+					select {
+					case <-drained:
+						continue
+					case <-timeout.C:
+						logger.Warningf("requests to the previous gateway did not complete within %s", drainTimeout)
+					}
+					break
+				}
+
+				if err := previous.Close(); err != nil {
+					logger.Errorf("error while closing previous gateway: %s", err)
+				}
+			}()
+
+			logger.Notice("configuration reloaded")
+			return nil
+		}
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				logger.Notice("received hangup signal")
+				if err := reload(); err != nil {
+					logger.Errorf("could not reload configuration: %s", err)
+				}
+			}
+		}()
+
+		go included.watch(reload, logger)
+
+		// secrets in Vault are read again when their lease expires, and
+		// the configuration is reloaded when one of them changed
+		if vaultClient != nil {
+			go vaultClient.Watch(func() {
+				logger.Notice("secrets in vault changed")
+				if err := reload(); err != nil {
+					logger.Errorf("could not reload configuration: %s", err)
+				}
+			})
+		}
+
 		shutdownServers()
 
-		proxyServer = manners.NewWithServer(&http.Server{Addr: listenAddress, Handler: disp})
+		var disp http.Handler = proxyHandler
+
+		// without TLS, clients speak HTTP/2 in plain text (h2c)
+		if cfg.Http2Enabled() && tlsConfig == nil {
+			disp = h2c.NewHandler(disp, &http2.Server{})
+		}
+
+		proxyServer = manners.NewWithServer(&http.Server{Addr: listenAddress, Handler: disp, TLSConfig: tlsConfig})
 		adminServer = manners.NewWithServer(&http.Server{Addr: adminListenAddress, Handler: adminHandler})
 
 		logger.Debug("Starting new servers")
 
 		go func() {
 			logger.Infof("starting dispatcher on address %s", listenAddress)
-			_ = proxyServer.ListenAndServe()
+			if tlsConfig != nil {
+				_ = proxyServer.Serve(tls.NewListener(proxyListener, tlsConfig))
+			} else {
+				_ = proxyServer.Serve(proxyListener)
+			}
 		}()
 
 		go func() {
 			logger.Infof("starting admin server on address %s", adminListenAddress)
-			_ = adminServer.ListenAndServe()
+			_ = adminServer.Serve(adminListener)
 		}()
 	}()
 
@@ -315,7 +598,7 @@ func main() {
 	<-done
 }
 
-func buildLoggers(cfg *config.Configuration, tok *auth.JwtVerifier) ([]httplogging.HttpLogger, error) {
+func buildLoggers(cfg *config.Configuration, tok *auth.JwtVerifier, redactor *redact.Redactor) ([]httplogging.HttpLogger, error) {
 	loggers := make([]httplogging.HttpLogger, len(cfg.Logging))
 	for i, loggingConfig := range cfg.Logging {
 		loggingLogger, err := logging.GetLogger("logger-" + loggingConfig.Type)
@@ -323,7 +606,7 @@ func buildLoggers(cfg *config.Configuration, tok *auth.JwtVerifier) ([]httploggi
 			return nil, err
 		}
 
-		httpLogger, err := httplogging.LoggerFromConfig(&loggingConfig, loggingLogger, tok)
+		httpLogger, err := httplogging.LoggerFromConfig(&loggingConfig, loggingLogger, tok, redactor)
 		if err != nil {
 			return nil, err
 		}
@@ -331,3 +614,292 @@ func buildLoggers(cfg *config.Configuration, tok *auth.JwtVerifier) ([]httploggi
 	}
 	return loggers, nil
 }
+
+// loadConfiguration reads the configuration file, in which environment
+// variables may be referenced as template variables ({{.Env.NAME}}), and
+// the application definitions that it includes.
+func loadConfiguration(filename string, secrets config.SecretSourceFactory, included *includedFiles) (config.Configuration, error) {
+	cfg := config.Configuration{}
+
+	renderedCfgContent, err := renderConfiguration(filename, secrets)
+	if err != nil {
+		return cfg, err
+	}
+
+	// unknown properties are rejected in YAML configurations; JSON
+	// configurations are still decoded leniently, for compatibility
+	if isYAMLFile(filename) {
+		if err := config.DecodeStrict(renderedCfgContent, &cfg); err != nil {
+			return cfg, err
+		}
+	} else if err := json.Unmarshal(renderedCfgContent, &cfg); err != nil {
+		// unmarshal rendered config to proper json
+		return cfg, err
+	}
+
+	if err := included.load(&cfg, filename, secrets); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// isYAMLFile reports whether a configuration file is written in YAML
+// instead of JSON, by its extension.
+func isYAMLFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// renderConfiguration reads the configuration file, replaces the template
+// variables and references in it, and converts YAML configurations to JSON.
+func renderConfiguration(filename string, secrets config.SecretSourceFactory) ([]byte, error) {
+	content, err := renderFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// replace ${...} references to env-variables, secret files and Vault
+	return config.Interpolate(content, secrets)
+}
+
+// renderFile reads a configuration file (or a file included by it),
+// replaces the template variables in it, and converts YAML to JSON.
+func renderFile(filename string) ([]byte, error) {
+	// read in config file to get raw content
+	rawCfgContent, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// create a new template from the raw content of our config file. YAML
+	// is rendered as plain text, since escaping HTML would break its syntax
+	// (like the merge key <<)
+	var tpl interface {
+		Execute(io.Writer, interface{}) error
+	}
+	if isYAMLFile(filename) {
+		tpl, err = texttemplate.New("").Parse(string(rawCfgContent))
+	} else {
+		tpl, err = template.New("").Parse(string(rawCfgContent))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare template data
+	type templateData struct {
+		Env map[string]string
+	}
+
+	data := templateData{
+		Env: make(map[string]string),
+	}
+
+	// load all env-vars into template data
+	for _, e := range os.Environ() {
+		e := strings.SplitN(e, "=", 2)
+		if len(e) > 1 {
+			data.Env[e[0]] = e[1]
+		}
+	}
+
+	// render the raw config in order to replace env-variables (if given)
+	renderedCfgContent := new(bytes.Buffer)
+	if err := tpl.Execute(renderedCfgContent, &data); err != nil {
+		return nil, err
+	}
+
+	if isYAMLFile(filename) {
+		return config.YAMLToJSON(renderedCfgContent.Bytes())
+	}
+
+	return renderedCfgContent.Bytes(), nil
+}
+
+// addReadinessChecks checks the services that the gateway depends on for
+// the readiness endpoint; Redis, the authentication provider (if it can be
+// checked) and the upstreams of critical applications, of which at least
+// one each has to be healthy.
+func addReadinessChecks(readiness *monitoring.Readiness, cfg *config.Configuration, redisPool redisconn.Source, activeHandler func() *proxy.ProxyHandler) {
+	readiness.AddCheck("redis", func(ctx context.Context) error {
+		conn := redisPool.Get()
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		_, err := conn.Do("PING")
+		return err
+	})
+
+	var providerUrl string
+	switch cfg.Authentication.Mode {
+	case "rest":
+		providerUrl = cfg.Authentication.ProviderConfig.Url
+	case "oidc":
+		providerUrl = strings.TrimRight(cfg.Authentication.OIDC.Issuer, "/") + "/.well-known/openid-configuration"
+	}
+
+	if providerUrl != "" {
+		readiness.AddCheck("auth_provider", func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, "GET", providerUrl, nil)
+			if err != nil {
+				return err
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			_ = res.Body.Close()
+
+			// any response but a server error shows that the provider is up
+			if res.StatusCode >= 500 {
+				return fmt.Errorf("authentication provider responded with status %d", res.StatusCode)
+			}
+
+			return nil
+		})
+	}
+
+	readiness.AddCheck("upstreams", func(ctx context.Context) error {
+		var unavailable []string
+		handler := activeHandler()
+		for _, app := range handler.Applications() {
+			if app.Config.Critical && !handler.Health().Available(app.Name) {
+				unavailable = append(unavailable, app.Name)
+			}
+		}
+
+		if len(unavailable) > 0 {
+			return fmt.Errorf("no healthy upstream for critical applications: %s", strings.Join(unavailable, ", "))
+		}
+
+		return nil
+	})
+}
+
+// openListeners opens the listeners of the proxy and the admin server, or
+// takes them from the sockets that the process was started with (the first
+// one for the proxy, the second one, if any, for the admin server).
+func openListeners(cfg *config.Configuration, listenAddress string, adminListenAddress string) (net.Listener, net.Listener, error) {
+	inherited, err := listeners.Inherited()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var proxyListener, adminListener net.Listener
+
+	if len(inherited) > 0 {
+		proxyListener = inherited[0]
+	} else if proxyListener, err = listeners.Listen(listenAddress, cfg.Shutdown.ReusePort); err != nil {
+		return nil, nil, fmt.Errorf("could not listen on %s: %s", listenAddress, err)
+	}
+
+	if len(inherited) > 1 {
+		adminListener = inherited[1]
+	} else if adminListener, err = listeners.Listen(adminListenAddress, cfg.Shutdown.ReusePort); err != nil {
+		return nil, nil, fmt.Errorf("could not listen on %s: %s", adminListenAddress, err)
+	}
+
+	return proxyListener, adminListener, nil
+}
+
+// checkAdminExposure refuses to serve the admin API without authentication
+// on addresses that other hosts can reach. Unix sockets and loopback
+// addresses are only reachable locally.
+func checkAdminExposure(cfg *config.Configuration, addr net.Addr) error {
+	if len(cfg.Admin.Tokens) > 0 {
+		return nil
+	}
+
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok && !tcpAddr.IP.IsLoopback() {
+		return fmt.Errorf("the admin API listens on %s without authentication; configure admin.tokens or listen on a loopback address (-admin-addr)", addr)
+	}
+
+	return nil
+}
+
+// buildTLSConfig configures the HTTPS listener, with the certificate given
+// on the command line, the ones from the configuration file and automatic
+// certificates, and client certificate verification when a client CA
+// bundle is configured. Without any certificate, the gateway serves plain
+// HTTP and nil is returned.
+func buildTLSConfig(cfg *config.Configuration, startup *config.Startup, redisPool redisconn.Source, logger *logging.Logger) (*tls.Config, error) {
+	var files []config.TLSCertificate
+	if startup.TlsCertFile != "" {
+		files = append(files, config.TLSCertificate{CertFile: startup.TlsCertFile, KeyFile: startup.TlsKeyFile})
+	}
+	files = append(files, cfg.TLS.Certificates...)
+
+	if len(files) == 0 && len(cfg.TLS.Acme.Hosts) == 0 {
+		return nil, nil
+	}
+
+	var certs *tlsconfig.Certificates
+	if len(files) > 0 {
+		reloadInterval := time.Duration(0)
+		if cfg.TLS.ReloadInterval != "" {
+			interval, err := time.ParseDuration(cfg.TLS.ReloadInterval)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TLS reload interval: %s", err)
+			}
+			reloadInterval = interval
+		}
+
+		loaded, err := tlsconfig.LoadCertificates(files, logging.MustGetLogger("tls"))
+		if err != nil {
+			return nil, err
+		}
+
+		certs = loaded
+		go certs.Watch(reloadInterval)
+	}
+
+	var automatic *tlsconfig.Acme
+	if len(cfg.TLS.Acme.Hosts) > 0 {
+		acme, err := tlsconfig.NewAcme(&cfg.TLS.Acme, redisPool)
+		if err != nil {
+			return nil, err
+		}
+
+		automatic = acme
+
+		// HTTP-01 challenges can only be answered on port 80
+		if addr := cfg.TLS.Acme.HttpAddress; addr != "" {
+			handler := acme.HTTPHandler()
+			go func() {
+				logger.Infof("starting ACME challenge server on address %s", addr)
+				if err := http.ListenAndServe(addr, handler); err != nil {
+					logger.Errorf("ACME challenge server stopped: %s", err)
+				}
+			}()
+		}
+	}
+
+	tlsConfig, err := tlsconfig.NewConfig(&cfg.TLS, certs, automatic)
+	if err != nil {
+		return nil, err
+	}
+
+	// HTTP/2 needs to be offered explicitly
+	if cfg.Http2Enabled() {
+		tlsConfig.NextProtos = append([]string{"h2", "http/1.1"}, tlsConfig.NextProtos...)
+	} else {
+		tlsConfig.NextProtos = append([]string{"http/1.1"}, tlsConfig.NextProtos...)
+	}
+
+	if cfg.Authentication.ClientCertificate.CAFile == "" {
+		return tlsConfig, nil
+	}
+
+	clientCAs, err := auth.LoadCertPool(cfg.Authentication.ClientCertificate.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	tlsConfig.ClientCAs = clientCAs
+
+	return tlsConfig, nil
+}
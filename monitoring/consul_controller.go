@@ -42,7 +42,9 @@ func NewConsulIntegrationMonitoringController(address string, port int, consul *
 		return nil, err
 	}
 
-	server, err := NewMonitoringServer()
+	readiness := NewReadiness()
+
+	server, err := NewMonitoringServer(readiness)
 	if err != nil {
 		return nil, err
 	}
@@ -61,6 +63,7 @@ func NewConsulIntegrationMonitoringController(address string, port int, consul *
 			httpServer:       server,
 			logger:           logger,
 			promMetrics:      metrics,
+			readiness:        readiness,
 		},
 		consulClient:    consul,
 		consulServiceID: fmt.Sprintf("servicegateway-%s", hostname),
@@ -123,6 +126,7 @@ func (m *consulIntegrationController) shutdown() error {
 }
 
 func (m *consulIntegrationController) SendShutdown() {
+	m.readiness.ShutDown()
 	m.Shutdown <- true
 }
 
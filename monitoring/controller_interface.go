@@ -21,6 +21,7 @@ package monitoring
 
 type Controller interface {
 	Metrics() *PromMetrics
+	Readiness() *Readiness
 	Start() error
 	shutdown() error
 
@@ -22,14 +22,49 @@ package monitoring
 import "github.com/prometheus/client_golang/prometheus"
 
 type PromMetrics struct {
+	Requests              *prometheus.CounterVec
+	RequestDurations      *prometheus.HistogramVec
 	TotalResponseTimes    *prometheus.SummaryVec
 	UpstreamResponseTimes *prometheus.SummaryVec
 	Errors                *prometheus.CounterVec
+	Retries               *prometheus.CounterVec
+	CircuitBreakerState   *prometheus.GaugeVec
+	UpstreamHealthy       *prometheus.GaugeVec
+	MirroredRequests      *prometheus.CounterVec
+	TokenStoreDegraded    prometheus.Gauge
+	RateLimitRejections   *prometheus.CounterVec
+	QuotaRejections       *prometheus.CounterVec
+	BlockedRequests       *prometheus.CounterVec
+	WafBlocked            *prometheus.CounterVec
+	OpenAPIRejected       *prometheus.CounterVec
+	BotDetections         *prometheus.CounterVec
+	RateLimitFallback     prometheus.Gauge
+	AuthFailures          *prometheus.CounterVec
+	CacheRequests         *prometheus.CounterVec
+
+	VerificationCacheHits      prometheus.Counter
+	VerificationCacheMisses    prometheus.Counter
+	VerificationCacheEvictions prometheus.Counter
 }
 
 func newMetrics() (*PromMetrics, error) {
 	p := new(PromMetrics)
 
+	p.Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "http",
+		Name:      "requests",
+		Help:      "HTTP requests handled by the gateway",
+	}, []string{"application", "route", "method", "status"})
+
+	p.RequestDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "servicegateway",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to handle HTTP requests, including all middlewares",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"application", "route", "status"})
+
 	p.TotalResponseTimes = prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Namespace: "servicegateway",
 		Subsystem: "proxy",
@@ -51,11 +86,149 @@ func newMetrics() (*PromMetrics, error) {
 		Help:      "HTTP proxy errors",
 	}, []string{"application", "reason"})
 
+	p.Retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "proxy",
+		Name:      "retries",
+		Help:      "Retried upstream requests",
+	}, []string{"application"})
+
+	p.CircuitBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "servicegateway",
+		Subsystem: "proxy",
+		Name:      "circuit_breaker_state",
+		Help:      "State of the circuit breakers: closed (0), open (1) or half-open (2)",
+	}, []string{"application"})
+
+	p.UpstreamHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "servicegateway",
+		Subsystem: "proxy",
+		Name:      "upstream_healthy",
+		Help:      "Whether an upstream passes its health checks (1) or not (0)",
+	}, []string{"application", "upstream"})
+
+	p.MirroredRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "proxy",
+		Name:      "mirrored_requests",
+		Help:      "Requests mirrored to shadow backends, by result (sent, failed or dropped)",
+	}, []string{"application", "result"})
+
+	p.TokenStoreDegraded = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "servicegateway",
+		Subsystem: "tokenstore",
+		Name:      "degraded",
+		Help:      "Whether the token store backend is unavailable (1) or not (0)",
+	})
+
+	p.RateLimitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "ratelimit",
+		Name:      "rejections",
+		Help:      "Requests rejected because the client exceeded its rate limit",
+	}, []string{"application"})
+
+	p.RateLimitFallback = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "servicegateway",
+		Subsystem: "ratelimit",
+		Name:      "fallback",
+		Help:      "Whether rate limits are enforced in memory because Redis is unavailable (1) or not (0)",
+	})
+
+	p.QuotaRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "quota",
+		Name:      "rejections",
+		Help:      "Requests rejected because the client used up its daily or monthly quota",
+	}, []string{"application"})
+
+	p.BlockedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "ipfilter",
+		Name:      "blocked",
+		Help:      "Requests blocked because of the client address",
+	}, []string{"application"})
+
+	p.WafBlocked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "waf",
+		Name:      "blocked",
+		Help:      "Requests blocked by WAF rules, by rule (method, headers, url or body)",
+	}, []string{"application", "rule"})
+
+	p.OpenAPIRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "openapi",
+		Name:      "rejected",
+		Help:      "Requests rejected because they do not match the OpenAPI document of the application, by reason (path, method, parameters or body)",
+	}, []string{"application", "reason"})
+
+	p.BotDetections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "bots",
+		Name:      "detections",
+		Help:      "Requests that matched a bot detection rule, by rule and action",
+	}, []string{"application", "rule", "action"})
+
+	p.AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "auth",
+		Name:      "failures",
+		Help:      "Requests rejected because they were not authenticated or authorized",
+	}, []string{"application"})
+
+	p.CacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "cache",
+		Name:      "requests",
+		Help:      "Requests to cached applications, by result (hit, stale, miss or pass)",
+	}, []string{"application", "result"})
+
+	p.VerificationCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "auth",
+		Name:      "verification_cache_hits",
+		Help:      "JWT verification results found in the cache",
+	})
+
+	p.VerificationCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "auth",
+		Name:      "verification_cache_misses",
+		Help:      "JWTs that needed to be verified because they were not cached",
+	})
+
+	p.VerificationCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "servicegateway",
+		Subsystem: "auth",
+		Name:      "verification_cache_evictions",
+		Help:      "JWT verification results evicted from the cache due to its size limit",
+	})
+
 	return p, nil
 }
 
 func (m *PromMetrics) Init() {
+	prometheus.MustRegister(m.Requests)
+	prometheus.MustRegister(m.RequestDurations)
 	prometheus.MustRegister(m.TotalResponseTimes)
 	prometheus.MustRegister(m.UpstreamResponseTimes)
 	prometheus.MustRegister(m.Errors)
+	prometheus.MustRegister(m.Retries)
+	prometheus.MustRegister(m.CircuitBreakerState)
+	prometheus.MustRegister(m.UpstreamHealthy)
+	prometheus.MustRegister(m.MirroredRequests)
+	prometheus.MustRegister(m.TokenStoreDegraded)
+	prometheus.MustRegister(m.RateLimitRejections)
+	prometheus.MustRegister(m.QuotaRejections)
+	prometheus.MustRegister(m.BlockedRequests)
+	prometheus.MustRegister(m.WafBlocked)
+	prometheus.MustRegister(m.OpenAPIRejected)
+	prometheus.MustRegister(m.BotDetections)
+	prometheus.MustRegister(m.RateLimitFallback)
+	prometheus.MustRegister(m.AuthFailures)
+	prometheus.MustRegister(m.CacheRequests)
+	prometheus.MustRegister(m.VerificationCacheHits)
+	prometheus.MustRegister(m.VerificationCacheMisses)
+	prometheus.MustRegister(m.VerificationCacheEvictions)
 }
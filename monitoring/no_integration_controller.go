@@ -38,10 +38,13 @@ type noIntegrationController struct {
 	logger *logging.Logger
 
 	promMetrics *PromMetrics
+	readiness   *Readiness
 }
 
 func NewNoIntegrationMonitoringController(address string, port int, logger *logging.Logger) (Controller, error) {
-	server, err := NewMonitoringServer()
+	readiness := NewReadiness()
+
+	server, err := NewMonitoringServer(readiness)
 	if err != nil {
 		return nil, err
 	}
@@ -59,6 +62,7 @@ func NewNoIntegrationMonitoringController(address string, port int, logger *logg
 		httpServer:       server,
 		logger:           logger,
 		promMetrics:      metrics,
+		readiness:        readiness,
 	}, nil
 }
 
@@ -66,6 +70,10 @@ func (m *noIntegrationController) Metrics() *PromMetrics {
 	return m.promMetrics
 }
 
+func (m *noIntegrationController) Readiness() *Readiness {
+	return m.readiness
+}
+
 func (m *noIntegrationController) Start() error {
 	m.promMetrics.Init()
 
@@ -92,6 +100,7 @@ func (m *noIntegrationController) shutdown() error {
 }
 
 func (m *noIntegrationController) SendShutdown() {
+	m.readiness.ShutDown()
 	m.Shutdown <- true
 }
 
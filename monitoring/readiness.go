@@ -0,0 +1,125 @@
+package monitoring
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const readinessCheckTimeout = 5 * time.Second
+
+// ReadinessCheck checks a service that the gateway depends on.
+type ReadinessCheck func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check ReadinessCheck
+}
+
+// CheckResult is the outcome of a readiness check.
+type CheckResult struct {
+	Healthy  bool   `json:"healthy"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Readiness decides whether the gateway is ready to serve requests, by
+// checking the services that it depends on. It is not ready anymore once it
+// is shutting down, so that load balancers stop sending requests to it
+// while it drains the requests in flight.
+type Readiness struct {
+	lock         sync.RWMutex
+	checks       []namedCheck
+	shuttingDown bool
+}
+
+func NewReadiness() *Readiness {
+	return &Readiness{}
+}
+
+// AddCheck adds a check, or replaces the check with the same name.
+func (r *Readiness) AddCheck(name string, check ReadinessCheck) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := range r.checks {
+		if r.checks[i].name == name {
+			r.checks[i].check = check
+			return
+		}
+	}
+
+	r.checks = append(r.checks, namedCheck{name: name, check: check})
+}
+
+// ShutDown marks the gateway as not ready.
+func (r *Readiness) ShutDown() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.shuttingDown = true
+}
+
+// Check runs all checks at the same time, each with a timeout of five
+// seconds, and reports whether all of them passed.
+func (r *Readiness) Check(ctx context.Context) (bool, map[string]CheckResult) {
+	r.lock.RLock()
+	checks := append([]namedCheck{}, r.checks...)
+	shuttingDown := r.shuttingDown
+	r.lock.RUnlock()
+
+	results := make(map[string]CheckResult, len(checks)+1)
+	ready := true
+
+	if shuttingDown {
+		results["shutdown"] = CheckResult{Error: "gateway is shutting down", Duration: "0s"}
+		ready = false
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c namedCheck) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := runCheck(checkCtx, c.check)
+			result := CheckResult{Healthy: err == nil, Duration: time.Since(start).String()}
+			if err != nil {
+				result.Error = err.Error()
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			results[c.name] = result
+			ready = ready && result.Healthy
+		}(c)
+	}
+
+	wg.Wait()
+
+	return ready, results
+}
+
+// runCheck gives up on checks that do not return within their deadline,
+// since not all clients of the checked services accept a context.
+func runCheck(ctx context.Context, check ReadinessCheck) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("check timed out: %s", ctx.Err())
+	}
+}
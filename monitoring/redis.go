@@ -0,0 +1,64 @@
+package monitoring
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RedisPool is implemented by Redis connection sources that keep statistics
+// about their connection pools.
+type RedisPool interface {
+	Stats() redis.PoolStats
+}
+
+type redisPoolCollector struct {
+	pool RedisPool
+
+	active       *prometheus.Desc
+	idle         *prometheus.Desc
+	waits        *prometheus.Desc
+	waitDuration *prometheus.Desc
+}
+
+// WatchRedisPool exports the statistics of a Redis connection pool.
+func (m *PromMetrics) WatchRedisPool(pool RedisPool) error {
+	return prometheus.Register(&redisPoolCollector{
+		pool: pool,
+		active: prometheus.NewDesc(
+			"servicegateway_redis_active_connections",
+			"Redis connections in the pool, including idle connections",
+			nil, nil,
+		),
+		idle: prometheus.NewDesc(
+			"servicegateway_redis_idle_connections",
+			"Idle Redis connections in the pool",
+			nil, nil,
+		),
+		waits: prometheus.NewDesc(
+			"servicegateway_redis_waits",
+			"Times that a connection had to be waited for because the pool was exhausted",
+			nil, nil,
+		),
+		waitDuration: prometheus.NewDesc(
+			"servicegateway_redis_wait_duration_seconds",
+			"Total time spent waiting for connections from the pool",
+			nil, nil,
+		),
+	})
+}
+
+func (c *redisPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.active
+	ch <- c.idle
+	ch <- c.waits
+	ch <- c.waitDuration
+}
+
+func (c *redisPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.pool.Stats()
+
+	ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(stats.ActiveCount))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.IdleCount))
+	ch <- prometheus.MustNewConstMetric(c.waits, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+}
@@ -20,6 +20,7 @@ package monitoring
  */
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -27,10 +28,11 @@ import (
 )
 
 type MonitoringServer struct {
+	readiness *Readiness
 }
 
-func NewMonitoringServer() (*MonitoringServer, error) {
-	return &MonitoringServer{}, nil
+func NewMonitoringServer(readiness *Readiness) (*MonitoringServer, error) {
+	return &MonitoringServer{readiness: readiness}, nil
 }
 
 func (s *MonitoringServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
@@ -43,6 +45,20 @@ func (s *MonitoringServer) ServeHTTP(res http.ResponseWriter, req *http.Request)
 	mux.GET("/metrics", func(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		promHandler.ServeHTTP(res, req)
 	})
+	mux.GET("/health/live", func(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		res.Header().Set("Content-Type", "application/json")
+		_, _ = res.Write([]byte(`{"live":true}`))
+	})
+	mux.GET("/health/ready", func(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		ready, checks := s.readiness.Check(req.Context())
+
+		res.Header().Set("Content-Type", "application/json")
+		if !ready {
+			res.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		_ = json.NewEncoder(res).Encode(map[string]interface{}{"ready": ready, "checks": checks})
+	})
 
 	mux.ServeHTTP(res, req)
 }
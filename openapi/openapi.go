@@ -0,0 +1,438 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+)
+
+const defaultMaxBodySize = 1 << 20
+
+// Validator validates requests against the operations of an OpenAPI 3.0
+// document; their path, parameters and bodies.
+type Validator struct {
+	doc         *openapi3.T
+	basePath    string
+	maxBodySize int64
+	paths       []*pathItem
+}
+
+type pathItem struct {
+	template string
+	regex    *regexp.Regexp
+	params   []string
+	literals int
+	item     *openapi3.PathItem
+}
+
+// fieldError is a part of a request that does not match the document.
+type fieldError struct {
+	Location string `json:"location"`
+	Message  string `json:"message"`
+}
+
+// NewValidator loads the OpenAPI document of an application. It returns nil
+// if the application has none.
+func NewValidator(app *config.Application) (*Validator, error) {
+	cfg := &app.OpenAPI
+	if cfg.Spec == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(cfg.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("could not read OpenAPI document: %s", err)
+	}
+
+	// JSON documents are YAML documents as well; they are converted like
+	// the configuration, so that their aliases are limited in the same way
+	converted, err := config.YAMLToJSON(content)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse OpenAPI document %s: %s", cfg.Spec, err)
+	}
+
+	// only local references (like `#/components/schemas/User`) are resolved
+	loader := openapi3.NewLoader()
+	loader.IsExternalRefsAllowed = false
+
+	doc, err := loader.LoadFromData(converted)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse OpenAPI document %s: %s", cfg.Spec, err)
+	}
+
+	if !strings.HasPrefix(doc.OpenAPI, "3.0") {
+		return nil, fmt.Errorf("%s is not an OpenAPI 3.0 document", cfg.Spec)
+	}
+
+	if err := doc.Validate(loader.Context, openapi3.DisableExamplesValidation()); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document %s: %s", cfg.Spec, err)
+	}
+
+	v := Validator{
+		doc:         doc,
+		basePath:    strings.TrimRight(cfg.BasePath, "/"),
+		maxBodySize: cfg.MaxBodySize,
+	}
+
+	if cfg.BasePath == "" && app.Routing.Type == "path" {
+		v.basePath = strings.TrimRight(app.Routing.Path, "/")
+	}
+
+	if v.maxBodySize < 0 {
+		return nil, fmt.Errorf("openapi.max_body_size must not be negative")
+	}
+
+	if v.maxBodySize == 0 {
+		v.maxBodySize = defaultMaxBodySize
+	}
+
+	for template, item := range doc.Paths.Map() {
+		p, err := newPathItem(template, item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OpenAPI document %s: %s", cfg.Spec, err)
+		}
+		v.paths = append(v.paths, p)
+	}
+
+	// concrete paths match before templated ones
+	sort.Slice(v.paths, func(i, j int) bool {
+		if len(v.paths[i].params) != len(v.paths[j].params) {
+			return len(v.paths[i].params) < len(v.paths[j].params)
+		}
+		if v.paths[i].literals != v.paths[j].literals {
+			return v.paths[i].literals > v.paths[j].literals
+		}
+		return v.paths[i].template < v.paths[j].template
+	})
+
+	return &v, nil
+}
+
+var templateParameter = regexp.MustCompile(`\{([^{}/]+)\}`)
+
+func newPathItem(template string, item *openapi3.PathItem) (*pathItem, error) {
+	p := pathItem{
+		template: template,
+		item:     item,
+	}
+
+	expr := strings.Builder{}
+	expr.WriteString("^")
+
+	last := 0
+	for _, match := range templateParameter.FindAllStringSubmatchIndex(template, -1) {
+		expr.WriteString(regexp.QuoteMeta(template[last:match[0]]))
+		expr.WriteString("([^/]+)")
+
+		p.literals += match[0] - last
+		p.params = append(p.params, template[match[2]:match[3]])
+		last = match[1]
+	}
+
+	expr.WriteString(regexp.QuoteMeta(template[last:]))
+	expr.WriteString("$")
+	p.literals += len(template) - last
+
+	regex, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid path '%s': %s", template, err)
+	}
+	p.regex = regex
+
+	// like the specification demands, these headers are not validated
+	item.Parameters = withoutReservedHeaders(item.Parameters)
+	for _, op := range item.Operations() {
+		op.Parameters = withoutReservedHeaders(op.Parameters)
+	}
+
+	return &p, nil
+}
+
+func withoutReservedHeaders(parameters openapi3.Parameters) openapi3.Parameters {
+	filtered := make(openapi3.Parameters, 0, len(parameters))
+	for _, param := range parameters {
+		if param.Value != nil && param.Value.In == openapi3.ParameterInHeader {
+			switch http.CanonicalHeaderKey(param.Value.Name) {
+			case "Accept", "Content-Type", "Authorization":
+				continue
+			}
+		}
+
+		filtered = append(filtered, param)
+	}
+
+	return filtered
+}
+
+// problem is a request that does not match the document, and how it is
+// answered.
+type problem struct {
+	status int
+	reason string
+	detail string
+	errors []fieldError
+	allow  string
+}
+
+// find returns the path item and the operation of a request, or the
+// problem if the document has none.
+func (v *Validator) find(req *http.Request) (*pathItem, *openapi3.Operation, map[string]string, *problem) {
+	path := req.URL.Path
+	if v.basePath != "" {
+		if path != v.basePath && !strings.HasPrefix(path, v.basePath+"/") {
+			return nil, nil, nil, &problem{status: 404, reason: "path", detail: "the path is not part of the API"}
+		}
+		path = strings.TrimPrefix(path, v.basePath)
+		if path == "" {
+			path = "/"
+		}
+	}
+
+	for _, p := range v.paths {
+		match := p.regex.FindStringSubmatch(path)
+		if match == nil {
+			continue
+		}
+
+		op := p.item.GetOperation(req.Method)
+		if op == nil && req.Method == "HEAD" {
+			op = p.item.Get
+		}
+
+		if op == nil {
+			return p, nil, nil, &problem{status: 405, reason: "method", detail: "the method is not allowed for this path"}
+		}
+
+		values := make(map[string]string, len(p.params))
+		for i, name := range p.params {
+			values[name] = match[i+1]
+		}
+
+		return p, op, values, nil
+	}
+
+	return nil, nil, nil, &problem{status: 404, reason: "path", detail: "the path is not part of the API"}
+}
+
+// check validates a request. Requests for operations that have a request
+// body have their body read into memory (and replaced); their size is
+// limited.
+func (v *Validator) check(req *http.Request) *problem {
+	if v == nil {
+		return nil
+	}
+
+	p, op, pathValues, prob := v.find(req)
+
+	// preflight requests are answered by the gateway or the upstream,
+	// whether the document has them or not
+	if prob != nil && prob.reason == "method" && req.Method == "OPTIONS" {
+		return nil
+	}
+
+	if prob != nil {
+		if prob.status == 405 {
+			prob.allow = allowed(p)
+		}
+		return prob
+	}
+
+	if op.RequestBody != nil && op.RequestBody.Value != nil {
+		if prob := v.readBody(req, op.RequestBody.Value); prob != nil {
+			return prob
+		}
+	}
+
+	input := openapi3filter.RequestValidationInput{
+		Request:    req,
+		PathParams: pathValues,
+		Route: &routers.Route{
+			Spec:      v.doc,
+			Path:      p.template,
+			PathItem:  p.item,
+			Method:    req.Method,
+			Operation: op,
+		},
+		Options: &openapi3filter.Options{
+			MultiError:          true,
+			SkipSettingDefaults: true,
+
+			// requests are authenticated by the gateway
+			AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+		},
+	}
+
+	err := openapi3filter.ValidateRequest(req.Context(), &input)
+	if err == nil {
+		return nil
+	}
+
+	var paramErrs, bodyErrs []fieldError
+	for _, e := range flatten(err) {
+		var reqErr *openapi3filter.RequestError
+		if !errors.As(e, &reqErr) {
+			continue
+		}
+
+		if reqErr.Parameter != nil {
+			location := reqErr.Parameter.In + "." + reqErr.Parameter.Name
+			paramErrs = append(paramErrs, fieldErrors(location, reqErr)...)
+		} else if reqErr.RequestBody != nil && !unsupportedFormat(reqErr) {
+			bodyErrs = append(bodyErrs, fieldErrors("body", reqErr)...)
+		}
+	}
+
+	if len(paramErrs) > 0 {
+		return &problem{status: 400, reason: "parameters", detail: "the request parameters do not match the API", errors: paramErrs}
+	}
+
+	if len(bodyErrs) > 0 {
+		return &problem{status: 400, reason: "body", detail: "the request body does not match the API", errors: bodyErrs}
+	}
+
+	return nil
+}
+
+// allowed returns the Allow header for the operations of a path.
+func allowed(p *pathItem) string {
+	methods := make([]string, 0, len(p.item.Operations()))
+	for method := range p.item.Operations() {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	return strings.Join(methods, ", ")
+}
+
+// readBody reads the body of a request into memory (and replaces it), and
+// checks that its content type is one of the media types of the operation.
+func (v *Validator) readBody(req *http.Request, body *openapi3.RequestBody) *problem {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+
+	content, err := io.ReadAll(io.LimitReader(req.Body, v.maxBodySize+1))
+	if err != nil {
+		return &problem{status: 400, reason: "body", detail: "the request body could not be read"}
+	}
+
+	if int64(len(content)) > v.maxBodySize {
+		return &problem{status: 413, reason: "body", detail: "the request body is too large to be validated"}
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(content))
+
+	if len(content) > 0 && len(body.Content) > 0 && body.Content.Get(req.Header.Get("Content-Type")) == nil {
+		return &problem{status: 415, reason: "body", detail: "the content type of the request body is not supported by the API"}
+	}
+
+	return nil
+}
+
+// flatten returns the errors that a multi error consists of.
+func flatten(err error) []error {
+	multi, ok := err.(openapi3.MultiError)
+	if !ok {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, e := range multi {
+		errs = append(errs, flatten(e)...)
+	}
+
+	return errs
+}
+
+// unsupportedFormat reports whether a body could not be validated since
+// its content type cannot be decoded; such bodies only need to have one of
+// the media types of the operation.
+func unsupportedFormat(err *openapi3filter.RequestError) bool {
+	var parseErr *openapi3filter.ParseError
+	return errors.As(err.Err, &parseErr) && parseErr.Kind == openapi3filter.KindUnsupportedFormat
+}
+
+// fieldErrors converts an error of the validation into the invalid parts of
+// the request; values that do not match their schema are located by their
+// path within the parameter or body (like `body.items[0].name`).
+func fieldErrors(location string, err *openapi3filter.RequestError) []fieldError {
+	if err.Err == nil {
+		return []fieldError{{Location: location, Message: err.Reason}}
+	}
+
+	var errs []fieldError
+	for _, e := range flatten(err.Err) {
+		var schemaErr *openapi3.SchemaError
+		if !errors.As(e, &schemaErr) {
+			message := e.Error()
+			switch {
+			case errors.Is(e, openapi3filter.ErrInvalidRequired):
+				message = "is required"
+			case err.RequestBody != nil && err.Reason != "":
+				message = err.Reason
+			}
+
+			errs = append(errs, fieldError{Location: location, Message: message})
+			continue
+		}
+
+		field := location
+		for _, token := range schemaErr.JSONPointer() {
+			if _, err := strconv.Atoi(token); err == nil {
+				field += "[" + token + "]"
+			} else {
+				field += "." + token
+			}
+		}
+
+		errs = append(errs, fieldError{Location: field, Message: schemaErr.Reason})
+	}
+
+	return errs
+}
+
+// DecorateHandler rejects the requests that do not match the OpenAPI
+// document of the validator with a problem details (RFC 7807) response. The
+// reason (path, method, parameters or body) is reported to the rejected
+// function.
+func DecorateHandler(handler httprouter.Handle, rejected func(reason string), v *Validator) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		prob := v.check(req)
+		if prob == nil {
+			handler(rw, req, params)
+			return
+		}
+
+		rejected(prob.reason)
+
+		body, _ := json.Marshal(struct {
+			Type   string       `json:"type"`
+			Title  string       `json:"title"`
+			Status int          `json:"status"`
+			Detail string       `json:"detail"`
+			Errors []fieldError `json:"errors,omitempty"`
+		}{"about:blank", http.StatusText(prob.status), prob.status, prob.detail, prob.errors})
+
+		if prob.allow != "" {
+			rw.Header().Set("Allow", prob.allow)
+		}
+
+		rw.Header().Set("Content-Type", "application/problem+json")
+		rw.WriteHeader(prob.status)
+		_, _ = rw.Write(body)
+	}
+}
@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ApplicationStatus describes an application that was registered with the
+// proxy handler.
+type ApplicationStatus struct {
+	Name        string
+	Config      config.Application
+	Upstreams   []config.Upstream
+	Enabled     bool
+	Maintenance bool
+}
+
+// Applications returns the status of all registered applications, ordered by
+// name.
+func (p *ProxyHandler) Applications() []ApplicationStatus {
+	p.balancerLock.Lock()
+	defer p.balancerLock.Unlock()
+
+	p.disabledLock.RLock()
+	defer p.disabledLock.RUnlock()
+
+	apps := make([]ApplicationStatus, 0, len(p.applications))
+	for name, app := range p.applications {
+		app.Enabled = !p.disabled[name]
+		app.Maintenance = p.inMaintenance(name, &app.Config)
+		apps = append(apps, app)
+	}
+
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+	return apps
+}
+
+// SetEnabled enables or disables an application at runtime. Requests to
+// disabled applications are rejected. It returns false if the application
+// is unknown.
+func (p *ProxyHandler) SetEnabled(appName string, enabled bool) bool {
+	p.balancerLock.Lock()
+	_, ok := p.applications[appName]
+	p.balancerLock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	p.disabledLock.Lock()
+	defer p.disabledLock.Unlock()
+
+	if enabled {
+		delete(p.disabled, appName)
+	} else {
+		p.disabled[appName] = true
+	}
+
+	return true
+}
+
+// Enabled reports whether an application accepts requests.
+func (p *ProxyHandler) Enabled(appName string) bool {
+	p.disabledLock.RLock()
+	defer p.disabledLock.RUnlock()
+
+	return !p.disabled[appName]
+}
+
+// SetMaintenance puts an application into maintenance mode at runtime,
+// regardless of its configuration, or clears that override again, so that
+// the application is in maintenance mode as configured. It returns false
+// if the application is unknown.
+func (p *ProxyHandler) SetMaintenance(appName string, maintenance bool) bool {
+	p.balancerLock.Lock()
+	_, ok := p.applications[appName]
+	p.balancerLock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	p.disabledLock.Lock()
+	defer p.disabledLock.Unlock()
+
+	if maintenance {
+		p.maintenance[appName] = true
+	} else {
+		delete(p.maintenance, appName)
+	}
+
+	return true
+}
+
+// inMaintenance reports whether an application is in maintenance mode;
+// because it was put into it at runtime, or because it is configured. The
+// caller must hold the disabledLock.
+func (p *ProxyHandler) inMaintenance(appName string, appCfg *config.Application) bool {
+	return p.maintenance[appName] || appCfg.Maintenance.Enabled
+}
+
+// DecorateEnabled rejects the requests to an application while it is
+// disabled or in maintenance mode, before any other middleware handles them.
+func (p *ProxyHandler) DecorateEnabled(appName string, appCfg *config.Application, handler httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		p.disabledLock.RLock()
+		disabled, maintenance := p.disabled[appName], p.inMaintenance(appName, appCfg)
+		p.disabledLock.RUnlock()
+
+		if disabled {
+			p.metrics.Errors.With(prometheus.Labels{"application": appName, "reason": "application_disabled"}).Inc()
+
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(503)
+			_, _ = rw.Write([]byte("{\"msg\": \"service unavailable\", \"reason\": \"application disabled\"}"))
+			return
+		}
+
+		if maintenance {
+			p.metrics.Errors.With(prometheus.Labels{"application": appName, "reason": "maintenance"}).Inc()
+			writeMaintenance(rw, req, &appCfg.Maintenance)
+			return
+		}
+
+		handler(rw, req, params)
+	}
+}
+
+// writeMaintenance answers a request to an application in maintenance mode
+// with the configured page, or with a JSON error like for disabled
+// applications.
+func writeMaintenance(rw http.ResponseWriter, req *http.Request, cfg *config.MaintenanceConfiguration) {
+	if cfg.RetryAfter != "" {
+		if retryAfter, err := time.ParseDuration(cfg.RetryAfter); err == nil && retryAfter > 0 {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		}
+	}
+
+	body := cfg.Body
+	contentType := cfg.ContentType
+
+	if body == "" {
+		body = "{\"msg\": \"service unavailable\", \"reason\": \"maintenance\"}"
+		contentType = "application/json"
+	} else if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(503)
+
+	if req.Method != "HEAD" {
+		_, _ = rw.Write([]byte(body))
+	}
+}
+
+// healthWatch is the health check configuration of an application's
+// upstreams.
+type healthWatch struct {
+	urls      []string
+	cfg       config.HealthCheckConfiguration
+	transport http.RoundTripper
+}
+
+// watch sets the health checks of an application. They are started (or
+// stopped) right away if the handler is active; otherwise, when it is
+// activated. The caller must hold the balancerLock.
+func (p *ProxyHandler) watch(appName string, w healthWatch) {
+	if w.cfg.Enabled {
+		p.watches[appName] = w
+	} else {
+		delete(p.watches, appName)
+	}
+
+	if !p.active || p.retired {
+		return
+	}
+
+	if err := p.health.Watch(appName, w.urls, &w.cfg, w.transport); err != nil {
+		p.Logger.Errorf("could not watch health of application %s: %s", appName, err)
+	}
+}
+
+// Activate makes a handler returned by Derive the active one, once it has
+// replaced the previous handler: its health checks are started, and the
+// health checks and runtime overrides of applications that it does not
+// register any longer are removed. The previous handler does not change the
+// health checks anymore, even if its upstreams are still updated.
+func (p *ProxyHandler) Activate(previous *ProxyHandler) []string {
+	previous.balancerLock.Lock()
+	previous.retired = true
+	previousApps := make([]string, 0, len(previous.applications))
+	for name := range previous.applications {
+		previousApps = append(previousApps, name)
+	}
+	previous.balancerLock.Unlock()
+
+	p.balancerLock.Lock()
+	defer p.balancerLock.Unlock()
+
+	p.active = true
+	p.previous = nil
+
+	for name, w := range p.watches {
+		if err := p.health.Watch(name, w.urls, &w.cfg, w.transport); err != nil {
+			p.Logger.Errorf("could not watch health of application %s: %s", name, err)
+		}
+	}
+
+	p.disabledLock.Lock()
+	defer p.disabledLock.Unlock()
+
+	removed := make([]string, 0)
+	for _, name := range previousApps {
+		if _, ok := p.applications[name]; ok {
+			continue
+		}
+
+		delete(p.disabled, name)
+		delete(p.maintenance, name)
+		removed = append(removed, name)
+	}
+
+	// health checks are also stopped for applications that are still
+	// registered, but no longer have them enabled
+	for _, name := range previousApps {
+		if _, ok := p.watches[name]; ok {
+			continue
+		}
+
+		if err := p.health.Watch(name, nil, &config.HealthCheckConfiguration{}, nil); err != nil {
+			p.Logger.Errorf("could not stop health checks of application %s: %s", name, err)
+		}
+	}
+
+	sort.Strings(removed)
+	return removed
+}
+
+// Application returns the status of a registered application.
+func (p *ProxyHandler) Application(appName string) (ApplicationStatus, bool) {
+	p.balancerLock.Lock()
+	defer p.balancerLock.Unlock()
+
+	app, ok := p.applications[appName]
+	if !ok {
+		return app, false
+	}
+
+	app.Enabled = p.Enabled(appName)
+
+	p.disabledLock.RLock()
+	app.Maintenance = p.inMaintenance(appName, &app.Config)
+	p.disabledLock.RUnlock()
+
+	return app, true
+}
+
+// PreviousApplication returns the configuration that an application had in
+// the handler that this one was derived from, so that it can be kept when
+// its new definition is invalid.
+func (p *ProxyHandler) PreviousApplication(appName string) (config.Application, bool) {
+	p.balancerLock.Lock()
+	defer p.balancerLock.Unlock()
+
+	app, ok := p.previous[appName]
+	return app.Config, ok
+}
@@ -0,0 +1,420 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/clientip"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/health"
+)
+
+// number of points on the hash ring per unit of weight
+const hashRingReplicas = 100
+
+var (
+	errNoHealthyUpstream = errors.New("no healthy upstream")
+	errQueueFull         = errors.New("upstream concurrency limit reached")
+	errQueueTimeout      = errors.New("timed out waiting for a free upstream")
+)
+
+type upstream struct {
+	url    string
+	weight int
+
+	// the current weight for smooth weighted round-robin
+	current int
+	active  int64
+}
+
+type ringPoint struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// balancer distributes the requests to an application across its upstream
+// services. Upstreams that fail their health checks are skipped, as long as
+// there are healthy ones. Upstreams that have reached their concurrency limit
+// are skipped as well; if all of them have, requests wait for a free slot.
+type balancer struct {
+	cfg         config.LoadBalancingConfiguration
+	concurrency config.ConcurrencyConfiguration
+
+	appName    string
+	strategy   string
+	hashHeader string
+	hashClaim  string
+
+	upstreams []*upstream
+	ring      []ringPoint
+	next      uint64
+
+	maxInFlight  int64
+	queueTimeout time.Duration
+	waiting      int
+	freed        chan struct{}
+
+	health *health.Monitor
+	lock   sync.Mutex
+}
+
+func newBalancer(appName string, cfg *config.LoadBalancingConfiguration, concurrency *config.ConcurrencyConfiguration, monitor *health.Monitor) (*balancer, error) {
+	b := balancer{
+		cfg:         *cfg,
+		concurrency: *concurrency,
+		maxInFlight: int64(concurrency.MaxInFlight),
+		freed:       make(chan struct{}),
+		appName:     appName,
+		strategy:    cfg.Strategy,
+		hashHeader:  cfg.HashHeader,
+		hashClaim:   cfg.HashClaim,
+		health:      monitor,
+	}
+
+	switch b.strategy {
+	case "":
+		b.strategy = "round_robin"
+	case "round_robin", "least_connections", "weighted":
+	case "consistent_hash":
+		if b.hashHeader == "" && b.hashClaim == "" {
+			return nil, fmt.Errorf("consistent hashing requires either a hash header or a hash claim")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported load balancing strategy '%s'", b.strategy)
+	}
+
+	if concurrency.MaxInFlight < 0 || concurrency.QueueSize < 0 {
+		return nil, fmt.Errorf("concurrency limit and queue size must not be negative")
+	}
+
+	b.queueTimeout = 5 * time.Second
+	if concurrency.QueueTimeout != "" {
+		timeout, err := time.ParseDuration(concurrency.QueueTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid queue timeout: %s", err)
+		}
+		b.queueTimeout = timeout
+	}
+
+	return &b, nil
+}
+
+// configuredFor reports whether the balancer was created for the load
+// balancing and concurrency configuration of an application.
+func (b *balancer) configuredFor(appCfg *config.Application) bool {
+	return b.cfg == appCfg.Backend.LoadBalancing && b.concurrency == appCfg.Backend.Concurrency
+}
+
+// SetUpstreams replaces the upstreams of the balancer. The connection
+// counts of upstreams that are still present are kept.
+func (b *balancer) SetUpstreams(upstreams []config.Upstream) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	existing := make(map[string]*upstream, len(b.upstreams))
+	for _, u := range b.upstreams {
+		existing[u.url] = u
+	}
+
+	b.upstreams = make([]*upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		weight := u.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		if prev, ok := existing[u.Url]; ok {
+			prev.weight = weight
+			b.upstreams = append(b.upstreams, prev)
+			continue
+		}
+
+		b.upstreams = append(b.upstreams, &upstream{url: u.Url, weight: weight})
+	}
+
+	b.ring = nil
+	if b.strategy == "consistent_hash" {
+		for _, u := range b.upstreams {
+			for i := 0; i < u.weight*hashRingReplicas; i++ {
+				hash := crc32.ChecksumIEEE([]byte(u.url + "#" + strconv.Itoa(i)))
+				b.ring = append(b.ring, ringPoint{hash: hash, upstream: u})
+			}
+		}
+
+		sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	}
+}
+
+// hashKey determines the key that requests are assigned to upstreams by
+// with consistent hashing. Requests without the header or claim fall back to
+// the client's IP address.
+func (b *balancer) hashKey(req *http.Request) string {
+	if b.hashHeader != "" {
+		if value := req.Header.Get(b.hashHeader); value != "" {
+			return value
+		}
+	}
+
+	if b.hashClaim != "" {
+		if claims, ok := auth.ClaimsFromContext(req.Context()); ok {
+			if value, ok := claims[b.hashClaim]; ok && value != nil {
+				return fmt.Sprintf("%v", value)
+			}
+		}
+	}
+
+	return clientip.FromRequest(req)
+}
+
+// Pick selects the upstream for a request. The returned release function
+// needs to be called once the request has been completed. If none of the
+// upstreams is healthy, Pick returns errNoHealthyUpstream. If all healthy
+// upstreams have reached their concurrency limit, Pick waits in the queue
+// until one of them completes a request, and fails if the queue is full or
+// the queue timeout passes.
+func (b *balancer) Pick(req *http.Request) (string, func(), error) {
+	var timeout <-chan time.Time
+
+	for {
+		b.lock.Lock()
+
+		picked, err := b.pick(req)
+		if err != errQueueFull {
+			b.lock.Unlock()
+
+			if err != nil {
+				return "", nil, err
+			}
+
+			return picked.url, b.releaser(picked), nil
+		}
+
+		if b.waiting >= b.concurrency.QueueSize {
+			b.lock.Unlock()
+			return "", nil, errQueueFull
+		}
+
+		if timeout == nil {
+			timer := time.NewTimer(b.queueTimeout)
+			defer timer.Stop()
+
+			timeout = timer.C
+		}
+
+		freed := b.freed
+		b.waiting++
+		b.lock.Unlock()
+
+		select {
+		case <-freed:
+			err = nil
+		case <-timeout:
+			err = errQueueTimeout
+		case <-req.Context().Done():
+			err = req.Context().Err()
+		}
+
+		b.lock.Lock()
+		b.waiting--
+		b.lock.Unlock()
+
+		if err != nil {
+			return "", nil, err
+		}
+	}
+}
+
+// releaser returns the function that frees the slot of a request to an
+// upstream, and wakes the requests that wait for one.
+func (b *balancer) releaser(picked *upstream) func() {
+	return func() {
+		atomic.AddInt64(&picked.active, -1)
+
+		if b.maxInFlight > 0 {
+			b.lock.Lock()
+			if b.waiting > 0 {
+				close(b.freed)
+				b.freed = make(chan struct{})
+			}
+			b.lock.Unlock()
+		}
+	}
+}
+
+// available reports whether an upstream may be sent another request.
+func (b *balancer) available(u *upstream) bool {
+	return b.maxInFlight <= 0 || atomic.LoadInt64(&u.active) < b.maxInFlight
+}
+
+// pick selects an upstream according to the balancing strategy and takes a
+// slot of it. The balancer needs to be locked.
+func (b *balancer) pick(req *http.Request) (*upstream, error) {
+	candidates := make([]*upstream, 0, len(b.upstreams))
+	healthy := false
+	for _, u := range b.upstreams {
+		if b.health.Healthy(b.appName, u.url) {
+			healthy = true
+			if b.available(u) {
+				candidates = append(candidates, u)
+			}
+		}
+	}
+
+	if !healthy {
+		return nil, errNoHealthyUpstream
+	}
+
+	if len(candidates) == 0 {
+		return nil, errQueueFull
+	}
+
+	var picked *upstream
+
+	switch b.strategy {
+	case "least_connections":
+		for _, u := range candidates {
+			if picked == nil || atomic.LoadInt64(&u.active)*int64(picked.weight) < atomic.LoadInt64(&picked.active)*int64(u.weight) {
+				picked = u
+			}
+		}
+	case "weighted":
+		// smooth weighted round-robin, which interleaves the upstreams
+		// instead of sending bursts of requests to the heaviest one
+		total := 0
+		for _, u := range candidates {
+			u.current += u.weight
+			total += u.weight
+			if picked == nil || u.current > picked.current {
+				picked = u
+			}
+		}
+		picked.current -= total
+	case "consistent_hash":
+		hash := crc32.ChecksumIEEE([]byte(b.hashKey(req)))
+		i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+
+		// unhealthy upstreams are skipped by walking the ring clockwise, so
+		// that only their share of the keys is moved to other upstreams
+		for n := 0; n < len(b.ring); n++ {
+			point := b.ring[(i+n)%len(b.ring)]
+			if b.health.Healthy(b.appName, point.upstream.url) && b.available(point.upstream) {
+				picked = point.upstream
+				break
+			}
+		}
+	default:
+		picked = candidates[b.next%uint64(len(candidates))]
+		b.next++
+	}
+
+	if picked == nil {
+		return nil, errNoHealthyUpstream
+	}
+
+	atomic.AddInt64(&picked.active, 1)
+	return picked, nil
+}
+
+// RegisterUpstreams sets the upstream services that the requests to an
+// application are distributed across, and starts (or updates) their health
+// checks. It may be called again whenever the upstreams change.
+func (p *ProxyHandler) RegisterUpstreams(appName string, upstreams []config.Upstream, appCfg *config.Application) error {
+	if len(upstreams) == 0 {
+		return fmt.Errorf("no upstreams configured for application %s", appName)
+	}
+
+	compiled, err := p.compileApplication(appName, appCfg)
+	if err != nil {
+		return err
+	}
+
+	if err := health.Validate(&appCfg.Backend.HealthCheck); err != nil {
+		return err
+	}
+
+	p.balancerLock.Lock()
+	defer p.balancerLock.Unlock()
+
+	b, ok := p.balancers[appName]
+	if !ok || !b.configuredFor(appCfg) {
+		if b, err = newBalancer(appName, &appCfg.Backend.LoadBalancing, &appCfg.Backend.Concurrency, p.health); err != nil {
+			return err
+		}
+	}
+
+	var split *trafficSplit
+	if len(appCfg.Backend.Groups) > 0 {
+		if split, err = newTrafficSplit(appName, appCfg, p.splits[appName], p.health); err != nil {
+			return err
+		}
+	}
+
+	// the upstreams of all groups are checked by the same health watch
+	urls := make([]string, 0, len(upstreams))
+	seen := make(map[string]bool)
+	addUrls := func(upstreams []config.Upstream) {
+		for i := range upstreams {
+			if !seen[upstreams[i].Url] {
+				seen[upstreams[i].Url] = true
+				urls = append(urls, upstreams[i].Url)
+			}
+		}
+	}
+
+	addUrls(upstreams)
+	for i := range appCfg.Backend.Groups {
+		addUrls(groupUpstreams(&appCfg.Backend.Groups[i]))
+	}
+
+	client, err := p.clientFor(urls[0], appCfg)
+	if err != nil {
+		return err
+	}
+
+	if appCfg.Backend.Transport.InsecureSkipVerify {
+		p.Logger.Warningf("INSECURE: certificates of the upstreams of application %s are not verified (insecure_skip_verify); connections to them can be intercepted", appName)
+	}
+
+	p.watch(appName, healthWatch{urls: urls, cfg: appCfg.Backend.HealthCheck, transport: client.Transport})
+
+	b.SetUpstreams(upstreams)
+	p.balancers[appName] = b
+	p.compiled[appName] = compiled
+	p.applications[appName] = ApplicationStatus{
+		Name:      appName,
+		Config:    *appCfg,
+		Upstreams: append([]config.Upstream(nil), upstreams...),
+	}
+
+	if split != nil {
+		p.splits[appName] = split
+	} else {
+		delete(p.splits, appName)
+	}
+
+	return nil
+}
+
+// balancer returns the balancer for a request to an application, which
+// depends on the upstream group that the request is sent to.
+func (p *ProxyHandler) balancer(req *http.Request, appName string) (*balancer, bool) {
+	p.balancerLock.Lock()
+	defer p.balancerLock.Unlock()
+
+	if split, ok := p.splits[appName]; ok {
+		if group := split.Pick(req); group != nil {
+			return group.balancer, true
+		}
+	}
+
+	b, ok := p.balancers[appName]
+	return b, ok
+}
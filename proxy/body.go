@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+// prepareRequestBody enforces an application's maximum request body size
+// and, in buffered mode, reads the entire body before the request is sent
+// upstream. Buffered bodies can always be retried; streamed bodies are never
+// retried. By default, only small bodies are buffered (see retryable).
+func prepareRequestBody(rw http.ResponseWriter, proxyReq *http.Request, cfg *config.RequestBodyConfiguration) error {
+	switch cfg.Buffering {
+	case "", "auto", "stream", "buffer":
+	default:
+		return fmt.Errorf("unsupported buffering mode '%s'", cfg.Buffering)
+	}
+
+	if proxyReq.Body == nil || proxyReq.Body == http.NoBody {
+		return nil
+	}
+
+	if cfg.MaxSize > 0 {
+		if proxyReq.ContentLength > cfg.MaxSize {
+			return bodyTooLarge
+		}
+
+		// the length of chunked bodies is only known once they are read
+		proxyReq.Body = http.MaxBytesReader(rw, proxyReq.Body, cfg.MaxSize)
+	}
+
+	if cfg.Buffering != "buffer" {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(proxyReq.Body)
+	if isBodyTooLarge(err) {
+		return bodyTooLarge
+	} else if err != nil {
+		return err
+	}
+
+	proxyReq.ContentLength = int64(len(body))
+	proxyReq.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	proxyReq.Body, _ = proxyReq.GetBody()
+
+	return nil
+}
+
+// isBodyTooLarge checks whether an error was caused by a request body that
+// exceeded the maximum size while it was streamed.
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return err == bodyTooLarge || errors.As(err, &maxBytesErr)
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+// compiledApplication holds the settings of an application that are parsed
+// when it is registered, so that a broken configuration fails the
+// registration instead of each request.
+type compiledApplication struct {
+	rewriter      *urlRewriter
+	headers       *headerTransform
+	scripts       *bodyTransform
+	mirror        *trafficMirror
+	retries       *retryPolicy
+	timeouts      *upstreamTimeouts
+	composite     *composite
+	flushInterval time.Duration
+}
+
+// compileApplication parses the settings of an application. Rewrite rules,
+// header rules, scripts, mirrors and composites are reused from a previous
+// registration if their configuration did not change.
+func (p *ProxyHandler) compileApplication(appName string, appCfg *config.Application) (*compiledApplication, error) {
+	var (
+		app compiledApplication
+		err error
+	)
+
+	if len(appCfg.Composite.Endpoints) > 0 {
+		if app.composite, err = p.composite(appName, &appCfg.Composite); err != nil {
+			return nil, err
+		}
+
+		for _, endpoint := range appCfg.Composite.Endpoints {
+			if _, err := p.clientFor(endpoint.Url, appCfg); err != nil {
+				return nil, err
+			}
+		}
+
+		return &app, nil
+	}
+
+	if appCfg.Static() {
+		return &app, nil
+	}
+
+	if app.rewriter, err = p.urlRewriter(appName, appCfg.Routing.Rewrites); err != nil {
+		return nil, fmt.Errorf("bad rewrite configuration: %s", err)
+	}
+
+	if app.headers, err = p.headerTransform(appName, &appCfg.Headers); err != nil {
+		return nil, fmt.Errorf("bad header configuration: %s", err)
+	}
+
+	if app.scripts, err = p.bodyTransform(appName, &appCfg.Body); err != nil {
+		return nil, fmt.Errorf("bad body transformation: %s", err)
+	}
+
+	if app.mirror, err = p.trafficMirror(appName, &appCfg.Backend.Mirror); err != nil {
+		return nil, fmt.Errorf("bad mirror configuration: %s", err)
+	}
+
+	if app.retries, err = newRetryPolicy(&appCfg.Retries); err != nil {
+		return nil, fmt.Errorf("bad retry configuration: %s", err)
+	}
+
+	if app.retries != nil {
+		app.retries.streamBodies = appCfg.RequestBody.Buffering == "stream"
+	}
+
+	if app.timeouts, err = newUpstreamTimeouts(&appCfg.Backend.Timeouts); err != nil {
+		return nil, fmt.Errorf("bad timeout configuration: %s", err)
+	}
+
+	interval := p.Config.Proxy.FlushInterval
+	if appCfg.Backend.FlushInterval != "" {
+		interval = appCfg.Backend.FlushInterval
+	}
+
+	if interval != "" {
+		if app.flushInterval, err = time.ParseDuration(interval); err != nil {
+			return nil, fmt.Errorf("invalid flush interval '%s': %s", interval, err)
+		}
+	}
+
+	return &app, nil
+}
+
+// compiledApplication returns the parsed settings of a registered
+// application.
+func (p *ProxyHandler) compiledApplication(appName string) (*compiledApplication, bool) {
+	p.balancerLock.Lock()
+	defer p.balancerLock.Unlock()
+
+	app, ok := p.compiled[appName]
+	return app, ok
+}
@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// compositeTemplateData is available to the templates of composite
+// responses.
+type compositeTemplateData struct {
+	Responses map[string]interface{}
+	Statuses  map[string]int
+	Params    map[string]string
+	Request   *http.Request
+}
+
+var compositeTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// composite requests the endpoints of a composite application and merges
+// their responses.
+type composite struct {
+	cfg         config.CompositeConfiguration
+	template    *template.Template
+	timeout     time.Duration
+	maxBodySize int64
+}
+
+// compositeResult is the response of an endpoint; a failed endpoint has an
+// error (and a nil body).
+type compositeResult struct {
+	name   string
+	status int
+	body   interface{}
+	err    error
+}
+
+func newComposite(cfg *config.CompositeConfiguration) (*composite, error) {
+	c := composite{
+		cfg:         *cfg,
+		timeout:     10 * time.Second,
+		maxBodySize: cfg.MaxBodySize,
+	}
+
+	for name, endpoint := range cfg.Endpoints {
+		if endpoint.Url == "" {
+			return nil, fmt.Errorf("composite.endpoints.%s.url must be set", name)
+		}
+	}
+
+	if cfg.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid composite timeout: %s", err)
+		}
+		c.timeout = timeout
+	}
+
+	if c.maxBodySize <= 0 {
+		c.maxBodySize = 1 << 20
+	}
+
+	if cfg.Template != "" {
+		t, err := template.New("composite").Funcs(compositeTemplateFuncs).Parse(cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid composite template: %s", err)
+		}
+		c.template = t
+	}
+
+	return &c, nil
+}
+
+// ValidateComposite checks the configuration of a composite application.
+func ValidateComposite(cfg *config.CompositeConfiguration) error {
+	_, err := newComposite(cfg)
+	return err
+}
+
+// composite returns the compiled configuration of a composite application.
+// It is only compiled again when the application's configuration changes.
+func (p *ProxyHandler) composite(appName string, cfg *config.CompositeConfiguration) (*composite, error) {
+	p.transformLock.Lock()
+	defer p.transformLock.Unlock()
+
+	if c, ok := p.composites[appName]; ok && reflect.DeepEqual(c.cfg, *cfg) {
+		return c, nil
+	}
+
+	c, err := newComposite(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	p.composites[appName] = c
+	return c, nil
+}
+
+// serveComposite requests the endpoints of a composite application in
+// parallel and answers the request with their merged responses. If an
+// endpoint that is not optional fails, the request fails with a 502 status;
+// optional endpoints that fail are `null` in the merged response.
+func (p *ProxyHandler) serveComposite(rw http.ResponseWriter, req *http.Request, appName string, c *composite, appCfg *config.Application) {
+	names := make([]string, 0, len(c.cfg.Endpoints))
+	for name := range c.cfg.Endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	client, err := p.clientFor(c.cfg.Endpoints[names[0]].Url, appCfg)
+	if err != nil {
+		p.Logger.Errorf("could not build HTTP client for application %s: %s", appName, err)
+		p.UnavailableError(rw, req, appName)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), c.timeout)
+	defer cancel()
+
+	params := RouteParams(req)
+	results := make([]compositeResult, len(names))
+
+	wg := sync.WaitGroup{}
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i] = c.request(ctx, client, req, name, params)
+		}(i, name)
+	}
+	wg.Wait()
+
+	data := compositeTemplateData{
+		Responses: make(map[string]interface{}, len(results)),
+		Statuses:  make(map[string]int, len(results)),
+		Params:    params,
+		Request:   req,
+	}
+
+	for _, result := range results {
+		if result.err != nil {
+			p.Logger.Warningf("composite endpoint %s of application %s failed: %s", result.name, appName, result.err)
+
+			if !c.cfg.Endpoints[result.name].Optional {
+				p.metrics.Errors.With(prometheus.Labels{"application": appName, "reason": "composite_failed"}).Inc()
+
+				rw.Header().Set("Content-Type", "application/json")
+				rw.WriteHeader(502)
+				_, _ = rw.Write([]byte(fmt.Sprintf("{\"msg\": \"bad gateway\", \"reason\": \"composite endpoint %s failed\"}", result.name)))
+				return
+			}
+		}
+
+		data.Responses[result.name] = result.body
+		data.Statuses[result.name] = result.status
+	}
+
+	var body []byte
+	if c.template != nil {
+		buf := bytes.Buffer{}
+		if err := c.template.Execute(&buf, &data); err != nil {
+			p.Logger.Errorf("error while rendering composite response of application %s: %s", appName, err)
+			p.TransformationError(rw, req, appName, 502)
+			return
+		}
+		body = buf.Bytes()
+	} else if body, err = json.Marshal(data.Responses); err != nil {
+		p.Logger.Errorf("error while encoding composite response of application %s: %s", appName, err)
+		p.TransformationError(rw, req, appName, 502)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(200)
+
+	if req.Method != "HEAD" {
+		_, _ = rw.Write(body)
+	}
+}
+
+// request requests an endpoint of a composite application and decodes its
+// JSON response.
+func (c *composite) request(ctx context.Context, client *http.Client, req *http.Request, name string, params map[string]string) compositeResult {
+	result := compositeResult{name: name}
+	endpoint := c.cfg.Endpoints[name]
+
+	endpointReq, err := http.NewRequestWithContext(ctx, "GET", expandRouteParams(endpoint.Url, params), nil)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	for _, header := range endpoint.ForwardHeaders {
+		for _, value := range req.Header.Values(header) {
+			endpointReq.Header.Add(header, value)
+		}
+	}
+
+	for header, value := range endpoint.Headers {
+		endpointReq.Header.Set(header, value)
+	}
+
+	endpointReq.Header.Set("Accept", "application/json")
+
+	res, err := send(client, endpointReq)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer res.Body.Close()
+
+	result.status = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		result.err = fmt.Errorf("unexpected status %d", res.StatusCode)
+		return result
+	}
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, c.maxBodySize+1))
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	if int64(len(b)) > c.maxBodySize {
+		result.err = fmt.Errorf("response exceeds %d bytes", c.maxBodySize)
+		return result
+	}
+
+	if err := json.Unmarshal(b, &result.body); err != nil {
+		result.body = nil
+		result.err = fmt.Errorf("invalid JSON response: %s", err)
+	}
+
+	return result
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/mittwald/servicegateway/compression"
+	"github.com/mittwald/servicegateway/config"
+)
+
+// needsPlainBody checks whether the gateway needs to read the uncompressed
+// response bodies of an application, in order to transform, cache or
+// compress them itself.
+func needsPlainBody(appCfg *config.Application) bool {
+	return appCfg.Compression.Decompress || appCfg.Compression.Enabled || appCfg.Caching.Enabled || appCfg.Body.Response != ""
+}
+
+// decompressResponse decompresses an upstream response body. Upstream
+// services may compress responses even if they were not asked to.
+func decompressResponse(res *http.Response) error {
+	encoding := res.Header.Get("Content-Encoding")
+	if !compression.CanDecode(encoding) {
+		return nil
+	}
+
+	body, err := compression.NewDecoder(encoding, res.Body)
+	if err == io.EOF {
+		// responses without a body (like to HEAD requests)
+		res.Body.Close()
+		body = http.NoBody
+	} else if err != nil {
+		return err
+	}
+
+	res.Body = body
+	res.ContentLength = -1
+	res.Uncompressed = true
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+
+	return nil
+}
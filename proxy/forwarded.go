@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mittwald/servicegateway/clientip"
+	"github.com/mittwald/servicegateway/config"
+)
+
+// forwardedHeaders sets the X-Forwarded-* (and optionally the RFC 7239
+// Forwarded) headers of upstream requests.
+type forwardedHeaders struct {
+	mode    string
+	rfc7239 bool
+	trusted []*net.IPNet
+}
+
+func newForwardedHeaders(cfg *config.ForwardedConfiguration) (*forwardedHeaders, error) {
+	f := forwardedHeaders{
+		mode:    cfg.Mode,
+		rfc7239: cfg.Rfc7239,
+	}
+
+	switch f.mode {
+	case "":
+		f.mode = "append"
+	case "append", "overwrite", "trusted":
+	default:
+		return nil, fmt.Errorf("unsupported forwarding mode '%s'", cfg.Mode)
+	}
+
+	trusted, err := clientip.ParseNetworks(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %s", err)
+	}
+	f.trusted = trusted
+
+	return &f, nil
+}
+
+func (f *forwardedHeaders) isTrusted(ip net.IP) bool {
+	for _, network := range f.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keepIncoming checks whether the forwarding headers sent by the client may
+// be passed on to the upstream service.
+func (f *forwardedHeaders) keepIncoming(req *http.Request) bool {
+	switch f.mode {
+	case "overwrite":
+		return false
+	case "trusted":
+		ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+		return f.isTrusted(net.ParseIP(ip))
+	}
+
+	return true
+}
+
+// Apply sets the forwarding headers of an upstream request. Incoming headers
+// are either extended with the client's address, or replaced entirely if the
+// client (or the proxy in front of the gateway) is not trusted to set them.
+func (f *forwardedHeaders) Apply(req *http.Request, proxyReq *http.Request) {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if !f.keepIncoming(req) {
+		proxyReq.Header.Del("X-Forwarded-For")
+		proxyReq.Header.Del("X-Forwarded-Proto")
+		proxyReq.Header.Del("X-Forwarded-Host")
+		proxyReq.Header.Del("Forwarded")
+	}
+
+	if forwardedFor := proxyReq.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		proxyReq.Header.Set("X-Forwarded-For", forwardedFor+", "+ip)
+	} else {
+		proxyReq.Header.Set("X-Forwarded-For", ip)
+	}
+
+	// protocol and host describe the original request, so they are only set
+	// by the first proxy
+	if proxyReq.Header.Get("X-Forwarded-Proto") == "" {
+		proxyReq.Header.Set("X-Forwarded-Proto", proto)
+	}
+
+	if proxyReq.Header.Get("X-Forwarded-Host") == "" {
+		proxyReq.Header.Set("X-Forwarded-Host", req.Host)
+	}
+
+	if f.rfc7239 {
+		element := fmt.Sprintf("for=%s;proto=%s;host=%s", forwardedNode(ip), proto, forwardedValue(req.Host))
+
+		if forwarded := strings.Join(proxyReq.Header.Values("Forwarded"), ", "); forwarded != "" {
+			proxyReq.Header.Set("Forwarded", forwarded+", "+element)
+		} else {
+			proxyReq.Header.Set("Forwarded", element)
+		}
+	}
+}
+
+// forwardedNode formats an IP address as a node of the Forwarded header;
+// IPv6 addresses need to be bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+
+	return forwardedValue(ip)
+}
+
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+
+	return value
+}
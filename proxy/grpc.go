@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+const (
+	grpcContentType        = "application/grpc"
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+)
+
+// isGrpcWebRequest checks whether a request was sent by a gRPC-Web client,
+// which needs to be translated into a gRPC request.
+func isGrpcWebRequest(req *http.Request, appCfg *config.Application) bool {
+	return appCfg.Grpc.Web && strings.HasPrefix(req.Header.Get("Content-Type"), grpcWebContentType)
+}
+
+// translateGrpcWebRequest turns a gRPC-Web request into a gRPC request. It
+// returns whether the client uses the base64-encoded text format.
+func translateGrpcWebRequest(proxyReq *http.Request) bool {
+	contentType := proxyReq.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, grpcWebTextContentType)
+
+	if text {
+		proxyReq.Body = io.NopCloser(base64.NewDecoder(base64.StdEncoding, proxyReq.Body))
+		contentType = grpcContentType + strings.TrimPrefix(contentType, grpcWebTextContentType)
+	} else {
+		contentType = grpcContentType + strings.TrimPrefix(contentType, grpcWebContentType)
+	}
+
+	proxyReq.ContentLength = -1
+	proxyReq.Header.Del("Content-Length")
+	proxyReq.Header.Del("X-Grpc-Web")
+	proxyReq.Header.Set("Content-Type", contentType)
+	proxyReq.Header.Set("Te", "trailers")
+
+	return text
+}
+
+// grpcWebResponseWriter translates a gRPC response body into the gRPC-Web
+// format, base64-encoding it for text clients. Each write is encoded on its
+// own, so that it can be flushed to the client immediately.
+type grpcWebResponseWriter struct {
+	http.ResponseWriter
+	text bool
+}
+
+func newGrpcWebResponseWriter(rw http.ResponseWriter, res *http.Response, text bool) *grpcWebResponseWriter {
+	contentType := grpcWebContentType
+	if text {
+		contentType = grpcWebTextContentType
+	}
+
+	rw.Header().Set("Content-Type", contentType+strings.TrimPrefix(res.Header.Get("Content-Type"), grpcContentType))
+	rw.Header().Del("Content-Length")
+
+	return &grpcWebResponseWriter{ResponseWriter: rw, text: text}
+}
+
+func (w *grpcWebResponseWriter) Write(b []byte) (int, error) {
+	if !w.text {
+		return w.ResponseWriter.Write(b)
+	}
+
+	if _, err := w.ResponseWriter.Write([]byte(base64.StdEncoding.EncodeToString(b))); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (w *grpcWebResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// WriteTrailers sends the gRPC trailers (like the grpc-status) as a
+// trailer frame at the end of the response body, since browsers cannot
+// access HTTP trailers.
+func (w *grpcWebResponseWriter) WriteTrailers(trailers http.Header) error {
+	if len(trailers) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(trailers))
+	for key := range trailers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	block := strings.Builder{}
+	for _, key := range keys {
+		for _, value := range trailers[key] {
+			block.WriteString(strings.ToLower(key) + ": " + value + "\r\n")
+		}
+	}
+
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = 0x80
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	frame = append(frame, block.String()...)
+
+	_, err := w.Write(frame)
+	return err
+}
@@ -21,14 +21,19 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"errors"
-	"net"
+	"io"
+	"mime"
 	"net/http"
-	"net/url"
+	"sync"
 	"time"
 
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/health"
+	"github.com/mittwald/servicegateway/httplogging"
 	"github.com/mittwald/servicegateway/monitoring"
+	"github.com/mittwald/servicegateway/tracing"
 	logging "github.com/op/go-logging"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -40,26 +45,120 @@ type ProxyHandler struct {
 	Logger *logging.Logger
 	Config *config.Configuration
 
-	metrics *monitoring.PromMetrics
+	upstreams *upstreamClients
+	health    *health.Monitor
+	metrics   *monitoring.PromMetrics
+	forwarded *forwardedHeaders
+
+	balancers    map[string]*balancer
+	splits       map[string]*trafficSplit
+	applications map[string]ApplicationStatus
+	compiled     map[string]*compiledApplication
+	balancerLock sync.Mutex
+
+	// watches are the health checks of the registered applications. They
+	// are only started once the handler is active, so that a handler that
+	// is built for a new configuration does not affect the current one.
+	watches map[string]healthWatch
+	active  bool
+	retired bool
+
+	// the applications of the handler that this one was derived from
+	previous map[string]ApplicationStatus
+
+	// applications that were disabled or put into maintenance at runtime;
+	// shared with the handlers derived from this one
+	disabled     map[string]bool
+	maintenance  map[string]bool
+	disabledLock *sync.RWMutex
+
+	transforms    map[string]*headerTransform
+	rewrites      map[string]*urlRewriter
+	scripts       map[string]*bodyTransform
+	composites    map[string]*composite
+	transformLock sync.Mutex
+
+	budgets    map[string]*retryBudget
+	budgetLock sync.Mutex
+
+	mirrors    map[string]*trafficMirror
+	mirrorLock sync.Mutex
 }
 
 func NewProxyHandler(logger *logging.Logger, config *config.Configuration, metrics *monitoring.PromMetrics) *ProxyHandler {
 	transport := &http.Transport{}
 	client := &http.Client{
-		Transport: transport,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return redirectRequest
-		},
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}
+
+	p := newProxyHandler(logger, config, metrics, client, newUpstreamClients(), health.NewMonitor(metrics, logging.MustGetLogger("health")))
+	p.active = true
+	p.disabled = make(map[string]bool)
+	p.maintenance = make(map[string]bool)
+	p.disabledLock = &sync.RWMutex{}
+
+	return p
+}
+
+func newProxyHandler(logger *logging.Logger, config *config.Configuration, metrics *monitoring.PromMetrics, client *http.Client, upstreams *upstreamClients, monitor *health.Monitor) *ProxyHandler {
+	// unless configured otherwise, the proxies that are trusted to report
+	// client addresses may also forward the other headers
+	forwardedCfg := config.Proxy.Forwarded
+	if len(forwardedCfg.TrustedProxies) == 0 {
+		forwardedCfg.TrustedProxies = config.ClientIP.TrustedProxies
+	}
+
+	forwarded, err := newForwardedHeaders(&forwardedCfg)
+	if err != nil {
+		logger.Errorf("bad forwarding configuration, falling back to overwriting forwarding headers: %s", err)
+		forwarded = &forwardedHeaders{mode: "overwrite"}
 	}
 
 	return &ProxyHandler{
-		Client:  client,
-		Logger:  logger,
-		Config:  config,
-		metrics: metrics,
+		Client:       client,
+		Logger:       logger,
+		Config:       config,
+		upstreams:    upstreams,
+		health:       monitor,
+		metrics:      metrics,
+		forwarded:    forwarded,
+		balancers:    make(map[string]*balancer),
+		splits:       make(map[string]*trafficSplit),
+		applications: make(map[string]ApplicationStatus),
+		compiled:     make(map[string]*compiledApplication),
+		watches:      make(map[string]healthWatch),
+		transforms:   make(map[string]*headerTransform),
+		rewrites:     make(map[string]*urlRewriter),
+		scripts:      make(map[string]*bodyTransform),
+		composites:   make(map[string]*composite),
+		budgets:      make(map[string]*retryBudget),
+		mirrors:      make(map[string]*trafficMirror),
 	}
 }
 
+// Derive returns a handler for a new configuration, which applications can
+// be registered with while this handler keeps serving requests. Both share
+// the connections to the upstreams, the health monitor and the applications
+// that were disabled or put into maintenance at runtime. The health checks
+// of the new handler are only started once it is activated.
+func (p *ProxyHandler) Derive(config *config.Configuration) *ProxyHandler {
+	derived := newProxyHandler(p.Logger, config, p.metrics, p.Client, p.upstreams, p.health)
+
+	p.balancerLock.Lock()
+	derived.previous = make(map[string]ApplicationStatus, len(p.applications))
+	for name, app := range p.applications {
+		derived.previous[name] = app
+	}
+	p.balancerLock.Unlock()
+
+	derived.disabled = p.disabled
+	derived.maintenance = p.maintenance
+	derived.disabledLock = p.disabledLock
+
+	return derived
+}
+
 func (p *ProxyHandler) UnavailableError(rw http.ResponseWriter, req *http.Request, appName string) {
 	p.metrics.Errors.With(prometheus.Labels{"application": appName, "reason": "upstream_unavailable"}).Inc()
 
@@ -68,17 +167,130 @@ func (p *ProxyHandler) UnavailableError(rw http.ResponseWriter, req *http.Reques
 	_, _ = rw.Write([]byte("{\"msg\": \"service unavailable\", \"reason\": \"no can do; sorry.\"}"))
 }
 
-func (p *ProxyHandler) HandleProxyRequest(rw http.ResponseWriter, req *http.Request, targetUrl string, appName string, appCfg *config.Application) {
+func (p *ProxyHandler) BodyTooLargeError(rw http.ResponseWriter, req *http.Request, appName string) {
+	p.metrics.Errors.With(prometheus.Labels{"application": appName, "reason": "body_too_large"}).Inc()
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(413)
+	_, _ = rw.Write([]byte("{\"msg\": \"request entity too large\"}"))
+}
+
+func (p *ProxyHandler) TransformationError(rw http.ResponseWriter, req *http.Request, appName string, status int) {
+	p.metrics.Errors.With(prometheus.Labels{"application": appName, "reason": "transformation_failed"}).Inc()
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_, _ = rw.Write([]byte("{\"msg\": \"body transformation failed\"}"))
+}
+
+// Health returns the health monitor of the upstream services.
+func (p *ProxyHandler) Health() *health.Monitor {
+	return p.health
+}
+
+// HandleProxyRequest proxies a request to one of an application's upstream
+// services; the target path is appended to the upstream's URL.
+func (p *ProxyHandler) HandleProxyRequest(rw http.ResponseWriter, req *http.Request, targetPath string, appName string, appCfg *config.Application) {
 	var totalStart, upstreamStart time.Time
 
 	totalStart = time.Now()
 
-	proxyReq, err := http.NewRequest(req.Method, targetUrl, req.Body)
+	details := httplogging.DetailsFromRequest(req)
+	if details != nil {
+		details.Application = appName
+	}
+
+	if appCfg.Static() {
+		p.serveStatic(rw, req, appCfg)
+		return
+	}
+
+	app, ok := p.compiledApplication(appName)
+	if !ok {
+		p.Logger.Errorf("application %s is not registered", appName)
+		p.UnavailableError(rw, req, appName)
+		return
+	}
+
+	if app.composite != nil {
+		p.serveComposite(rw, req, appName, app.composite, appCfg)
+		return
+	}
+
+	// preflight requests are answered by the application's CORS policy;
+	// gRPC servers cannot handle them
+	if appCfg.Grpc.Web && req.Method == "OPTIONS" {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(403)
+		_, _ = rw.Write([]byte(`{"msg":"cross-origin request not allowed"}`))
+		return
+	}
+
+	// rewrite rules match the path that was requested from the gateway, and
+	// replace the path that the application's routing would use
+	rawQuery := req.URL.RawQuery
+
+	if app.rewriter != nil {
+		if path, query, ok := app.rewriter.Rewrite(req.URL.Path, rawQuery, RouteParams(req)); ok {
+			targetPath, rawQuery = path, query
+		}
+	}
+
+	b, ok := p.balancer(req, appName)
+	if !ok {
+		p.Logger.Errorf("no upstreams registered for application %s", appName)
+		p.UnavailableError(rw, req, appName)
+		return
+	}
+
+	// fail fast instead of waiting for unhealthy upstreams to time out
+	upstreamUrl, release, err := b.Pick(req)
+	if err == errNoHealthyUpstream {
+		p.metrics.Errors.With(prometheus.Labels{"application": appName, "reason": "upstream_unhealthy"}).Inc()
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(503)
+		_, _ = rw.Write([]byte("{\"msg\": \"service unavailable\", \"reason\": \"no healthy upstream\"}"))
+		return
+	} else if err == errQueueFull || err == errQueueTimeout {
+		p.metrics.Errors.With(prometheus.Labels{"application": appName, "reason": "concurrency_limit"}).Inc()
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(503)
+		_, _ = rw.Write([]byte("{\"msg\": \"service unavailable\", \"reason\": \"" + err.Error() + "\"}"))
+		return
+	} else if err != nil {
+		// the client went away while waiting for a free upstream
+		return
+	}
+
+	defer release()
+
+	if details != nil {
+		details.Upstream = upstreamUrl
+	}
+
+	targetUrl := upstreamUrl + targetPath
+
+	// the upstream request is cancelled when the client goes away, so that
+	// long-lived streams are not kept open needlessly
+	proxyReq, err := http.NewRequestWithContext(req.Context(), req.Method, targetUrl, req.Body)
 	if err != nil {
 		p.UnavailableError(rw, req, appName)
 		return
 	}
 
+	proxyReq.ContentLength = req.ContentLength
+
+	if err := prepareRequestBody(rw, proxyReq, &appCfg.RequestBody); isBodyTooLarge(err) {
+		p.BodyTooLargeError(rw, req, appName)
+		return
+	} else if err != nil {
+		p.Logger.Errorf("could not read request body for application %s: %s", appName, err)
+		p.UnavailableError(rw, req, appName)
+		return
+	}
+
 	for header, values := range req.Header {
 		for _, value := range values {
 			proxyReq.Header.Add(header, value)
@@ -87,14 +299,7 @@ func (p *ProxyHandler) HandleProxyRequest(rw http.ResponseWriter, req *http.Requ
 
 	proxyReq.Header.Set("Host", req.Host)
 
-	forwardedFor := req.Header.Get("X-Forwarded-For")
-	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
-
-	if forwardedFor != "" {
-		proxyReq.Header.Set("X-Forwarded-For", forwardedFor+", "+ip)
-	} else {
-		proxyReq.Header.Set("X-Forwarded-For", ip)
-	}
+	p.forwarded.Apply(req, proxyReq)
 
 	for header, value := range p.Config.Proxy.SetRequestHeaders {
 		proxyReq.Header.Set(header, value)
@@ -104,21 +309,123 @@ func (p *ProxyHandler) HandleProxyRequest(rw http.ResponseWriter, req *http.Requ
 		proxyReq.SetBasicAuth(appCfg.Backend.Username, appCfg.Backend.Password)
 	}
 
-	proxyReq.URL.RawQuery = req.URL.RawQuery
+	proxyReq.URL.RawQuery = rawQuery
+
+	// bodies that the gateway needs to read are requested uncompressed
+	plainBody := needsPlainBody(appCfg)
+	if plainBody {
+		proxyReq.Header.Del("Accept-Encoding")
+	}
+
+	transform := app.headers
+	templateData := headerTemplateData{
+		Application: appName,
+		Upstream:    upstreamUrl,
+		Start:       totalStart,
+		Request:     req,
+		Params:      RouteParams(req),
+	}
+
+	if transform != nil {
+		if err := applyHeaderRules(transform.request, proxyReq.Header, &templateData); err != nil {
+			p.Logger.Errorf("could not transform request headers for application %s: %s", appName, err)
+			p.UnavailableError(rw, req, appName)
+			return
+		}
+	}
+
+	client, err := p.clientFor(targetUrl, appCfg)
+	if err != nil {
+		p.Logger.Errorf("could not build HTTP client for application %s: %s", appName, err)
+		p.UnavailableError(rw, req, appName)
+		return
+	}
+
+	grpcWeb, grpcWebText := false, false
+
+	if appCfg.Grpc.Enabled {
+		// HTTP/2 does not allow connection-specific headers
+		for _, header := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Upgrade"} {
+			proxyReq.Header.Del(header)
+		}
+
+		if isGrpcWebRequest(req, appCfg) {
+			grpcWeb = true
+			grpcWebText = translateGrpcWebRequest(proxyReq)
+		}
+	}
+
+	scripts := app.scripts
+	if scripts != nil {
+		if err := scripts.TransformRequest(req, proxyReq); isBodyTooLarge(err) {
+			p.BodyTooLargeError(rw, req, appName)
+			return
+		} else if err != nil {
+			p.Logger.Errorf("could not transform request body for application %s: %s", appName, err)
+			p.TransformationError(rw, req, appName, 500)
+			return
+		}
+	}
+
+	if app.mirror != nil {
+		p.mirrorRequest(app.mirror, proxyReq, targetPath, appName, appCfg)
+	}
+
+	proxyReq, span := tracing.StartUpstream(proxyReq, appName)
+	defer span.End()
+
+	if app.timeouts != nil {
+		var cancelTimeouts context.CancelFunc
+		proxyReq, cancelTimeouts = app.timeouts.apply(proxyReq)
+		defer cancelTimeouts()
+	}
 
 	upstreamStart = time.Now()
 
-	proxyRes, err := p.Client.Do(proxyReq)
+	proxyRes, cancel, err := p.doRequest(client, proxyReq, proxyReq.ContentLength, appName, app.retries)
+	tracing.EndUpstream(span, proxyRes, err)
+
 	if err != nil {
-		if uerr, ok := err.(*url.Error); !ok || uerr.Err != redirectRequest {
-			p.Logger.Errorf("could not proxy request to %s: %s", targetUrl, uerr)
-			p.UnavailableError(rw, req, appName)
+		if isBodyTooLarge(err) {
+			p.BodyTooLargeError(rw, req, appName)
 			return
 		}
+
+		if cause := timeoutCause(proxyReq); cause != nil || err == perTryTimeout {
+			if cause == nil {
+				cause = err
+			}
+
+			p.Logger.Warningf("request to %s timed out: %s", targetUrl, cause)
+			p.TimeoutError(rw, req, appName, cause)
+			return
+		}
+
+		p.Logger.Errorf("could not proxy request to %s: %s", targetUrl, err)
+		p.UnavailableError(rw, req, appName)
+		return
 	}
 
+	defer cancel()
+
 	p.metrics.UpstreamResponseTimes.With(prometheus.Labels{"application": appName}).Observe(time.Since(upstreamStart).Seconds())
 
+	if plainBody {
+		if err := decompressResponse(proxyRes); err != nil {
+			p.Logger.Errorf("could not decompress response of %s: %s", targetUrl, err)
+			p.TransformationError(rw, req, appName, 502)
+			return
+		}
+	}
+
+	if scripts != nil {
+		if err := scripts.TransformResponse(req, proxyRes); err != nil {
+			p.Logger.Errorf("could not transform response body of %s: %s", targetUrl, err)
+			p.TransformationError(rw, req, appName, 502)
+			return
+		}
+	}
+
 	for header, values := range proxyRes.Header {
 		if _, ok := p.Config.Proxy.StripResponseHeaders[header]; ok {
 			continue
@@ -133,15 +440,131 @@ func (p *ProxyHandler) HandleProxyRequest(rw http.ResponseWriter, req *http.Requ
 		rw.Header().Set(header, value)
 	}
 
-	rw.WriteHeader(proxyRes.StatusCode)
+	if transform != nil {
+		templateData.Response = proxyRes
+		if err := applyHeaderRules(transform.response, rw.Header(), &templateData); err != nil {
+			p.Logger.Errorf("could not transform response headers for application %s: %s", appName, err)
+		}
+	}
+
+	var body http.ResponseWriter = rw
+	var grpcWebWriter *grpcWebResponseWriter
+
+	if grpcWeb {
+		grpcWebWriter = newGrpcWebResponseWriter(rw, proxyRes, grpcWebText)
+		body = grpcWebWriter
+	}
 
-	reader := bufio.NewReader(proxyRes.Body)
-	_, err = reader.WriteTo(rw)
+	rw.WriteHeader(proxyRes.StatusCode)
 
 	defer proxyRes.Body.Close()
+	err = p.copyResponse(body, proxyRes.Body, flushInterval(proxyRes, app.flushInterval))
+
+	// gRPC servers send the call status in trailers, which are only
+	// available after the body has been read
+	if err == nil && grpcWebWriter != nil {
+		err = grpcWebWriter.WriteTrailers(proxyRes.Trailer)
+	} else if err == nil && appCfg.Grpc.Enabled {
+		for header, values := range proxyRes.Trailer {
+			for _, value := range values {
+				rw.Header().Add(http.TrailerPrefix+header, value)
+			}
+		}
+	}
+
 	p.metrics.TotalResponseTimes.With(prometheus.Labels{"application": appName}).Observe(time.Since(totalStart).Seconds())
 
-	if err != nil {
+	// clients closing a stream are not an error
+	if err != nil && req.Context().Err() == nil {
 		p.Logger.Errorf("error while writing response body: %s", err)
 	}
 }
+
+// flushInterval determines how often the response body is flushed to the
+// client while it is copied. Event streams and responses of unknown length
+// (like chunked long-poll responses) are flushed after each write; for all
+// other responses, the configured interval is used. Zero disables flushing
+// (the response is flushed by the HTTP server when its buffer is full).
+func flushInterval(res *http.Response, configured time.Duration) time.Duration {
+	if mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return -1
+	}
+
+	if res.ContentLength == -1 {
+		return -1
+	}
+
+	return configured
+}
+
+// copyResponse copies an upstream response body to the client, flushing it
+// in the given interval. A negative interval flushes after each write.
+func (p *ProxyHandler) copyResponse(rw http.ResponseWriter, body io.Reader, flushInterval time.Duration) error {
+	flusher, ok := rw.(http.Flusher)
+	if !ok || flushInterval == 0 {
+		_, err := bufio.NewReader(body).WriteTo(rw)
+		return err
+	}
+
+	var lock sync.Mutex
+
+	if flushInterval > 0 {
+		ticker := time.NewTicker(flushInterval)
+		done := make(chan struct{})
+		stopped := false
+
+		// the response writer must not be flushed anymore once the handler
+		// has returned
+		defer func() {
+			lock.Lock()
+			stopped = true
+			lock.Unlock()
+
+			ticker.Stop()
+			close(done)
+		}()
+
+		go func() {
+			for {
+				select {
+				case <-ticker.C:
+					lock.Lock()
+					if !stopped {
+						flusher.Flush()
+					}
+					lock.Unlock()
+				case <-done:
+					return
+				}
+			}
+		}()
+	} else {
+		// send the response headers right away; event streams may take a
+		// while until the first event is sent
+		flusher.Flush()
+	}
+
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			lock.Lock()
+			_, writeErr := rw.Write(buf[:n])
+			if writeErr == nil && flushInterval < 0 {
+				flusher.Flush()
+			}
+			lock.Unlock()
+
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+}
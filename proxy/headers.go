@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+// headerTemplateData is available to the templates of header values.
+type headerTemplateData struct {
+	Application string
+	Upstream    string
+	Start       time.Time
+	Request     *http.Request
+	Response    *http.Response
+	Params      map[string]string
+}
+
+type headerRule struct {
+	action   string
+	name     string
+	to       string
+	value    string
+	template *template.Template
+	pattern  *regexp.Regexp
+}
+
+type headerTransform struct {
+	cfg      config.HeaderTransformation
+	request  []headerRule
+	response []headerRule
+}
+
+func compileHeaderRules(rules []config.HeaderRule) ([]headerRule, error) {
+	compiled := make([]headerRule, len(rules))
+
+	for i, rule := range rules {
+		r := headerRule{
+			action: rule.Action,
+			name:   http.CanonicalHeaderKey(rule.Name),
+			to:     http.CanonicalHeaderKey(rule.To),
+			value:  rule.Value,
+		}
+
+		if r.name == "" {
+			return nil, fmt.Errorf("header rule %d has no header name", i)
+		}
+
+		switch r.action {
+		case "set", "add":
+			if strings.Contains(rule.Value, "{{") {
+				t, err := template.New(r.name).Parse(rule.Value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid template for header %s: %s", r.name, err)
+				}
+				r.template = t
+			}
+		case "remove":
+		case "rename":
+			if r.to == "" {
+				return nil, fmt.Errorf("header rule %d renames %s, but has no new name", i, r.name)
+			}
+		case "replace":
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern for header %s: %s", r.name, err)
+			}
+			r.pattern = pattern
+		default:
+			return nil, fmt.Errorf("unsupported header action '%s'", r.action)
+		}
+
+		compiled[i] = r
+	}
+
+	return compiled, nil
+}
+
+// headerTransform returns the compiled header rules of an application. They
+// are only compiled again when the application's configuration changes.
+func (p *ProxyHandler) headerTransform(appName string, cfg *config.HeaderTransformation) (*headerTransform, error) {
+	if len(cfg.Request) == 0 && len(cfg.Response) == 0 {
+		return nil, nil
+	}
+
+	p.transformLock.Lock()
+	defer p.transformLock.Unlock()
+
+	if transform, ok := p.transforms[appName]; ok && reflect.DeepEqual(transform.cfg, *cfg) {
+		return transform, nil
+	}
+
+	request, err := compileHeaderRules(cfg.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := compileHeaderRules(cfg.Response)
+	if err != nil {
+		return nil, err
+	}
+
+	transform := &headerTransform{cfg: *cfg, request: request, response: response}
+	p.transforms[appName] = transform
+
+	return transform, nil
+}
+
+// applyHeaderRules applies header rules to a set of headers, in the order
+// in which they are configured.
+func applyHeaderRules(rules []headerRule, header http.Header, data *headerTemplateData) error {
+	for _, rule := range rules {
+		value := rule.value
+		if rule.template != nil {
+			buf := bytes.Buffer{}
+			if err := rule.template.Execute(&buf, data); err != nil {
+				return fmt.Errorf("error while rendering header %s: %s", rule.name, err)
+			}
+			value = buf.String()
+		}
+
+		switch rule.action {
+		case "set":
+			header.Set(rule.name, value)
+		case "add":
+			header.Add(rule.name, value)
+		case "remove":
+			header.Del(rule.name)
+		case "rename":
+			if values, ok := header[rule.name]; ok {
+				header.Del(rule.name)
+				header[rule.to] = values
+			}
+		case "replace":
+			for i, v := range header[rule.name] {
+				header[rule.name][i] = rule.pattern.ReplaceAllString(v, rule.value)
+			}
+		}
+	}
+
+	return nil
+}
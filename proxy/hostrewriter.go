@@ -1,7 +1,6 @@
 package proxy
 
 import (
-	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -96,42 +95,112 @@ func (j *JsonHostRewriter) Decorate(handler httprouter.Handle) httprouter.Handle
 
 		req.Header.Del("Accept-Encoding")
 
-		recorder := httptest.NewRecorder()
-		handler(recorder, req, params)
+		writer := &rewritingResponseWriter{
+			rewriter:  j,
+			target:    rw,
+			publicUrl: &publicUrl,
+			header:    make(http.Header),
+		}
+
+		handler(writer, req, params)
+
+		if !writer.wroteHeader {
+			writer.WriteHeader(200)
+		}
+
+		recorder := writer.recorder
+		if recorder == nil {
+			return
+		}
 
-		if j.CanHandle(recorder) {
-			b, err := ioutil.ReadAll(recorder.Body)
+		b, err := ioutil.ReadAll(recorder.Body)
+		if err != nil {
+			j.Logger.Errorf("error while reading response body: %s", err)
+			rw.WriteHeader(500)
+			_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
+		}
+
+		if req.Method != "HEAD" {
+			b, err = j.Rewrite(b, &publicUrl)
 			if err != nil {
-				j.Logger.Errorf("error while reading response body: %s", err)
+				j.Logger.Errorf("error while rewriting response body: %s", err)
 				rw.WriteHeader(500)
 				_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
+				return
 			}
+		}
 
-			if req.Method != "HEAD" {
-				b, err = j.Rewrite(b, &publicUrl)
-				if err != nil {
-					j.Logger.Errorf("error while rewriting response body: %s", err)
-					rw.WriteHeader(500)
-					_, _ = rw.Write([]byte(`{"msg":"internal server error"}`))
-					return
-				}
-			}
+		j.copyAndRewriteHeaders(recorder, rw, &publicUrl)
 
-			j.copyAndRewriteHeaders(recorder, rw, &publicUrl)
+		rw.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		rw.WriteHeader(recorder.Code)
+		_, _ = rw.Write(b)
+	}
+}
 
-			rw.Header().Set("Content-Length", strconv.Itoa(len(b)))
-			rw.WriteHeader(recorder.Code)
-			_, _ = rw.Write(b)
-		} else {
-			j.copyAndRewriteHeaders(recorder, rw, &publicUrl)
-			rw.WriteHeader(recorder.Code)
-			reader := bufio.NewReader(recorder.Body)
-			_, err := reader.WriteTo(rw)
+// rewritingResponseWriter buffers JSON responses, so that the URLs contained
+// in them can be rewritten. All other responses are passed through to the
+// client as they are written (only their Location header is rewritten), so
+// that streaming responses like server-sent events are not held back.
+type rewritingResponseWriter struct {
+	rewriter    *JsonHostRewriter
+	target      http.ResponseWriter
+	publicUrl   *url.URL
+	header      http.Header
+	recorder    *httptest.ResponseRecorder
+	wroteHeader bool
+}
 
-			if err != nil {
-				j.Logger.Errorf("error while writing response body after rewriting: %s", err)
-			}
+func (w *rewritingResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *rewritingResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	if w.rewriter.CanHandle(w) {
+		w.recorder = httptest.NewRecorder()
+		for k, values := range w.header {
+			w.recorder.Header()[k] = values
 		}
+		w.recorder.WriteHeader(code)
+		return
+	}
+
+	w.rewriter.copyAndRewriteHeaders(w, w.target, w.publicUrl)
+	w.target.WriteHeader(code)
+
+	// headers that are set after the response has been started are trailers
+	w.header = w.target.Header()
+}
+
+func (w *rewritingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+
+	if w.recorder != nil {
+		return w.recorder.Write(b)
+	}
+
+	return w.target.Write(b)
+}
+
+func (w *rewritingResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+
+	if w.recorder != nil {
+		return
+	}
+
+	if flusher, ok := w.target.(http.Flusher); ok {
+		flusher.Flush()
 	}
 }
 
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// trafficMirror duplicates a share of an application's requests to a shadow
+// backend. Mirrored requests are sent in the background and their responses
+// are discarded; they never affect the response to the client.
+type trafficMirror struct {
+	cfg         config.MirrorConfiguration
+	timeout     time.Duration
+	maxBodySize int64
+	slots       chan struct{}
+}
+
+// trafficMirror returns the traffic mirror of an application. It is only
+// created again when the application's configuration changes, so that the
+// limit of concurrent mirrored requests is shared between requests.
+func (p *ProxyHandler) trafficMirror(appName string, cfg *config.MirrorConfiguration) (*trafficMirror, error) {
+	if cfg.Url == "" || cfg.Percentage <= 0 {
+		return nil, nil
+	}
+
+	p.mirrorLock.Lock()
+	defer p.mirrorLock.Unlock()
+
+	if mirror, ok := p.mirrors[appName]; ok && mirror.cfg == *cfg {
+		return mirror, nil
+	}
+
+	mirror := trafficMirror{
+		cfg:         *cfg,
+		timeout:     10 * time.Second,
+		maxBodySize: cfg.MaxBodySize,
+	}
+
+	if cfg.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror timeout: %s", err)
+		}
+		mirror.timeout = timeout
+	}
+
+	if mirror.maxBodySize <= 0 {
+		mirror.maxBodySize = 1 << 20
+	}
+
+	maxConcurrent := cfg.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = 100
+	}
+	mirror.slots = make(chan struct{}, maxConcurrent)
+
+	p.mirrors[appName] = &mirror
+	return &mirror, nil
+}
+
+func (m *trafficMirror) sample() bool {
+	return m.cfg.Percentage >= 100 || rand.Float64()*100 < m.cfg.Percentage
+}
+
+// mirrorBody returns a copy of the body of an upstream request. Bodies that
+// are not buffered already are read into memory and replaced; if they
+// exceed the maximum size, the request is not mirrored.
+func (m *trafficMirror) mirrorBody(proxyReq *http.Request) ([]byte, bool) {
+	if proxyReq.Body == nil || proxyReq.Body == http.NoBody {
+		return nil, true
+	}
+
+	if proxyReq.GetBody != nil {
+		body, err := proxyReq.GetBody()
+		if err != nil {
+			return nil, false
+		}
+		defer body.Close()
+
+		b, err := ioutil.ReadAll(body)
+		return b, err == nil
+	}
+
+	original := proxyReq.Body
+	b, err := ioutil.ReadAll(io.LimitReader(original, m.maxBodySize+1))
+
+	if err != nil || int64(len(b)) > m.maxBodySize {
+		// the upstream request still gets the entire body (or the same
+		// error when reading it)
+		proxyReq.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), original), original}
+		return nil, false
+	}
+
+	proxyReq.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(b), original}
+	return b, true
+}
+
+// mirrorRequest sends a copy of an upstream request to the shadow backend,
+// if the request was selected for mirroring.
+func (p *ProxyHandler) mirrorRequest(m *trafficMirror, proxyReq *http.Request, targetPath string, appName string, appCfg *config.Application) {
+	if !m.sample() {
+		return
+	}
+
+	mirrored := p.metrics.MirroredRequests.MustCurryWith(prometheus.Labels{"application": appName})
+
+	body, ok := m.mirrorBody(proxyReq)
+	if !ok {
+		mirrored.With(prometheus.Labels{"result": "dropped"}).Inc()
+		return
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		mirrored.With(prometheus.Labels{"result": "dropped"}).Inc()
+		return
+	}
+
+	mirrorUrl := m.cfg.Url + targetPath
+
+	client, err := p.clientFor(mirrorUrl, appCfg)
+	if err != nil {
+		<-m.slots
+		p.Logger.Errorf("could not build HTTP client for mirror of application %s: %s", appName, err)
+		mirrored.With(prometheus.Labels{"result": "failed"}).Inc()
+		return
+	}
+
+	header := proxyReq.Header.Clone()
+	method := proxyReq.Method
+	rawQuery := proxyReq.URL.RawQuery
+
+	go func() {
+		defer func() { <-m.slots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, method, mirrorUrl, bytes.NewReader(body))
+		if err != nil {
+			p.Logger.Warningf("could not mirror request to %s: %s", mirrorUrl, err)
+			mirrored.With(prometheus.Labels{"result": "failed"}).Inc()
+			return
+		}
+
+		req.Header = header
+		req.URL.RawQuery = rawQuery
+
+		res, err := send(client, req)
+		if err != nil {
+			p.Logger.Warningf("could not mirror request to %s: %s", mirrorUrl, err)
+			mirrored.With(prometheus.Labels{"result": "failed"}).Inc()
+			return
+		}
+
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+
+		mirrored.With(prometheus.Labels{"result": "sent"}).Inc()
+	}()
+}
@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey int
+
+const routeParamsContextKey contextKey = iota
+
+// WithRouteParams returns a copy of a request that carries the named
+// parameters of the route pattern that it matched (like `id` of
+// `/users/:id`), so that rewrite rules and header templates can use them.
+func WithRouteParams(req *http.Request, params map[string]string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), routeParamsContextKey, params))
+}
+
+// RouteParams returns the named parameters of the route pattern that a
+// request matched, if any.
+func RouteParams(req *http.Request) map[string]string {
+	params, _ := req.Context().Value(routeParamsContextKey).(map[string]string)
+	return params
+}
@@ -0,0 +1,350 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// request bodies up to this size are buffered, so that they can be sent
+// again; requests with larger bodies are not retried
+const maxRetryBodySize = 1 << 20
+
+var perTryTimeout = errors.New("per-try timeout exceeded")
+
+type retryPolicy struct {
+	attempts      int
+	methods       map[string]bool
+	statuses      map[int]bool
+	backoff       time.Duration
+	maxBackoff    time.Duration
+	perTryTimeout time.Duration
+	budget        config.RetryBudgetConfiguration
+
+	// requests with a body are not retried if the body is streamed
+	streamBodies bool
+}
+
+// newRetryPolicy parses an application's retry configuration. It returns
+// nil if retries are disabled.
+func newRetryPolicy(cfg *config.RetryConfiguration) (*retryPolicy, error) {
+	if cfg.Attempts <= 0 {
+		return nil, nil
+	}
+
+	policy := retryPolicy{
+		attempts:   cfg.Attempts,
+		methods:    make(map[string]bool),
+		statuses:   make(map[int]bool),
+		backoff:    25 * time.Millisecond,
+		maxBackoff: 250 * time.Millisecond,
+		budget:     cfg.Budget,
+	}
+
+	methods := cfg.Methods
+	if len(methods) == 0 {
+		methods = []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE"}
+	}
+
+	for _, method := range methods {
+		policy.methods[strings.ToUpper(method)] = true
+	}
+
+	statuses := cfg.Statuses
+	if len(statuses) == 0 {
+		statuses = []int{502, 503, 504}
+	}
+
+	for _, status := range statuses {
+		policy.statuses[status] = true
+	}
+
+	durations := []struct {
+		value  string
+		target *time.Duration
+		name   string
+	}{
+		{cfg.Backoff, &policy.backoff, "backoff"},
+		{cfg.MaxBackoff, &policy.maxBackoff, "maximum backoff"},
+		{cfg.PerTryTimeout, &policy.perTryTimeout, "per-try timeout"},
+	}
+
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry %s: %s", d.name, err)
+		}
+
+		*d.target = duration
+	}
+
+	if policy.budget.Ratio == 0 {
+		policy.budget.Ratio = 0.2
+	}
+
+	if policy.budget.MinPerSecond == 0 {
+		policy.budget.MinPerSecond = 10
+	}
+
+	return &policy, nil
+}
+
+// backoffFor computes the delay before a retry, using exponential backoff
+// with full jitter.
+func (r *retryPolicy) backoffFor(attempt int) time.Duration {
+	backoff := r.backoff << uint(attempt)
+	if backoff > r.maxBackoff || backoff <= 0 {
+		backoff = r.maxBackoff
+	}
+
+	if backoff <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+func (r *retryPolicy) shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	return r.statuses[res.StatusCode]
+}
+
+// retryable checks whether a request may be retried. Its body is buffered
+// in order to be able to send it again, unless the application streams
+// request bodies.
+func (r *retryPolicy) retryable(req *http.Request, contentLength int64) (bool, error) {
+	if !r.methods[req.Method] {
+		return false, nil
+	}
+
+	// the body has already been buffered
+	if req.GetBody != nil {
+		return true, nil
+	}
+
+	if req.Body == nil || req.Body == http.NoBody || contentLength == 0 {
+		req.Body = http.NoBody
+		req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return true, nil
+	}
+
+	if r.streamBodies || contentLength < 0 || contentLength > maxRetryBodySize {
+		return false, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return false, err
+	}
+
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+
+	return true, nil
+}
+
+// send sends a request upstream. Redirects are not followed, but passed on
+// to the client.
+func send(client *http.Client, req *http.Request) (*http.Response, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok && uerr.Err == redirectRequest {
+			return res, nil
+		}
+
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// try sends a single attempt of a request. The returned cancel function
+// needs to be called once the response body has been read.
+func (r *retryPolicy) try(client *http.Client, req *http.Request) (*http.Response, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+
+	attemptReq := req.Clone(ctx)
+	body, err := req.GetBody()
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	attemptReq.Body = body
+
+	// the per-try timeout applies until the response headers are received
+	var timer *time.Timer
+	if r.perTryTimeout > 0 {
+		timer = time.AfterFunc(r.perTryTimeout, cancel)
+	}
+
+	res, err := send(client, attemptReq)
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			res.Body.Close()
+		}
+		err = perTryTimeout
+	}
+
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	return res, cancel, nil
+}
+
+// doRequest sends an upstream request and retries it according to the
+// application's retry policy, as long as the application's retry budget
+// permits. The returned cancel function needs to be called once the response
+// body has been read.
+func (p *ProxyHandler) doRequest(client *http.Client, req *http.Request, contentLength int64, appName string, policy *retryPolicy) (*http.Response, context.CancelFunc, error) {
+	noop := func() {}
+
+	if policy == nil {
+		res, err := send(client, req)
+		return res, noop, err
+	}
+
+	retryable, err := policy.retryable(req, contentLength)
+	if err != nil {
+		return nil, noop, err
+	}
+
+	if !retryable {
+		res, err := send(client, req)
+		return res, noop, err
+	}
+
+	budget := p.retryBudget(appName, policy.budget)
+	budget.Request()
+
+	for attempt := 0; ; attempt++ {
+		res, cancel, err := policy.try(client, req)
+		if attempt >= policy.attempts || !policy.shouldRetry(res, err) {
+			if cancel == nil {
+				cancel = noop
+			}
+			return res, cancel, err
+		}
+
+		if !budget.Withdraw() {
+			p.metrics.Errors.With(prometheus.Labels{"application": appName, "reason": "retry_budget_exhausted"}).Inc()
+			if cancel == nil {
+				cancel = noop
+			}
+			return res, cancel, err
+		}
+
+		if err != nil {
+			p.Logger.Warningf("retrying request to %s after error: %s", req.URL, err)
+		} else {
+			p.Logger.Warningf("retrying request to %s after status %d", req.URL, res.StatusCode)
+			res.Body.Close()
+			cancel()
+		}
+
+		p.metrics.Retries.With(prometheus.Labels{"application": appName}).Inc()
+
+		select {
+		case <-time.After(policy.backoffFor(attempt)):
+		case <-req.Context().Done():
+			return nil, noop, req.Context().Err()
+		}
+	}
+}
+
+func (p *ProxyHandler) retryBudget(appName string, cfg config.RetryBudgetConfiguration) *retryBudget {
+	p.budgetLock.Lock()
+	defer p.budgetLock.Unlock()
+
+	budget, ok := p.budgets[appName]
+	if !ok || budget.ratio != cfg.Ratio || budget.minPerSecond != cfg.MinPerSecond {
+		budget = &retryBudget{ratio: cfg.Ratio, minPerSecond: cfg.MinPerSecond}
+		p.budgets[appName] = budget
+	}
+
+	return budget
+}
+
+const retryBudgetWindow = 10
+
+type retryBudgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// retryBudget limits the retries of an application to a fraction of its
+// requests (plus a minimum number of retries per second) within a sliding
+// window of ten seconds, so that retries cannot multiply the load on an
+// upstream service that is already overloaded.
+type retryBudget struct {
+	ratio        float64
+	minPerSecond int
+
+	buckets [retryBudgetWindow]retryBudgetBucket
+	lock    sync.Mutex
+}
+
+func (b *retryBudget) bucket(now int64) *retryBudgetBucket {
+	bucket := &b.buckets[now%retryBudgetWindow]
+	if bucket.second != now {
+		*bucket = retryBudgetBucket{second: now}
+	}
+
+	return bucket
+}
+
+// Request records a request that may be retried.
+func (b *retryBudget) Request() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.bucket(time.Now().Unix()).requests++
+}
+
+// Withdraw reports whether a retry is permitted, and records it if so.
+func (b *retryBudget) Withdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now().Unix()
+	requests, retries := 0, 0
+
+	for _, bucket := range b.buckets {
+		if bucket.second > now-retryBudgetWindow {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+
+	allowed := float64(b.minPerSecond*retryBudgetWindow) + b.ratio*float64(requests)
+	if float64(retries+1) > allowed {
+		return false
+	}
+
+	b.bucket(now).retries++
+	return true
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	matchQuery  bool
+	last        bool
+}
+
+type urlRewriter struct {
+	cfg   []config.RewriteRule
+	rules []rewriteRule
+}
+
+// urlRewriter returns the compiled rewrite rules of an application. They are
+// only compiled again when the application's configuration changes.
+func (p *ProxyHandler) urlRewriter(appName string, rules []config.RewriteRule) (*urlRewriter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	p.transformLock.Lock()
+	defer p.transformLock.Unlock()
+
+	if rewriter, ok := p.rewrites[appName]; ok && reflect.DeepEqual(rewriter.cfg, rules) {
+		return rewriter, nil
+	}
+
+	rewriter := urlRewriter{
+		cfg:   append([]config.RewriteRule(nil), rules...),
+		rules: make([]rewriteRule, len(rules)),
+	}
+
+	for i, rule := range rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for rewrite rule %d: %s", i, err)
+		}
+
+		rewriter.rules[i] = rewriteRule{
+			pattern:     pattern,
+			replacement: rule.Replacement,
+			matchQuery:  rule.MatchQuery,
+			last:        rule.Last,
+		}
+	}
+
+	p.rewrites[appName] = &rewriter
+	return &rewriter, nil
+}
+
+// Rewrite applies the rewrite rules to the path and query of a request, in
+// the order in which they are configured. A matching rule replaces the
+// entire URL with its replacement, in which `$1` or `${name}` refer to the
+// pattern's capture groups, or (for names that are not capture groups of
+// the pattern) to the parameters of the route. Unless the rule matched the
+// query as well, the original query is appended to the one of the
+// replacement.
+func (r *urlRewriter) Rewrite(path string, rawQuery string, params map[string]string) (string, string, bool) {
+	rewritten := false
+
+	for _, rule := range r.rules {
+		subject := path
+		if rule.matchQuery && rawQuery != "" {
+			subject += "?" + rawQuery
+		}
+
+		match := rule.pattern.FindStringSubmatchIndex(subject)
+		if match == nil {
+			continue
+		}
+
+		replacement := rule.replacement
+		for name, value := range params {
+			if rule.pattern.SubexpIndex(name) < 0 {
+				replacement = strings.ReplaceAll(replacement, "${"+name+"}", strings.ReplaceAll(value, "$", "$$"))
+			}
+		}
+
+		result := string(rule.pattern.ExpandString(nil, replacement, subject, match))
+
+		query := ""
+		if i := strings.Index(result, "?"); i >= 0 {
+			result, query = result[:i], result[i+1:]
+		}
+
+		if !rule.matchQuery && rawQuery != "" {
+			if query != "" {
+				query += "&" + rawQuery
+			} else {
+				query = rawQuery
+			}
+		}
+
+		path, rawQuery, rewritten = result, query, true
+
+		if rule.last {
+			break
+		}
+	}
+
+	return path, rawQuery, rewritten
+}
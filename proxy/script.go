@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	logging "github.com/op/go-logging"
+	"github.com/robertkrimen/otto"
+)
+
+var (
+	scriptTimeout = errors.New("body transformation timed out")
+	bodyTooLarge  = errors.New("body too large to transform")
+)
+
+// the bodies are passed to and from the scripts as JSON strings, so that
+// they do not need to be converted between Go and JS values
+var callTransformScript = mustCompileScript(`(function () {
+	var result = exports(JSON.parse(__body), __meta);
+	return result === undefined ? undefined : JSON.stringify(result);
+})()`)
+
+func mustCompileScript(source string) *otto.Script {
+	script, err := otto.New().Compile("", source)
+	if err != nil {
+		panic(err)
+	}
+
+	return script
+}
+
+// bodyScript runs a body transformation script. Since JS runtimes cannot be
+// shared between concurrent requests, each request takes a copy of the
+// initialized runtime from a pool.
+type bodyScript struct {
+	vms  sync.Pool
+	lock sync.Mutex
+}
+
+func newBodyScript(source string, logger *logging.Logger) (*bodyScript, error) {
+	vm := otto.New()
+	err := vm.Set(
+		"log", func(call otto.FunctionCall) otto.Value {
+			format := call.Argument(0).String()
+			args := call.ArgumentList[1:]
+			values := make([]interface{}, len(args))
+
+			for i := range args {
+				values[i], _ = args[i].Export()
+			}
+
+			logger.Debugf(format, values...)
+			return otto.UndefinedValue()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := vm.Run(source); err != nil {
+		return nil, fmt.Errorf("could not load transformation script: %s", err)
+	}
+
+	if export, _ := vm.Get("exports"); !export.IsFunction() {
+		return nil, fmt.Errorf("transformation script must export a function!")
+	}
+
+	s := bodyScript{}
+	s.vms.New = func() interface{} {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		return vm.Copy()
+	}
+
+	return &s, nil
+}
+
+// Transform passes a JSON body to the script and returns the JSON body that
+// the script returned. If the script returns nothing, the body is kept.
+func (s *bodyScript) Transform(body []byte, meta map[string]interface{}, timeout time.Duration) (result []byte, err error) {
+	vm := s.vms.Get().(*otto.Otto)
+
+	defer func() {
+		if caught := recover(); caught != nil {
+			if caught != scriptTimeout {
+				panic(caught)
+			}
+
+			// an interrupted runtime may be in an inconsistent state, so it
+			// is not put back into the pool
+			result, err = nil, scriptTimeout
+			return
+		}
+
+		s.vms.Put(vm)
+	}()
+
+	// a new channel is used for each run, so that a timeout firing right
+	// after the script has returned does not affect the next run
+	vm.Interrupt = make(chan func(), 1)
+	if timeout > 0 {
+		interrupt := vm.Interrupt
+		timer := time.AfterFunc(timeout, func() {
+			interrupt <- func() { panic(scriptTimeout) }
+		})
+		defer timer.Stop()
+	}
+
+	if err := vm.Set("__body", string(body)); err != nil {
+		return nil, err
+	}
+
+	if err := vm.Set("__meta", meta); err != nil {
+		return nil, err
+	}
+
+	value, err := vm.Run(callTransformScript)
+	if err != nil {
+		return nil, fmt.Errorf("error while calling transformation script: %s", err)
+	}
+
+	if value.IsUndefined() {
+		return body, nil
+	}
+
+	return []byte(value.String()), nil
+}
+
+type bodyTransform struct {
+	cfg         config.BodyTransformation
+	request     *bodyScript
+	response    *bodyScript
+	maxBodySize int64
+	timeout     time.Duration
+}
+
+// bodyTransform returns the body transformation scripts of an application.
+// They are only loaded again when the application's configuration changes.
+func (p *ProxyHandler) bodyTransform(appName string, cfg *config.BodyTransformation) (*bodyTransform, error) {
+	if cfg.Request == "" && cfg.Response == "" {
+		return nil, nil
+	}
+
+	p.transformLock.Lock()
+	defer p.transformLock.Unlock()
+
+	if transform, ok := p.scripts[appName]; ok && transform.cfg == *cfg {
+		return transform, nil
+	}
+
+	transform := bodyTransform{
+		cfg:         *cfg,
+		maxBodySize: cfg.MaxBodySize,
+		timeout:     100 * time.Millisecond,
+	}
+
+	if transform.maxBodySize <= 0 {
+		transform.maxBodySize = 1 << 20
+	}
+
+	if cfg.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body transformation timeout: %s", err)
+		}
+		transform.timeout = timeout
+	}
+
+	var err error
+	logger := logging.MustGetLogger("transform")
+
+	if cfg.Request != "" {
+		if transform.request, err = newBodyScript(cfg.Request, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Response != "" {
+		if transform.response, err = newBodyScript(cfg.Response, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	p.scripts[appName] = &transform
+	return &transform, nil
+}
+
+// isJson checks whether a message has a JSON body that can be transformed.
+// Compressed bodies are left alone.
+func isJson(header http.Header) bool {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func scriptMeta(req *http.Request, header http.Header) map[string]interface{} {
+	headers := make(map[string]interface{}, len(header))
+	for name := range header {
+		headers[name] = header.Get(name)
+	}
+
+	return map[string]interface{}{
+		"method":  req.Method,
+		"path":    req.URL.Path,
+		"query":   req.URL.RawQuery,
+		"headers": headers,
+	}
+}
+
+func (t *bodyTransform) readBody(body io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, t.maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(b)) > t.maxBodySize {
+		return nil, bodyTooLarge
+	}
+
+	return b, nil
+}
+
+// TransformRequest replaces the JSON body of an upstream request with the
+// result of the request script.
+func (t *bodyTransform) TransformRequest(req *http.Request, proxyReq *http.Request) error {
+	if t.request == nil || proxyReq.Body == nil || proxyReq.Body == http.NoBody || !isJson(proxyReq.Header) {
+		return nil
+	}
+
+	body, err := t.readBody(proxyReq.Body)
+	if err != nil {
+		return err
+	}
+
+	body, err = t.request.Transform(body, scriptMeta(req, proxyReq.Header), t.timeout)
+	if err != nil {
+		return err
+	}
+
+	// retries and mirrors need to send the transformed body, too
+	proxyReq.ContentLength = int64(len(body))
+	proxyReq.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	proxyReq.Body, _ = proxyReq.GetBody()
+	proxyReq.Header.Del("Content-Length")
+
+	return nil
+}
+
+// TransformResponse replaces the JSON body of an upstream response with the
+// result of the response script.
+func (t *bodyTransform) TransformResponse(req *http.Request, res *http.Response) error {
+	if t.response == nil || req.Method == "HEAD" || !isJson(res.Header) {
+		return nil
+	}
+
+	body, err := t.readBody(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	meta := scriptMeta(req, res.Header)
+	meta["status"] = res.StatusCode
+
+	body, err = t.response.Transform(body, meta, t.timeout)
+	if err != nil {
+		return err
+	}
+
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/health"
+)
+
+type upstreamGroup struct {
+	name     string
+	weight   float64
+	headers  map[string]string
+	claims   map[string]string
+	balancer *balancer
+}
+
+// trafficSplit sends a share of an application's requests to other groups
+// of upstreams (like canary releases) instead of its backend. Requests that
+// match the headers or claims of a group are always sent to that group.
+type trafficSplit struct {
+	groups []*upstreamGroup
+}
+
+func groupUpstreams(group *config.UpstreamGroup) []config.Upstream {
+	if len(group.Upstreams) > 0 {
+		return group.Upstreams
+	}
+
+	return []config.Upstream{{Url: group.Url}}
+}
+
+// newTrafficSplit creates the balancers of an application's upstream groups.
+// The balancers of a previous split are reused, so that their connection
+// counts are kept.
+func newTrafficSplit(appName string, appCfg *config.Application, previous *trafficSplit, monitor *health.Monitor) (*trafficSplit, error) {
+	split := trafficSplit{}
+	total := 0.0
+
+	for i := range appCfg.Backend.Groups {
+		group := &appCfg.Backend.Groups[i]
+
+		if group.Name == "" {
+			return nil, fmt.Errorf("upstream group %d has no name", i)
+		}
+
+		if group.Weight < 0 {
+			return nil, fmt.Errorf("upstream group %s has a negative weight", group.Name)
+		}
+
+		upstreams := groupUpstreams(group)
+		if upstreams[0].Url == "" {
+			return nil, fmt.Errorf("no upstreams configured for upstream group %s", group.Name)
+		}
+
+		total += group.Weight
+
+		var b *balancer
+		if previous != nil {
+			for _, g := range previous.groups {
+				if g.name == group.Name && g.balancer.configuredFor(appCfg) {
+					b = g.balancer
+				}
+			}
+		}
+
+		if b == nil {
+			var err error
+			if b, err = newBalancer(appName, &appCfg.Backend.LoadBalancing, &appCfg.Backend.Concurrency, monitor); err != nil {
+				return nil, err
+			}
+		}
+
+		b.SetUpstreams(upstreams)
+
+		split.groups = append(split.groups, &upstreamGroup{
+			name:     group.Name,
+			weight:   group.Weight,
+			headers:  group.Headers,
+			claims:   group.Claims,
+			balancer: b,
+		})
+	}
+
+	if total > 100 {
+		return nil, fmt.Errorf("the weights of the upstream groups add up to more than 100%%")
+	}
+
+	return &split, nil
+}
+
+func (g *upstreamGroup) matches(req *http.Request) bool {
+	if len(g.headers) == 0 && len(g.claims) == 0 {
+		return false
+	}
+
+	for name, value := range g.headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+
+	if len(g.claims) > 0 {
+		claims, ok := auth.ClaimsFromContext(req.Context())
+		if !ok {
+			return false
+		}
+
+		for name, value := range g.claims {
+			if claim, ok := claims[name]; !ok || fmt.Sprintf("%v", claim) != value {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Pick selects the upstream group for a request. If the request is not
+// sent to one of the groups, Pick returns nil.
+func (s *trafficSplit) Pick(req *http.Request) *upstreamGroup {
+	for _, g := range s.groups {
+		if g.matches(req) {
+			return g
+		}
+	}
+
+	r := rand.Float64() * 100
+	for _, g := range s.groups {
+		if r < g.weight {
+			return g
+		}
+		r -= g.weight
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+// RegisterStatic registers an application without a backend (with a static
+// response, a redirect or composite responses), so that it is listed and
+// can be disabled like applications with upstreams. Upstreams and health
+// checks of a previous configuration of the application are removed.
+func (p *ProxyHandler) RegisterStatic(appName string, appCfg *config.Application) error {
+	compiled, err := p.compileApplication(appName, appCfg)
+	if err != nil {
+		return err
+	}
+
+	p.balancerLock.Lock()
+	defer p.balancerLock.Unlock()
+
+	delete(p.balancers, appName)
+	delete(p.splits, appName)
+	p.watch(appName, healthWatch{})
+
+	p.compiled[appName] = compiled
+	p.applications[appName] = ApplicationStatus{
+		Name:   appName,
+		Config: *appCfg,
+	}
+
+	return nil
+}
+
+// serveStatic answers a request to an application without an upstream.
+func (p *ProxyHandler) serveStatic(rw http.ResponseWriter, req *http.Request, appCfg *config.Application) {
+	if appCfg.Redirect.Url != "" {
+		target := expandRouteParams(appCfg.Redirect.Url, RouteParams(req))
+
+		if appCfg.Redirect.KeepQuery && req.URL.RawQuery != "" {
+			if strings.Contains(target, "?") {
+				target += "&" + req.URL.RawQuery
+			} else {
+				target += "?" + req.URL.RawQuery
+			}
+		}
+
+		status := appCfg.Redirect.Status
+		if status == 0 {
+			status = http.StatusMovedPermanently
+		}
+
+		http.Redirect(rw, req, target, status)
+		return
+	}
+
+	for name, value := range appCfg.Response.Headers {
+		rw.Header().Set(name, value)
+	}
+
+	contentType := appCfg.Response.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	status := appCfg.Response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(appCfg.Response.Body)))
+	rw.WriteHeader(status)
+
+	if req.Method != "HEAD" {
+		_, _ = rw.Write([]byte(appCfg.Response.Body))
+	}
+}
+
+// routeParamPattern matches the references to route parameters in the URLs
+// of redirects and composite endpoints.
+var routeParamPattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// expandRouteParams replaces the parameters of a route (written as
+// `${name}`) in a URL; unknown parameters are kept. The values are escaped,
+// so that they cannot add path segments or a query to the URL; only the
+// segments of `path` (the rest of the path) are escaped one by one. The
+// URL is expanded in a single pass, so that values are not expanded again.
+func expandRouteParams(s string, params map[string]string) string {
+	return routeParamPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+
+		value, ok := params[name]
+		if !ok {
+			return ref
+		}
+
+		if name == "path" {
+			segments := strings.Split(value, "/")
+			for i, segment := range segments {
+				segments[i] = url.PathEscape(segment)
+			}
+
+			return strings.Join(segments, "/")
+		}
+
+		return url.PathEscape(value)
+	})
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connectTimeout        = errors.New("connect timeout exceeded")
+	responseHeaderTimeout = errors.New("response header timeout exceeded")
+	totalTimeout          = errors.New("total timeout exceeded")
+)
+
+type upstreamTimeouts struct {
+	connect        time.Duration
+	responseHeader time.Duration
+	total          time.Duration
+}
+
+// newUpstreamTimeouts parses the timeouts of an application (or route). It
+// returns nil if no timeouts are configured.
+func newUpstreamTimeouts(cfg *config.TimeoutConfiguration) (*upstreamTimeouts, error) {
+	if *cfg == (config.TimeoutConfiguration{}) {
+		return nil, nil
+	}
+
+	timeouts := upstreamTimeouts{}
+
+	durations := []struct {
+		value  string
+		target *time.Duration
+		name   string
+	}{
+		{cfg.Connect, &timeouts.connect, "connect timeout"},
+		{cfg.ResponseHeader, &timeouts.responseHeader, "response header timeout"},
+		{cfg.Total, &timeouts.total, "total timeout"},
+	}
+
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", d.name, err)
+		}
+
+		*d.target = duration
+	}
+
+	return &timeouts, nil
+}
+
+// apply bounds an upstream request by the timeouts. The connect timeout
+// applies to establishing each connection, the response header timeout to
+// waiting for the response after the request has been sent (both are
+// re-armed when a request is retried), and the total timeout to the entire
+// request, including reading the response body. The returned cancel
+// function needs to be called once the response body has been read.
+func (t *upstreamTimeouts) apply(req *http.Request) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timers := make([]*time.Timer, 0, 3)
+
+	timer := func(d time.Duration, cause error) *time.Timer {
+		timer := time.AfterFunc(d, func() { cancel(cause) })
+		timers = append(timers, timer)
+		return timer
+	}
+
+	if t.total > 0 {
+		timer(t.total, totalTimeout)
+	}
+
+	trace := httptrace.ClientTrace{}
+
+	if t.connect > 0 {
+		connect := timer(t.connect, connectTimeout)
+		connect.Stop()
+
+		trace.GetConn = func(string) { connect.Reset(t.connect) }
+		trace.GotConn = func(httptrace.GotConnInfo) { connect.Stop() }
+	}
+
+	if t.responseHeader > 0 {
+		responseHeader := timer(t.responseHeader, responseHeaderTimeout)
+		responseHeader.Stop()
+
+		trace.WroteRequest = func(httptrace.WroteRequestInfo) { responseHeader.Reset(t.responseHeader) }
+		trace.GotFirstResponseByte = func() { responseHeader.Stop() }
+	}
+
+	ctx = httptrace.WithClientTrace(ctx, &trace)
+
+	return req.WithContext(ctx), func() {
+		for _, timer := range timers {
+			timer.Stop()
+		}
+		cancel(nil)
+	}
+}
+
+// timeoutCause returns the timeout that an upstream request was aborted by,
+// if any.
+func timeoutCause(req *http.Request) error {
+	switch cause := context.Cause(req.Context()); cause {
+	case connectTimeout, responseHeaderTimeout, totalTimeout:
+		return cause
+	}
+
+	return nil
+}
+
+func (p *ProxyHandler) TimeoutError(rw http.ResponseWriter, req *http.Request, appName string, cause error) {
+	p.metrics.Errors.With(prometheus.Labels{"application": appName, "reason": "upstream_timeout"}).Inc()
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(504)
+	_, _ = rw.Write([]byte(fmt.Sprintf("{\"msg\": \"gateway timeout\", \"reason\": \"%s\"}", cause)))
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"golang.org/x/net/http2"
+)
+
+// transportKey identifies an HTTP client for upstream requests. Clients are
+// shared between all applications with the same transport settings.
+type transportKey struct {
+	settings config.BackendTransport
+	h2c      bool
+}
+
+type upstreamClients struct {
+	clients map[transportKey]*http.Client
+	lock    sync.Mutex
+}
+
+func newUpstreamClients() *upstreamClients {
+	return &upstreamClients{
+		clients: make(map[transportKey]*http.Client),
+	}
+}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	return redirectRequest
+}
+
+// clientFor returns the HTTP client for requests to an application's
+// backend. Applications without transport settings use the default client.
+func (p *ProxyHandler) clientFor(targetUrl string, appCfg *config.Application) (*http.Client, error) {
+	settings := appCfg.Backend.Transport
+
+	// gRPC always requires HTTP/2
+	if appCfg.Grpc.Enabled {
+		settings.Protocol = "http2"
+	}
+
+	if settings == (config.BackendTransport{}) {
+		return p.Client, nil
+	}
+
+	key := transportKey{
+		settings: settings,
+		h2c:      settings.Protocol == "http2" && !strings.HasPrefix(targetUrl, "https://"),
+	}
+
+	p.upstreams.lock.Lock()
+	defer p.upstreams.lock.Unlock()
+
+	if client, ok := p.upstreams.clients[key]; ok {
+		return client, nil
+	}
+
+	transport, err := buildTransport(key)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}
+
+	p.upstreams.clients[key] = client
+	return client, nil
+}
+
+func buildTransport(key transportKey) (http.RoundTripper, error) {
+	settings := key.settings
+	dialer := net.Dialer{}
+
+	if settings.DialTimeout != "" {
+		timeout, err := time.ParseDuration(settings.DialTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dial timeout: %s", err)
+		}
+		dialer.Timeout = timeout
+	}
+
+	var idleConnTimeout time.Duration
+	if settings.IdleConnTimeout != "" {
+		var err error
+		if idleConnTimeout, err = time.ParseDuration(settings.IdleConnTimeout); err != nil {
+			return nil, fmt.Errorf("invalid idle connection timeout: %s", err)
+		}
+	}
+
+	tlsConfig, err := settings.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	switch settings.Protocol {
+	case "http2":
+		transport := &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				tlsDialer := tls.Dialer{NetDialer: &dialer, Config: cfg}
+				return tlsDialer.DialContext(ctx, network, addr)
+			},
+		}
+
+		// without TLS, HTTP/2 is spoken in plain text (h2c) with prior
+		// knowledge, since upgrading from HTTP/1.1 is not supported
+		if key.h2c {
+			transport.AllowHTTP = true
+			transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			}
+		}
+
+		return transport, nil
+	case "", "auto", "http1":
+		transport := &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     tlsConfig,
+			IdleConnTimeout:     idleConnTimeout,
+			MaxIdleConnsPerHost: settings.MaxIdleConnsPerHost,
+			ForceAttemptHTTP2:   settings.Protocol != "http1",
+		}
+
+		if settings.Protocol == "http1" {
+			transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		}
+
+		return transport, nil
+	}
+
+	return nil, fmt.Errorf("unsupported backend protocol '%s'", settings.Protocol)
+}
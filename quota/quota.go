@@ -0,0 +1,303 @@
+package quota
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/clientip"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/redisconn"
+	"github.com/op/go-logging"
+)
+
+const keyPrefix = "QUOTA_"
+
+// consumeScript counts the requests of a client in a hash that holds one
+// counter for the current day and one for the current month, and removes
+// the counters of past periods. Requests are only counted if neither quota
+// is used up.
+//
+// KEYS[1] is the client's hash, ARGV[1] and ARGV[2] the fields of the current
+// day and month, ARGV[3] and ARGV[4] the daily and monthly limit (0 for no
+// limit), ARGV[5] the number of requests to count (0 only reads the hash),
+// ARGV[6] the time-to-live of the hash in seconds and ARGV[7] the name of the
+// plan. It returns whether the requests were counted, and the consumption of
+// the day and month.
+var consumeScript = redis.NewScript(1, `
+local key = KEYS[1]
+local day = ARGV[1]
+local month = ARGV[2]
+local dailyLimit = tonumber(ARGV[3])
+local monthlyLimit = tonumber(ARGV[4])
+local cost = tonumber(ARGV[5])
+
+for _, field in ipairs(redis.call("HKEYS", key)) do
+	if field ~= day and field ~= month and field ~= "plan" then
+		redis.call("HDEL", key, field)
+	end
+end
+
+local daily = tonumber(redis.call("HGET", key, day) or "0")
+local monthly = tonumber(redis.call("HGET", key, month) or "0")
+
+if cost == 0 then
+	return {0, daily, monthly}
+end
+
+if (dailyLimit > 0 and daily + cost > dailyLimit) or (monthlyLimit > 0 and monthly + cost > monthlyLimit) then
+	return {0, daily, monthly}
+end
+
+daily = redis.call("HINCRBY", key, day, cost)
+monthly = redis.call("HINCRBY", key, month, cost)
+redis.call("HSET", key, "plan", ARGV[7])
+redis.call("EXPIRE", key, ARGV[6])
+
+return {1, daily, monthly}
+`)
+
+// Usage describes the consumption of a client in the current day and month.
+type Usage struct {
+	Client       string
+	Plan         string
+	Daily        int64
+	DailyLimit   int64
+	Monthly      int64
+	MonthlyLimit int64
+}
+
+// Manager enforces daily and monthly quotas for API keys and authenticated
+// users, according to their usage plan. The consumption is kept in Redis, so
+// that it is shared by all gateway instances.
+type Manager struct {
+	plans       map[string]config.QuotaPlan
+	defaultPlan string
+	planClaim   string
+	location    *time.Location
+
+	redisPool redisconn.Source
+	logger    *logging.Logger
+}
+
+func NewManager(cfg *config.QuotaConfiguration, red redisconn.Source, logger *logging.Logger) (*Manager, error) {
+	m := Manager{
+		plans:       cfg.Plans,
+		defaultPlan: cfg.DefaultPlan,
+		planClaim:   cfg.PlanClaim,
+		location:    time.UTC,
+		redisPool:   red,
+		logger:      logger,
+	}
+
+	if m.planClaim == "" {
+		m.planClaim = "rate_limit_tier"
+	}
+
+	if cfg.Timezone != "" {
+		location, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota timezone: %s", err)
+		}
+		m.location = location
+	}
+
+	if m.defaultPlan != "" {
+		if _, ok := m.plans[m.defaultPlan]; !ok {
+			return nil, fmt.Errorf("default quota plan '%s' is not defined", m.defaultPlan)
+		}
+	}
+
+	return &m, nil
+}
+
+// identify returns the client that a request is counted for, and the name
+// of its usage plan. Anonymous requests have no client.
+func (m *Manager) identify(req *http.Request) (string, string) {
+	if key, ok := auth.ApiKeyFromContext(req.Context()); ok && key.Owner != "" {
+		return "apikey:" + key.Owner, key.RateLimitTier
+	}
+
+	claims, ok := auth.ClaimsFromContext(req.Context())
+	if !ok {
+		return "", ""
+	}
+
+	subject, ok := claims["sub"].(string)
+	if !ok || subject == "" {
+		return "", ""
+	}
+
+	plan, _ := claims[m.planClaim].(string)
+	return "sub:" + subject, plan
+}
+
+// plan returns the usage plan with the given name, or the default plan if
+// there is no such plan.
+func (m *Manager) plan(name string) (string, config.QuotaPlan, bool) {
+	if plan, ok := m.plans[name]; ok {
+		return name, plan, true
+	}
+
+	plan, ok := m.plans[m.defaultPlan]
+	return m.defaultPlan, plan, ok
+}
+
+// periods returns the hash fields of the current day and month, and the
+// time until the day and month end.
+func (m *Manager) periods(now time.Time) (string, string, time.Duration, time.Duration) {
+	now = now.In(m.location)
+
+	year, month, day := now.Date()
+	nextDay := time.Date(year, month, day+1, 0, 0, 0, 0, m.location)
+	nextMonth := time.Date(year, month+1, 1, 0, 0, 0, 0, m.location)
+
+	return "d:" + now.Format("2006-01-02"), "m:" + now.Format("2006-01"), nextDay.Sub(now), nextMonth.Sub(now)
+}
+
+func (m *Manager) consume(conn redis.Conn, client string, planName string, plan config.QuotaPlan, cost int64) (bool, int64, int64, error) {
+	day, month, _, untilNextMonth := m.periods(time.Now())
+	ttl := int64((untilNextMonth + 24*time.Hour) / time.Second)
+
+	values, err := redis.Int64s(consumeScript.Do(conn, keyPrefix+client, day, month, plan.Daily, plan.Monthly, cost, ttl, planName))
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	return values[0] == 1, values[1], values[2], nil
+}
+
+// DecorateHandler counts the requests of API keys and authenticated users,
+// and rejects them when their daily or monthly quota is used up. Anonymous
+// requests and clients without a usage plan are not limited.
+func (m *Manager) DecorateHandler(handler httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		client, planName := m.identify(req)
+		if client == "" {
+			handler(rw, req, p)
+			return
+		}
+
+		planName, plan, ok := m.plan(planName)
+		if !ok || (plan.Daily <= 0 && plan.Monthly <= 0) {
+			handler(rw, req, p)
+			return
+		}
+
+		conn := m.redisPool.Get()
+		counted, daily, monthly, err := m.consume(conn, client, planName, plan, 1)
+		_ = conn.Close()
+
+		if err != nil {
+			m.logger.Errorf("Error occurred while counting quota of request from %s: %s", clientip.FromRequest(req), err)
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(503)
+			_, _ = rw.Write([]byte("{\"msg\":\"service unavailable\"}"))
+			return
+		}
+
+		_, _, untilNextDay, untilNextMonth := m.periods(time.Now())
+		retryAfter := time.Duration(0)
+
+		if plan.Daily > 0 {
+			rw.Header().Set("X-Quota-Daily-Limit", strconv.FormatInt(plan.Daily, 10))
+			rw.Header().Set("X-Quota-Daily-Remaining", strconv.FormatInt(remaining(plan.Daily, daily), 10))
+
+			if daily >= plan.Daily {
+				retryAfter = untilNextDay
+			}
+		}
+
+		if plan.Monthly > 0 {
+			rw.Header().Set("X-Quota-Monthly-Limit", strconv.FormatInt(plan.Monthly, 10))
+			rw.Header().Set("X-Quota-Monthly-Remaining", strconv.FormatInt(remaining(plan.Monthly, monthly), 10))
+
+			if monthly >= plan.Monthly {
+				retryAfter = untilNextMonth
+			}
+		}
+
+		if !counted {
+			rw.Header().Set("Retry-After", strconv.FormatInt(int64((retryAfter+time.Second-1)/time.Second), 10))
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(429)
+			_, _ = rw.Write([]byte("{\"msg\":\"quota exceeded\"}"))
+			return
+		}
+
+		handler(rw, req, p)
+	}
+}
+
+func remaining(limit int64, used int64) int64 {
+	if used >= limit {
+		return 0
+	}
+
+	return limit - used
+}
+
+// Usage returns the consumption of all clients that sent requests within
+// the current month.
+func (m *Manager) Usage() ([]Usage, error) {
+	keys, err := redisconn.Keys(m.redisPool, keyPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	conn := m.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	usages := make([]Usage, 0, len(keys))
+	for _, key := range keys {
+		planName, err := redis.String(conn.Do("HGET", key, "plan"))
+		if err == redis.ErrNil {
+			// expired or reset in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		planName, plan, _ := m.plan(planName)
+		client := strings.TrimPrefix(key, keyPrefix)
+
+		_, daily, monthly, err := m.consume(conn, client, planName, plan, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		usages = append(usages, Usage{
+			Client:       client,
+			Plan:         planName,
+			Daily:        daily,
+			DailyLimit:   plan.Daily,
+			Monthly:      monthly,
+			MonthlyLimit: plan.Monthly,
+		})
+	}
+
+	return usages, nil
+}
+
+// Reset sets the consumption of a client back to zero. It returns false if
+// the client has not sent any requests within the current month.
+func (m *Manager) Reset(client string) (bool, error) {
+	conn := m.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	deleted, err := redis.Int(conn.Do("DEL", keyPrefix+client))
+	if err != nil {
+		return false, err
+	}
+
+	return deleted > 0, nil
+}
@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/clientip"
+	"github.com/mittwald/servicegateway/config"
+)
+
+// Exemptions matches the requests that bypass the rate limit of an
+// application.
+type Exemptions struct {
+	networks []*net.IPNet
+	claims   map[string]string
+	apiKeys  map[string]bool
+}
+
+// NewExemptions compiles the rate-limit exemptions of an application. It
+// returns nil if the application has none.
+func NewExemptions(cfg *config.RateLimitExemptions) (*Exemptions, error) {
+	if len(cfg.Networks) == 0 && len(cfg.Claims) == 0 && len(cfg.ApiKeys) == 0 {
+		return nil, nil
+	}
+
+	networks, err := clientip.ParseNetworks(cfg.Networks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit exemption: %s", err)
+	}
+
+	e := Exemptions{
+		networks: networks,
+		claims:   cfg.Claims,
+		apiKeys:  make(map[string]bool, len(cfg.ApiKeys)),
+	}
+
+	for _, owner := range cfg.ApiKeys {
+		e.apiKeys[owner] = true
+	}
+
+	return &e, nil
+}
+
+// Exempt reports whether a request is sent from one of the networks, by a
+// client with one of the claims, or with an API key of one of the owners.
+func (e *Exemptions) Exempt(req *http.Request) bool {
+	if e == nil {
+		return false
+	}
+
+	if len(e.networks) > 0 {
+		if ip := net.ParseIP(clientip.FromRequest(req)); ip != nil {
+			for _, network := range e.networks {
+				if network.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+
+	if len(e.apiKeys) > 0 {
+		if key, ok := auth.ApiKeyFromContext(req.Context()); ok && e.apiKeys[key.Owner] {
+			return true
+		}
+	}
+
+	if len(e.claims) > 0 {
+		if claims, ok := auth.ClaimsFromContext(req.Context()); ok {
+			for name, expected := range e.claims {
+				if claimContains(claims[name], expected) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// claimContains checks whether a claim has the expected value, or is a list
+// that contains it.
+func claimContains(claim interface{}, expected string) bool {
+	switch v := claim.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		for _, item := range v {
+			if fmt.Sprintf("%v", item) == expected {
+				return true
+			}
+		}
+		return false
+	default:
+		return fmt.Sprintf("%v", v) == expected
+	}
+}
@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FallbackOptions configure the in-memory limiter that is used while Redis
+// cannot be reached.
+type FallbackOptions struct {
+	RetryInterval time.Duration
+	Instances     int
+	Gauge         prometheus.Gauge
+	Logger        *logging.Logger
+}
+
+type localBucket struct {
+	remaining int64
+	resetAt   time.Time
+}
+
+// fallbackLimiter keeps the rate limits enforced while Redis cannot be
+// reached. In this fallback mode, each gateway instance counts requests in
+// fixed windows in memory, allowing its share of the burst size (the burst
+// size divided by the number of instances); Redis is retried periodically.
+type fallbackLimiter struct {
+	options FallbackOptions
+
+	buckets   map[string]*localBucket
+	lastSweep time.Time
+
+	fallbackUntil time.Time
+	lock          sync.Mutex
+}
+
+func newFallbackLimiter(options FallbackOptions) *fallbackLimiter {
+	if options.RetryInterval == 0 {
+		options.RetryInterval = 10 * time.Second
+	}
+
+	if options.Instances <= 0 {
+		options.Instances = 1
+	}
+
+	if options.Gauge != nil {
+		options.Gauge.Set(0)
+	}
+
+	return &fallbackLimiter{
+		options: options,
+		buckets: make(map[string]*localBucket),
+	}
+}
+
+// wrap returns a function that takes tokens from Redis, and from memory
+// while Redis is unavailable. Without a fallback limiter, errors are
+// returned as they are.
+func (f *fallbackLimiter) wrap(takeToken func(user string, limit Limit) (token, error)) func(user string, limit Limit) (token, error) {
+	if f == nil {
+		return takeToken
+	}
+
+	return func(user string, limit Limit) (token, error) {
+		if f.available() {
+			tok, err := takeToken(user, limit)
+			if !f.unavailable(err) {
+				return tok, err
+			}
+		}
+
+		return f.takeToken(user, limit), nil
+	}
+}
+
+// available reports whether tokens should be taken from Redis. Once the
+// retry interval has passed, the next request is used to probe Redis again.
+func (f *fallbackLimiter) available() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return !time.Now().Before(f.fallbackUntil)
+}
+
+// unavailable reports whether an error indicates that Redis cannot be
+// reached, and enters the fallback mode if so. Errors reported by Redis
+// itself do not count.
+func (f *fallbackLimiter) unavailable(err error) bool {
+	if _, ok := err.(redis.Error); ok {
+		return false
+	}
+
+	f.lock.Lock()
+	wasActive := !f.fallbackUntil.IsZero()
+
+	if err == nil {
+		f.fallbackUntil = time.Time{}
+	} else {
+		f.fallbackUntil = time.Now().Add(f.options.RetryInterval)
+	}
+	f.lock.Unlock()
+
+	if err == nil && wasActive {
+		f.options.Logger.Noticef("Redis is available again; leaving rate limiting fallback mode")
+		if f.options.Gauge != nil {
+			f.options.Gauge.Set(0)
+		}
+	} else if err != nil && !wasActive {
+		f.options.Logger.Warningf("Redis is unavailable; limiting requests in memory: %s", err)
+		if f.options.Gauge != nil {
+			f.options.Gauge.Set(1)
+		}
+	}
+
+	return err != nil
+}
+
+func (f *fallbackLimiter) takeToken(user string, limit Limit) token {
+	burst := limit.Burst / int64(f.options.Instances)
+	if burst < 1 {
+		burst = 1
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := time.Now()
+	f.sweep(now)
+
+	key := bucketKey("", limit, user)
+	bucket, ok := f.buckets[key]
+	if !ok || !now.Before(bucket.resetAt) {
+		bucket = &localBucket{remaining: burst, resetAt: now.Add(limit.Window)}
+		f.buckets[key] = bucket
+	}
+
+	taken := bucket.remaining > 0
+	if taken {
+		bucket.remaining--
+	}
+
+	return token{
+		taken:      taken,
+		remaining:  int(bucket.remaining),
+		limit:      int(burst),
+		reset:      bucket.resetAt.Sub(now),
+		retryAfter: bucket.resetAt.Sub(now),
+	}
+}
+
+// sweep removes the buckets whose window has passed, at most once a minute.
+// The limiter needs to be locked.
+func (f *fallbackLimiter) sweep(now time.Time) {
+	if now.Sub(f.lastSweep) < time.Minute {
+		return
+	}
+
+	for key, bucket := range f.buckets {
+		if !now.Before(bucket.resetAt) {
+			delete(f.buckets, key)
+		}
+	}
+
+	f.lastSweep = now
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/clientip"
+	"github.com/mittwald/servicegateway/config"
+)
+
+// ClientIdentifier determines the client that a request is counted for.
+type ClientIdentifier func(req *http.Request) string
+
+// NewClientIdentifier builds the client identifier for a rate-limit key
+// configuration. Requests for which the configured key has no value (like
+// anonymous requests when the key is a claim) are counted by client IP.
+func NewClientIdentifier(cfg *config.RateLimitKey) (ClientIdentifier, error) {
+	switch cfg.Type {
+	case "", "authorization":
+		return identifyClient, nil
+	case "ip":
+		return clientip.FromRequest, nil
+	case "header":
+		if cfg.Header == "" {
+			return nil, fmt.Errorf("rate limit key of type header requires a header name")
+		}
+
+		return func(req *http.Request) string {
+			return withFallback(req, "header:", req.Header.Get(cfg.Header))
+		}, nil
+	case "subject":
+		return claimIdentifier("sub:", "sub"), nil
+	case "claim":
+		if cfg.Claim == "" {
+			return nil, fmt.Errorf("rate limit key of type claim requires a claim name")
+		}
+
+		return claimIdentifier("claim:", cfg.Claim), nil
+	case "api_key":
+		return func(req *http.Request) string {
+			owner := ""
+			if key, ok := auth.ApiKeyFromContext(req.Context()); ok {
+				owner = key.Owner
+			}
+
+			return withFallback(req, "apikey:", owner)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported rate limit key type: %s", cfg.Type)
+	}
+}
+
+func claimIdentifier(prefix string, claim string) ClientIdentifier {
+	return func(req *http.Request) string {
+		value := ""
+		if claims, ok := auth.ClaimsFromContext(req.Context()); ok {
+			if v, ok := claims[claim]; ok && v != nil {
+				value = fmt.Sprintf("%v", v)
+			}
+		}
+
+		return withFallback(req, prefix, value)
+	}
+}
+
+func withFallback(req *http.Request, prefix string, value string) string {
+	if value == "" {
+		return clientip.FromRequest(req)
+	}
+
+	return prefix + value
+}
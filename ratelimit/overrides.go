@@ -0,0 +1,164 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+// Limit is the number of requests that a client may send within a window.
+// Requests that are counted against a named limit use a bucket of their own;
+// a zero burst or window is taken from the default limit.
+type Limit struct {
+	Name   string
+	Burst  int64
+	Window time.Duration
+}
+
+// Override is a limit that applies to the requests to an application that
+// match a path pattern and a list of methods, instead of the default limit.
+type Override struct {
+	Limit
+
+	path    *regexp.Regexp
+	methods []string
+}
+
+// NewOverrides compiles the rate-limit overrides of an application.
+func NewOverrides(appName string, cfg []config.RateLimitOverride) ([]Override, error) {
+	overrides := make([]Override, len(cfg))
+
+	for i, overrideCfg := range cfg {
+		override := Override{
+			Limit: Limit{
+				Name:  fmt.Sprintf("%s#%d", appName, i),
+				Burst: int64(overrideCfg.Burst),
+			},
+		}
+
+		if overrideCfg.Burst < 0 {
+			return nil, fmt.Errorf("burst of rate limit override %d must not be negative", i)
+		}
+
+		if overrideCfg.Window != "" {
+			window, err := time.ParseDuration(overrideCfg.Window)
+			if err != nil {
+				return nil, fmt.Errorf("invalid window of rate limit override %d: %s", i, err)
+			}
+			if window < 0 || (window > 0 && window < time.Millisecond) {
+				return nil, fmt.Errorf("window of rate limit override %d must be at least 1ms", i)
+			}
+			override.Window = window
+		}
+
+		if overrideCfg.Path != "" {
+			re, err := regexp.Compile(overrideCfg.Path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path pattern '%s' in rate limit override %d: %s", overrideCfg.Path, i, err)
+			}
+			override.path = re
+		}
+
+		for _, method := range overrideCfg.Methods {
+			override.methods = append(override.methods, strings.ToUpper(method))
+		}
+
+		overrides[i] = override
+	}
+
+	return overrides, nil
+}
+
+func (o *Override) matches(req *http.Request) bool {
+	if o.path != nil && !o.path.MatchString(req.URL.Path) {
+		return false
+	}
+
+	if len(o.methods) == 0 {
+		return true
+	}
+
+	for _, method := range o.methods {
+		if method == req.Method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// merge fills in the burst and window that an override does not set from
+// the default limit.
+func (l Limit) merge(defaults Limit) Limit {
+	if l.Burst == 0 {
+		l.Burst = defaults.Burst
+	}
+
+	if l.Window == 0 {
+		l.Window = defaults.Window
+	}
+
+	return l
+}
+
+// selectLimit returns the limit of the first override that matches a
+// request, merged with the default limit.
+func selectLimit(req *http.Request, overrides []Override, defaults Limit) Limit {
+	for i := range overrides {
+		if overrides[i].matches(req) {
+			return overrides[i].Limit.merge(defaults)
+		}
+	}
+
+	return defaults
+}
+
+// bucketKey returns the Redis key of a client's bucket for a limit.
+func bucketKey(prefix string, limit Limit, user string) string {
+	if limit.Name == "" {
+		return prefix + user
+	}
+
+	return prefix + limit.Name + "|" + user
+}
+
+// limitRegistry remembers the named limits that buckets were created for,
+// so that buckets can be listed with their limit.
+type limitRegistry struct {
+	lock   sync.Mutex
+	limits map[string]Limit
+}
+
+func (r *limitRegistry) add(overrides []Override, defaults Limit) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.limits == nil {
+		r.limits = make(map[string]Limit)
+	}
+
+	for i := range overrides {
+		r.limits[overrides[i].Name] = overrides[i].Limit.merge(defaults)
+	}
+}
+
+// parse splits the name of a bucket (without the key prefix) into the
+// limit and the client.
+func (r *limitRegistry) parse(bucket string, defaults Limit) (Limit, string) {
+	if i := strings.Index(bucket, "|"); i >= 0 {
+		r.lock.Lock()
+		limit, ok := r.limits[bucket[:i]]
+		r.lock.Unlock()
+
+		if ok {
+			return limit, bucket[i+1:]
+		}
+	}
+
+	return defaults, bucket
+}
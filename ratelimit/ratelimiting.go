@@ -20,7 +20,7 @@ package ratelimit
  */
 
 import (
-	"net"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -29,8 +29,11 @@ import (
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/clientip"
 	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/redisconn"
 	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Bucket struct {
@@ -38,45 +41,181 @@ type Bucket struct {
 }
 
 type RateLimitingMiddleware interface {
-	DecorateHandler(handler httprouter.Handle) httprouter.Handle
+	DecorateHandler(handler httprouter.Handle, identify ClientIdentifier, overrides []Override) httprouter.Handle
+	Buckets() ([]BucketStatus, error)
+}
+
+// BucketStatus describes the rate-limit bucket of a client that sent
+// requests within the current window.
+type BucketStatus struct {
+	Client    string
+	Override  string
+	Remaining int
+	Limit     int
+	ResetIn   time.Duration
 }
 
 type RedisSimpleRateThrottler struct {
 	burstSize int64
 	window    time.Duration
-	redisPool *redis.Pool
+	redisPool redisconn.Source
 	logger    *logging.Logger
+	limits    limitRegistry
+	rejection rejection
+	fallback  *fallbackLimiter
+}
+
+// token is the result of taking a token from a client's bucket.
+type token struct {
+	taken     bool
+	remaining int
+	limit     int
+
+	// reset is the time until the bucket is refilled, and retryAfter the
+	// time until a token can be taken again if none was taken.
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// rejection is the response to requests that exceed the rate limit.
+type rejection struct {
+	contentType string
+	body        []byte
 }
 
-func NewRateLimiter(cfg config.RateLimiting, red *redis.Pool, logger *logging.Logger) (RateLimitingMiddleware, error) {
-	t := new(RedisSimpleRateThrottler)
-	t.burstSize = int64(cfg.Burst)
-	t.redisPool = red
-	t.logger = logger
+func newRejection(cfg *config.RateLimitRejection) rejection {
+	r := rejection{
+		contentType: cfg.ContentType,
+		body:        []byte(cfg.Body),
+	}
+
+	if cfg.Body == "" {
+		r.body = []byte("{\"msg\":\"rate limit exceeded\"}")
+	}
+
+	if r.contentType == "" {
+		r.contentType = "application/json"
+	}
+
+	return r
+}
 
-	if w, err := time.ParseDuration(cfg.Window); err != nil {
+func NewRateLimiter(cfg config.RateLimiting, red redisconn.Source, fallbackGauge prometheus.Gauge, logger *logging.Logger) (RateLimitingMiddleware, error) {
+	window, err := time.ParseDuration(cfg.Window)
+	if err != nil {
 		return nil, err
-	} else {
-		t.window = w
 	}
 
-	logger.Infof("Initialize rate limiter (burst size %d)", t.burstSize)
+	var fallback *fallbackLimiter
+	if cfg.Fallback.Enabled {
+		options := FallbackOptions{
+			Instances: cfg.Fallback.Instances,
+			Gauge:     fallbackGauge,
+			Logger:    logger,
+		}
+
+		if cfg.Fallback.RetryInterval != "" {
+			retryInterval, err := time.ParseDuration(cfg.Fallback.RetryInterval)
+			if err != nil {
+				return nil, fmt.Errorf("invalid fallback retry interval '%s': %s", cfg.Fallback.RetryInterval, err)
+			}
+			options.RetryInterval = retryInterval
+		}
+
+		fallback = newFallbackLimiter(options)
+	}
+
+	switch cfg.Algorithm {
+	case "", "fixed_window":
+		t := new(RedisSimpleRateThrottler)
+		t.burstSize = int64(cfg.Burst)
+		t.redisPool = red
+		t.logger = logger
+		t.window = window
+		t.rejection = newRejection(&cfg.Rejection)
+		t.fallback = fallback
 
-	return t, nil
+		logger.Infof("Initialize rate limiter (burst size %d)", t.burstSize)
+
+		return t, nil
+	case "sliding_window":
+		if window < time.Millisecond {
+			return nil, fmt.Errorf("window of sliding window rate limiter must be at least 1ms")
+		}
+
+		logger.Infof("Initialize sliding window rate limiter (burst size %d)", cfg.Burst)
+
+		t := NewSlidingWindowRateLimiter(int64(cfg.Burst), window, red, logger)
+		t.rejection = newRejection(&cfg.Rejection)
+		t.fallback = fallback
+
+		return t, nil
+	default:
+		return nil, fmt.Errorf("unsupported rate limiting algorithm: %s", cfg.Algorithm)
+	}
 }
 
-func (t *RedisSimpleRateThrottler) identifyClient(req *http.Request) string {
+func identifyClient(req *http.Request) string {
 	auth := req.Header.Get("Authorization")
 	if auth != "" {
 		return strings.Replace(auth, " ", "", -1)
 	}
 
-	addr, _ := net.ResolveTCPAddr("tcp", req.RemoteAddr)
-	return addr.IP.String()
+	return clientip.FromRequest(req)
+}
+
+// Buckets returns the buckets of all clients that sent requests within the
+// current window.
+func (t *RedisSimpleRateThrottler) Buckets() ([]BucketStatus, error) {
+	keys, err := redisconn.Keys(t.redisPool, "RL_BUCKET_*")
+	if err != nil {
+		return nil, err
+	}
+
+	conn := t.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	defaults := t.defaultLimit()
+	buckets := make([]BucketStatus, 0, len(keys))
+	for _, key := range keys {
+		remaining, err := redis.Int(conn.Do("GET", key))
+		if err == redis.ErrNil {
+			// expired in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		ttl, err := redis.Int(conn.Do("PTTL", key))
+		if err != nil {
+			return nil, err
+		}
+
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		limit, client := t.limits.parse(strings.TrimPrefix(key, "RL_BUCKET_"), defaults)
+		buckets = append(buckets, BucketStatus{
+			Client:    client,
+			Override:  limit.Name,
+			Remaining: remaining,
+			Limit:     int(limit.Burst),
+			ResetIn:   time.Duration(ttl) * time.Millisecond,
+		})
+	}
+
+	return buckets, nil
+}
+
+func (t *RedisSimpleRateThrottler) defaultLimit() Limit {
+	return Limit{Burst: t.burstSize, Window: t.window}
 }
 
-func (t *RedisSimpleRateThrottler) takeToken(user string) (int, int, error) {
-	key := "RL_BUCKET_" + user
+func (t *RedisSimpleRateThrottler) takeToken(user string, limit Limit) (token, error) {
+	key := bucketKey("RL_BUCKET_", limit, user)
 	conn := t.redisPool.Get()
 	defer func() {
 		_ = conn.Close()
@@ -84,21 +223,34 @@ func (t *RedisSimpleRateThrottler) takeToken(user string) (int, int, error) {
 
 	err := conn.Send("MULTI")
 	if err != nil {
-		return 0, 0, err
+		return token{}, err
 	}
-	err = conn.Send("SET", key, t.burstSize, "EX", t.window.Seconds(), "NX")
+	err = conn.Send("SET", key, limit.Burst, "EX", limit.Window.Seconds(), "NX")
 	if err != nil {
-		return 0, 0, err
+		return token{}, err
 	}
 	err = conn.Send("DECR", key)
 	if err != nil {
-		return 0, 0, err
+		return token{}, err
+	}
+	err = conn.Send("PTTL", key)
+	if err != nil {
+		return token{}, err
 	}
 
 	if val, err := redis.Values(conn.Do("EXEC")); err != nil {
-		return 0, 0, err
+		return token{}, err
 	} else {
-		return int(val[1].(int64)), int(t.burstSize), nil
+		remaining := int(val[1].(int64))
+		reset := time.Duration(val[2].(int64)) * time.Millisecond
+
+		return token{
+			taken:      remaining > 0,
+			remaining:  remaining,
+			limit:      int(limit.Burst),
+			reset:      reset,
+			retryAfter: reset,
+		}, nil
 	}
 }
 
@@ -138,32 +290,55 @@ func (t *RedisSimpleRateThrottler) takeToken(user string) (int, int, error) {
 //	}
 // }
 
-func (t *RedisSimpleRateThrottler) DecorateHandler(handler httprouter.Handle) httprouter.Handle {
+func (t *RedisSimpleRateThrottler) DecorateHandler(handler httprouter.Handle, identify ClientIdentifier, overrides []Override) httprouter.Handle {
+	t.limits.add(overrides, t.defaultLimit())
+	return limitRequests(t.fallback.wrap(t.takeToken), identify, overrides, t.defaultLimit(), &t.rejection, t.logger, handler)
+}
+
+// limitRequests takes a token for the client of each request from the
+// bucket of the limit that applies to the request, and rejects the request
+// if no token could be taken.
+func limitRequests(takeToken func(user string, limit Limit) (token, error), identify ClientIdentifier, overrides []Override, defaults Limit, rejection *rejection, logger *logging.Logger, handler httprouter.Handle) httprouter.Handle {
 	return func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
-		user := t.identifyClient(req)
-		remaining, limit, err := t.takeToken(user)
+		user := identify(req)
+		tok, err := takeToken(user, selectLimit(req, overrides, defaults))
 
 		if err != nil {
-			t.logger.Errorf("Error occurred while handling request from %s: %s", req.RemoteAddr, err)
+			logger.Errorf("Error occurred while handling request from %s: %s", clientip.FromRequest(req), err)
 			rw.Header().Set("Content-Type", "application/json")
 			rw.WriteHeader(503)
 			_, _ = rw.Write([]byte("{\"msg\":\"service unavailable\"}"))
 			return
 		}
 
+		remaining := tok.remaining
 		if remaining < 0 {
 			remaining = 0
 		}
 
-		rw.Header().Add("X-RateLimit", strconv.Itoa(limit))
+		rw.Header().Add("X-RateLimit", strconv.Itoa(tok.limit))
 		rw.Header().Add("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		rw.Header().Set("RateLimit-Limit", strconv.Itoa(tok.limit))
+		rw.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		rw.Header().Set("RateLimit-Reset", seconds(tok.reset))
 
-		if remaining <= 0 {
-			rw.Header().Set("Content-Type", "application/json")
+		if !tok.taken {
+			rw.Header().Set("Retry-After", seconds(tok.retryAfter))
+			rw.Header().Set("Content-Type", rejection.contentType)
 			rw.WriteHeader(429)
-			_, _ = rw.Write([]byte("{\"msg\":\"rate limit exceeded\"}"))
+			_, _ = rw.Write(rejection.body)
 		} else {
 			handler(rw, req, p)
 		}
 	}
 }
+
+// seconds formats a duration as whole seconds for the rate-limit headers,
+// rounding up so that clients do not retry too early.
+func seconds(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
@@ -0,0 +1,170 @@
+package ratelimit
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/redisconn"
+	"github.com/op/go-logging"
+)
+
+// slidingWindowScript counts the requests of a client in a hash that holds
+// one counter per fixed window. The requests of the previous window are
+// weighted by how much of it still overlaps with the sliding window, so that
+// bursts at the boundary of two windows cannot exceed the limit. The Redis
+// server's clock is used, so that all gateway instances agree on the current
+// window.
+//
+// KEYS[1] is the client's hash, ARGV[1] the limit, ARGV[2] the window length
+// in milliseconds and ARGV[3] the number of tokens to take (0 only reads the
+// bucket). It returns whether the tokens were taken, the remaining tokens,
+// the milliseconds until the current window ends and, if the tokens were not
+// taken, the milliseconds until they can be taken.
+var slidingWindowScript = redis.NewScript(1, `
+if redis.replicate_commands then
+	redis.replicate_commands()
+end
+
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local current = math.floor(now / window)
+local elapsed = now - current * window
+
+local currentCount = 0
+local previousCount = 0
+local counts = redis.call("HGETALL", key)
+for i = 1, #counts, 2 do
+	local index = tonumber(counts[i])
+	if index == current then
+		currentCount = tonumber(counts[i + 1])
+	elseif index == current - 1 then
+		previousCount = tonumber(counts[i + 1])
+	else
+		redis.call("HDEL", key, counts[i])
+	end
+end
+
+local remaining = limit - (previousCount * (window - elapsed) / window + currentCount)
+local taken = 0
+local retry = 0
+if cost > 0 and remaining >= cost then
+	redis.call("HINCRBY", key, current, cost)
+	redis.call("PEXPIRE", key, window * 2)
+	remaining = remaining - cost
+	taken = 1
+elseif cost > 0 and currentCount + cost <= limit then
+	-- wait until enough of the previous window has left the sliding window
+	retry = math.ceil(window - (limit - cost - currentCount) * window / previousCount - elapsed)
+elseif cost > 0 then
+	-- wait for the next window, and until enough of the current one has left
+	-- the sliding window
+	retry = window - elapsed + math.ceil(math.min(window, window * (1 - (limit - cost) / currentCount)))
+end
+
+return {taken, math.floor(remaining), window - elapsed, retry}
+`)
+
+// RedisSlidingWindowRateThrottler limits the requests of each client within
+// a sliding time window, which is approximated from the request counts of the
+// current and the previous fixed window. The counters are kept in Redis, so
+// that the limit is shared by all gateway instances.
+type RedisSlidingWindowRateThrottler struct {
+	burstSize int64
+	window    time.Duration
+	redisPool redisconn.Source
+	logger    *logging.Logger
+	limits    limitRegistry
+	rejection rejection
+	fallback  *fallbackLimiter
+}
+
+func NewSlidingWindowRateLimiter(burstSize int64, window time.Duration, red redisconn.Source, logger *logging.Logger) *RedisSlidingWindowRateThrottler {
+	return &RedisSlidingWindowRateThrottler{
+		burstSize: burstSize,
+		window:    window,
+		redisPool: red,
+		logger:    logger,
+		rejection: newRejection(&config.RateLimitRejection{}),
+	}
+}
+
+func (t *RedisSlidingWindowRateThrottler) defaultLimit() Limit {
+	return Limit{Burst: t.burstSize, Window: t.window}
+}
+
+func (t *RedisSlidingWindowRateThrottler) run(conn redis.Conn, key string, limit Limit, cost int) (token, error) {
+	values, err := redis.Int64s(slidingWindowScript.Do(conn, key, limit.Burst, limit.Window.Milliseconds(), cost))
+	if err != nil {
+		return token{}, err
+	}
+
+	remaining := int(values[1])
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return token{
+		taken:      values[0] == 1,
+		remaining:  remaining,
+		limit:      int(limit.Burst),
+		reset:      time.Duration(values[2]) * time.Millisecond,
+		retryAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
+
+func (t *RedisSlidingWindowRateThrottler) takeToken(user string, limit Limit) (token, error) {
+	conn := t.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	return t.run(conn, bucketKey("RL_SLIDING_", limit, user), limit, 1)
+}
+
+// Buckets returns the buckets of all clients that sent requests within the
+// last two windows.
+func (t *RedisSlidingWindowRateThrottler) Buckets() ([]BucketStatus, error) {
+	keys, err := redisconn.Keys(t.redisPool, "RL_SLIDING_*")
+	if err != nil {
+		return nil, err
+	}
+
+	conn := t.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	defaults := t.defaultLimit()
+	buckets := make([]BucketStatus, 0, len(keys))
+	for _, key := range keys {
+		limit, client := t.limits.parse(strings.TrimPrefix(key, "RL_SLIDING_"), defaults)
+
+		tok, err := t.run(conn, key, limit, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		buckets = append(buckets, BucketStatus{
+			Client:    client,
+			Override:  limit.Name,
+			Remaining: tok.remaining,
+			Limit:     tok.limit,
+			ResetIn:   tok.reset,
+		})
+	}
+
+	return buckets, nil
+}
+
+func (t *RedisSlidingWindowRateThrottler) DecorateHandler(handler httprouter.Handle, identify ClientIdentifier, overrides []Override) httprouter.Handle {
+	t.limits.add(overrides, t.defaultLimit())
+	return limitRequests(t.fallback.wrap(t.takeToken), identify, overrides, t.defaultLimit(), &t.rejection, t.logger, handler)
+}
@@ -0,0 +1,38 @@
+package redact
+
+import (
+	"sync/atomic"
+
+	"github.com/op/go-logging"
+)
+
+// Backend is a logging backend that masks credentials in the arguments of
+// log records before passing them on.
+type Backend struct {
+	backend  logging.Backend
+	redactor atomic.Value
+}
+
+func NewBackend(backend logging.Backend, redactor *Redactor) *Backend {
+	b := Backend{backend: backend}
+	b.redactor.Store(redactor)
+	return &b
+}
+
+// SetRedactor replaces the redactor, for example once the configuration
+// has been loaded.
+func (b *Backend) SetRedactor(redactor *Redactor) {
+	b.redactor.Store(redactor)
+}
+
+func (b *Backend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	redactor := b.redactor.Load().(*Redactor)
+
+	redacted := *rec
+	redacted.Args = make([]interface{}, len(rec.Args))
+	for i, arg := range rec.Args {
+		redacted.Args[i] = redactor.Value(arg)
+	}
+
+	return b.backend.Log(level, calldepth+1, &redacted)
+}
@@ -0,0 +1,147 @@
+package redact
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+const Mask = "*REDACTED*"
+
+var (
+	defaultHeaders         = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+	defaultQueryParameters = []string{"token", "access_token", "refresh_token", "id_token", "password", "api_key", "apikey", "client_secret", "code"}
+	defaultJsonFields      = []string{"password", "token", "access_token", "refresh_token", "id_token", "jwt", "secret", "client_secret", "api_key", "private_key"}
+)
+
+// Redactor masks credentials (like passwords and tokens) in log output. It
+// recognizes them as header values, query parameters and JSON fields with
+// one of the configured names, in addition to a set of common names.
+type Redactor struct {
+	headers    map[string]bool
+	jsonFields map[string]bool
+
+	headerPattern *regexp.Regexp
+	queryPattern  *regexp.Regexp
+	jsonPattern   *regexp.Regexp
+}
+
+func NewRedactor(cfg *config.LogRedactionConfiguration) *Redactor {
+	headers := append(append([]string{}, defaultHeaders...), cfg.Headers...)
+	queryParameters := append(append([]string{}, defaultQueryParameters...), cfg.QueryParameters...)
+	jsonFields := append(append([]string{}, defaultJsonFields...), cfg.JsonFields...)
+
+	r := Redactor{
+		headers:    make(map[string]bool),
+		jsonFields: make(map[string]bool),
+	}
+
+	for _, h := range headers {
+		r.headers[http.CanonicalHeaderKey(h)] = true
+	}
+
+	for _, f := range jsonFields {
+		r.jsonFields[strings.ToLower(f)] = true
+	}
+
+	r.headerPattern = regexp.MustCompile(`(?i)\b(` + alternatives(headers) + `)(\s*:\s*)[^\r\n]+`)
+	r.queryPattern = regexp.MustCompile(`(?i)(^|[?&;\s])((?:` + alternatives(queryParameters) + `)=)[^&;\s"']*`)
+	r.jsonPattern = regexp.MustCompile(`(?i)("(?:` + alternatives(jsonFields) + `)"\s*:\s*)("(?:[^"\\]|\\.)*"|[^,}\]\s]+)`)
+
+	return &r
+}
+
+func alternatives(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = regexp.QuoteMeta(name)
+	}
+
+	return strings.Join(quoted, "|")
+}
+
+// String masks the credentials contained in a string.
+func (r *Redactor) String(s string) string {
+	s = r.headerPattern.ReplaceAllString(s, "${1}${2}"+Mask)
+	s = r.queryPattern.ReplaceAllString(s, "${1}${2}"+Mask)
+	s = r.jsonPattern.ReplaceAllString(s, `${1}"`+Mask+`"`)
+	return s
+}
+
+// Header returns a copy of a header in which the values of credential
+// headers are masked.
+func (r *Redactor) Header(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for name, values := range header {
+		if r.headers[http.CanonicalHeaderKey(name)] {
+			redacted[name] = []string{Mask}
+		} else {
+			redacted[name] = values
+		}
+	}
+
+	return redacted
+}
+
+// Map returns a copy of a decoded JSON object in which credential fields
+// are masked.
+func (r *Redactor) Map(m map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		if r.jsonFields[strings.ToLower(key)] {
+			redacted[key] = Mask
+		} else if nested, ok := value.(map[string]interface{}); ok {
+			redacted[key] = r.Map(nested)
+		} else {
+			redacted[key] = value
+		}
+	}
+
+	return redacted
+}
+
+// Value masks the credentials contained in an argument of a log statement.
+// Values that do not contain credentials are returned unchanged, so that
+// they are still formatted according to their type.
+func (r *Redactor) Value(value interface{}) interface{} {
+	var s string
+
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case http.Header:
+		return r.Header(v)
+	case map[string]interface{}:
+		return r.Map(v)
+	case *url.URL:
+		s = v.String()
+	case error:
+		s = v.Error()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		return value
+	}
+
+	if redacted := r.String(s); redacted != s {
+		return redacted
+	}
+
+	return value
+}
+
+// Token masks a token that is logged on purpose, keeping only a short prefix
+// so that log lines about the same token can still be correlated.
+func Token(token string) string {
+	if len(token) <= 12 {
+		return Mask
+	}
+
+	return token[:6] + Mask
+}
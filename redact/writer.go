@@ -0,0 +1,24 @@
+package redact
+
+import (
+	"io"
+)
+
+type writer struct {
+	writer   io.Writer
+	redactor *Redactor
+}
+
+// Writer masks credentials in the data written to a log. Each write needs
+// to contain complete log lines.
+func Writer(w io.Writer, redactor *Redactor) io.Writer {
+	return &writer{writer: w, redactor: redactor}
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	if _, err := w.writer.Write([]byte(w.redactor.String(string(b)))); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
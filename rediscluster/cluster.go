@@ -0,0 +1,80 @@
+package rediscluster
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+)
+
+// maxAttempts limits the redirections (MOVED and ASK replies) and retries
+// (TRYAGAIN replies) that are followed for a single command.
+const maxAttempts = 5
+
+const tryAgainDelay = 100 * time.Millisecond
+
+// UnavailableError is returned when no node of the cluster can be reached,
+// or the cluster's slots cannot be resolved to a node.
+var UnavailableError = errors.New("redis cluster is unavailable")
+
+// Cluster is a Redis Cluster client. Slot mapping, connection pools per node
+// and redirections are handled by redisc; Cluster adds the routing of
+// scripts and transactions by their keys, so that it can be used like a
+// *redis.Pool.
+type Cluster struct {
+	cluster *redisc.Cluster
+}
+
+func NewCluster(seeds []string, dialOpts ...redis.DialOption) *Cluster {
+	return &Cluster{
+		cluster: &redisc.Cluster{
+			StartupNodes: seeds,
+			DialOptions:  dialOpts,
+			CreatePool: func(addr string, opts ...redis.DialOption) (*redis.Pool, error) {
+				return &redis.Pool{
+					MaxIdle: 8,
+					Dial: func() (redis.Conn, error) {
+						return redis.Dial("tcp", addr, opts...)
+					},
+				}, nil
+			},
+		},
+	}
+}
+
+// Get returns a connection that routes commands across the cluster. It
+// satisfies the same contract as (*redis.Pool).Get.
+func (c *Cluster) Get() redis.Conn {
+	return &conn{cluster: c.cluster}
+}
+
+func (c *Cluster) Close() error {
+	return c.cluster.Close()
+}
+
+// Stats returns the combined statistics of the connection pools of all
+// nodes.
+func (c *Cluster) Stats() redis.PoolStats {
+	var stats redis.PoolStats
+	for _, s := range c.cluster.Stats() {
+		stats.ActiveCount += s.ActiveCount
+		stats.IdleCount += s.IdleCount
+		stats.WaitCount += s.WaitCount
+		stats.WaitDuration += s.WaitDuration
+	}
+
+	return stats
+}
+
+// EachMaster calls a function with a connection to each master node, for
+// commands that operate on the keys of a node (like SCAN).
+func (c *Cluster) EachMaster(fn func(conn redis.Conn) error) error {
+	if err := c.cluster.Refresh(); err != nil {
+		return err
+	}
+
+	return c.cluster.EachNode(false, func(_ string, conn redis.Conn) error {
+		return fn(conn)
+	})
+}
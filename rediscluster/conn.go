@@ -0,0 +1,230 @@
+package rediscluster
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+)
+
+// keylessCommands lists commands that do not operate on a key and can
+// therefore be sent to an arbitrary node.
+var keylessCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"PING":    true,
+	"ECHO":    true,
+	"INFO":    true,
+	"TIME":    true,
+	"SCRIPT":  true,
+	"CLUSTER": true,
+}
+
+type command struct {
+	name string
+	args []interface{}
+}
+
+// conn routes single commands by their key. Pipelined commands (Send, Flush
+// and Receive, e.g. for MULTI/EXEC transactions) are pinned to the node that
+// serves the first key in the pipeline, so all keys of a transaction must
+// hash to the same slot.
+type conn struct {
+	cluster *redisc.Cluster
+	bound   redis.Conn
+	pending []command
+	err     error
+}
+
+func argString(arg interface{}) string {
+	switch a := arg.(type) {
+	case string:
+		return a
+	case []byte:
+		return string(a)
+	default:
+		return fmt.Sprint(a)
+	}
+}
+
+func commandKey(name string, args []interface{}) (string, bool) {
+	name = strings.ToUpper(name)
+
+	if keylessCommands[name] || len(args) == 0 {
+		return "", false
+	}
+
+	if name == "EVAL" || name == "EVALSHA" {
+		if len(args) < 3 {
+			return "", false
+		}
+
+		numKeys, err := strconv.Atoi(argString(args[1]))
+		if err != nil || numKeys < 1 {
+			return "", false
+		}
+
+		return argString(args[2]), true
+	}
+
+	return argString(args[0]), true
+}
+
+// nodeConn returns a connection that is bound to the node serving the key
+// (or to a random node).
+func (c *conn) nodeConn(key string, hasKey bool) (redis.Conn, error) {
+	nodeConn := c.cluster.Get()
+
+	var err error
+	if hasKey {
+		err = redisc.BindConn(nodeConn, key)
+	} else {
+		err = redisc.BindConn(nodeConn)
+	}
+
+	if err != nil {
+		_ = nodeConn.Close()
+		return nil, clusterError(err)
+	}
+
+	return nodeConn, nil
+}
+
+func (c *conn) Close() error {
+	if c.bound != nil {
+		return c.bound.Close()
+	}
+	return nil
+}
+
+func (c *conn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.bound != nil {
+		return c.bound.Err()
+	}
+	return nil
+}
+
+func (c *conn) bind(key string, hasKey bool) error {
+	if c.bound != nil {
+		return nil
+	}
+
+	nodeConn, err := c.nodeConn(key, hasKey)
+	if err != nil {
+		c.err = err
+		return err
+	}
+
+	c.bound = nodeConn
+	for _, cmd := range c.pending {
+		if err := c.bound.Send(cmd.name, cmd.args...); err != nil {
+			c.err = err
+			return err
+		}
+	}
+	c.pending = nil
+
+	return nil
+}
+
+func (c *conn) Do(name string, args ...interface{}) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	key, hasKey := commandKey(name, args)
+
+	// inside of a pipeline or transaction; stay on the same node
+	if c.bound != nil || len(c.pending) > 0 {
+		if err := c.bind(key, hasKey); err != nil {
+			return nil, err
+		}
+		return c.bound.Do(name, args...)
+	}
+
+	if name == "" {
+		return nil, nil
+	}
+
+	nodeConn, err := c.nodeConn(key, hasKey)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = nodeConn.Close()
+	}()
+
+	retryConn, err := redisc.RetryConn(nodeConn, maxAttempts, tryAgainDelay)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := retryConn.Do(name, args...)
+	return reply, clusterError(err)
+}
+
+// clusterError marks the errors of redisc about the state of the cluster
+// (like unreachable nodes), as opposed to errors reported by Redis.
+func clusterError(err error) error {
+	if err != nil && strings.HasPrefix(err.Error(), "redisc: ") {
+		return fmt.Errorf("%w: %s", UnavailableError, err)
+	}
+
+	return err
+}
+
+func (c *conn) Send(name string, args ...interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+
+	if c.bound == nil {
+		key, hasKey := commandKey(name, args)
+		if !hasKey {
+			c.pending = append(c.pending, command{name: name, args: args})
+			return nil
+		}
+
+		if err := c.bind(key, true); err != nil {
+			return err
+		}
+	}
+
+	return c.bound.Send(name, args...)
+}
+
+func (c *conn) Flush() error {
+	if c.bound == nil && len(c.pending) == 0 {
+		return nil
+	}
+
+	if err := c.bind("", false); err != nil {
+		return err
+	}
+
+	return c.bound.Flush()
+}
+
+func (c *conn) Receive() (interface{}, error) {
+	if err := c.bind("", false); err != nil {
+		return nil, err
+	}
+
+	return c.bound.Receive()
+}
+
+// ReceiveWithTimeout makes the connection usable with redigo's PubSubConn.
+func (c *conn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	if err := c.bind("", false); err != nil {
+		return nil, err
+	}
+
+	return redis.ReceiveWithTimeout(c.bound, timeout)
+}
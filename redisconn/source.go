@@ -0,0 +1,151 @@
+package redisconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/rediscluster"
+	"github.com/mittwald/servicegateway/redissentinel"
+)
+
+// Source provides Redis connections. It is implemented by *redis.Pool,
+// *rediscluster.Cluster and *redissentinel.Sentinel.
+type Source interface {
+	Get() redis.Conn
+}
+
+// FromConfig builds a connection source for the Redis deployment described
+// by the configuration; either a single server, a master monitored by Redis
+// Sentinel, or a Redis Cluster.
+func FromConfig(cfg *config.RedisConfiguration) (Source, error) {
+	dialOpts, err := cfg.DialOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Mode {
+	case "", "standalone":
+		return &redis.Pool{
+			MaxIdle: 8,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", cfg.Address, dialOpts...)
+			},
+		}, nil
+	case "sentinel":
+		if cfg.MasterName == "" {
+			return nil, fmt.Errorf("redis sentinel mode requires a master name")
+		}
+
+		if len(cfg.Addresses) == 0 {
+			return nil, fmt.Errorf("no redis sentinel addresses configured")
+		}
+
+		sentinelOpts, err := cfg.SentinelDialOptions()
+		if err != nil {
+			return nil, err
+		}
+
+		return redissentinel.NewSentinel(cfg.MasterName, cfg.Addresses, sentinelOpts, dialOpts), nil
+	case "cluster":
+		if len(cfg.Addresses) == 0 {
+			return nil, fmt.Errorf("no redis cluster addresses configured")
+		}
+
+		if cfg.Database != 0 {
+			return nil, fmt.Errorf("redis cluster mode does not support databases other than 0")
+		}
+
+		return rediscluster.NewCluster(cfg.Addresses, dialOpts...), nil
+	}
+
+	return nil, fmt.Errorf("unsupported redis mode: '%s'", cfg.Mode)
+}
+
+// Keys returns the keys matching a pattern. Unlike the KEYS command, it
+// iterates over the keys with SCAN, so that Redis is not blocked while
+// large databases are searched. On a Redis Cluster, the keys of all master
+// nodes are returned.
+func Keys(source Source, pattern string) ([]string, error) {
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+
+	scan := func(conn redis.Conn) error {
+		cursor := "0"
+		for {
+			values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+			if err != nil {
+				return err
+			}
+
+			var batch []string
+			if _, err := redis.Scan(values, &cursor, &batch); err != nil {
+				return err
+			}
+
+			// SCAN may return a key more than once
+			for _, key := range batch {
+				if !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
+				}
+			}
+
+			if cursor == "0" {
+				return nil
+			}
+		}
+	}
+
+	if cluster, ok := source.(*rediscluster.Cluster); ok {
+		if err := cluster.EachMaster(scan); err != nil {
+			return nil, err
+		}
+		return keys, nil
+	}
+
+	conn := source.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if err := scan(conn); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// IsUnavailable reports whether an error means that Redis cannot be reached,
+// as opposed to errors reported by Redis itself or values that cannot be
+// decoded.
+func IsUnavailable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	for _, target := range []error{
+		io.EOF,
+		io.ErrUnexpectedEOF,
+		syscall.ECONNREFUSED,
+		syscall.ECONNRESET,
+		syscall.EPIPE,
+		context.DeadlineExceeded,
+		redis.ErrPoolExhausted,
+		redissentinel.NoSentinelsError,
+		redissentinel.NotMasterError,
+		rediscluster.UnavailableError,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,154 @@
+package redissentinel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var NoSentinelsError = errors.New("no reachable redis sentinels")
+
+// NotMasterError is returned when the node that the sentinels reported as
+// master is not (or no longer) the master, for example during a failover.
+var NotMasterError = errors.New("redis node is not the master")
+
+// Sentinel is a connection pool for a Redis master that is monitored by a
+// set of Redis Sentinels. The address of the current master is looked up
+// from the sentinels whenever a new connection is dialed, and pooled
+// connections are checked to still point to a master before they are
+// reused, so that the pool follows failovers.
+type Sentinel struct {
+	masterName   string
+	addresses    []string
+	sentinelOpts []redis.DialOption
+	dialOpts     []redis.DialOption
+
+	pool *redis.Pool
+	lock sync.Mutex
+}
+
+func NewSentinel(masterName string, addresses []string, sentinelOpts []redis.DialOption, dialOpts []redis.DialOption) *Sentinel {
+	s := Sentinel{
+		masterName:   masterName,
+		addresses:    append([]string{}, addresses...),
+		sentinelOpts: sentinelOpts,
+		dialOpts:     dialOpts,
+	}
+
+	s.pool = &redis.Pool{
+		MaxIdle: 8,
+		Dial:    s.dial,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Second {
+				return nil
+			}
+
+			return checkMaster(c)
+		},
+	}
+
+	return &s
+}
+
+// Get returns a connection to the current master. It satisfies the same
+// contract as (*redis.Pool).Get.
+func (s *Sentinel) Get() redis.Conn {
+	return s.pool.Get()
+}
+
+func (s *Sentinel) Stats() redis.PoolStats {
+	return s.pool.Stats()
+}
+
+func (s *Sentinel) Close() error {
+	return s.pool.Close()
+}
+
+// MasterAddress asks the sentinels for the address of the current master.
+// The first sentinel that answers is preferred for subsequent lookups.
+func (s *Sentinel) MasterAddress() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var lastErr error = NoSentinelsError
+	for i, addr := range s.addresses {
+		masterAddr, err := s.queryMasterAddress(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		s.addresses[0], s.addresses[i] = s.addresses[i], s.addresses[0]
+		return masterAddr, nil
+	}
+
+	return "", fmt.Errorf("could not look up redis master '%s': %w", s.masterName, lastErr)
+}
+
+func (s *Sentinel) queryMasterAddress(addr string) (string, error) {
+	conn, err := redis.Dial("tcp", addr, s.sentinelOpts...)
+	if err != nil {
+		return "", err
+	}
+
+	defer conn.Close()
+
+	reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.masterName))
+	if err == redis.ErrNil {
+		return "", fmt.Errorf("sentinel %s does not know master '%s'", addr, s.masterName)
+	} else if err != nil {
+		return "", err
+	}
+
+	if len(reply) != 2 {
+		return "", fmt.Errorf("unexpected reply from sentinel %s", addr)
+	}
+
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+func (s *Sentinel) dial() (redis.Conn, error) {
+	addr, err := s.MasterAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := redis.Dial("tcp", addr, s.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// the sentinels may not have noticed a failover yet
+	if err := checkMaster(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func checkMaster(conn redis.Conn) error {
+	reply, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+
+	if len(reply) == 0 {
+		return errors.New("unexpected ROLE reply")
+	}
+
+	role, err := redis.String(reply[0], nil)
+	if err != nil {
+		return err
+	}
+
+	if role != "master" {
+		return fmt.Errorf("%w (its role is '%s')", NotMasterError, role)
+	}
+
+	return nil
+}
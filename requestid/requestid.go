@@ -0,0 +1,116 @@
+package requestid
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/mittwald/servicegateway/clientip"
+	"github.com/mittwald/servicegateway/config"
+)
+
+type contextKey int
+
+const requestIdContextKey contextKey = iota
+
+// Generator assigns a unique ID to each request. The ID is passed to the
+// upstream services and returned to the client in a header, so that a
+// request can be traced across services and log files.
+type Generator struct {
+	header    string
+	clientIPs *clientip.Resolver
+}
+
+func NewGenerator(cfg *config.RequestIdConfiguration, clientIPs *clientip.Resolver) *Generator {
+	g := Generator{
+		header:    http.CanonicalHeaderKey(cfg.Header),
+		clientIPs: clientIPs,
+	}
+
+	if g.header == "" {
+		g.header = "X-Request-Id"
+	}
+
+	return &g
+}
+
+// isValid checks whether an incoming request ID can be used. IDs end up in
+// log files and headers, so only short, printable IDs are accepted.
+func isValid(id string) bool {
+	if id == "" || len(id) > 200 {
+		return false
+	}
+
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Decorate assigns an ID to each request. Request IDs that were set by one
+// of the trusted proxies are kept, so that a request has the same ID in
+// front of and behind the gateway.
+func (g *Generator) Decorate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(g.header)
+		if !isValid(id) || !g.clientIPs.IsTrustedPeer(req) {
+			id = uuid.NewString()
+		}
+
+		ctx := context.WithValue(req.Context(), requestIdContextKey, id)
+		req = req.WithContext(ctx)
+
+		req.Header = req.Header.Clone()
+		req.Header.Set(g.header, id)
+
+		handler.ServeHTTP(&responseWriter{ResponseWriter: rw, header: g.header, id: id}, req)
+	})
+}
+
+// FromRequest returns the ID of a request.
+func FromRequest(req *http.Request) string {
+	if id, ok := req.Context().Value(requestIdContextKey).(string); ok {
+		return id
+	}
+
+	return req.Header.Get("X-Request-Id")
+}
+
+// responseWriter sets the request ID header of a response once it is
+// written, replacing any IDs that upstream services may have sent back.
+type responseWriter struct {
+	http.ResponseWriter
+	header      string
+	id          string
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set(w.header, w.id)
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mittwald/servicegateway/config"
+)
+
+// runSchema implements the schema subcommand, which prints the JSON schema
+// of the configuration file (or of application definitions), and returns
+// the exit code of the process.
+func runSchema(args []string) int {
+	flags := flag.NewFlagSet("schema", flag.ExitOnError)
+	application := flags.Bool("application", false, "print the schema of application definitions (like included files)")
+	_ = flags.Parse(args)
+
+	schema := config.Schema(config.Configuration{})
+	if *application {
+		schema = config.Schema(config.Application{})
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(schema); err != nil {
+		fmt.Fprintf(os.Stderr, "could not encode schema: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
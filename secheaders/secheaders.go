@@ -0,0 +1,102 @@
+package secheaders
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+)
+
+// defaults are suitable for APIs; applications that serve web pages will
+// usually need a less strict content security policy.
+var defaults = config.SecurityHeaders{
+	StrictTransportSecurity: "max-age=31536000; includeSubDomains",
+	ContentTypeOptions:      "nosniff",
+	FrameOptions:            "DENY",
+	ReferrerPolicy:          "strict-origin-when-cross-origin",
+	ContentSecurityPolicy:   "default-src 'none'; frame-ancestors 'none'",
+}
+
+type header struct {
+	name  string
+	value string
+}
+
+// Injector adds security headers to responses.
+type Injector struct {
+	headers  []header
+	override bool
+}
+
+func NewInjector(cfg *config.SecurityHeaders) *Injector {
+	i := Injector{override: cfg.Override}
+
+	i.add("Strict-Transport-Security", cfg.StrictTransportSecurity, defaults.StrictTransportSecurity)
+	i.add("X-Content-Type-Options", cfg.ContentTypeOptions, defaults.ContentTypeOptions)
+	i.add("X-Frame-Options", cfg.FrameOptions, defaults.FrameOptions)
+	i.add("Referrer-Policy", cfg.ReferrerPolicy, defaults.ReferrerPolicy)
+	i.add("Content-Security-Policy", cfg.ContentSecurityPolicy, defaults.ContentSecurityPolicy)
+
+	return &i
+}
+
+func (i *Injector) add(name string, value string, defaultValue string) {
+	switch value {
+	case "-":
+		return
+	case "":
+		value = defaultValue
+	}
+
+	i.headers = append(i.headers, header{name: name, value: value})
+}
+
+// DecorateHandler adds the security headers to the responses of a handler,
+// including the responses that the gateway itself generates. Headers that
+// the upstream sets are kept, unless they should be overridden.
+func (i *Injector) DecorateHandler(handler httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		handler(&injectingResponseWriter{ResponseWriter: rw, injector: i}, req, params)
+	}
+}
+
+type injectingResponseWriter struct {
+	http.ResponseWriter
+	injector    *Injector
+	wroteHeader bool
+}
+
+func (w *injectingResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	header := w.Header()
+	for _, h := range w.injector.headers {
+		if w.injector.override || header.Get(h.name) == "" {
+			header.Set(h.name, h.value)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *injectingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *injectingResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
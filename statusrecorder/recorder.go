@@ -0,0 +1,67 @@
+package statusrecorder
+
+import (
+	"net/http"
+)
+
+// Recorder passes a response through unchanged, and records its status code
+// and the number of body bytes written, so that middlewares can log or count
+// the response once the handler returned.
+type Recorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+// New wraps a response writer. Responses whose handler never sets a status
+// code are recorded with status 200, like the HTTP server sends them.
+func New(rw http.ResponseWriter) *Recorder {
+	return &Recorder{ResponseWriter: rw, status: 200}
+}
+
+// Status returns the status code of the response.
+func (r *Recorder) Status() int {
+	return r.status
+}
+
+// Bytes returns the number of body bytes written.
+func (r *Recorder) Bytes() int64 {
+	return r.bytes
+}
+
+// WroteHeader reports whether the response headers were sent.
+func (r *Recorder) WroteHeader() bool {
+	return r.wroteHeader
+}
+
+func (r *Recorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.wroteHeader = true
+		r.status = code
+	}
+
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *Recorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *Recorder) Flush() {
+	r.wroteHeader = true
+
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped response writer, for use by
+// http.ResponseController.
+func (r *Recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
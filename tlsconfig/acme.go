@@ -0,0 +1,116 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/redisconn"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const acmeRedisKeyPrefix = "ACME_"
+
+// Acme obtains and renews certificates for the configured host names from
+// an ACME certificate authority (Let's Encrypt, unless configured
+// otherwise).
+type Acme struct {
+	manager *autocert.Manager
+	hosts   map[string]bool
+}
+
+// NewAcme sets up automatic certificates. Certificates, account keys and
+// challenge tokens are stored in Redis or in a directory, so that gateway
+// instances that share the storage share their certificates.
+func NewAcme(cfg *config.AcmeConfiguration, redisPool redisconn.Source) (*Acme, error) {
+	a := Acme{hosts: make(map[string]bool)}
+
+	for _, host := range cfg.Hosts {
+		a.hosts[strings.ToLower(host)] = true
+	}
+
+	a.manager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.Hosts...),
+		Email:      cfg.Email,
+	}
+
+	if cfg.DirectoryUrl != "" {
+		a.manager.Client = &acme.Client{DirectoryURL: cfg.DirectoryUrl}
+	}
+
+	switch cfg.Storage {
+	case "", "redis":
+		a.manager.Cache = &redisCache{redisPool: redisPool}
+	case "disk":
+		if cfg.Directory == "" {
+			return nil, fmt.Errorf("acme storage 'disk' requires a directory")
+		}
+		a.manager.Cache = autocert.DirCache(cfg.Directory)
+	default:
+		return nil, fmt.Errorf("unsupported acme storage '%s'", cfg.Storage)
+	}
+
+	return &a, nil
+}
+
+// handles reports whether a TLS handshake is answered with an automatic
+// certificate; either because it is for one of the configured host names,
+// or because it is a TLS-ALPN-01 challenge.
+func (a *Acme) handles(hello *tls.ClientHelloInfo) bool {
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+		return true
+	}
+
+	return a.hosts[strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))]
+}
+
+// HTTPHandler answers HTTP-01 challenges, and redirects all other requests
+// to HTTPS.
+func (a *Acme) HTTPHandler() http.Handler {
+	return a.manager.HTTPHandler(nil)
+}
+
+// redisCache stores the data of the ACME manager in Redis.
+type redisCache struct {
+	redisPool redisconn.Source
+}
+
+func (r *redisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	conn := r.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	value, err := redis.Bytes(conn.Do("GET", acmeRedisKeyPrefix+key))
+	if err == redis.ErrNil {
+		return nil, autocert.ErrCacheMiss
+	}
+
+	return value, err
+}
+
+func (r *redisCache) Put(ctx context.Context, key string, data []byte) error {
+	conn := r.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_, err := conn.Do("SET", acmeRedisKeyPrefix+key, data)
+	return err
+}
+
+func (r *redisCache) Delete(ctx context.Context, key string) error {
+	conn := r.redisPool.Get()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_, err := conn.Do("DEL", acmeRedisKeyPrefix+key)
+	return err
+}
@@ -0,0 +1,242 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+	"golang.org/x/crypto/acme"
+)
+
+const defaultReloadInterval = 30 * time.Second
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewConfig builds the TLS configuration of the HTTPS listener, which
+// takes its certificates from the given certificate store, or from the
+// ACME certificate authority for the host names that are configured there.
+// One of both may be nil.
+func NewConfig(cfg *config.TLSConfiguration, certs *Certificates, automatic *Acme) (*tls.Config, error) {
+	tlsConfig := tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if automatic != nil && (certs == nil || automatic.handles(hello)) {
+				return automatic.manager.GetCertificate(hello)
+			}
+
+			return certs.GetCertificate(hello)
+		},
+	}
+
+	// TLS-ALPN-01 challenges are answered on the HTTPS listener
+	if automatic != nil {
+		tlsConfig.NextProtos = []string{acme.ALPNProto}
+	}
+
+	if cfg.MinVersion != "" {
+		version, ok := versions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported minimum TLS version '%s'", cfg.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	for _, name := range cfg.CipherSuites {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite '%s'", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+
+	return &tlsConfig, nil
+}
+
+// cipherSuite looks up a cipher suite by its name (like
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). Only cipher suites without known
+// security issues are supported.
+func cipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+
+	return 0, false
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// Certificates holds the certificates of the HTTPS listener, and selects
+// one by the server name that clients ask for (SNI). Certificate files are
+// watched for changes and loaded again without a restart.
+type Certificates struct {
+	files  []config.TLSCertificate
+	logger *logging.Logger
+
+	lock   sync.RWMutex
+	first  *tls.Certificate
+	byName map[string]*tls.Certificate
+	states map[string]fileState
+}
+
+// LoadCertificates loads certificates and their keys. The first
+// certificate is used for clients that do not ask for a server name, or
+// for one that no certificate is issued for.
+func LoadCertificates(files []config.TLSCertificate, logger *logging.Logger) (*Certificates, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no TLS certificates configured")
+	}
+
+	c := Certificates{files: files, logger: logger}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// load reads all certificate files. The certificates in use are only
+// replaced when all of them could be read.
+func (c *Certificates) load() error {
+	var first *tls.Certificate
+	byName := make(map[string]*tls.Certificate)
+	states := make(map[string]fileState)
+
+	for _, file := range c.files {
+		for _, name := range []string{file.CertFile, file.KeyFile} {
+			state, err := stat(name)
+			if err != nil {
+				return err
+			}
+			states[name] = state
+		}
+
+		cert, err := tls.LoadX509KeyPair(file.CertFile, file.KeyFile)
+		if err != nil {
+			return fmt.Errorf("could not load certificate '%s': %s", file.CertFile, err)
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("could not parse certificate '%s': %s", file.CertFile, err)
+		}
+		cert.Leaf = leaf
+
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+
+		// earlier certificates take precedence for names that several
+		// certificates are issued for
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+
+		if first == nil {
+			first = &cert
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.first = first
+	c.byName = byName
+	c.states = states
+
+	return nil
+}
+
+func stat(name string) (fileState, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileState{}, fmt.Errorf("could not read '%s': %s", name, err)
+	}
+
+	return fileState{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// changed reports whether any certificate or key file was modified since
+// the certificates were loaded.
+func (c *Certificates) changed() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for name, state := range c.states {
+		current, err := stat(name)
+		if err != nil || current != state {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetCertificate selects the certificate for a TLS handshake; by exact
+// server name, then by wildcard certificates for its parent domain.
+func (c *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return c.first, nil
+	}
+
+	if cert, ok := c.byName[name]; ok {
+		return cert, nil
+	}
+
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := c.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+
+	return c.first, nil
+}
+
+// Watch checks the certificate files for changes in the given interval
+// (30 seconds if zero), and loads them again when they were modified. If
+// they cannot be loaded (for example, because a certificate was replaced
+// but its key was not yet), the previous certificates stay in use.
+func (c *Certificates) Watch(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !c.changed() {
+			continue
+		}
+
+		if err := c.load(); err != nil {
+			c.logger.Errorf("could not reload TLS certificates: %s", err)
+			continue
+		}
+
+		c.logger.Notice("reloaded TLS certificates")
+	}
+}
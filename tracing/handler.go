@@ -0,0 +1,117 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/clientip"
+	"github.com/mittwald/servicegateway/requestid"
+	"github.com/mittwald/servicegateway/statusrecorder"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type contextKey int
+
+const layerContextKey contextKey = iota
+
+// layer is the span of a middleware (like authentication or rate limiting)
+// that is ended once the middleware passes on the request.
+type layer struct {
+	span   trace.Span
+	parent trace.Span
+}
+
+// Decorate records a span for each request. Trace contexts sent by the
+// client are continued.
+func Decorate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := Tracer().Start(ctx, req.Method, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		if span.IsRecording() {
+			span.SetAttributes(
+				semconv.HTTPMethod(req.Method),
+				semconv.URLPath(req.URL.Path),
+				semconv.ClientAddress(clientip.FromRequest(req)),
+				attribute.String("http.request_id", requestid.FromRequest(req)),
+			)
+		}
+
+		writer := statusrecorder.New(rw)
+		handler.ServeHTTP(writer, req.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCode(writer.Status()))
+		if writer.Status() >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(writer.Status()))
+		}
+	})
+}
+
+// StartLayer records a span for a middleware. The middleware needs to pass
+// requests on to a handler that was wrapped with EndLayer, so that the span
+// only covers the time spent in the middleware itself.
+func StartLayer(name string, handler httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		parent := trace.SpanFromContext(req.Context())
+		ctx, span := Tracer().Start(req.Context(), name)
+		defer span.End()
+
+		ctx = context.WithValue(ctx, layerContextKey, &layer{span: span, parent: parent})
+		handler(rw, req.WithContext(ctx), params)
+	}
+}
+
+// EndLayer ends the span of the middleware that calls the handler. The
+// following handlers are recorded as siblings of the middleware's span.
+func EndLayer(handler httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if l, ok := req.Context().Value(layerContextKey).(*layer); ok && l != nil {
+			l.span.End()
+
+			ctx := trace.ContextWithSpan(req.Context(), l.parent)
+			ctx = context.WithValue(ctx, layerContextKey, (*layer)(nil))
+			req = req.WithContext(ctx)
+		}
+
+		handler(rw, req, params)
+	}
+}
+
+// StartUpstream records a span for an upstream request, and passes the trace
+// context on to the upstream service.
+func StartUpstream(proxyReq *http.Request, appName string) (*http.Request, trace.Span) {
+	ctx, span := Tracer().Start(proxyReq.Context(), "upstream "+appName, trace.WithSpanKind(trace.SpanKindClient))
+
+	if span.IsRecording() {
+		span.SetAttributes(
+			semconv.HTTPMethod(proxyReq.Method),
+			semconv.URLFull(proxyReq.URL.String()),
+			attribute.String("servicegateway.application", appName),
+		)
+	}
+
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(proxyReq.Header))
+
+	return proxyReq.WithContext(ctx), span
+}
+
+// EndUpstream records the result of an upstream request.
+func EndUpstream(span trace.Span, res *http.Response, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+
+	span.SetAttributes(semconv.HTTPStatusCode(res.StatusCode))
+	if res.StatusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(res.StatusCode))
+	}
+}
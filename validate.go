@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/mittwald/servicegateway/auth"
+	"github.com/mittwald/servicegateway/bots"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/mittwald/servicegateway/dispatcher"
+	"github.com/mittwald/servicegateway/ipfilter"
+	"github.com/mittwald/servicegateway/tlsconfig"
+	"github.com/mittwald/servicegateway/vault"
+	"github.com/mittwald/servicegateway/waf"
+	"github.com/op/go-logging"
+)
+
+// runValidate implements the validate subcommand, which checks a
+// configuration file without starting the gateway, and returns the exit
+// code of the process.
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := flags.String("config", "/etc/servicegateway.json", "configuration file")
+	_ = flags.Parse(args)
+
+	errs := validateConfiguration(*configFile)
+	if len(errs) == 0 {
+		fmt.Printf("%s: configuration is valid\n", *configFile)
+		return 0
+	}
+
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *configFile, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: found %d error(s)\n", *configFile, len(errs))
+	return 1
+}
+
+// validateConfiguration parses a configuration file strictly, and checks
+// everything that the gateway would reject on startup (or when registering
+// applications) that can be checked without connecting to other services.
+// Only Vault is connected to, if secrets in it are referenced.
+func validateConfiguration(filename string) []error {
+	var errs []error
+
+	secrets := func(cfg *config.VaultConfiguration) (config.SecretSource, error) {
+		return vault.NewClient(cfg, logging.MustGetLogger("vault"))
+	}
+
+	content, err := renderConfiguration(filename, secrets)
+	if err != nil {
+		return []error{err}
+	}
+
+	cfg := config.Configuration{}
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return []error{err}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config.Configuration{}); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := (&includedFiles{}).load(&cfg, filename, secrets); err != nil {
+		errs = append(errs, err)
+	}
+
+	errs = append(errs, validateAuthentication(&cfg.Authentication)...)
+
+	if _, err := time.ParseDuration(cfg.RateLimiting.Window); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limiting.window: %s", err))
+	}
+
+	if _, err := ipfilter.NewFilter(&cfg.IPFilter); err != nil {
+		errs = append(errs, fmt.Errorf("ip_filter: %s", err))
+	}
+
+	if _, err := waf.NewFilter(&cfg.Waf); err != nil {
+		errs = append(errs, fmt.Errorf("waf: %s", err))
+	}
+
+	if _, err := bots.NewDetector(&cfg.BotDetection, logging.MustGetLogger("bots")); err != nil {
+		errs = append(errs, fmt.Errorf("bot_detection: %s", err))
+	}
+
+	if len(cfg.TLS.Certificates) > 0 {
+		certs, err := tlsconfig.LoadCertificates(cfg.TLS.Certificates, logging.MustGetLogger("tls"))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tls: %s", err))
+		} else if _, err := tlsconfig.NewConfig(&cfg.TLS, certs, nil); err != nil {
+			errs = append(errs, fmt.Errorf("tls: %s", err))
+		}
+	}
+
+	if cfg.Shutdown.DrainTimeout != "" {
+		if _, err := time.ParseDuration(cfg.Shutdown.DrainTimeout); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown.drain_timeout: %s", err))
+		}
+	}
+
+	if cfg.Vault.RefreshInterval != "" {
+		if _, err := time.ParseDuration(cfg.Vault.RefreshInterval); err != nil {
+			errs = append(errs, fmt.Errorf("vault.refresh_interval: %s", err))
+		}
+	}
+
+	switch cfg.Vault.AuthMethod {
+	case "", "token", "approle", "kubernetes":
+	default:
+		errs = append(errs, fmt.Errorf("vault.auth_method: unsupported authentication method '%s'", cfg.Vault.AuthMethod))
+	}
+
+	names := make([]string, 0, len(cfg.Applications))
+	for name := range cfg.Applications {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		appCfg := cfg.Applications[name]
+
+		if err := dispatcher.ValidateApplication(&appCfg); err != nil {
+			errs = append(errs, fmt.Errorf("application %s: %s", name, err))
+		}
+	}
+
+	errs = append(errs, dispatcher.RouteConflicts(cfg.Applications)...)
+
+	return errs
+}
+
+func validateAuthentication(cfg *config.GlobalAuth) []error {
+	var errs []error
+
+	switch cfg.Mode {
+	case "rest", "mtls", "oidc", "saml":
+	default:
+		errs = append(errs, fmt.Errorf("authentication.mode: unsupported authentication mode '%s'", cfg.Mode))
+	}
+
+	if len(cfg.VerificationKey) == 0 && cfg.VerificationKeyUrl == "" && cfg.JwksUrl == "" {
+		errs = append(errs, fmt.Errorf("authentication: one of verification_key, verification_key_url or jwks_url is required"))
+	}
+
+	if _, err := auth.NewJwtVerifier(cfg); err != nil {
+		errs = append(errs, fmt.Errorf("authentication: %s", err))
+	}
+
+	hooks := []struct{ key, file string }{
+		{"hook_pre_authentication", cfg.ProviderConfig.PreAuthenticationHook},
+		{"hook_post_authentication", cfg.ProviderConfig.PostAuthenticationHook},
+	}
+
+	for _, hook := range hooks {
+		if hook.file == "" {
+			continue
+		}
+
+		if err := auth.CheckHook(hook.file); err != nil {
+			errs = append(errs, fmt.Errorf("authentication.provider.%s: %s", hook.key, err))
+		}
+	}
+
+	return errs
+}
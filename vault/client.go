@@ -0,0 +1,320 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/mittwald/servicegateway/config"
+	"github.com/op/go-logging"
+)
+
+const (
+	defaultRefreshInterval = 5 * time.Minute
+	watchInterval          = 10 * time.Second
+	requestTimeout         = 10 * time.Second
+	kubernetesTokenFile    = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+type secret struct {
+	data map[string]string
+	due  time.Time
+
+	// the lease of a dynamic secret, which is renewed until it reaches its
+	// maximum TTL
+	leaseID       string
+	leaseDuration int
+	renewable     bool
+}
+
+// Client reads secrets from HashiCorp Vault. It remembers the secrets that
+// were read, so that their leases can be renewed, and so that they can be
+// read again when their lease cannot be renewed any longer (or, for secrets
+// without a lease, in the refresh interval).
+type Client struct {
+	cfg             *config.VaultConfiguration
+	client          *api.Client
+	refreshInterval time.Duration
+	logger          *logging.Logger
+
+	lock         sync.Mutex
+	tokenExpires time.Time
+	secrets      map[string]*secret
+}
+
+// NewClient logs in to Vault with the configured authentication method;
+// a token (`token`, the default), AppRole (`approle`) or the service
+// account of the Kubernetes pod (`kubernetes`).
+func NewClient(cfg *config.VaultConfiguration, logger *logging.Logger) (*Client, error) {
+	c := Client{
+		cfg:             cfg,
+		refreshInterval: defaultRefreshInterval,
+		logger:          logger,
+		secrets:         make(map[string]*secret),
+	}
+
+	if cfg.RefreshInterval != "" {
+		interval, err := time.ParseDuration(cfg.RefreshInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid refresh interval: %s", err)
+		}
+		c.refreshInterval = interval
+	}
+
+	apiCfg := api.DefaultConfig()
+	if apiCfg.Error != nil {
+		return nil, apiCfg.Error
+	}
+
+	apiCfg.Address = cfg.Address
+	apiCfg.Timeout = requestTimeout
+
+	if cfg.CaFile != "" {
+		if err := apiCfg.ConfigureTLS(&api.TLSConfig{CACert: cfg.CaFile}); err != nil {
+			return nil, fmt.Errorf("could not read CA file: %s", err)
+		}
+	}
+
+	client, err := api.NewClient(apiCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Namespace != "" {
+		client.SetNamespace(cfg.Namespace)
+	}
+
+	c.client = client
+
+	if err := c.login(); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// login obtains a token. Tokens that were obtained with AppRole or
+// Kubernetes credentials are obtained again before they expire.
+func (c *Client) login() error {
+	var mount string
+	var body map[string]interface{}
+
+	switch c.cfg.AuthMethod {
+	case "", "token":
+		token := c.cfg.Token
+		if token == "" {
+			token = os.Getenv("VAULT_TOKEN")
+		}
+
+		if token == "" {
+			return fmt.Errorf("no vault token configured")
+		}
+
+		c.client.SetToken(token)
+		return nil
+	case "approle":
+		mount = "approle"
+		body = map[string]interface{}{"role_id": c.cfg.RoleId, "secret_id": c.cfg.SecretId}
+	case "kubernetes":
+		jwt, err := os.ReadFile(kubernetesTokenFile)
+		if err != nil {
+			return fmt.Errorf("could not read service account token: %s", err)
+		}
+
+		mount = "kubernetes"
+		body = map[string]interface{}{"role": c.cfg.Role, "jwt": strings.TrimSpace(string(jwt))}
+	default:
+		return fmt.Errorf("unsupported vault authentication method '%s'", c.cfg.AuthMethod)
+	}
+
+	if c.cfg.AuthMount != "" {
+		mount = strings.Trim(c.cfg.AuthMount, "/")
+	}
+
+	// an expired token would be rejected, even for logging in
+	c.client.ClearToken()
+
+	res, err := c.client.Logical().Write("auth/"+mount+"/login", body)
+	if err != nil {
+		return fmt.Errorf("could not log in to vault: %s", err)
+	}
+
+	if res == nil || res.Auth == nil || res.Auth.ClientToken == "" {
+		return fmt.Errorf("could not log in to vault: no token in response")
+	}
+
+	c.client.SetToken(res.Auth.ClientToken)
+	c.tokenExpires = time.Time{}
+	if res.Auth.LeaseDuration > 0 {
+		c.tokenExpires = time.Now().Add(renewAfter(res.Auth.LeaseDuration))
+	}
+
+	c.logger.Noticef("logged in to vault at %s using %s", c.cfg.Address, c.cfg.AuthMethod)
+	return nil
+}
+
+// renewAfter returns the time after which a lease (in seconds) is renewed;
+// after two thirds of it, so that there is time to try again.
+func renewAfter(lease int) time.Duration {
+	return time.Duration(lease) * time.Second * 2 / 3
+}
+
+// read reads a secret. Secrets of the KV version 2 engine are unwrapped,
+// so that they are referenced by the same keys as in other engines. Values
+// that are not strings are returned as JSON.
+func (c *Client) read(path string) (*secret, error) {
+	res, err := c.client.Logical().Read(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if res == nil {
+		return nil, fmt.Errorf("secret not found")
+	}
+
+	data := res.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	s := secret{data: make(map[string]string, len(data))}
+	for key, value := range data {
+		if str, ok := value.(string); ok {
+			s.data[key] = str
+			continue
+		}
+
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		s.data[key] = string(encoded)
+	}
+
+	if res.LeaseID != "" && res.LeaseDuration > 0 {
+		s.leaseID = res.LeaseID
+		s.leaseDuration = res.LeaseDuration
+		s.renewable = res.Renewable
+		s.due = time.Now().Add(renewAfter(res.LeaseDuration))
+	} else {
+		s.due = time.Now().Add(c.refreshInterval)
+	}
+
+	return &s, nil
+}
+
+// renew extends the lease of a secret by its original duration. It reports
+// false if the lease cannot be renewed (any longer); leases are not
+// extended beyond their maximum TTL, so that a shorter extension means
+// that the secret has to be read again soon.
+func (c *Client) renew(s *secret) (bool, error) {
+	if s.leaseID == "" || !s.renewable {
+		return false, nil
+	}
+
+	res, err := c.client.Sys().Renew(s.leaseID, s.leaseDuration)
+	if err != nil {
+		return false, err
+	}
+
+	if res == nil || res.LeaseDuration < s.leaseDuration {
+		return false, nil
+	}
+
+	s.due = time.Now().Add(renewAfter(res.LeaseDuration))
+	return true, nil
+}
+
+// Secret returns the value of a key of the secret at the given path (like
+// `secret/data/servicegateway`). Secrets are read once until they are due
+// for a refresh, so that all keys of a dynamic secret (like a username and
+// a password) belong to the same lease.
+func (c *Client) Secret(path string, key string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s, ok := c.secrets[path]
+	if !ok {
+		var err error
+		if s, err = c.read(path); err != nil {
+			return "", err
+		}
+		c.secrets[path] = s
+	}
+
+	value, ok := s.data[key]
+	if !ok {
+		return "", fmt.Errorf("secret has no key '%s'", key)
+	}
+
+	return value, nil
+}
+
+// Watch renews the leases of the secrets when they are due (or reads them
+// again, if that is not possible), and calls changed when any of them has a
+// new value.
+func (c *Client) Watch(changed func()) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if c.refresh() {
+			changed()
+		}
+	}
+}
+
+func (c *Client) refresh() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+
+	if !c.tokenExpires.IsZero() && now.After(c.tokenExpires) {
+		if err := c.login(); err != nil {
+			c.logger.Errorf("could not renew vault token: %s", err)
+			return false
+		}
+	}
+
+	changed := false
+
+	for path, s := range c.secrets {
+		if now.Before(s.due) {
+			continue
+		}
+
+		// the values of leased secrets stay valid while their lease is
+		// renewed, so that the configuration does not change
+		renewed, err := c.renew(s)
+		if err != nil {
+			c.logger.Warningf("could not renew lease of vault secret '%s', reading it again: %s", path, err)
+		}
+
+		if renewed {
+			continue
+		}
+
+		fresh, err := c.read(path)
+		if err != nil {
+			c.logger.Errorf("could not read vault secret '%s' again: %s", path, err)
+			continue
+		}
+
+		if !maps.Equal(s.data, fresh.data) {
+			c.logger.Noticef("vault secret '%s' changed", path)
+			changed = true
+		}
+
+		c.secrets[path] = fresh
+	}
+
+	return changed
+}
@@ -0,0 +1,202 @@
+package waf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mittwald/servicegateway/config"
+)
+
+const defaultMaxBodyScan = 64 * 1024
+
+// Filter blocks requests that match one of its rules: a blocked method, too
+// many or too large headers, a denied URL pattern, or a denied pattern in
+// the beginning of the body.
+type Filter struct {
+	methods       map[string]bool
+	maxHeaders    int
+	maxHeaderSize int
+	urls          []*regexp.Regexp
+	bodies        []*regexp.Regexp
+	maxBodyScan   int64
+}
+
+// violation is a rule that a request breaks, and the status code that the
+// request is answered with.
+type violation struct {
+	rule   string
+	status int
+	reason string
+}
+
+// NewFilter compiles a WAF configuration. It returns nil if it has no
+// rules.
+func NewFilter(cfg *config.WafConfiguration) (*Filter, error) {
+	if len(cfg.BlockedMethods) == 0 && cfg.MaxHeaders == 0 && cfg.MaxHeaderSize == 0 && len(cfg.DeniedUrls) == 0 && len(cfg.DeniedBodies) == 0 {
+		return nil, nil
+	}
+
+	f := Filter{
+		methods:       make(map[string]bool),
+		maxHeaders:    cfg.MaxHeaders,
+		maxHeaderSize: cfg.MaxHeaderSize,
+		maxBodyScan:   cfg.MaxBodyScan,
+	}
+
+	if f.maxHeaders < 0 || f.maxHeaderSize < 0 || f.maxBodyScan < 0 {
+		return nil, fmt.Errorf("waf limits must not be negative")
+	}
+
+	if f.maxBodyScan == 0 {
+		f.maxBodyScan = defaultMaxBodyScan
+	}
+
+	for _, method := range cfg.BlockedMethods {
+		f.methods[strings.ToUpper(method)] = true
+	}
+
+	for _, pattern := range cfg.DeniedUrls {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied url pattern '%s': %s", pattern, err)
+		}
+		f.urls = append(f.urls, re)
+	}
+
+	for _, pattern := range cfg.DeniedBodies {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied body pattern '%s': %s", pattern, err)
+		}
+		f.bodies = append(f.bodies, re)
+	}
+
+	return &f, nil
+}
+
+func (f *Filter) checkHeaders(req *http.Request) *violation {
+	if f.maxHeaders == 0 && f.maxHeaderSize == 0 {
+		return nil
+	}
+
+	count, size := 0, 0
+	for name, values := range req.Header {
+		for _, value := range values {
+			count++
+			size += len(name) + len(value)
+		}
+	}
+
+	if (f.maxHeaders > 0 && count > f.maxHeaders) || (f.maxHeaderSize > 0 && size > f.maxHeaderSize) {
+		return &violation{rule: "headers", status: 431, reason: "request headers too large"}
+	}
+
+	return nil
+}
+
+// checkUrl matches the URL patterns against the URL as it was sent, and
+// after decoding it, so that encoding does not hide a denied pattern.
+func (f *Filter) checkUrl(req *http.Request) *violation {
+	if len(f.urls) == 0 {
+		return nil
+	}
+
+	raw := req.URL.RequestURI()
+	candidates := []string{raw}
+	if decoded, err := url.QueryUnescape(raw); err == nil && decoded != raw {
+		candidates = append(candidates, decoded)
+	}
+
+	for _, re := range f.urls {
+		for _, candidate := range candidates {
+			if re.MatchString(candidate) {
+				return &violation{rule: "url", status: 403, reason: "request url is denied"}
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkBody matches the body patterns against the beginning of the body.
+// The body is restored, so that it can still be sent upstream.
+func (f *Filter) checkBody(req *http.Request) (*violation, error) {
+	if len(f.bodies) == 0 || req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	prefix, err := io.ReadAll(io.LimitReader(req.Body, f.maxBodyScan))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(prefix), req.Body), Closer: req.Body}
+
+	for _, re := range f.bodies {
+		if re.Match(prefix) {
+			return &violation{rule: "body", status: 403, reason: "request body is denied"}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (f *Filter) check(req *http.Request) (*violation, error) {
+	if f == nil {
+		return nil, nil
+	}
+
+	if f.methods[req.Method] {
+		return &violation{rule: "method", status: 405, reason: "request method is blocked"}, nil
+	}
+
+	if v := f.checkHeaders(req); v != nil {
+		return v, nil
+	}
+
+	if v := f.checkUrl(req); v != nil {
+		return v, nil
+	}
+
+	return f.checkBody(req)
+}
+
+// DecorateHandler blocks the requests that break a rule of one of the
+// filters; usually the global filter and the filter of an application. Nil
+// filters let all requests pass. The rules that requests break are reported
+// to the blocked function.
+func DecorateHandler(handler httprouter.Handle, blocked func(rule string), filters ...*Filter) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		for _, filter := range filters {
+			v, err := filter.check(req)
+			if err != nil {
+				rw.Header().Set("Content-Type", "application/json")
+				rw.WriteHeader(400)
+				_, _ = rw.Write([]byte(`{"msg":"could not read request body"}`))
+				return
+			}
+
+			if v != nil {
+				blocked(v.rule)
+
+				rw.Header().Set("Content-Type", "application/json")
+				rw.WriteHeader(v.status)
+				_, _ = rw.Write([]byte(`{"msg":"request blocked","reason":"` + v.reason + `"}`))
+				return
+			}
+		}
+
+		handler(rw, req, params)
+	}
+}